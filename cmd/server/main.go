@@ -1,42 +1,273 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/obzva/image-server/internal/envvar"
 	"github.com/obzva/image-server/internal/server"
 	"github.com/obzva/image-server/internal/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/crypto/acme/autocert"
 )
 
+// flags stand for the env vars they are named after here, taking precedence over them
+var flagEnvKeys = map[string]string{
+	"bucket":          "S3_BUCKET_NAME",
+	"original-folder": "ORIGINAL_FOLDER",
+	"resized-folder":  "RESIZED_FOLDER",
+	"region":          "S3_REGION",
+	"port":            "PORT",
+	"log-level":       "LOG_LEVEL",
+	"config":          "CONFIG_FILE",
+}
+
+// parseFlags sets the env var of every flag passed, so envvar.New validates them like the env vars themselves
+// it returns the keys of the env vars it set
+func parseFlags() ([]string, error) {
+	for name, envKey := range flagEnvKeys {
+		flag.String(name, "", "overrides env var "+envKey)
+	}
+	flag.Parse()
+
+	var keys []string
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if err == nil {
+			keys = append(keys, flagEnvKeys[f.Name])
+			err = os.Setenv(flagEnvKeys[f.Name], f.Value.String())
+		}
+	})
+	return keys, err
+}
+
 func main() {
-	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
-		AddSource: true,
-		Level:     slog.LevelDebug,
-	}))
+	flagKeys, err := parseFlags()
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	// flags take precedence over the config file too
+	configFile, err := envvar.LoadConfigFile(flagKeys...)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
 
 	envVar, err := envvar.New()
 	if err != nil {
-		logger.Error(err.Error())
+		slog.Error(err.Error())
 		os.Exit(1)
 	}
 
-	s3Client, err := storage.NewS3Client(envVar.BucketName)
+	logger := slog.New(newLogHandler(envVar))
+
+	// spans are dropped by the default no-op tracer provider until one is registered with otel.SetTracerProvider
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	storageClient, opts, err := newStorageClient(envVar, envVar.BucketName)
 	if err != nil {
-		logger.Error(err.Error())
+		logger.Error("creating S3 client", "bucket", envVar.BucketName, "error", err)
 		os.Exit(1)
 	}
 
-	srv := server.New(logger, s3Client, envVar)
+	// run on SIGHUP
+	var reloads []func()
+	var buckets map[string]storage.Client
+	if len(envVar.Buckets) > 0 {
+		buckets = make(map[string]storage.Client, len(envVar.Buckets))
+		for name, bucketName := range envVar.Buckets {
+			client, cacheOpts, err := newStorageClient(envVar, bucketName)
+			if err != nil {
+				logger.Error("creating S3 client", "bucket", bucketName, "error", err)
+				os.Exit(1)
+			}
+			buckets[name] = client
+			opts = append(opts, cacheOpts...)
+		}
+		opts = append(opts, server.WithBuckets(buckets))
+	}
+	if envVar.WatermarkKey != "" {
+		watermark, err := server.LoadWatermark(context.Background(), storageClient, envVar.WatermarkKey)
+		if err != nil {
+			logger.Error("loading watermark", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, server.WithWatermark(watermark))
+	}
+
+	if envVar.VariantBudget > 0 {
+		// one evictor per bucket, each deleting the variants used in its own
+		budget := server.NewVariantBudget(envVar.VariantBudget, envVar.EvictionPolicy)
+		go budget.Run(context.Background(), logger, storageClient, envVar.EvictionInterval)
+		for _, client := range buckets {
+			go budget.Run(context.Background(), logger, client, envVar.EvictionInterval)
+		}
+		opts = append(opts, server.WithVariantBudget(budget))
+	}
+
+	if envVar.VariantMaxAge > 0 {
+		// one janitor sweeps every bucket, each on its own
+		janitor := server.NewJanitor(envVar.VariantMaxAge)
+		go janitor.Run(context.Background(), logger, storageClient, envVar, envVar.JanitorInterval)
+		for _, client := range buckets {
+			go janitor.Run(context.Background(), logger, client, envVar, envVar.JanitorInterval)
+		}
+		opts = append(opts, server.WithJanitor(janitor))
+	}
+
+	if envVar.PresetsFile != "" {
+		presets, err := server.LoadPresets(envVar.PresetsFile)
+		if err != nil {
+			logger.Error("loading presets", "error", err)
+			os.Exit(1)
+		}
+		opts = append(opts, server.WithPresets(presets))
+		reloads = append(reloads, func() {
+			if err := presets.Reload(); err != nil {
+				logger.Error("reloading presets", "error", err)
+				return
+			}
+			logger.Info("reloaded presets", "file", envVar.PresetsFile)
+		})
+	}
+
+	if envVar.OriginalCacheSize > 0 {
+		originals := server.NewMemoryOriginalCache(int64(envVar.OriginalCacheSize)<<20, envVar.OriginalCacheTTL)
+		opts = append(opts, server.WithOriginalCache(originals), server.WithCacheStats("original_cache", originals))
+	}
+
+	if envVar.MemoryBudget > 0 {
+		opts = append(opts, server.WithMemoryBudget(server.NewMemoryBudget(int64(envVar.MemoryBudget)<<20)))
+	}
+	if envVar.UploadConcurrency > 0 {
+		opts = append(opts, server.WithUploadLimiter(server.NewUploadLimiter(envVar.UploadConcurrency, envVar.UploadQueueTimeout)))
+	}
+
+	srv := server.NewReloadable(server.New(logger, storageClient, envVar, opts...))
+	if configFile != nil {
+		// settings read while answering requests apply to the requests that start after the reload,
+		// the ones used at startup, like the buckets, the port or the caches, still need a restart
+		reloads = append(reloads, func() {
+			if err := configFile.Load(); err != nil {
+				logger.Error("reloading config", "error", err)
+				return
+			}
+			next, err := envvar.New()
+			if err != nil {
+				logger.Error("reloading config", "file", configFile.Path(), "error", err)
+				return
+			}
+			srv.Swap(server.New(logger, storageClient, next, opts...))
+			logger.Info("reloaded config", "file", configFile.Path())
+		})
+	}
+
+	// SIGHUP reloads the config file and the presets, a broken one keeps what was loaded before
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			for _, reload := range reloads {
+				reload()
+			}
+		}
+	}()
+
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	// plain HTTP serves HTTP/2 without TLS (h2c) too
+	protocols.SetUnencryptedHTTP2(true)
 
 	s := http.Server{
-		Handler: srv,
-		Addr:    ":3000",
+		Handler:           srv,
+		Addr:              ":" + strconv.Itoa(envVar.Port),
+		Protocols:         &protocols,
+		ReadHeaderTimeout: envVar.ReadHeaderTimeout,
+		ReadTimeout:       envVar.ReadTimeout,
+		WriteTimeout:      envVar.WriteTimeout,
+		IdleTimeout:       envVar.IdleTimeout,
 	}
 
-	if err := s.ListenAndServe(); err != nil {
-		logger.Error(err.Error())
+	switch {
+	case envVar.TLSCertFile != "":
+		err = s.ListenAndServeTLS(envVar.TLSCertFile, envVar.TLSKeyFile)
+	case len(envVar.AutocertDomains) > 0:
+		// certificates are obtained through the TLS-ALPN-01 challenge, so port 443 must reach this server
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(envVar.AutocertDomains...),
+			Cache:      autocert.DirCache(envVar.AutocertCacheDir),
+		}
+		s.TLSConfig = m.TLSConfig()
+		err = s.ListenAndServeTLS("", "")
+	default:
+		err = s.ListenAndServe()
+	}
+	if err != nil {
+		logger.Error("serving http", "error", err)
 		os.Exit(1)
 	}
 }
+
+// startupCheckTimeout bounds the check of a bucket with STARTUP_CHECK, so a server that can't reach S3 fails instead of hanging
+const startupCheckTimeout = 10 * time.Second
+
+// newStorageClient wraps the client of every bucket on its own, so a failing bucket doesn't open the breaker of the others
+// along with the options reporting the stats of its caches, named after the bucket
+func newStorageClient(envVar *envvar.EnvVar, bucketName string) (storage.Client, []server.Option, error) {
+	s3Client, err := storage.NewS3Client(bucketName, envVar.Region)
+	if err != nil {
+		return nil, nil, err
+	}
+	if envVar.StartupCheck {
+		ctx, cancel := context.WithTimeout(context.Background(), startupCheckTimeout)
+		defer cancel()
+		if err := s3Client.CheckBucket(ctx); err != nil {
+			return nil, nil, fmt.Errorf("bucket %q is not accessible, check its name, region and the permissions of the credentials: %w", bucketName, err)
+		}
+	}
+	var opts []server.Option
+	var storageClient storage.Client = storage.NewTracingClient(s3Client)
+	if envVar.BreakerThreshold > 0 {
+		storageClient = storage.NewBreakerClient(storageClient, envVar.BreakerThreshold, envVar.BreakerCooldown)
+	}
+	// outermost, so remembered answers don't go through the breaker
+	if envVar.ExistenceCacheTTL > 0 || envVar.ExistenceCacheNegativeTTL > 0 {
+		existence := storage.NewExistenceCacheClient(storageClient, envVar.ExistenceCacheTTL, envVar.ExistenceCacheNegativeTTL)
+		opts = append(opts, server.WithCacheStats("existence_cache/"+bucketName, existence))
+		storageClient = existence
+	}
+	// every bucket in a directory of its own, since their keys may be the same
+	if envVar.DiskCacheDir != "" {
+		disk, err := storage.NewDiskCacheClient(storageClient, filepath.Join(envVar.DiskCacheDir, bucketName), int64(envVar.DiskCacheSize)<<20)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, server.WithCacheStats("disk_cache/"+bucketName, disk))
+		storageClient = disk
+	}
+	return storageClient, opts, nil
+}
+
+func newLogHandler(envVar *envvar.EnvVar) slog.Handler {
+	opts := &slog.HandlerOptions{
+		AddSource: envVar.LogSource,
+		Level:     envVar.LogLevel,
+	}
+	if envVar.LogFormat == envvar.LogFormatJSON {
+		return slog.NewJSONHandler(os.Stdout, opts)
+	}
+	return slog.NewTextHandler(os.Stdout, opts)
+}
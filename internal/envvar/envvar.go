@@ -2,19 +2,327 @@ package envvar
 
 import (
 	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/netip"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpguts"
 )
 
 const (
 	bucketNameEnvKey     = "S3_BUCKET_NAME"
 	envKeyFolderOriginal = "ORIGINAL_FOLDER"
 	envKeyFolderResized  = "RESIZED_FOLDER"
+	envKeyResizedLayout  = "RESIZED_LAYOUT"
+	envKeyServeMode      = "SERVE_MODE"
+	envKeyOnError        = "ON_ERROR"
+	envKeyMalformedPaths = "MALFORMED_PATHS"
+	envKeyWatermarkKey   = "WATERMARK_KEY"
+	envKeyDefaultImage   = "DEFAULT_IMAGE"
+	envKeyPresetsFile    = "PRESETS_FILE"
+	envKeyLogLevel       = "LOG_LEVEL"
+	envKeyLogSource      = "LOG_SOURCE"
+	envKeyLogFormat      = "LOG_FORMAT"
+
+	envKeyBreakerThreshold = "BREAKER_THRESHOLD"
+	envKeyBreakerCooldown  = "BREAKER_COOLDOWN"
+
+	envKeyVariantBudget    = "VARIANT_BUDGET"
+	envKeyEvictionPolicy   = "EVICTION_POLICY"
+	envKeyEvictionInterval = "EVICTION_INTERVAL"
+
+	envKeyVariantLimit       = "VARIANT_LIMIT"
+	envKeyVariantLimitAction = "VARIANT_LIMIT_ACTION"
+
+	envKeyVariantMaxAge   = "VARIANT_MAX_AGE"
+	envKeyJanitorInterval = "JANITOR_INTERVAL"
+
+	envKeyOriginalCacheSize = "ORIGINAL_CACHE_SIZE"
+	envKeyOriginalCacheTTL  = "ORIGINAL_CACHE_TTL"
+
+	envKeyExistenceCacheTTL         = "EXISTENCE_CACHE_TTL"
+	envKeyExistenceCacheNegativeTTL = "EXISTENCE_CACHE_NEGATIVE_TTL"
+
+	envKeyDiskCacheDir  = "DISK_CACHE_DIR"
+	envKeyDiskCacheSize = "DISK_CACHE_SIZE"
+
+	envKeyBatchConcurrency = "BATCH_CONCURRENCY"
+	envKeyBatchTimeout     = "BATCH_TIMEOUT"
+
+	envKeyAutoFormats    = "AUTO_FORMATS"
+	envKeyAllowedFormats = "ALLOWED_FORMATS"
+
+	envKeyPassthroughExtensions = "PASSTHROUGH_EXTENSIONS"
+
+	envKeyMaxDimension = "MAX_DIMENSION"
+	envKeyMemoryBudget = "MEMORY_BUDGET"
+
+	envKeyQualityLabelsJPEG = "QUALITY_LABELS_JPEG"
+	envKeyQualityLabelsWebP = "QUALITY_LABELS_WEBP"
+	envKeyQualityAutoSSIM   = "QUALITY_AUTO_SSIM"
+
+	envKeyResampleDown = "RESAMPLE_DOWN"
+	envKeyResampleUp   = "RESAMPLE_UP"
+
+	envKeyUploadConcurrency  = "UPLOAD_CONCURRENCY"
+	envKeyUploadQueueTimeout = "UPLOAD_QUEUE_TIMEOUT"
+	envKeyDetachGeneration   = "DETACH_GENERATION"
+	envKeyDetachTimeout      = "DETACH_TIMEOUT"
+
+	envKeyReadHeaderTimeout = "READ_HEADER_TIMEOUT"
+	envKeyReadTimeout       = "READ_TIMEOUT"
+	envKeyWriteTimeout      = "WRITE_TIMEOUT"
+	envKeyIdleTimeout       = "IDLE_TIMEOUT"
+
+	envKeyTLSCertFile      = "TLS_CERT_FILE"
+	envKeyTLSKeyFile       = "TLS_KEY_FILE"
+	envKeyAutocertDomains  = "TLS_AUTOCERT_DOMAINS"
+	envKeyAutocertCacheDir = "TLS_AUTOCERT_CACHE_DIR"
+
+	envKeyTrustedProxies = "TRUSTED_PROXIES"
+	envKeyTenantHeader   = "TENANT_HEADER"
+
+	envKeyTimingAllowOrigin = "TIMING_ALLOW_ORIGIN"
+
+	envKeyExtraHeaders = "EXTRA_HEADERS"
+
+	envKeyCacheControl = "CACHE_CONTROL"
+
+	envKeyCacheMaxAgeOriginal               = "CACHE_MAX_AGE_ORIGINAL"
+	envKeyCacheMaxAgeResized                = "CACHE_MAX_AGE_RESIZED"
+	envKeyCacheSMaxAgeOriginal              = "CACHE_S_MAXAGE_ORIGINAL"
+	envKeyCacheSMaxAgeResized               = "CACHE_S_MAXAGE_RESIZED"
+	envKeyCacheStaleWhileRevalidateOriginal = "CACHE_STALE_WHILE_REVALIDATE_ORIGINAL"
+	envKeyCacheStaleWhileRevalidateResized  = "CACHE_STALE_WHILE_REVALIDATE_RESIZED"
+
+	envKeyBuckets = "BUCKETS"
+
+	envKeyRedirectStatus = "REDIRECT_STATUS"
+	envKeyNoCacheToken   = "NOCACHE_TOKEN"
+	envKeyAdminToken     = "ADMIN_TOKEN"
+	envKeyDedup          = "DEDUP"
+	envKeyVersionedKeys  = "VERSIONED_KEYS"
+	envKeyClientHints    = "CLIENT_HINTS"
+	envKeyStrictParams   = "STRICT_PARAMS"
+	envKeyReadOnly       = "READ_ONLY"
+	envKeyStartupCheck   = "STARTUP_CHECK"
+
+	envKeyRegion = "S3_REGION"
+	envKeyPort   = "PORT"
+)
+
+const (
+	// resized variants of "img.jpg" go under "img.jpg/"
+	ResizedLayoutPath = "path"
+	// resized variants of "img.jpg" go under "img/", shared with "img.png"
+	ResizedLayoutName = "name"
+)
+
+const (
+	// redirect to the object URL in the bucket
+	ServeModeRedirect = "redirect"
+	// write the image bytes into the response
+	ServeModeInline = "inline"
+)
+
+const (
+	// answer 500 when a variant fails to be produced
+	OnErrorFail = "fail"
+	// answer with the original instead
+	OnErrorOriginal = "original"
+)
+
+const (
+	// answer a path with repeated or trailing slashes or dot segments like its clean form
+	MalformedPathsClean = "clean"
+	// redirect it to its clean form with 301 Moved Permanently
+	MalformedPathsRedirect = "redirect"
+	// answer it with 400 Bad Request
+	MalformedPathsReject = "reject"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+const (
+	// answer new variants over VARIANT_LIMIT with 429
+	VariantLimitReject = "reject"
+	// answer new variants over VARIANT_LIMIT with the stored variant nearest in size, or 429 without any
+	VariantLimitNearest = "nearest"
+)
+
+const (
+	// evict the least frequently used variants first
+	EvictionPolicyLFU = "lfu"
+	// evict the least recently used variants first
+	EvictionPolicyLRU = "lru"
+)
+
+// QualityLabels are the labels ?quality may name instead of a number, lowest first
+var QualityLabels = []string{"low", "medium", "high", "max"}
+
+// qualities of the labels unless configured otherwise, medium of jpeg and high of webp being the default qualities of their encoders
+var (
+	DefaultJPEGQualityLabels = map[string]int{"low": 50, "medium": 75, "high": 85, "max": 95}
+	DefaultWebPQualityLabels = map[string]int{"low": 50, "medium": 75, "high": 90, "max": 100}
 )
 
+// DefaultQualityAutoSSIM is the similarity ?quality=auto targets unless configured otherwise,
+// where the artifacts of most photos start to show
+const DefaultQualityAutoSSIM = 0.95
+
+// DefaultFolderResized is the folder of the variants unless RESIZED_FOLDER names another
+const DefaultFolderResized = "resized"
+
+// Resamplings are the filters images are resized with, sharpest and slowest first
+var Resamplings = []string{"lanczos", "cubic", "linear", "box", "nearest"}
+
 type EnvVar struct {
 	BucketName     string
 	FolderOriginal string
 	FolderResized  string
+	ResizedLayout  string
+	ServeMode      string
+	OnError        string
+	// what answers a path that isn't clean, one of MalformedPathsClean, MalformedPathsRedirect or MalformedPathsReject
+	MalformedPaths string
+	// storage key of the image overlaid with ?watermark=1, empty disables watermarks
+	WatermarkKey string
+	// name of the original answered at /, resized by the query like any other, the usage message when empty
+	DefaultImage string
+	// JSON file of the presets requested with ?t, none when empty
+	PresetsFile string
+
+	LogLevel  slog.Level
+	LogSource bool
+	LogFormat string
+
+	// consecutive storage failures that open the circuit breaker, 0 disables it
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// resized variants kept per original before the least used ones are deleted, 0 keeps them all
+	VariantBudget    int
+	EvictionPolicy   string
+	EvictionInterval time.Duration
+
+	// resized variants stored per original before new ones are refused, 0 stores them all
+	VariantLimit       int
+	VariantLimitAction string
+
+	// resized variants unused for this long are deleted, 0 keeps them however old
+	VariantMaxAge   time.Duration
+	JanitorInterval time.Duration
+
+	// megabytes of decoded originals kept in memory for the next resizes of the same originals, 0 disables the cache
+	OriginalCacheSize int
+	OriginalCacheTTL  time.Duration
+
+	// how long the storage answers that an object exists, or doesn't, are remembered, 0 doesn't remember them
+	ExistenceCacheTTL         time.Duration
+	ExistenceCacheNegativeTTL time.Duration
+
+	// directory of the objects downloaded from and uploaded to the buckets kept on disk, empty disables the cache
+	DiskCacheDir string
+	// megabytes of objects kept in DiskCacheDir per bucket
+	DiskCacheSize int
+
+	// images of a batch request resized at the same time, and the time the whole batch may take
+	BatchConcurrency int
+	BatchTimeout     time.Duration
+
+	// candidate formats of ?fm=auto, each of them encoded for every new variant
+	AutoFormats []string
+	// output formats requests may produce, the first one replaces the format of originals outside of them
+	// empty allows every format
+	AllowedFormats []string
+	// lowercase extensions of originals that aren't images to resize, like svg or pdf, answered as they are
+	PassthroughExtensions []string
+	// largest w and h requests may ask for, 0 for no limit
+	MaxDimension int
+	// megabytes of decoded pixels the resizes in flight may take, 0 for no limit
+	MemoryBudget int
+	// qualities of the labels of QualityLabels by format
+	JPEGQualityLabels map[string]int
+	WebPQualityLabels map[string]int
+	// similarity to the unencoded output, 0 to 1, that ?quality=auto lowers the quality down to
+	QualityAutoSSIM float64
+	// filters of the resizes shrinking and enlarging an original, one of Resamplings
+	ResampleDown string
+	ResampleUp   string
+	// uploads of new variants in flight, 0 for no limit
+	UploadConcurrency int
+	// how long a new variant waits for an upload slot before it is given up on
+	UploadQueueTimeout time.Duration
+	// keep producing a variant once its requester is gone, for at most DetachTimeout
+	DetachGeneration bool
+	DetachTimeout    time.Duration
+
+	// timeouts of the http server, 0 disables one
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+
+	// serve TLS with this certificate and key, both empty serves plain HTTP
+	TLSCertFile string
+	TLSKeyFile  string
+	// serve TLS with certificates obtained from Let's Encrypt for these domains instead
+	AutocertDomains  []string
+	AutocertCacheDir string
+
+	// peers whose X-Forwarded-For and X-Real-IP headers are believed, none by default
+	TrustedProxies []netip.Prefix
+	// header of trusted proxies naming the tenant of a request, whose variants are kept apart, none when empty
+	TenantHeader string
+
+	// origins allowed to read the Server-Timing of image responses, like "*", none when empty
+	TimingAllowOrigin string
+
+	// headers set on every response, X-Content-Type-Options: nosniff unless replaced
+	ExtraHeaders http.Header
+
+	// Cache-Control of image responses whose original doesn't set its own with the cache-control metadata,
+	// built from CacheOriginal and CacheResized when empty
+	CacheControl  string
+	CacheOriginal CacheDirectives
+	CacheResized  CacheDirectives
+
+	// more buckets by the name selecting them, with a path prefix like /{name}/{image} or a trusted X-Bucket header
+	// the bucket of BucketName answers every other request
+	Buckets map[string]string
+
+	// status of the redirect to the image in the bucket, 302, 303 or 307, 0 means 303
+	RedirectStatus int
+	// bearer token authorizing ?nocache=1, which is refused when empty
+	NoCacheToken string
+	// bearer token authorizing the admin endpoints, which are refused when empty
+	AdminToken string
+	// store identical variants once, under the hash of their content, with their keys linking to it
+	Dedup bool
+	// name the version of the original in the keys of its variants, so replacing it produces new ones
+	VersionedKeys bool
+	// pick the pixel multiplier of requests without ?dpr from their DPR client hints
+	ClientHints bool
+	// answer 400 to image requests with query params the server doesn't know, instead of ignoring them
+	StrictParams bool
+	// only answer originals, refusing whatever would write to the bucket, for buckets this server may not write to
+	ReadOnly bool
+	// check every bucket is accessible before serving, failing fast instead of answering the first requests with 500
+	StartupCheck bool
+
+	// region of every bucket, defaults to ca-west-1
+	Region string
+	// port the server listens on, defaults to 3000
+	Port int
 }
 
 func New() (*EnvVar, error) {
@@ -22,22 +330,603 @@ func New() (*EnvVar, error) {
 	if err != nil {
 		return nil, err
 	}
-	folderOriginal, err := checkKey(envKeyFolderOriginal)
+	// originals may live at the bucket root, so the folder is optional
+	folderOriginal := trimFolder(os.Getenv(envKeyFolderOriginal))
+	// variants may not, since the janitor treats everything under their folder as a variant
+	folderResized := DefaultFolderResized
+	if value, ok := os.LookupEnv(envKeyFolderResized); ok && value != "" {
+		folderResized = trimFolder(value)
+	}
+	if folderResized == "" {
+		return nil, fmt.Errorf("env var %q must not be the bucket root", envKeyFolderResized)
+	}
+
+	resizedLayout, err := optionalEnum(envKeyResizedLayout, ResizedLayoutPath, ResizedLayoutName)
+	if err != nil {
+		return nil, err
+	}
+
+	serveMode, err := optionalEnum(envKeyServeMode, ServeModeRedirect, ServeModeInline)
+	if err != nil {
+		return nil, err
+	}
+	onError, err := optionalEnum(envKeyOnError, OnErrorFail, OnErrorOriginal)
+	if err != nil {
+		return nil, err
+	}
+	malformedPaths, err := optionalEnum(envKeyMalformedPaths, MalformedPathsClean, MalformedPathsRedirect, MalformedPathsReject)
+	if err != nil {
+		return nil, err
+	}
+
+	logLevel, err := parseLogLevel(os.Getenv(envKeyLogLevel))
+	if err != nil {
+		return nil, err
+	}
+	logSource, err := optionalBool(envKeyLogSource, false)
+	if err != nil {
+		return nil, err
+	}
+	logFormat, err := optionalEnum(envKeyLogFormat, LogFormatText, LogFormatJSON)
+	if err != nil {
+		return nil, err
+	}
+	breakerThreshold, err := optionalInt(envKeyBreakerThreshold, 5)
+	if err != nil {
+		return nil, err
+	}
+	breakerCooldown, err := optionalDuration(envKeyBreakerCooldown, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	variantBudget, err := optionalInt(envKeyVariantBudget, 0)
+	if err != nil {
+		return nil, err
+	}
+	evictionPolicy, err := optionalEnum(envKeyEvictionPolicy, EvictionPolicyLFU, EvictionPolicyLRU)
+	if err != nil {
+		return nil, err
+	}
+	evictionInterval, err := optionalDuration(envKeyEvictionInterval, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if evictionInterval == 0 {
+		return nil, fmt.Errorf("env var %q must be longer than 0", envKeyEvictionInterval)
+	}
+
+	variantLimit, err := optionalInt(envKeyVariantLimit, 0)
+	if err != nil {
+		return nil, err
+	}
+	variantLimitAction, err := optionalEnum(envKeyVariantLimitAction, VariantLimitReject, VariantLimitNearest)
+	if err != nil {
+		return nil, err
+	}
+
+	variantMaxAge, err := optionalDuration(envKeyVariantMaxAge, 0)
+	if err != nil {
+		return nil, err
+	}
+	janitorInterval, err := optionalDuration(envKeyJanitorInterval, time.Hour)
+	if err != nil {
+		return nil, err
+	}
+	if janitorInterval == 0 {
+		return nil, fmt.Errorf("env var %q must be longer than 0", envKeyJanitorInterval)
+	}
+
+	originalCacheSize, err := optionalInt(envKeyOriginalCacheSize, 0)
+	if err != nil {
+		return nil, err
+	}
+	originalCacheTTL, err := optionalDuration(envKeyOriginalCacheTTL, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if originalCacheTTL == 0 {
+		return nil, fmt.Errorf("env var %q must be longer than 0", envKeyOriginalCacheTTL)
+	}
+
+	existenceCacheTTL, err := optionalDuration(envKeyExistenceCacheTTL, 0)
+	if err != nil {
+		return nil, err
+	}
+	existenceCacheNegativeTTL, err := optionalDuration(envKeyExistenceCacheNegativeTTL, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	diskCacheDir := os.Getenv(envKeyDiskCacheDir)
+	diskCacheSize, err := optionalInt(envKeyDiskCacheSize, 1024)
+	if err != nil {
+		return nil, err
+	}
+	if diskCacheDir != "" && diskCacheSize == 0 {
+		return nil, fmt.Errorf("env var %q must be larger than 0", envKeyDiskCacheSize)
+	}
+
+	batchConcurrency, err := optionalInt(envKeyBatchConcurrency, 4)
+	if err != nil {
+		return nil, err
+	}
+	if batchConcurrency == 0 {
+		return nil, fmt.Errorf("env var %q must be larger than 0", envKeyBatchConcurrency)
+	}
+	batchTimeout, err := optionalDuration(envKeyBatchTimeout, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if batchTimeout == 0 {
+		return nil, fmt.Errorf("env var %q must be longer than 0", envKeyBatchTimeout)
+	}
+
+	autoFormats, err := parseAutoFormats(os.Getenv(envKeyAutoFormats))
+	if err != nil {
+		return nil, err
+	}
+	extraHeaders, err := parseExtraHeaders(os.Getenv(envKeyExtraHeaders))
+	if err != nil {
+		return nil, err
+	}
+	cacheControl := os.Getenv(envKeyCacheControl)
+	if !httpguts.ValidHeaderFieldValue(cacheControl) {
+		return nil, fmt.Errorf("env var %q must be a valid header value, got %q", envKeyCacheControl, cacheControl)
+	}
+	cacheOriginal, err := parseCacheDirectives(envKeyCacheMaxAgeOriginal, envKeyCacheSMaxAgeOriginal, envKeyCacheStaleWhileRevalidateOriginal)
+	if err != nil {
+		return nil, err
+	}
+	cacheResized, err := parseCacheDirectives(envKeyCacheMaxAgeResized, envKeyCacheSMaxAgeResized, envKeyCacheStaleWhileRevalidateResized)
+	if err != nil {
+		return nil, err
+	}
+	allowedFormats, err := parseAllowedFormats(os.Getenv(envKeyAllowedFormats))
+	if err != nil {
+		return nil, err
+	}
+	passthroughExtensions, err := parsePassthroughExtensions(os.Getenv(envKeyPassthroughExtensions))
+	if err != nil {
+		return nil, err
+	}
+	maxDimension, err := optionalInt(envKeyMaxDimension, 10000)
+	if err != nil {
+		return nil, err
+	}
+	memoryBudget, err := optionalInt(envKeyMemoryBudget, 0)
+	if err != nil {
+		return nil, err
+	}
+	jpegQualityLabels, err := parseQualityLabels(envKeyQualityLabelsJPEG, DefaultJPEGQualityLabels)
+	if err != nil {
+		return nil, err
+	}
+	webpQualityLabels, err := parseQualityLabels(envKeyQualityLabelsWebP, DefaultWebPQualityLabels)
 	if err != nil {
 		return nil, err
 	}
-	folderResized, err := checkKey(envKeyFolderResized)
+	qualityAutoSSIM, err := optionalFloat(envKeyQualityAutoSSIM, DefaultQualityAutoSSIM)
 	if err != nil {
 		return nil, err
 	}
+	if !(qualityAutoSSIM > 0 && qualityAutoSSIM <= 1) {
+		return nil, fmt.Errorf("env var %q must be larger than 0 and at most 1", envKeyQualityAutoSSIM)
+	}
+	resampleDown, err := optionalEnum(envKeyResampleDown, Resamplings...)
+	if err != nil {
+		return nil, err
+	}
+	resampleUp, err := optionalEnum(envKeyResampleUp, Resamplings...)
+	if err != nil {
+		return nil, err
+	}
+	uploadConcurrency, err := optionalInt(envKeyUploadConcurrency, 0)
+	if err != nil {
+		return nil, err
+	}
+	uploadQueueTimeout, err := optionalDuration(envKeyUploadQueueTimeout, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if uploadQueueTimeout == 0 {
+		return nil, fmt.Errorf("env var %q must be longer than 0", envKeyUploadQueueTimeout)
+	}
+	detachGeneration, err := optionalBool(envKeyDetachGeneration, false)
+	if err != nil {
+		return nil, err
+	}
+	detachTimeout, err := optionalDuration(envKeyDetachTimeout, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if detachTimeout == 0 {
+		return nil, fmt.Errorf("env var %q must be longer than 0", envKeyDetachTimeout)
+	}
+
+	readHeaderTimeout, err := optionalDuration(envKeyReadHeaderTimeout, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	readTimeout, err := optionalDuration(envKeyReadTimeout, 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	// resizing happens while the response is written, so this bounds the slowest resize as well
+	writeTimeout, err := optionalDuration(envKeyWriteTimeout, 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	idleTimeout, err := optionalDuration(envKeyIdleTimeout, 120*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCertFile, tlsKeyFile := os.Getenv(envKeyTLSCertFile), os.Getenv(envKeyTLSKeyFile)
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		return nil, fmt.Errorf("env vars %q and %q must be set together", envKeyTLSCertFile, envKeyTLSKeyFile)
+	}
+	var autocertDomains []string
+	for _, domain := range strings.Split(os.Getenv(envKeyAutocertDomains), ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			autocertDomains = append(autocertDomains, domain)
+		}
+	}
+	if len(autocertDomains) > 0 && tlsCertFile != "" {
+		return nil, fmt.Errorf("env var %q can't be combined with %q and %q", envKeyAutocertDomains, envKeyTLSCertFile, envKeyTLSKeyFile)
+	}
+	autocertCacheDir := os.Getenv(envKeyAutocertCacheDir)
+	if autocertCacheDir == "" {
+		autocertCacheDir = "autocert-cache"
+	}
+
+	trustedProxies, err := parseTrustedProxies(os.Getenv(envKeyTrustedProxies))
+	if err != nil {
+		return nil, err
+	}
+	// the tenant is authenticated by the proxy setting the header, anyone else could pick another one
+	tenantHeader := os.Getenv(envKeyTenantHeader)
+	if tenantHeader != "" && !httpguts.ValidHeaderFieldName(tenantHeader) {
+		return nil, fmt.Errorf("env var %q must be a header name, got %q", envKeyTenantHeader, tenantHeader)
+	}
+	if tenantHeader != "" && len(trustedProxies) == 0 {
+		return nil, fmt.Errorf("env var %q requires %q", envKeyTenantHeader, envKeyTrustedProxies)
+	}
+
+	buckets, err := parseBuckets(os.Getenv(envKeyBuckets))
+	if err != nil {
+		return nil, err
+	}
+
+	redirectStatusValue, err := optionalEnum(envKeyRedirectStatus, "303", "302", "307")
+	if err != nil {
+		return nil, err
+	}
+	redirectStatus, _ := strconv.Atoi(redirectStatusValue)
+	dedup, err := optionalBool(envKeyDedup, false)
+	if err != nil {
+		return nil, err
+	}
+	versionedKeys, err := optionalBool(envKeyVersionedKeys, false)
+	if err != nil {
+		return nil, err
+	}
+	clientHints, err := optionalBool(envKeyClientHints, false)
+	if err != nil {
+		return nil, err
+	}
+	strictParams, err := optionalBool(envKeyStrictParams, false)
+	if err != nil {
+		return nil, err
+	}
+	readOnly, err := optionalBool(envKeyReadOnly, false)
+	if err != nil {
+		return nil, err
+	}
+	// both delete variants from the bucket
+	if readOnly && variantBudget > 0 {
+		return nil, fmt.Errorf("env var %q can't be combined with %q", envKeyReadOnly, envKeyVariantBudget)
+	}
+	if readOnly && variantMaxAge > 0 {
+		return nil, fmt.Errorf("env var %q can't be combined with %q", envKeyReadOnly, envKeyVariantMaxAge)
+	}
+
+	startupCheck, err := optionalBool(envKeyStartupCheck, false)
+	if err != nil {
+		return nil, err
+	}
+
+	region := os.Getenv(envKeyRegion)
+	if region == "" {
+		region = "ca-west-1"
+	}
+	port, err := optionalInt(envKeyPort, 3000)
+	if err != nil {
+		return nil, err
+	}
+	if port == 0 || port > 65535 {
+		return nil, fmt.Errorf("env var %q must be a port between 1 and 65535", envKeyPort)
+	}
 
 	return &EnvVar{
 		BucketName:     bucketName,
 		FolderOriginal: folderOriginal,
 		FolderResized:  folderResized,
+		ResizedLayout:  resizedLayout,
+		ServeMode:      serveMode,
+		OnError:        onError,
+		MalformedPaths: malformedPaths,
+		WatermarkKey:   os.Getenv(envKeyWatermarkKey),
+		DefaultImage:   os.Getenv(envKeyDefaultImage),
+		PresetsFile:    os.Getenv(envKeyPresetsFile),
+		LogLevel:       logLevel,
+		LogSource:      logSource,
+		LogFormat:      logFormat,
+
+		BreakerThreshold: breakerThreshold,
+		BreakerCooldown:  breakerCooldown,
+
+		VariantBudget:    variantBudget,
+		EvictionPolicy:   evictionPolicy,
+		EvictionInterval: evictionInterval,
+
+		VariantLimit:       variantLimit,
+		VariantLimitAction: variantLimitAction,
+
+		VariantMaxAge:   variantMaxAge,
+		JanitorInterval: janitorInterval,
+
+		OriginalCacheSize: originalCacheSize,
+		OriginalCacheTTL:  originalCacheTTL,
+
+		ExistenceCacheTTL:         existenceCacheTTL,
+		ExistenceCacheNegativeTTL: existenceCacheNegativeTTL,
+
+		DiskCacheDir:  diskCacheDir,
+		DiskCacheSize: diskCacheSize,
+
+		BatchConcurrency: batchConcurrency,
+		BatchTimeout:     batchTimeout,
+
+		AutoFormats:           autoFormats,
+		AllowedFormats:        allowedFormats,
+		PassthroughExtensions: passthroughExtensions,
+		MaxDimension:          maxDimension,
+		MemoryBudget:          memoryBudget,
+		JPEGQualityLabels:     jpegQualityLabels,
+		WebPQualityLabels:     webpQualityLabels,
+		QualityAutoSSIM:       qualityAutoSSIM,
+		ResampleDown:          resampleDown,
+		ResampleUp:            resampleUp,
+		UploadConcurrency:     uploadConcurrency,
+		UploadQueueTimeout:    uploadQueueTimeout,
+		DetachGeneration:      detachGeneration,
+		DetachTimeout:         detachTimeout,
+
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+
+		TLSCertFile:      tlsCertFile,
+		TLSKeyFile:       tlsKeyFile,
+		AutocertDomains:  autocertDomains,
+		AutocertCacheDir: autocertCacheDir,
+
+		TrustedProxies: trustedProxies,
+		TenantHeader:   tenantHeader,
+
+		TimingAllowOrigin: os.Getenv(envKeyTimingAllowOrigin),
+
+		ExtraHeaders:  extraHeaders,
+		CacheControl:  cacheControl,
+		CacheOriginal: cacheOriginal,
+		CacheResized:  cacheResized,
+
+		Buckets: buckets,
+
+		RedirectStatus: redirectStatus,
+		NoCacheToken:   os.Getenv(envKeyNoCacheToken),
+		AdminToken:     os.Getenv(envKeyAdminToken),
+		Dedup:          dedup,
+		VersionedKeys:  versionedKeys,
+		ClientHints:    clientHints,
+		StrictParams:   strictParams,
+		ReadOnly:       readOnly,
+		StartupCheck:   startupCheck,
+
+		Region: region,
+		Port:   port,
 	}, nil
 }
 
+// maxAutoFormats caps the encodes spent on a single variant
+const maxAutoFormats = 3
+
+// parseAutoFormats defaults to webp and jpeg, webp is skipped by servers that can't encode it
+func parseAutoFormats(value string) ([]string, error) {
+	if value == "" {
+		return []string{"webp", "jpeg"}, nil
+	}
+	var formats []string
+	for _, format := range strings.Split(value, ",") {
+		format = strings.TrimSpace(format)
+		if !slices.Contains([]string{"jpeg", "png", "webp"}, format) {
+			return nil, fmt.Errorf("env var %q must list jpeg, png or webp, got %q", envKeyAutoFormats, value)
+		}
+		if !slices.Contains(formats, format) {
+			formats = append(formats, format)
+		}
+	}
+	if len(formats) > maxAutoFormats {
+		return nil, fmt.Errorf("env var %q must list at most %d formats, got %q", envKeyAutoFormats, maxAutoFormats, value)
+	}
+	return formats, nil
+}
+
+// reservedBucketNames are the first path segments of the routes of the server, which bucket names would shadow
+var reservedBucketNames = []string{"admin", "batch", "capabilities", "i", "sprites"}
+
+// parseBuckets reads a comma separated list of name=bucket pairs
+// names are a single path segment that can't be mistaken for an image or another route
+func parseBuckets(value string) (map[string]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	buckets := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		name, bucket, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || bucket == "" || !validBucketName(name) {
+			return nil, fmt.Errorf("env var %q must list name=bucket pairs with names of lowercase letters, digits and dashes, got %q", envKeyBuckets, pair)
+		}
+		if slices.Contains(reservedBucketNames, name) {
+			return nil, fmt.Errorf("env var %q can't name a bucket %q, it is already a route", envKeyBuckets, name)
+		}
+		if _, ok := buckets[name]; ok {
+			return nil, fmt.Errorf("env var %q names %q twice", envKeyBuckets, name)
+		}
+		buckets[name] = bucket
+	}
+	return buckets, nil
+}
+
+// parseQualityLabels reads a comma separated list of label=quality pairs, like low=40,high=90,
+// the labels left out keeping their quality of defaults
+func parseQualityLabels(key string, defaults map[string]int) (map[string]int, error) {
+	labels := maps.Clone(defaults)
+	value := os.Getenv(key)
+	if value == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		label, quality, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		n, err := strconv.Atoi(quality)
+		if !slices.Contains(QualityLabels, label) || err != nil || n < 1 || n > 100 {
+			return nil, fmt.Errorf("env var %q must list label=quality pairs of %q and qualities between 1 and 100, got %q", key, QualityLabels, pair)
+		}
+		labels[label] = n
+	}
+	return labels, nil
+}
+
+func validBucketName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !('a' <= r && r <= 'z' || '0' <= r && r <= '9' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseTrustedProxies reads a comma separated list of CIDRs, a bare IP trusts that single address
+func parseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(s); err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("env var %q must list CIDRs or IPs, got %q", envKeyTrustedProxies, s)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// parseExtraHeaders reads name:value pairs separated by commas on top of the default headers
+// a name without value drops a default header
+func parseExtraHeaders(value string) (http.Header, error) {
+	headers := http.Header{"X-Content-Type-Options": {"nosniff"}}
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		name, v, ok := strings.Cut(s, ":")
+		name, v = strings.TrimSpace(name), strings.TrimSpace(v)
+		if !ok || !httpguts.ValidHeaderFieldName(name) || !httpguts.ValidHeaderFieldValue(v) {
+			return nil, fmt.Errorf("env var %q must list name:value headers, got %q", envKeyExtraHeaders, s)
+		}
+		if v == "" {
+			headers.Del(name)
+			continue
+		}
+		headers.Set(name, v)
+	}
+	return headers, nil
+}
+
+// parseAllowedFormats keeps the order of value, jpg standing for jpeg
+func parseAllowedFormats(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var formats []string
+	for _, format := range strings.Split(value, ",") {
+		format = strings.ToLower(strings.TrimSpace(format))
+		if format == "jpg" {
+			format = "jpeg"
+		}
+		if !slices.Contains([]string{"jpeg", "png", "webp", "ico"}, format) {
+			return nil, fmt.Errorf("env var %q must list jpeg, png, webp or ico, got %q", envKeyAllowedFormats, value)
+		}
+		if !slices.Contains(formats, format) {
+			formats = append(formats, format)
+		}
+	}
+	return formats, nil
+}
+
+// parsePassthroughExtensions reads a comma separated list of extensions, lowercased and without their dot
+// the extensions of originals that are resized can't be passed through
+func parsePassthroughExtensions(value string) ([]string, error) {
+	var exts []string
+	for _, ext := range strings.Split(value, ",") {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" {
+			continue
+		}
+		if strings.IndexFunc(ext, func(r rune) bool { return !('a' <= r && r <= 'z' || '0' <= r && r <= '9') }) >= 0 {
+			return nil, fmt.Errorf("env var %q must list extensions of letters and digits, got %q", envKeyPassthroughExtensions, ext)
+		}
+		if slices.Contains([]string{"jpeg", "jpg", "png", "heic", "heif", "gif"}, ext) {
+			return nil, fmt.Errorf("env var %q can't list %q, its originals are resized", envKeyPassthroughExtensions, ext)
+		}
+		if !slices.Contains(exts, ext) {
+			exts = append(exts, ext)
+		}
+	}
+	return exts, nil
+}
+
+// parseLogLevel defaults to info when the value is empty
+func parseLogLevel(value string) (slog.Level, error) {
+	switch value {
+	case "":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return 0, fmt.Errorf("env var %q must be one of debug, info, warn or error, got %q", envKeyLogLevel, value)
+	}
+}
+
 func checkKey(key string) (string, error) {
 	value := os.Getenv(key)
 	if value == "" {
@@ -45,3 +934,106 @@ func checkKey(key string) (string, error) {
 	}
 	return value, nil
 }
+
+// trimFolder strips leading and trailing slashes, S3 keys don't start with a slash and folders are joined with one
+func trimFolder(folder string) string {
+	return strings.Trim(folder, "/")
+}
+
+// optionalEnum returns the first allowed value, the default, when the env var is empty
+func optionalEnum(key string, allowed ...string) (string, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return allowed[0], nil
+	}
+	if !slices.Contains(allowed, value) {
+		return "", fmt.Errorf("env var %q must be one of %q, got %q", key, allowed, value)
+	}
+	return value, nil
+}
+
+func optionalBool(key string, fallback bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("env var %q must be a boolean, got %q", key, value)
+	}
+	return b, nil
+}
+
+// CacheDirectives are the seconds of the directives of a Cache-Control, 0 leaving a directive out
+type CacheDirectives struct {
+	MaxAge               int
+	SMaxAge              int
+	StaleWhileRevalidate int
+}
+
+// maxCacheSeconds is the largest delta-seconds caches must understand, RFC 9111 section 1.2.2
+const maxCacheSeconds = 1<<31 - 1
+
+// parseCacheDirectives reads the directives of one kind of image, keeping a day long max-age by default
+func parseCacheDirectives(maxAgeKey, sMaxAgeKey, staleWhileRevalidateKey string) (CacheDirectives, error) {
+	maxAge, err := optionalCacheSeconds(maxAgeKey, 86400)
+	if err != nil {
+		return CacheDirectives{}, err
+	}
+	sMaxAge, err := optionalCacheSeconds(sMaxAgeKey, 0)
+	if err != nil {
+		return CacheDirectives{}, err
+	}
+	staleWhileRevalidate, err := optionalCacheSeconds(staleWhileRevalidateKey, 0)
+	if err != nil {
+		return CacheDirectives{}, err
+	}
+	return CacheDirectives{MaxAge: maxAge, SMaxAge: sMaxAge, StaleWhileRevalidate: staleWhileRevalidate}, nil
+}
+
+func optionalCacheSeconds(key string, fallback int) (int, error) {
+	seconds, err := optionalInt(key, fallback)
+	if err != nil {
+		return 0, err
+	}
+	if seconds > maxCacheSeconds {
+		return 0, fmt.Errorf("env var %q must be at most %d seconds, got %d", key, maxCacheSeconds, seconds)
+	}
+	return seconds, nil
+}
+
+func optionalInt(key string, fallback int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("env var %q must be a non-negative integer, got %q", key, value)
+	}
+	return i, nil
+}
+
+func optionalFloat(key string, fallback float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("env var %q must be a non-negative number, got %q", key, value)
+	}
+	return f, nil
+}
+
+func optionalDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("env var %q must be a non-negative duration like \"30s\", got %q", key, value)
+	}
+	return d, nil
+}
@@ -0,0 +1,978 @@
+package envvar
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFolders(t *testing.T) {
+	tt := []struct {
+		testName       string
+		folderOriginal string
+		folderResized  string
+		// desired folders
+		wantOriginal string
+		wantResized  string
+		wantErr      bool
+	}{
+		{
+			testName:       "both folders set",
+			folderOriginal: "original",
+			folderResized:  "resized",
+			wantOriginal:   "original",
+			wantResized:    "resized",
+		},
+		{
+			testName:      "originals at the bucket root",
+			folderResized: "resized",
+			wantResized:   "resized",
+		},
+		{
+			testName:       "slash as original folder means the bucket root",
+			folderOriginal: "/",
+			folderResized:  "resized",
+			wantResized:    "resized",
+		},
+		{
+			testName:       "leading and trailing slashes are trimmed",
+			folderOriginal: "/original/",
+			folderResized:  "/resized/nested/",
+			wantOriginal:   "original",
+			wantResized:    "resized/nested",
+		},
+		{
+			testName:       "resized folder defaults to resized",
+			folderOriginal: "original",
+			wantOriginal:   "original",
+			wantResized:    DefaultFolderResized,
+		},
+		{
+			testName:    "only the bucket name set",
+			wantResized: DefaultFolderResized,
+		},
+		{
+			testName:       "resized alongside the originals",
+			folderOriginal: "images",
+			folderResized:  "images/resized",
+			wantOriginal:   "images",
+			wantResized:    "images/resized",
+		},
+		{
+			testName:       "resized folder can't be the bucket root",
+			folderOriginal: "original",
+			folderResized:  "/",
+			wantErr:        true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderOriginal, tc.folderOriginal)
+			t.Setenv(envKeyFolderResized, tc.folderResized)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.FolderOriginal, tc.wantOriginal)
+			assertEqual(t, ev.FolderResized, tc.wantResized)
+		})
+	}
+}
+
+func TestBucketNameRequired(t *testing.T) {
+	t.Setenv(bucketNameEnvKey, "")
+	t.Setenv(envKeyFolderOriginal, "original")
+	t.Setenv(envKeyFolderResized, "resized")
+
+	if _, err := New(); err == nil {
+		t.Fatal("want error, got nil")
+	}
+}
+
+func assertEqual[U comparable](t *testing.T, got, want U) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestAutoFormats(t *testing.T) {
+	tt := []struct {
+		testName string
+		value    string
+		// desired candidate formats
+		want    string
+		wantErr bool
+	}{
+		{
+			testName: "defaults to webp and jpeg",
+			want:     "webp,jpeg",
+		},
+		{
+			testName: "duplicates are dropped",
+			value:    "png, jpeg,png",
+			want:     "png,jpeg",
+		},
+		{
+			testName: "unknown format",
+			value:    "jpeg,gif",
+			wantErr:  true,
+		},
+		{
+			testName: "too many formats",
+			value:    "jpeg,png,webp,jpg",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			formats, err := parseAutoFormats(tc.value)
+			assertEqual(t, err != nil, tc.wantErr)
+			assertEqual(t, strings.Join(formats, ","), tc.want)
+		})
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	tt := []struct {
+		testName   string
+		readHeader string
+		write      string
+		// desired timeouts
+		wantReadHeader time.Duration
+		wantWrite      time.Duration
+		wantErr        bool
+	}{
+		{
+			testName:       "defaults",
+			wantReadHeader: 5 * time.Second,
+			wantWrite:      60 * time.Second,
+		},
+		{
+			testName:       "configured",
+			readHeader:     "2s",
+			write:          "5m",
+			wantReadHeader: 2 * time.Second,
+			wantWrite:      5 * time.Minute,
+		},
+		{
+			testName:       "zero disables a timeout",
+			write:          "0s",
+			wantReadHeader: 5 * time.Second,
+		},
+		{
+			testName:   "not a duration",
+			readHeader: "5",
+			wantErr:    true,
+		},
+		{
+			testName: "negative",
+			write:    "-1s",
+			wantErr:  true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyReadHeaderTimeout, tc.readHeader)
+			t.Setenv(envKeyWriteTimeout, tc.write)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.ReadHeaderTimeout, tc.wantReadHeader)
+			assertEqual(t, ev.WriteTimeout, tc.wantWrite)
+			assertEqual(t, ev.ReadTimeout, 30*time.Second)
+			assertEqual(t, ev.IdleTimeout, 120*time.Second)
+		})
+	}
+}
+
+func TestTLS(t *testing.T) {
+	tt := []struct {
+		testName        string
+		certFile        string
+		keyFile         string
+		autocertDomains string
+		// desired TLS config
+		wantDomains string
+		wantErr     bool
+	}{
+		{
+			testName: "plain HTTP",
+		},
+		{
+			testName: "cert and key files",
+			certFile: "cert.pem",
+			keyFile:  "key.pem",
+		},
+		{
+			testName: "cert file without key file",
+			certFile: "cert.pem",
+			wantErr:  true,
+		},
+		{
+			testName: "key file without cert file",
+			keyFile:  "key.pem",
+			wantErr:  true,
+		},
+		{
+			testName:        "autocert domains",
+			autocertDomains: "example.com, www.example.com,",
+			wantDomains:     "example.com,www.example.com",
+		},
+		{
+			testName:        "autocert can't be combined with cert files",
+			certFile:        "cert.pem",
+			keyFile:         "key.pem",
+			autocertDomains: "example.com",
+			wantErr:         true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyTLSCertFile, tc.certFile)
+			t.Setenv(envKeyTLSKeyFile, tc.keyFile)
+			t.Setenv(envKeyAutocertDomains, tc.autocertDomains)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.TLSCertFile, tc.certFile)
+			assertEqual(t, ev.TLSKeyFile, tc.keyFile)
+			assertEqual(t, strings.Join(ev.AutocertDomains, ","), tc.wantDomains)
+			assertEqual(t, ev.AutocertCacheDir, "autocert-cache")
+		})
+	}
+}
+
+func TestTrustedProxies(t *testing.T) {
+	tt := []struct {
+		testName string
+		value    string
+		// desired prefixes
+		want    string
+		wantErr bool
+	}{
+		{testName: "none by default"},
+		{testName: "CIDRs", value: "10.0.0.0/8, fd00::/8", want: "10.0.0.0/8,fd00::/8"},
+		{testName: "bare IPs", value: "192.0.2.1,2001:db8::1", want: "192.0.2.1/32,2001:db8::1/128"},
+		{testName: "host bits are masked", value: "10.1.2.3/8", want: "10.0.0.0/8"},
+		{testName: "not an address", value: "10.0.0.0/8,proxy", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			prefixes, err := parseTrustedProxies(tc.value)
+			assertEqual(t, err != nil, tc.wantErr)
+			var got []string
+			for _, p := range prefixes {
+				got = append(got, p.String())
+			}
+			assertEqual(t, strings.Join(got, ","), tc.want)
+		})
+	}
+}
+
+func TestTenantHeader(t *testing.T) {
+	tt := []struct {
+		testName       string
+		value          string
+		trustedProxies string
+		wantErr        bool
+	}{
+		{testName: "none by default"},
+		{testName: "header of trusted proxies", value: "X-Tenant", trustedProxies: "10.0.0.0/8"},
+		{testName: "without trusted proxies", value: "X-Tenant", wantErr: true},
+		{testName: "not a header name", value: "X Tenant", trustedProxies: "10.0.0.0/8", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyTenantHeader, tc.value)
+			t.Setenv(envKeyTrustedProxies, tc.trustedProxies)
+
+			ev, err := New()
+			assertEqual(t, err != nil, tc.wantErr)
+			if err == nil {
+				assertEqual(t, ev.TenantHeader, tc.value)
+			}
+		})
+	}
+}
+
+func TestAllowedFormats(t *testing.T) {
+	tt := []struct {
+		testName string
+		value    string
+		// desired formats
+		want    string
+		wantErr bool
+	}{
+		{testName: "every format by default"},
+		{testName: "order is kept", value: "webp, jpeg", want: "webp,jpeg"},
+		{testName: "jpg stands for jpeg", value: "JPG,png,jpeg", want: "jpeg,png"},
+		{testName: "ico", value: "ico", want: "ico"},
+		{testName: "unknown format", value: "jpeg,gif", wantErr: true},
+		{testName: "auto is not a format", value: "auto", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			formats, err := parseAllowedFormats(tc.value)
+			assertEqual(t, err != nil, tc.wantErr)
+			assertEqual(t, strings.Join(formats, ","), tc.want)
+		})
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	tt := []struct {
+		testName      string
+		value         string
+		budget        string
+		variantMaxAge string
+		// desired read-only mode
+		want    bool
+		wantErr bool
+	}{
+		{testName: "writable by default"},
+		{testName: "read-only", value: "true", want: true},
+		{testName: "not a boolean", value: "sometimes", wantErr: true},
+		{testName: "variant budget", value: "true", budget: "5", wantErr: true},
+		{testName: "variant max age", value: "true", variantMaxAge: "24h", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyReadOnly, tc.value)
+			t.Setenv(envKeyVariantBudget, tc.budget)
+			t.Setenv(envKeyVariantMaxAge, tc.variantMaxAge)
+
+			ev, err := New()
+			assertEqual(t, err != nil, tc.wantErr)
+			if err == nil {
+				assertEqual(t, ev.ReadOnly, tc.want)
+			}
+		})
+	}
+}
+
+func TestPassthroughExtensions(t *testing.T) {
+	tt := []struct {
+		testName string
+		value    string
+		// desired extensions
+		want    string
+		wantErr bool
+	}{
+		{testName: "none by default"},
+		{testName: "lowercased without dots", value: "SVG, .pdf,svg", want: "svg,pdf"},
+		{testName: "not an extension", value: "svg,tar.gz", wantErr: true},
+		{testName: "resized extension", value: "svg,png", wantErr: true},
+		{testName: "gif is resized too", value: "gif", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			exts, err := parsePassthroughExtensions(tc.value)
+			assertEqual(t, err != nil, tc.wantErr)
+			assertEqual(t, strings.Join(exts, ","), tc.want)
+		})
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	tt := []struct {
+		testName string
+		value    string
+		budget   string
+		// desired buckets
+		want    map[string]string
+		wantErr bool
+	}{
+		{testName: "a single bucket by default"},
+		{testName: "named buckets", value: "shard-a=bucket-a, shard-b=bucket-b", want: map[string]string{"shard-a": "bucket-a", "shard-b": "bucket-b"}},
+		{testName: "not a pair", value: "shard-a", wantErr: true},
+		{testName: "no bucket", value: "shard-a=", wantErr: true},
+		{testName: "name mistaken for an image", value: "photo.jpg=bucket-a", wantErr: true},
+		{testName: "name of a route", value: "sprites=bucket-a", wantErr: true},
+		{testName: "name of the admin routes", value: "admin=bucket-a", wantErr: true},
+		{testName: "name of the immutable route", value: "i=bucket-a", wantErr: true},
+		{testName: "name of the capabilities route", value: "capabilities=bucket-a", wantErr: true},
+		{testName: "name twice", value: "shard-a=bucket-a,shard-a=bucket-b", wantErr: true},
+		{testName: "variant budget", value: "shard-a=bucket-a", budget: "5", want: map[string]string{"shard-a": "bucket-a"}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyBuckets, tc.value)
+			t.Setenv(envKeyVariantBudget, tc.budget)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, len(ev.Buckets), len(tc.want))
+			for name, bucket := range tc.want {
+				assertEqual(t, ev.Buckets[name], bucket)
+			}
+		})
+	}
+}
+
+func TestPortAndRegion(t *testing.T) {
+	tt := []struct {
+		testName string
+		port     string
+		region   string
+		// desired port and region
+		wantPort   int
+		wantRegion string
+		wantErr    bool
+	}{
+		{testName: "defaults", wantPort: 3000, wantRegion: "ca-west-1"},
+		{testName: "configured", port: "8080", region: "us-east-1", wantPort: 8080, wantRegion: "us-east-1"},
+		{testName: "port 0", port: "0", wantErr: true},
+		{testName: "port out of range", port: "65536", wantErr: true},
+		{testName: "not a port", port: "http", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyPort, tc.port)
+			t.Setenv(envKeyRegion, tc.region)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.Port, tc.wantPort)
+			assertEqual(t, ev.Region, tc.wantRegion)
+		})
+	}
+}
+
+func TestRedirectStatus(t *testing.T) {
+	tt := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: 303},
+		{value: "302", want: 302},
+		{value: "307", want: 307},
+		{value: "301", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyRedirectStatus, tc.value)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.RedirectStatus, tc.want)
+		})
+	}
+}
+
+func TestMaxDimension(t *testing.T) {
+	tt := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: 10000},
+		{value: "0", want: 0},
+		{value: "4096", want: 4096},
+		{value: "-1", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyMaxDimension, tc.value)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.MaxDimension, tc.want)
+		})
+	}
+}
+
+func TestDiskCache(t *testing.T) {
+	tt := []struct {
+		testName string
+		dir      string
+		size     string
+		wantSize int
+		wantErr  bool
+	}{
+		{testName: "disabled", wantSize: 1024},
+		{testName: "default size", dir: "/var/cache/image-server", wantSize: 1024},
+		{testName: "size", dir: "/var/cache/image-server", size: "256", wantSize: 256},
+		{testName: "zero size", dir: "/var/cache/image-server", size: "0", wantErr: true},
+		{testName: "negative size", dir: "/var/cache/image-server", size: "-1", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyDiskCacheDir, tc.dir)
+			t.Setenv(envKeyDiskCacheSize, tc.size)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.DiskCacheDir, tc.dir)
+			assertEqual(t, ev.DiskCacheSize, tc.wantSize)
+		})
+	}
+}
+
+func TestResampling(t *testing.T) {
+	tt := []struct {
+		testName string
+		down     string
+		up       string
+		wantDown string
+		wantUp   string
+		wantErr  bool
+	}{
+		{testName: "default", wantDown: "lanczos", wantUp: "lanczos"},
+		{testName: "both", down: "box", up: "nearest", wantDown: "box", wantUp: "nearest"},
+		{testName: "up only", up: "cubic", wantDown: "lanczos", wantUp: "cubic"},
+		{testName: "invalid", down: "bicubic", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyResampleDown, tc.down)
+			t.Setenv(envKeyResampleUp, tc.up)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.ResampleDown, tc.wantDown)
+			assertEqual(t, ev.ResampleUp, tc.wantUp)
+		})
+	}
+}
+
+func TestUploadLimiter(t *testing.T) {
+	tt := []struct {
+		testName    string
+		concurrency string
+		timeout     string
+		want        int
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{testName: "disabled", want: 0, wantTimeout: 10 * time.Second},
+		{testName: "concurrency", concurrency: "16", want: 16, wantTimeout: 10 * time.Second},
+		{testName: "timeout", concurrency: "16", timeout: "2s", want: 16, wantTimeout: 2 * time.Second},
+		{testName: "negative concurrency", concurrency: "-1", wantErr: true},
+		{testName: "zero timeout", concurrency: "16", timeout: "0s", wantErr: true},
+		{testName: "invalid timeout", concurrency: "16", timeout: "soon", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyUploadConcurrency, tc.concurrency)
+			t.Setenv(envKeyUploadQueueTimeout, tc.timeout)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.UploadConcurrency, tc.want)
+			assertEqual(t, ev.UploadQueueTimeout, tc.wantTimeout)
+		})
+	}
+}
+
+func TestDetachGeneration(t *testing.T) {
+	tt := []struct {
+		testName    string
+		detach      string
+		timeout     string
+		want        bool
+		wantTimeout time.Duration
+		wantErr     bool
+	}{
+		{testName: "disabled", want: false, wantTimeout: 30 * time.Second},
+		{testName: "enabled", detach: "1", want: true, wantTimeout: 30 * time.Second},
+		{testName: "timeout", detach: "true", timeout: "1m", want: true, wantTimeout: time.Minute},
+		{testName: "invalid", detach: "sometimes", wantErr: true},
+		{testName: "zero timeout", detach: "1", timeout: "0s", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyDetachGeneration, tc.detach)
+			t.Setenv(envKeyDetachTimeout, tc.timeout)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.DetachGeneration, tc.want)
+			assertEqual(t, ev.DetachTimeout, tc.wantTimeout)
+		})
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tt := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		// built from the directives
+		{value: "", want: ""},
+		{value: "no-store", want: "no-store"},
+		{value: "max-age=60\nX-Injected: 1", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyCacheControl, tc.value)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.CacheControl, tc.want)
+		})
+	}
+}
+
+func TestCacheDirectives(t *testing.T) {
+	tt := []struct {
+		testName string
+		env      map[string]string
+		original CacheDirectives
+		resized  CacheDirectives
+		wantErr  bool
+	}{
+		{testName: "defaults", original: CacheDirectives{MaxAge: 86400}, resized: CacheDirectives{MaxAge: 86400}},
+		{
+			testName: "each kind on its own",
+			env: map[string]string{
+				envKeyCacheMaxAgeOriginal:              "60",
+				envKeyCacheSMaxAgeResized:              "31536000",
+				envKeyCacheStaleWhileRevalidateResized: "600",
+			},
+			original: CacheDirectives{MaxAge: 60},
+			resized:  CacheDirectives{MaxAge: 86400, SMaxAge: 31536000, StaleWhileRevalidate: 600},
+		},
+		{testName: "0 leaves max-age out", env: map[string]string{envKeyCacheMaxAgeResized: "0"}, original: CacheDirectives{MaxAge: 86400}},
+		{testName: "negative", env: map[string]string{envKeyCacheSMaxAgeOriginal: "-1"}, wantErr: true},
+		{testName: "not a number", env: map[string]string{envKeyCacheStaleWhileRevalidateOriginal: "1h"}, wantErr: true},
+		{testName: "too large", env: map[string]string{envKeyCacheMaxAgeResized: "2147483648"}, wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, ev.CacheOriginal, tc.original)
+			assertEqual(t, ev.CacheResized, tc.resized)
+		})
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.env")
+	write := func(data string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv(envKeyConfigFile, file)
+	t.Setenv(bucketNameEnvKey, "bucket")
+	t.Setenv(envKeyFolderResized, "resized")
+	t.Setenv(envKeyServeMode, ServeModeInline)
+	t.Setenv(envKeyPort, "8080")
+	// restored once the test is over, like every key the file sets
+	t.Setenv(envKeyRedirectStatus, "")
+
+	write("# reloadable settings\nSERVE_MODE=redirect\n\nREDIRECT_STATUS = 307\nPORT=9090\n")
+	// PORT was set by a flag
+	cf, err := LoadConfigFile(envKeyPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ev.ServeMode, ServeModeRedirect)
+	assertEqual(t, ev.RedirectStatus, 307)
+	assertEqual(t, ev.Port, 8080)
+
+	// a setting dropped from the file gets the value of the env back
+	write("REDIRECT_STATUS=302\n")
+	assertEqual(t, cf.Load(), nil)
+	ev, err = New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, ev.ServeMode, ServeModeInline)
+	assertEqual(t, ev.RedirectStatus, 302)
+
+	// a broken file sets nothing
+	write("REDIRECT_STATUS=303\nnot an assignment\n")
+	assertEqual(t, cf.Load() != nil, true)
+	assertEqual(t, os.Getenv(envKeyRedirectStatus), "302")
+
+	write("CONFIG_FILE=other.env\n")
+	assertEqual(t, cf.Load() != nil, true)
+
+	t.Setenv(envKeyConfigFile, "")
+	cf, err = LoadConfigFile()
+	assertEqual(t, cf == nil, true)
+	assertEqual(t, err, nil)
+}
+
+func TestExtraHeaders(t *testing.T) {
+	tt := []struct {
+		testName string
+		value    string
+		// desired headers
+		want    string
+		wantErr bool
+	}{
+		{testName: "nosniff by default", want: "X-Content-Type-Options: nosniff\r\n"},
+		{testName: "more headers", value: "cache-tag: images, X-Robots-Tag:noindex", want: "Cache-Tag: images\r\nX-Content-Type-Options: nosniff\r\nX-Robots-Tag: noindex\r\n"},
+		{testName: "default replaced", value: "X-Content-Type-Options:nosniff2", want: "X-Content-Type-Options: nosniff2\r\n"},
+		{testName: "default dropped", value: "X-Content-Type-Options:"},
+		{testName: "not a pair", value: "X-Robots-Tag", wantErr: true},
+		{testName: "invalid name", value: "X Robots:noindex", wantErr: true},
+		{testName: "invalid value", value: "X-Robots-Tag:no\x7findex", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			headers, err := parseExtraHeaders(tc.value)
+			assertEqual(t, err != nil, tc.wantErr)
+			var b strings.Builder
+			headers.Write(&b)
+			assertEqual(t, b.String(), tc.want)
+		})
+	}
+}
+
+func TestQualityLabels(t *testing.T) {
+	tt := []struct {
+		testName string
+		jpeg     string
+		webp     string
+		wantJPEG map[string]int
+		wantWebP map[string]int
+		wantErr  bool
+	}{
+		{testName: "default", wantJPEG: DefaultJPEGQualityLabels, wantWebP: DefaultWebPQualityLabels},
+		{
+			testName: "partial",
+			jpeg:     "low=30, high=90",
+			webp:     "max=95",
+			wantJPEG: map[string]int{"low": 30, "medium": 75, "high": 90, "max": 95},
+			wantWebP: map[string]int{"low": 50, "medium": 75, "high": 90, "max": 95},
+		},
+		{testName: "unknown label", jpeg: "ultra=99", wantErr: true},
+		{testName: "quality out of range", webp: "low=0", wantErr: true},
+		{testName: "missing quality", jpeg: "low", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyQualityLabelsJPEG, tc.jpeg)
+			t.Setenv(envKeyQualityLabelsWebP, tc.webp)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !maps.Equal(ev.JPEGQualityLabels, tc.wantJPEG) {
+				t.Errorf("got jpeg labels %v, want %v", ev.JPEGQualityLabels, tc.wantJPEG)
+			}
+			if !maps.Equal(ev.WebPQualityLabels, tc.wantWebP) {
+				t.Errorf("got webp labels %v, want %v", ev.WebPQualityLabels, tc.wantWebP)
+			}
+		})
+	}
+}
+
+func TestQualityAutoSSIM(t *testing.T) {
+	tt := []struct {
+		testName string
+		value    string
+		want     float64
+		wantErr  bool
+	}{
+		{testName: "default", want: DefaultQualityAutoSSIM},
+		{testName: "configured", value: "0.9", want: 0.9},
+		{testName: "identical", value: "1", want: 1},
+		{testName: "zero", value: "0", wantErr: true},
+		{testName: "above one", value: "1.5", wantErr: true},
+		{testName: "not a number", value: "high", wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			t.Setenv(bucketNameEnvKey, "bucket")
+			t.Setenv(envKeyFolderResized, "resized")
+			t.Setenv(envKeyQualityAutoSSIM, tc.value)
+
+			ev, err := New()
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ev.QualityAutoSSIM != tc.want {
+				t.Errorf("got %v, want %v", ev.QualityAutoSSIM, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package envvar
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const envKeyConfigFile = "CONFIG_FILE"
+
+// ConfigFile sets the env vars assigned in a file of KEY=VALUE lines, blank lines and lines starting with # are ignored
+// its values take precedence over the env, and Load picks up the changes made to it since, for New to read them again
+type ConfigFile struct {
+	path string
+	// keys the file doesn't set, like the ones of command line flags
+	skip map[string]bool
+	// the env of every key set by the file as it was before, to put it back once the file doesn't set it anymore
+	saved map[string]savedEnv
+}
+
+type savedEnv struct {
+	value string
+	set   bool
+}
+
+// LoadConfigFile loads the file named by CONFIG_FILE, nil when there is none
+func LoadConfigFile(skip ...string) (*ConfigFile, error) {
+	path := os.Getenv(envKeyConfigFile)
+	if path == "" {
+		return nil, nil
+	}
+	cf := &ConfigFile{
+		path:  path,
+		skip:  make(map[string]bool, len(skip)),
+		saved: make(map[string]savedEnv),
+	}
+	for _, key := range skip {
+		cf.skip[key] = true
+	}
+	if err := cf.Load(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+func (cf *ConfigFile) Path() string {
+	return cf.path
+}
+
+// Load sets the env vars of the file, nothing is set when it is invalid
+func (cf *ConfigFile) Load() error {
+	data, err := os.ReadFile(cf.path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+	values, err := parseConfigFile(data)
+	if err != nil {
+		return fmt.Errorf("parsing config file %q: %w", cf.path, err)
+	}
+
+	for key, saved := range cf.saved {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		if saved.set {
+			os.Setenv(key, saved.value)
+		} else {
+			os.Unsetenv(key)
+		}
+		delete(cf.saved, key)
+	}
+	for key, value := range values {
+		if cf.skip[key] {
+			continue
+		}
+		if _, ok := cf.saved[key]; !ok {
+			v, set := os.LookupEnv(key)
+			cf.saved[key] = savedEnv{value: v, set: set}
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseConfigFile(data []byte) (map[string]string, error) {
+	values := make(map[string]string)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d is not a KEY=VALUE assignment", n)
+		}
+		if key == envKeyConfigFile {
+			return nil, fmt.Errorf("line %d: %q can't be set by the config file", n, envKeyConfigFile)
+		}
+		values[key] = strings.TrimSpace(value)
+	}
+	return values, s.Err()
+}
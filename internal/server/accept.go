@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// negotiatedFormats are the candidates of fm=auto only picked for clients whose Accept header names them,
+// since browsers that can't decode them send image/* or */* all the same
+// jpeg and png are decoded by every client
+var negotiatedFormats = []string{formatWebP}
+
+type acceptKey struct{}
+
+// withAccept makes fm=auto pick among the formats the Accept header accept names, see acceptedCandidates
+func withAccept(ctx context.Context, accept string) context.Context {
+	return context.WithValue(ctx, acceptKey{}, accept)
+}
+
+// acceptedCandidates drops the candidates of fm=auto the Accept header of ctx doesn't name
+// a request without one accepts any format, so they are all kept
+func acceptedCandidates(ctx context.Context, candidates []params) ([]params, error) {
+	accept, ok := ctx.Value(acceptKey{}).(string)
+	if !ok {
+		return candidates, nil
+	}
+	accepted := slices.DeleteFunc(slices.Clone(candidates), func(c params) bool {
+		return slices.Contains(negotiatedFormats, c.outputFormat) && !accepts(accept, mimeType(c.outputFormat))
+	})
+	if len(accepted) == 0 {
+		return nil, &statusError{code: http.StatusNotAcceptable, message: "fm=auto has no candidate format the Accept header names"}
+	}
+	return accepted, nil
+}
+
+// accepts tells whether the Accept header accept names mime with a quality above 0, wildcards left aside
+func accepts(accept string, mime string) bool {
+	for _, mediaRange := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(mediaRange, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), mime) {
+			continue
+		}
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(key) != "q" {
+				continue
+			}
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && q <= 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestAccepts(t *testing.T) {
+	tt := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "image/avif,image/webp,image/apng,image/*,*/*;q=0.8", want: true},
+		{accept: "image/webp", want: true},
+		{accept: "IMAGE/WEBP;q=0.5", want: true},
+		{accept: "image/png, image/webp ; q=0.9", want: true},
+		{accept: "image/webp;q=0", want: false},
+		{accept: "image/*,*/*;q=0.8", want: false},
+		{accept: "image/png,image/svg+xml,image/*;q=0.8", want: false},
+		{accept: "", want: false},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.accept, func(t *testing.T) {
+			assertEqual(t, accepts(tc.accept, "image/webp"), tc.want)
+		})
+	}
+}
+
+func TestAutoFormatAccept(t *testing.T) {
+	if !outputSupported(formatWebP) {
+		t.Skip("webp output requires a cgo build")
+	}
+
+	tt := []struct {
+		testName    string
+		autoFormats []string
+		serveMode   string
+		accept      string
+		target      string
+		// desired response status code, and extension of the variant redirected to or content type served
+		statusCode  int
+		location    string
+		contentType string
+		vary        string
+	}{
+		{testName: "webp accepted", autoFormats: []string{"webp", "png"}, accept: "image/avif,image/webp,*/*", target: "/imagePNG.png?w=100&fm=auto", statusCode: http.StatusSeeOther, location: "w100h0-auto.webp", vary: "Accept"},
+		{testName: "webp not accepted", autoFormats: []string{"webp", "png"}, accept: "image/png,image/*;q=0.8,*/*;q=0.5", target: "/imagePNG.png?w=100&fm=auto", statusCode: http.StatusSeeOther, location: "w100h0-auto.png", vary: "Accept"},
+		{testName: "without Accept every candidate is kept", autoFormats: []string{"webp", "png"}, target: "/imagePNG.png?w=100&fm=auto", statusCode: http.StatusSeeOther, location: "w100h0-auto.webp", vary: "Accept"},
+		{testName: "stored webp not redirected to when not accepted", autoFormats: []string{"webp", "png"}, accept: "*/*", target: "/imageJPEG.jpeg?w=600&h=900&fm=auto", statusCode: http.StatusSeeOther, location: "w600h900-auto.png", vary: "Accept"},
+		{testName: "stored webp redirected to when accepted", autoFormats: []string{"webp", "png"}, accept: "image/webp", target: "/imageJPEG.jpeg?w=600&h=900&fm=auto", statusCode: http.StatusSeeOther, location: "w600h900-auto.webp", vary: "Accept"},
+		{testName: "inline", autoFormats: []string{"webp", "png"}, serveMode: envvar.ServeModeInline, accept: "image/png", target: "/imagePNG.png?w=100&fm=auto", statusCode: http.StatusOK, contentType: "image/png", vary: "Accept"},
+		{testName: "only fm=auto varies", autoFormats: []string{"webp", "png"}, accept: "image/png", target: "/imagePNG.png?w=100&fm=webp", statusCode: http.StatusSeeOther, location: "w100h0.webp"},
+		{testName: "no candidate accepted", autoFormats: []string{"webp"}, accept: "image/png", target: "/imagePNG.png?w=100&fm=auto", statusCode: http.StatusNotAcceptable, vary: "Accept"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				AutoFormats:    tc.autoFormats,
+				ServeMode:      tc.serveMode,
+			}
+			ssc := newStubStorageClient(sev)
+			ssc.storage[path.Join(sev.FolderResized, "imageJPEG.jpeg", "w600h900-auto.webp")] = newStubObject("webp", 600, 900)
+			ssc.storage[path.Join(sev.FolderResized, "imageJPEG.jpeg", "w600h900-auto.png")] = newStubObject("png", 600, 900)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, rr.Header().Get("Vary"), tc.vary)
+			if tc.location != "" {
+				assertEqual(t, strings.TrimPrefix(rr.Header().Get("Location"), "https://test.test/"+path.Join(sev.BucketName, sev.FolderResized)+"/"), path.Join(strings.Split(strings.TrimPrefix(tc.target, "/"), "?")[0], tc.location))
+			}
+			if tc.contentType != "" {
+				assertEqual(t, rr.Header().Get("Content-Type"), tc.contentType)
+			}
+		})
+	}
+}
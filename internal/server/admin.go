@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+const maxCopyRequestSize = 1 << 16
+
+// copyRequest copies the object under From to To, keys of the bucket rather than image names,
+// and deletes the one under From afterwards when Move is set
+type copyRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Move bool   `json:"move"`
+}
+
+// adminAuthorized checks the bearer token of r against the configured one
+// admin endpoints write to any key of the bucket, so they are refused when no token is configured
+func adminAuthorized(envVar *envvar.EnvVar, r *http.Request) bool {
+	return bearerAuthorized(r, envVar.AdminToken)
+}
+
+// bearerAuthorized checks the bearer token of r against token, refusing every request when token is empty
+func bearerAuthorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// copyHandler copies or moves an object of the bucket, answering 204 No Content once it is done
+func copyHandler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(envVar, r) {
+			http.Error(w, "copying requires a valid bearer token", http.StatusForbidden)
+			return
+		}
+
+		var req copyRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxCopyRequestSize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&req); err != nil {
+			http.Error(w, "invalid copy request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.From == "" || req.To == "" {
+			http.Error(w, "copy request must name both from and to", http.StatusBadRequest)
+			return
+		}
+		if req.From == req.To {
+			// moving an object onto itself would delete it
+			http.Error(w, "from and to must differ", http.StatusBadRequest)
+			return
+		}
+
+		if err := storageClient.CopyObject(r.Context(), req.From, req.To); err != nil {
+			if errors.Is(err, storage.ErrBadRequest) {
+				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+				return
+			}
+			if se := storageStatus(err); se != nil {
+				http.Error(w, se.message, se.code)
+				return
+			}
+			logger.ErrorContext(r.Context(), "copying object", "from", req.From, "to", req.To, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if req.Move {
+			if err := storageClient.DeleteObject(r.Context(), req.From); err != nil {
+				// the copy is done, only the source is left behind, so a retry of the move succeeds
+				logger.ErrorContext(r.Context(), "deleting moved object", "from", req.From, "to", req.To, "error", err)
+				http.Error(w, "copied but failed to delete "+req.From, http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
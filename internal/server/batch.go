@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	maxBatchItems       = 100
+	maxBatchRequestSize = 1 << 20
+)
+
+// batchItem is one image of a batch request, w, h and format are left out of the query when zero
+type batchItem struct {
+	Name   string `json:"name"`
+	Width  int    `json:"w"`
+	Height int    `json:"h"`
+	Format string `json:"format"`
+}
+
+func (bi batchItem) query() url.Values {
+	q := url.Values{}
+	if bi.Width != 0 {
+		q.Set(queryWidth, strconv.Itoa(bi.Width))
+	}
+	if bi.Height != 0 {
+		q.Set(queryHeight, strconv.Itoa(bi.Height))
+	}
+	if bi.Format != "" {
+		q.Set(queryFormat, bi.Format)
+	}
+	return q
+}
+
+type batchResult struct {
+	Name   string `json:"name"`
+	Status int    `json:"status"`
+	URL    string `json:"url,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchHandler resizes every image of a JSON array at most envVar.BatchConcurrency at a time
+// and answers with 207 Multi-Status, each result carrying the status its own image request would have gotten
+func batchHandler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, o options) func(w http.ResponseWriter, r *http.Request) {
+	tracer := otel.Tracer(tracerName)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		var items []batchItem
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchRequestSize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&items); err != nil {
+			http.Error(w, "invalid batch request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(items) == 0 || len(items) > maxBatchItems {
+			http.Error(w, "batch must list between 1 and 100 images", http.StatusBadRequest)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), envVar.BatchTimeout)
+		defer cancel()
+
+		results := make([]batchResult, len(items))
+		sem := make(chan struct{}, envVar.BatchConcurrency)
+		var wg sync.WaitGroup
+		for i, item := range items {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] = batchResult{Name: item.Name}
+
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				case <-ctx.Done():
+					results[i].Status = http.StatusGatewayTimeout
+					results[i].Error = "batch timed out"
+					return
+				}
+
+				itemCtx, span := tracer.Start(ctx, "batch.item", trace.WithAttributes(attribute.Int("batch.index", i)))
+				defer span.End()
+
+				v, err := resizeVariant(itemCtx, logger, storageClient, envVar, o, item.Name, item.query(), nil)
+				if err != nil {
+					var se *statusError
+					if !errors.As(err, &se) {
+						se = newStatusError(http.StatusInternalServerError)
+					}
+					// storage calls cut short by the timeout fail like any other storage error
+					if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+						se = &statusError{code: http.StatusGatewayTimeout, message: "batch timed out"}
+					}
+					results[i].Status = se.code
+					results[i].Error = se.message
+					return
+				}
+				results[i].Status = http.StatusOK
+				results[i].URL = storageClient.ObjectURL(v.key)
+			}()
+		}
+		wg.Wait()
+
+		data, err := json.Marshal(results)
+		if err != nil {
+			logger.ErrorContext(ctx, "encoding batch results", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write(data)
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/gift"
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+const (
+	queryBlurHashX = "x"
+	queryBlurHashY = "y"
+
+	defaultBlurHashX = 4
+	defaultBlurHashY = 3
+	// the BlurHash format allows 1 to 9 components on each axis
+	maxBlurHashComponents = 9
+
+	// a BlurHash only keeps a few colors, so it is computed from a small thumbnail
+	blurHashSampleWidth = 64
+)
+
+func parseBlurHashComponents(q url.Values, key string, fallback int) (int, error) {
+	if !q.Has(key) {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(q.Get(key))
+	if err != nil || n < 1 || n > maxBlurHashComponents {
+		return 0, fmt.Errorf("%s must be an integer between 1 and %d", key, maxBlurHashComponents)
+	}
+	return n, nil
+}
+
+// blurHashKey names the cached BlurHash of an original after its component counts, like "blurhash-x4y3.txt"
+func blurHashKey(folder string, x, y int) string {
+	return path.Join(folder, fmt.Sprintf("blurhash-x%dy%d.txt", x, y))
+}
+
+// blurHashHandler answers with the BlurHash of an original, computed once and then stored next to its variants
+func blurHashHandler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// check image path
+		imagePath := r.PathValue(slug)
+		imageName, _, ok := parseImageName(imagePath)
+		if !ok {
+			http.Error(w, errStrInvalidImagePath, http.StatusBadRequest)
+			return
+		}
+
+		q := r.URL.Query()
+		x, err := parseBlurHashComponents(q, queryBlurHashX, defaultBlurHashX)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		y, err := parseBlurHashComponents(q, queryBlurHashY, defaultBlurHashY)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// check if the hash was already computed
+		hashKey := blurHashKey(resizedFolder(envVar, tenant(r.Context()), imagePath, imageName), x, y)
+		body, _, err := storageClient.DownloadObject(r.Context(), hashKey)
+		if err == nil {
+			defer body.Close()
+			hash, err := io.ReadAll(io.LimitReader(body, 1<<10))
+			if err != nil {
+				logger.ErrorContext(r.Context(), "reading blurhash", "key", hashKey, "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			writeBlurHash(w, r, logger, string(hash))
+			return
+		}
+		if !errors.Is(err, storage.ErrNotFound) {
+			if se := storageStatus(err); se != nil {
+				http.Error(w, se.message, se.code)
+				return
+			}
+			logger.ErrorContext(r.Context(), "downloading blurhash", "key", hashKey, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// else, compute it from the original
+		originalKey := originalKey(envVar.FolderOriginal, imagePath)
+		body, _, err = storageClient.DownloadObject(r.Context(), originalKey)
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				http.Error(w, se.message, se.code)
+				return
+			}
+			logger.ErrorContext(r.Context(), "downloading original image", "key", originalKey, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer body.Close()
+
+		source := &sourceReader{r: body}
+		src, _, err := decodeImage(source)
+		if err != nil {
+			se := decodeFailure(r.Context(), logger, originalKey, source, err)
+			http.Error(w, se.message, se.code)
+			return
+		}
+
+		g := gift.New()
+		if src.Bounds().Dx() > blurHashSampleWidth {
+			g.Add(gift.Resize(blurHashSampleWidth, 0, gift.BoxResampling))
+		}
+		sample := image.NewNRGBA(g.Bounds(src.Bounds()))
+		g.Draw(sample, src)
+
+		hash, err := blurhash.Encode(x, y, sample)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "encoding blurhash", "key", originalKey, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// a failed upload only costs computing the hash again next time
+		err = storageClient.UploadObject(r.Context(), hashKey, strings.NewReader(hash), "text/plain")
+		if err != nil && !errors.Is(err, storage.ErrUnavailable) {
+			logger.ErrorContext(r.Context(), "uploading blurhash", "key", hashKey, "error", err)
+		}
+
+		writeBlurHash(w, r, logger, hash)
+	}
+}
+
+func writeBlurHash(w http.ResponseWriter, r *http.Request, logger *slog.Logger, hash string) {
+	data, err := json.Marshal(struct {
+		BlurHash string `json:"blurhash"`
+	}{hash})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "encoding blurhash response", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
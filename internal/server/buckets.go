@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+const headerBucket = "X-Bucket"
+
+type pathPrefixKey struct{}
+
+// pathPrefix is the path prefix that selected the bucket of r, stripped before routing it, "" when there is none
+func pathPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(pathPrefixKey{}).(string)
+	return prefix
+}
+
+// selectBucket passes requests on to the handler of the bucket they select, or to fallback when they select none
+//
+// a bucket is selected by a leading path segment naming it, like /{name}/{image}, which is stripped,
+// or by an X-Bucket header naming it, only believed from trusted proxies since it sends requests to another bucket
+func selectBucket(trustedProxies []netip.Prefix, fallback http.Handler, buckets map[string]http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// bucket names have no dot, so they can't be mistaken for an image
+		name, _, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if h, found := buckets[name]; ok && found {
+			r = r.WithContext(context.WithValue(r.Context(), pathPrefixKey{}, "/"+name))
+			http.StripPrefix("/"+name, h).ServeHTTP(w, r)
+			return
+		}
+
+		if name := r.Header.Get(headerBucket); name != "" && fromTrustedProxy(r, trustedProxies) {
+			h, ok := buckets[name]
+			if !ok {
+				http.Error(w, "unknown bucket", http.StatusBadRequest)
+				return
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		fallback.ServeHTTP(w, r)
+	})
+}
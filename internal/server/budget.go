@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+// VariantBudget caps the number of resized variants kept per original
+//
+// usage is counted in memory as variants are served or created, so variants untouched since startup aren't known to it
+// and counts start over on restart
+// Run deletes the least used variants of every original over budget in the bucket of its client, as ranked by the eviction policy
+type VariantBudget struct {
+	budget int
+	policy string
+	now    func() time.Time
+
+	mu sync.Mutex
+	// usage of every known variant, by URL of its resized folder so that buckets don't share their keys, and then by key
+	usage map[string]map[string]*variantUsage
+}
+
+type variantUsage struct {
+	folder   string
+	key      string
+	hits     int
+	lastUsed time.Time
+}
+
+func NewVariantBudget(budget int, policy string) *VariantBudget {
+	return &VariantBudget{
+		budget: budget,
+		policy: policy,
+		now:    time.Now,
+		usage:  make(map[string]map[string]*variantUsage),
+	}
+}
+
+// record counts a use of the variant stored at key under the resized folder of its original, in the bucket of storageClient
+func (vb *VariantBudget) record(storageClient storage.Client, folder string, key string) {
+	folderURL := storageClient.ObjectURL(folder)
+
+	vb.mu.Lock()
+	defer vb.mu.Unlock()
+
+	variants, ok := vb.usage[folderURL]
+	if !ok {
+		variants = make(map[string]*variantUsage)
+		vb.usage[folderURL] = variants
+	}
+	u, ok := variants[key]
+	if !ok {
+		u = &variantUsage{folder: folder, key: key}
+		variants[key] = u
+	}
+	u.hits++
+	u.lastUsed = vb.now()
+}
+
+// victims lists the variants to delete so that every original in the bucket of storageClient is back within budget
+func (vb *VariantBudget) victims(storageClient storage.Client) []variantUsage {
+	vb.mu.Lock()
+	defer vb.mu.Unlock()
+
+	var victims []variantUsage
+	for folderURL, variants := range vb.usage {
+		if len(variants) <= vb.budget {
+			continue
+		}
+		ranked := make([]*variantUsage, 0, len(variants))
+		for _, u := range variants {
+			ranked = append(ranked, u)
+		}
+		if storageClient.ObjectURL(ranked[0].folder) != folderURL {
+			continue
+		}
+		// least used first, ties broken by age and then by key to keep evictions deterministic
+		slices.SortFunc(ranked, func(a, b *variantUsage) int {
+			if vb.policy == envvar.EvictionPolicyLFU && a.hits != b.hits {
+				return a.hits - b.hits
+			}
+			if c := a.lastUsed.Compare(b.lastUsed); c != 0 {
+				return c
+			}
+			if a.key < b.key {
+				return -1
+			}
+			return 1
+		})
+		for _, u := range ranked[:len(ranked)-vb.budget] {
+			victims = append(victims, *u)
+		}
+	}
+	return victims
+}
+
+func (vb *VariantBudget) forget(folderURL string, key string) {
+	vb.mu.Lock()
+	defer vb.mu.Unlock()
+
+	delete(vb.usage[folderURL], key)
+	if len(vb.usage[folderURL]) == 0 {
+		delete(vb.usage, folderURL)
+	}
+}
+
+// evict deletes every variant over budget in the bucket of storageClient, variants that fail to be deleted are retried on the next run
+func (vb *VariantBudget) evict(ctx context.Context, logger *slog.Logger, storageClient storage.Client) {
+	for _, v := range vb.victims(storageClient) {
+		err := storageClient.DeleteObject(ctx, v.key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logger.Error("evicting resized image", "key", v.key, "error", err)
+			continue
+		}
+		logger.Debug("evicted resized image", "key", v.key, "hits", v.hits)
+		vb.forget(storageClient.ObjectURL(v.folder), v.key)
+	}
+}
+
+// Run evicts variants over budget from the bucket of storageClient every interval until ctx is done
+func (vb *VariantBudget) Run(ctx context.Context, logger *slog.Logger, storageClient storage.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			vb.evict(ctx, logger, storageClient)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+func TestVariantBudget(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	folder := path.Join(sev.FolderResized, "imagePNG.png")
+
+	tt := []struct {
+		testName string
+		policy   string
+		// desired variants left after eviction
+		kept []string
+	}{
+		{
+			testName: "least frequently used",
+			policy:   envvar.EvictionPolicyLFU,
+			kept:     []string{"w100h0.png", "w200h0.png"},
+		},
+		{
+			testName: "least recently used",
+			policy:   envvar.EvictionPolicyLRU,
+			kept:     []string{"w250h0.png", "w200h0.png"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			vb := NewVariantBudget(2, tc.policy)
+			now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+			vb.now = func() time.Time {
+				now = now.Add(time.Second)
+				return now
+			}
+			ss := New(slogt.New(t), ssc, sev, WithVariantBudget(vb))
+
+			// w100 is requested the most but w250 the latest
+			for _, w := range []string{"100", "100", "100", "200", "200", "250"} {
+				rr := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "/imagePNG.png?w="+w, nil)
+				ss.ServeHTTP(rr, req)
+				assertEqual(t, rr.Code, http.StatusSeeOther)
+			}
+
+			vb.evict(context.Background(), slogt.New(t), ssc)
+
+			var kept int
+			for _, name := range []string{"w100h0.png", "w200h0.png", "w250h0.png"} {
+				_, ok := ssc.storage[path.Join(folder, name)]
+				if ok {
+					kept++
+				}
+				want := name == tc.kept[0] || name == tc.kept[1]
+				assertEqual(t, ok, want)
+			}
+			assertEqual(t, kept, 2)
+			assertEqual(t, len(vb.usage[ssc.ObjectURL(folder)]), 2)
+
+			// originals within budget are left alone
+			vb.evict(context.Background(), slogt.New(t), ssc)
+			assertEqual(t, len(vb.usage[ssc.ObjectURL(folder)]), 2)
+		})
+	}
+}
+
+func TestVariantBudgetBuckets(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	folder := path.Join(sev.FolderResized, "imagePNG.png")
+	ssc := newStubStorageClient(sev)
+	shard := newStubStorageClient(&envvar.EnvVar{BucketName: "shard-bucket", FolderOriginal: sev.FolderOriginal, FolderResized: sev.FolderResized})
+	vb := NewVariantBudget(1, envvar.EvictionPolicyLRU)
+	ss := New(slogt.New(t), ssc, sev, WithVariantBudget(vb), WithBuckets(map[string]storage.Client{"shard": shard}))
+
+	// each bucket keeps the variants used in it, within budget on their own
+	for _, target := range []string{"/imagePNG.png?w=100", "/shard/imagePNG.png?w=200"} {
+		rr := httptest.NewRecorder()
+		ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		assertEqual(t, rr.Code, http.StatusSeeOther)
+	}
+	vb.evict(context.Background(), slogt.New(t), ssc)
+	vb.evict(context.Background(), slogt.New(t), shard)
+	_, ok := ssc.storage[path.Join(folder, "w100h0.png")]
+	assertEqual(t, ok, true)
+	_, ok = shard.storage[path.Join(folder, "w200h0.png")]
+	assertEqual(t, ok, true)
+
+	// a variant over budget in the shard is evicted from the shard only
+	rr := httptest.NewRecorder()
+	ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/shard/imagePNG.png?w=250", nil))
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+	vb.evict(context.Background(), slogt.New(t), ssc)
+	_, ok = shard.storage[path.Join(folder, "w200h0.png")]
+	assertEqual(t, ok, true)
+	vb.evict(context.Background(), slogt.New(t), shard)
+	_, ok = shard.storage[path.Join(folder, "w200h0.png")]
+	assertEqual(t, ok, false)
+	_, ok = ssc.storage[path.Join(folder, "w100h0.png")]
+	assertEqual(t, ok, true)
+}
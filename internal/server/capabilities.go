@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+const capabilitiesPath = "/capabilities"
+
+// otherImageFormats are formats fm may name that no build of this server encodes
+var otherImageFormats = []string{"avif", "jxl", "bmp", "tiff"}
+
+// errOutputUnsupported rejects fm naming an image format this build can't encode, value as it was requested
+func errOutputUnsupported(value string) error {
+	return fmt.Errorf("output format %s not supported by this server", strings.ToLower(value))
+}
+
+// capabilitiesHandler answers with the extensions of the originals this server resizes
+// and the formats fm may ask for, the ones this build encodes that ALLOWED_FORMATS allows, in the order fm lists them
+func capabilitiesHandler(logger *slog.Logger, envVar *envvar.EnvVar) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var inputs []string
+		for _, ext := range originalExtensions() {
+			if formatFromExtension(ext) != formatHEIF || heifSupported {
+				inputs = append(inputs, ext)
+			}
+		}
+		var outputs []string
+		for _, format := range outputFormats() {
+			if formatAllowed(envVar.AllowedFormats, format) {
+				outputs = append(outputs, format)
+			}
+		}
+
+		data, err := json.Marshal(struct {
+			InputFormats  []string `json:"input_formats"`
+			OutputFormats []string `json:"output_formats"`
+		}{inputs, outputs})
+		if err != nil {
+			logger.ErrorContext(r.Context(), "encoding capabilities response", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}
+}
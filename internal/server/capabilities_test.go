@@ -0,0 +1,129 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestCapabilities(t *testing.T) {
+	inputs := `["jpeg","jpg","png","gif"]`
+	if heifSupported {
+		inputs = `["jpeg","jpg","png","gif","heic","heif"]`
+	}
+	outputs := `["jpeg","png","ico"]`
+	if outputSupported(formatWebP) {
+		outputs = `["jpeg","png","webp","ico"]`
+	}
+
+	tt := []struct {
+		testName       string
+		allowedFormats []string
+		body           string
+	}{
+		{
+			testName: "every format allowed",
+			body:     `{"input_formats":` + inputs + `,"output_formats":` + outputs + `}`,
+		},
+		{
+			testName:       "allowed formats",
+			allowedFormats: []string{formatICO, formatPNG},
+			body:           `{"input_formats":` + inputs + `,"output_formats":["png","ico"]}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				AllowedFormats: tc.allowedFormats,
+			}
+			ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, capabilitiesPath, nil))
+
+			assertEqual(t, rr.Code, http.StatusOK)
+			assertEqual(t, rr.Header().Get("Content-Type"), "application/json")
+			assertEqual(t, rr.Body.String(), tc.body)
+		})
+	}
+}
+
+func TestUnsupportedOutputFormat(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	// only encoded by cgo builds
+	webpStatus, webpBody := http.StatusSeeOther, ""
+	if !outputSupported(formatWebP) {
+		webpStatus, webpBody = http.StatusBadRequest, "output format webp not supported by this server"
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code and body, unless it redirects
+		statusCode int
+		body       string
+	}{
+		{
+			testName:   "avif",
+			target:     "/imageJPEG.jpeg?w=100&fm=avif",
+			statusCode: http.StatusBadRequest,
+			body:       "output format avif not supported by this server",
+		},
+		{
+			testName:   "avif in another case",
+			target:     "/imageJPEG.jpeg?w=100&fm=AVIF",
+			statusCode: http.StatusBadRequest,
+			body:       "output format avif not supported by this server",
+		},
+		{
+			testName:   "gif is only an input",
+			target:     "/imageJPEG.jpeg?w=100&fm=gif",
+			statusCode: http.StatusBadRequest,
+			body:       "output format gif not supported by this server",
+		},
+		{
+			testName:   "heic is only an input",
+			target:     "/imageJPEG.jpeg?fm=heic",
+			statusCode: http.StatusBadRequest,
+			body:       "output format heic not supported by this server",
+		},
+		{
+			testName:   "webp",
+			target:     "/imageJPEG.jpeg?w=100&fm=webp",
+			statusCode: webpStatus,
+			body:       webpBody,
+		},
+		{
+			testName:   "supported",
+			target:     "/imageJPEG.jpeg?w=100&fm=png",
+			statusCode: http.StatusSeeOther,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+// withClientIP resolves the client IP of every request once, see clientIP
+func withClientIP(trustedProxies []netip.Prefix, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r, trustedProxies)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// clientIP returns the IP of the client that sent r, through any trusted proxy in front of this server
+// it is empty when the remote address can't be parsed
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return resolveClientIP(r, nil)
+}
+
+// peerAddr parses the address of the peer that sent r, which is the closest proxy when there is one
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// fromTrustedProxy tells whether the headers of r were set by one of trustedProxies
+func fromTrustedProxy(r *http.Request, trustedProxies []netip.Prefix) bool {
+	addr, ok := peerAddr(r)
+	return ok && isTrustedProxy(addr, trustedProxies)
+}
+
+func isTrustedProxy(addr netip.Addr, trustedProxies []netip.Prefix) bool {
+	return slices.ContainsFunc(trustedProxies, func(p netip.Prefix) bool {
+		return p.Contains(addr)
+	})
+}
+
+// resolveClientIP only believes the forwarding headers when the peer is a trusted proxy
+//
+// X-Forwarded-For is walked from the right since every proxy appends the address it received the request from,
+// the first address that isn't a trusted proxy is the client, anything left of it may be forged by that client
+func resolveClientIP(r *http.Request, trustedProxies []netip.Prefix) string {
+	addr, ok := peerAddr(r)
+	if !ok {
+		return ""
+	}
+	if !isTrustedProxy(addr, trustedProxies) {
+		return addr.String()
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIP.Unmap().String()
+		}
+		return addr.String()
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// a trusted proxy wouldn't append garbage, so the last address reached is as far as it can be followed
+			break
+		}
+		addr = hop.Unmap()
+		if !isTrustedProxy(addr, trustedProxies) {
+			break
+		}
+	}
+	return addr.String()
+}
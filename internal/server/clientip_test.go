@@ -0,0 +1,115 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("fd00::/8"),
+	}
+
+	tt := []struct {
+		testName       string
+		remoteAddr     string
+		forwardedFor   []string
+		realIP         string
+		trustedProxies []netip.Prefix
+		want           string
+	}{
+		{
+			testName:   "no proxy",
+			remoteAddr: "203.0.113.7:51234",
+			want:       "203.0.113.7",
+		},
+		{
+			testName:     "headers are ignored without trusted proxies",
+			remoteAddr:   "10.0.0.2:51234",
+			forwardedFor: []string{"203.0.113.7"},
+			realIP:       "203.0.113.8",
+			want:         "10.0.0.2",
+		},
+		{
+			testName:       "untrusted peer can't spoof its IP",
+			remoteAddr:     "198.51.100.1:51234",
+			forwardedFor:   []string{"203.0.113.7"},
+			realIP:         "203.0.113.8",
+			trustedProxies: trusted,
+			want:           "198.51.100.1",
+		},
+		{
+			testName:       "trusted proxy",
+			remoteAddr:     "10.0.0.2:51234",
+			forwardedFor:   []string{"203.0.113.7"},
+			trustedProxies: trusted,
+			want:           "203.0.113.7",
+		},
+		{
+			testName:       "chain of trusted proxies",
+			remoteAddr:     "10.0.0.2:51234",
+			forwardedFor:   []string{"203.0.113.7, 10.0.0.3", "10.0.0.4"},
+			trustedProxies: trusted,
+			want:           "203.0.113.7",
+		},
+		{
+			testName:       "addresses forged by the client are skipped",
+			remoteAddr:     "10.0.0.2:51234",
+			forwardedFor:   []string{"1.1.1.1, 203.0.113.7"},
+			trustedProxies: trusted,
+			want:           "203.0.113.7",
+		},
+		{
+			testName:       "every hop trusted",
+			remoteAddr:     "10.0.0.2:51234",
+			forwardedFor:   []string{"10.0.0.3"},
+			trustedProxies: trusted,
+			want:           "10.0.0.3",
+		},
+		{
+			testName:       "garbage stops the walk",
+			remoteAddr:     "10.0.0.2:51234",
+			forwardedFor:   []string{"203.0.113.7, unknown"},
+			trustedProxies: trusted,
+			want:           "10.0.0.2",
+		},
+		{
+			testName:       "X-Real-IP from a trusted proxy",
+			remoteAddr:     "10.0.0.2:51234",
+			realIP:         "203.0.113.8",
+			trustedProxies: trusted,
+			want:           "203.0.113.8",
+		},
+		{
+			testName:       "IPv6",
+			remoteAddr:     "[fd00::1]:51234",
+			forwardedFor:   []string{"2001:db8::7"},
+			trustedProxies: trusted,
+			want:           "2001:db8::7",
+		},
+		{
+			testName:       "IPv4-mapped IPv6 peer",
+			remoteAddr:     "[::ffff:10.0.0.2]:51234",
+			forwardedFor:   []string{"203.0.113.7"},
+			trustedProxies: trusted,
+			want:           "203.0.113.7",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/photo.jpg", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, v := range tc.forwardedFor {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tc.realIP != "" {
+				r.Header.Set("X-Real-IP", tc.realIP)
+			}
+
+			assertEqual(t, resolveClientIP(r, tc.trustedProxies), tc.want)
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+const (
+	queryCompareFormats   = "formats"
+	queryCompareQualities = "qualities"
+)
+
+// maxCompareCandidates caps the encodes spent on a single comparison
+const maxCompareCandidates = 16
+
+// compareFormats are the formats compared unless ?formats names others, those the server can't encode or doesn't allow left out
+var compareFormats = []string{formatJPEG, formatWebP, formatPNG}
+
+// compareEncodeParams pick the encode of a single variant, which a comparison picks with ?formats and ?qualities instead
+var compareEncodeParams = []string{queryFormat, queryFallback, queryQuality, queryWebPQuality, queryWebPLossless, queryMaxBytes, queryICOSizes}
+
+// compareResult is the size of the variant encoded in format, at quality for the lossy ones
+type compareResult struct {
+	Format  string `json:"format"`
+	Quality int    `json:"quality,omitempty"`
+	Bytes   int    `json:"bytes"`
+}
+
+// compareCandidate is a format and the quality it is encoded at, 0 for the lossless ones
+type compareCandidate struct {
+	format  string
+	quality int
+}
+
+// compareHandler resizes an image once and encodes it in every candidate format and quality,
+// answering the size of each without storing any
+func compareHandler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, o options) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		results, err := compareVariants(r.Context(), logger, storageClient, envVar, o, r.PathValue(slug), r.URL.Query())
+		if err != nil {
+			var se *statusError
+			if !errors.As(err, &se) {
+				se = newStatusError(http.StatusInternalServerError)
+			}
+			http.Error(w, se.message, se.code)
+			return
+		}
+
+		data, err := json.Marshal(results)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "encoding comparison", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}
+}
+
+// compareVariants produces the output of q for the image at imagePath like resizeVariant does, and encodes it in every candidate
+// every error it returns is a *statusError
+func compareVariants(ctx context.Context, logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, o options, imagePath string, q url.Values) ([]compareResult, error) {
+	_, imageFormat, ok := parseImageName(imagePath)
+	if !ok {
+		return nil, &statusError{code: http.StatusBadRequest, message: errStrInvalidImagePath}
+	}
+	q, err := expandPreset(o.presets, q)
+	if err != nil {
+		return nil, &statusError{code: http.StatusBadRequest, message: err.Error()}
+	}
+	for _, key := range compareEncodeParams {
+		if q.Has(key) {
+			return nil, &statusError{code: http.StatusBadRequest, message: fmt.Sprintf("%s can't be compared, name the candidates with formats and qualities", key)}
+		}
+	}
+	qc := envQualityConfig(envVar)
+	p, err := parseParams(q, imageFormat, envVar.AllowedFormats, envVar.MaxDimension, envResampling(envVar), qc)
+	if err != nil {
+		return nil, &statusError{code: http.StatusBadRequest, message: err.Error()}
+	}
+	if p.watermark && o.watermark == nil {
+		return nil, &statusError{code: http.StatusBadRequest, message: "watermark is not configured on this server"}
+	}
+	candidates, err := parseCompareCandidates(q, envVar.AllowedFormats, qc)
+	if err != nil {
+		return nil, &statusError{code: http.StatusBadRequest, message: err.Error()}
+	}
+
+	// the decoded original, when the cache of decoded originals holds it, and else its size, read from its header
+	// its version keys the cache, which would otherwise hold the pixels of an original replaced under the same key
+	key := originalKey(envVar.FolderOriginal, imagePath)
+	var cacheKey, version string
+	var src image.Image
+	var bounds image.Rectangle
+	if o.originals != nil {
+		_, version, err = storageClient.ObjectMetadata(ctx, key)
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				return nil, se
+			}
+			logger.ErrorContext(ctx, "checking original image", "key", key, "error", err)
+			return nil, newStatusError(http.StatusInternalServerError)
+		}
+		cacheKey = originalCacheKey(storageClient, key, version, p.frame)
+		src, _, _ = o.originals.Get(cacheKey)
+	}
+	var original io.Reader
+	var source *sourceReader
+	if src != nil {
+		bounds = src.Bounds()
+	} else {
+		body, _, err := storageClient.DownloadObject(storage.WithVersion(ctx, version), key)
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				return nil, se
+			}
+			logger.ErrorContext(ctx, "downloading original image", "key", key, "error", err)
+			return nil, newStatusError(http.StatusInternalServerError)
+		}
+		defer body.Close()
+		source = &sourceReader{r: body}
+		var header bytes.Buffer
+		cfg, _, err := decodeConfig(io.TeeReader(source, &header))
+		if err != nil {
+			return nil, decodeFailure(ctx, logger, key, source, err)
+		}
+		original = io.MultiReader(&header, source)
+		bounds = image.Rect(0, 0, cfg.Width, cfg.Height)
+	}
+
+	p = p.withinBounds(bounds)
+	if p.scale > 1 && envVar.MaxDimension > 0 {
+		if size := outputSize(bounds, p); size.X > envVar.MaxDimension || size.Y > envVar.MaxDimension {
+			return nil, &statusError{code: http.StatusBadRequest, message: fmt.Sprintf("scale=%d gives a %dx%d image, larger than the max dimension %d", p.scale, size.X, size.Y, envVar.MaxDimension)}
+		}
+	}
+	if o.memory != nil {
+		n := resizeBytes(bounds, outputSize(bounds, p), src != nil)
+		if !o.memory.acquire(n) {
+			logger.WarnContext(ctx, "memory budget spent, refusing comparison", "key", key, "bytes", n)
+			return nil, &statusError{code: http.StatusServiceUnavailable, message: "too many images being resized, try again later"}
+		}
+		defer o.memory.release(n)
+	}
+
+	if src == nil {
+		var format string
+		var frames int
+		if p.frame > 0 {
+			src, frames, err = decodeFrame(original, p.frame)
+			format = formatGIF
+		} else {
+			src, format, err = decodeImage(original)
+		}
+		if err != nil {
+			return nil, decodeFailure(ctx, logger, key, source, err)
+		}
+		if src == nil {
+			return nil, &statusError{code: http.StatusBadRequest, message: fmt.Sprintf("frame %d is out of range, the original has %d frames", p.frame, frames)}
+		}
+		if o.originals != nil {
+			o.originals.Add(cacheKey, src, format)
+		}
+	}
+
+	dst := render(src, p, o.watermark)
+	results := make([]compareResult, 0, len(candidates))
+	for _, c := range candidates {
+		wc := &writeCounter{w: io.Discard}
+		if err := encode(wc, dst, c.format, p.encode.withQuality(c.format, c.quality)); err != nil {
+			logger.ErrorContext(ctx, "encoding comparison candidate", "image", imagePath, "format", c.format, "quality", c.quality, "error", err)
+			return nil, newStatusError(http.StatusInternalServerError)
+		}
+		results = append(results, compareResult{Format: c.format, Quality: c.quality, Bytes: wc.n})
+	}
+	return results, nil
+}
+
+// parseCompareCandidates crosses the lossy formats of ?formats with the qualities of ?qualities, labels or numbers,
+// each lossless format being a single candidate
+// without ?qualities, a lossy format is compared at the qualities of its labels
+func parseCompareCandidates(q url.Values, allowedFormats []string, qc qualityConfig) ([]compareCandidate, error) {
+	var formats []string
+	if q.Has(queryCompareFormats) {
+		for _, name := range strings.Split(q.Get(queryCompareFormats), ",") {
+			format := formatFromExtension(strings.TrimSpace(name))
+			if format == "" || inputOnly(format) || format == formatICO {
+				return nil, fmt.Errorf("formats must list jpeg, png or webp, got %q", name)
+			}
+			if !outputSupported(format) {
+				return nil, errOutputUnsupported(name)
+			}
+			if !formatAllowed(allowedFormats, format) {
+				return nil, fmt.Errorf("formats=%s is not allowed on this server", name)
+			}
+			if !slices.Contains(formats, format) {
+				formats = append(formats, format)
+			}
+		}
+	} else {
+		for _, format := range compareFormats {
+			if outputSupported(format) && formatAllowed(allowedFormats, format) {
+				formats = append(formats, format)
+			}
+		}
+		if len(formats) == 0 {
+			return nil, errors.New("none of the compared formats is supported by this server and allowed")
+		}
+	}
+
+	var qualities []string
+	if q.Has(queryCompareQualities) {
+		qualities = strings.Split(q.Get(queryCompareQualities), ",")
+	}
+	var candidates []compareCandidate
+	for _, format := range formats {
+		if format != formatJPEG && format != formatWebP {
+			candidates = append(candidates, compareCandidate{format: format})
+			continue
+		}
+		values := qualities
+		if values == nil {
+			values = envvar.QualityLabels
+		}
+		for _, value := range values {
+			quality, err := qc.parseQuality(strings.TrimSpace(value), format)
+			if err != nil {
+				return nil, fmt.Errorf("qualities must list labels of %v or integers between 1 and 100, got %q", envvar.QualityLabels, value)
+			}
+			c := compareCandidate{format: format, quality: quality}
+			if !slices.Contains(candidates, c) {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+	if len(candidates) > maxCompareCandidates {
+		return nil, fmt.Errorf("formats and qualities make %d candidates, more than %d", len(candidates), maxCompareCandidates)
+	}
+	return candidates, nil
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestCompare(t *testing.T) {
+	tt := []struct {
+		testName       string
+		allowedFormats []string
+		target         string
+		// desired response status code, and body or candidates compared
+		statusCode int
+		body       string
+		want       []compareResult
+	}{
+		{
+			testName:   "formats and qualities",
+			target:     "/imagePNG.png/compare?w=100&formats=jpeg,png&qualities=50,high",
+			statusCode: http.StatusOK,
+			want:       []compareResult{{Format: formatJPEG, Quality: 50}, {Format: formatJPEG, Quality: 85}, {Format: formatPNG}},
+		},
+		{
+			testName:   "qualities of the labels by default",
+			target:     "/imageJPEG.jpeg/compare?w=100&formats=jpg",
+			statusCode: http.StatusOK,
+			want:       []compareResult{{Format: formatJPEG, Quality: 50}, {Format: formatJPEG, Quality: 75}, {Format: formatJPEG, Quality: 85}, {Format: formatJPEG, Quality: 95}},
+		},
+		{
+			testName:   "same quality twice",
+			target:     "/imageJPEG.jpeg/compare?formats=jpeg&qualities=75,medium",
+			statusCode: http.StatusOK,
+			want:       []compareResult{{Format: formatJPEG, Quality: 75}},
+		},
+		{
+			testName:       "allowed formats by default",
+			allowedFormats: []string{formatPNG},
+			target:         "/imageJPEG.jpeg/compare?w=100",
+			statusCode:     http.StatusOK,
+			want:           []compareResult{{Format: formatPNG}},
+		},
+		{testName: "format not allowed", allowedFormats: []string{formatPNG}, target: "/imageJPEG.jpeg/compare?formats=jpeg", statusCode: http.StatusBadRequest, body: "formats=jpeg is not allowed on this server"},
+		{testName: "unknown format", target: "/imageJPEG.jpeg/compare?formats=bmp", statusCode: http.StatusBadRequest, body: `formats must list jpeg, png or webp, got "bmp"`},
+		{testName: "unknown quality", target: "/imageJPEG.jpeg/compare?formats=jpeg&qualities=ultra", statusCode: http.StatusBadRequest, body: `qualities must list labels of [low medium high max] or integers between 1 and 100, got "ultra"`},
+		{testName: "too many candidates", target: "/imageJPEG.jpeg/compare?formats=jpeg&qualities=1,2,3,4,5,6,7,8,9,10,11,12,13,14,15,16,17", statusCode: http.StatusBadRequest, body: "formats and qualities make 17 candidates, more than 16"},
+		{testName: "encode params", target: "/imageJPEG.jpeg/compare?fm=webp", statusCode: http.StatusBadRequest, body: "fm can't be compared, name the candidates with formats and qualities"},
+		{testName: "missing original", target: "/missing.jpeg/compare?formats=png", statusCode: http.StatusNotFound, body: http.StatusText(http.StatusNotFound)},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				AllowedFormats: tc.allowedFormats,
+			}
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			assertEqual(t, rr.Header().Get("Content-Type"), "application/json")
+			var got []compareResult
+			if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, len(got), len(tc.want))
+			for i := range min(len(got), len(tc.want)) {
+				assertEqual(t, got[i].Format, tc.want[i].Format)
+				assertEqual(t, got[i].Quality, tc.want[i].Quality)
+				assertEqual(t, got[i].Bytes > 0, true)
+			}
+			// nothing is stored
+			assertEqual(t, ssc.execution[exeKeyUpload], false)
+		})
+	}
+}
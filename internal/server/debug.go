@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"image"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+const queryDebug = "debug"
+
+// debugReport describes what an image request resolves to, without producing anything
+type debugReport struct {
+	OriginalKey    string `json:"original_key"`
+	OriginalWidth  int    `json:"original_width"`
+	OriginalHeight int    `json:"original_height"`
+	// false when the original itself answers the request
+	Resized bool `json:"resized"`
+	// effective size of the output, after keeping the aspect ratio
+	Width      int               `json:"width"`
+	Height     int               `json:"height"`
+	Format     string            `json:"format"`
+	Transforms []string          `json:"transforms"`
+	Variants   []debugVariantKey `json:"variants"`
+}
+
+type debugVariantKey struct {
+	Key      string `json:"key"`
+	Format   string `json:"format"`
+	CacheHit bool   `json:"cache_hit"`
+}
+
+func debugRequested(q url.Values) bool {
+	debug, _ := strconv.ParseBool(q.Get(queryDebug))
+	return debug
+}
+
+// debugVariant resolves the params and keys of an image request like resizeVariant does
+// the original is only read as far as its header, and nothing is resized nor uploaded
+// every error it returns is a *statusError
+func debugVariant(ctx context.Context, logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, o options, imagePath string, q url.Values) (debugReport, error) {
+	var report debugReport
+
+	imageName, imageFormat, ok := parseImageName(imagePath)
+	if !ok {
+		return report, &statusError{code: http.StatusBadRequest, message: errStrInvalidImagePath}
+	}
+	q, err := expandPreset(o.presets, q)
+	if err != nil {
+		return report, &statusError{code: http.StatusBadRequest, message: err.Error()}
+	}
+	p, err := parseParams(q, imageFormat, envVar.AllowedFormats, envVar.MaxDimension, envResampling(envVar), envQualityConfig(envVar))
+	if err != nil {
+		return report, &statusError{code: http.StatusBadRequest, message: err.Error()}
+	}
+
+	report.OriginalKey = originalKey(envVar.FolderOriginal, imagePath)
+	body, _, err := storageClient.DownloadObject(ctx, report.OriginalKey)
+	if err != nil {
+		if se := storageStatus(err); se != nil {
+			return report, se
+		}
+		logger.ErrorContext(ctx, "downloading original image", "key", report.OriginalKey, "error", err)
+		return report, newStatusError(http.StatusInternalServerError)
+	}
+	defer body.Close()
+	source := &sourceReader{r: body}
+	cfg, _, err := decodeConfig(source)
+	if err != nil {
+		return report, decodeFailure(ctx, logger, report.OriginalKey, source, err)
+	}
+	report.OriginalWidth, report.OriginalHeight = cfg.Width, cfg.Height
+	p = p.withinBounds(image.Rect(0, 0, cfg.Width, cfg.Height))
+
+	size := outputSize(image.Rect(0, 0, cfg.Width, cfg.Height), p)
+	report.Width, report.Height = size.X, size.Y
+	report.Resized = p.requested(imageFormat)
+	report.Transforms = p.keyTransforms()
+	report.Format = p.outputFormat
+	if p.auto {
+		report.Format = formatAuto
+	}
+	if !report.Resized {
+		return report, nil
+	}
+
+	candidates, err := variantCandidates(envVar, p, imageFormat)
+	if err != nil {
+		return report, err
+	}
+	candidates, err = acceptedCandidates(ctx, candidates)
+	if err != nil {
+		return report, err
+	}
+	var version string
+	if envVar.VersionedKeys {
+		_, version, err = storageClient.ObjectMetadata(ctx, report.OriginalKey)
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				return report, se
+			}
+			logger.ErrorContext(ctx, "checking original image", "key", report.OriginalKey, "error", err)
+			return report, newStatusError(http.StatusInternalServerError)
+		}
+	}
+	folder := resizedFolder(envVar, tenant(ctx), imagePath, imageName)
+	for _, c := range candidates {
+		key := variantKey(folder, c, version)
+		ok, err := storageClient.CheckObject(ctx, key)
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				return report, se
+			}
+			logger.ErrorContext(ctx, "checking resized image", "key", key, "error", err)
+			return report, newStatusError(http.StatusInternalServerError)
+		}
+		report.Variants = append(report.Variants, debugVariantKey{Key: key, Format: c.outputFormat, CacheHit: ok})
+	}
+	return report, nil
+}
+
+func writeDebugReport(w http.ResponseWriter, r *http.Request, logger *slog.Logger, report debugReport) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		logger.ErrorContext(r.Context(), "encoding debug report", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"path"
+
+	"github.com/obzva/image-server/internal/storage"
+)
+
+// blobKey names the content of a deduplicated variant after its hash, like "blobs/{sha256}.jpeg" in the resized folder
+func blobKey(folderResized string, data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+	return path.Join(folderResized, "blobs", hex.EncodeToString(sum[:])+ext)
+}
+
+// produceDeduplicated is produce when DEDUP is on, returning the key of the blob holding the output
+//
+// the output is encoded into memory to be hashed before anything is stored,
+// the blob is only uploaded when no other variant stored the same bytes yet, and the variant at key links to it
+func produceDeduplicated(ctx context.Context, storageClient storage.Client, uploads *UploadLimiter, folderResized string, key string, contentType string, write func(w io.Writer) error, inline func(contentType string) io.Writer) (target string, encodeErr error, uploadErr error, streamed bool) {
+	var buf bytes.Buffer
+	stopEncode := startPhase(ctx, "encode")
+	encodeErr = write(&buf)
+	stopEncode()
+	if encodeErr != nil {
+		return "", encodeErr, nil, false
+	}
+
+	if uploads != nil {
+		stopQueue := startPhase(ctx, "upload_queue")
+		acquired := uploads.acquire(ctx)
+		stopQueue()
+		if !acquired {
+			return "", nil, errUploadQueueFull, writeUnstored(inline, contentType, buf.Bytes())
+		}
+		defer uploads.release()
+	}
+
+	stopUpload := startPhase(ctx, "upload")
+	defer stopUpload()
+	target = blobKey(folderResized, buf.Bytes(), path.Ext(key))
+	ok, err := storageClient.CheckObject(ctx, target)
+	if err != nil {
+		return "", nil, err, writeUnstored(inline, contentType, buf.Bytes())
+	}
+	if !ok {
+		if err := storageClient.UploadObject(ctx, target, bytes.NewReader(buf.Bytes()), contentType); err != nil {
+			return "", nil, err, writeUnstored(inline, contentType, buf.Bytes())
+		}
+	}
+	if err := storageClient.LinkObject(ctx, key, target); err != nil {
+		return "", nil, err, writeUnstored(inline, contentType, buf.Bytes())
+	}
+	stopUpload()
+
+	if inline != nil {
+		// a client gone by now doesn't undo anything stored
+		inline(contentType).Write(buf.Bytes())
+		streamed = true
+	}
+	return target, nil, nil, streamed
+}
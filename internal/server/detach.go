@@ -0,0 +1,29 @@
+package server
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// detach keeps the values of ctx but not its cancellation, so a variant is still produced and stored once its requester is gone,
+// for at most timeout
+func detach(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), timeout)
+}
+
+// detachedWriter writes into the response of a detached request until the first error, the client being gone,
+// after which it drops what it is given, so the upload the response is teed from isn't cut short with it
+type detachedWriter struct {
+	w    io.Writer
+	gone bool
+}
+
+func (dw *detachedWriter) Write(b []byte) (int, error) {
+	if !dw.gone {
+		if _, err := dw.w.Write(b); err != nil {
+			dw.gone = true
+		}
+	}
+	return len(b), nil
+}
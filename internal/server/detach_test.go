@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+// leavingStorageClient cancels the request once its original is downloaded, like a client leaving mid-resize,
+// and fails the uploads whose context is done like S3 would
+type leavingStorageClient struct {
+	*stubStorageClient
+	cancel context.CancelFunc
+}
+
+func (lsc *leavingStorageClient) DownloadObject(ctx context.Context, objectKey string) (io.ReadCloser, string, error) {
+	body, contentType, err := lsc.stubStorageClient.DownloadObject(ctx, objectKey)
+	lsc.cancel()
+	return body, contentType, err
+}
+
+func (lsc *leavingStorageClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return lsc.stubStorageClient.UploadObject(ctx, objectKey, body, contentType)
+}
+
+func TestDetachGeneration(t *testing.T) {
+	tt := []struct {
+		testName  string
+		detach    bool
+		serveMode string
+		// whether the variant is stored although its requester left
+		stored bool
+	}{
+		{testName: "abandoned", stored: false},
+		{testName: "detached", detach: true, stored: true},
+		{testName: "detached inline", detach: true, serveMode: envvar.ServeModeInline, stored: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:       "stub-bucket",
+				FolderOriginal:   "stub-original-folder",
+				FolderResized:    "stub-resized-folder",
+				ServeMode:        tc.serveMode,
+				DetachGeneration: tc.detach,
+				DetachTimeout:    time.Minute,
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), &leavingStorageClient{stubStorageClient: ssc, cancel: cancel}, sev, WithUploadLimiter(NewUploadLimiter(1, time.Second)))
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequestWithContext(ctx, http.MethodGet, "/imagePNG.png?w=100", nil))
+
+			assertEqual(t, ctx.Err(), context.Canceled)
+			_, ok := ssc.storage[path.Join(sev.FolderResized, "imagePNG.png", "w100h0.png")]
+			assertEqual(t, ok, tc.stored)
+		})
+	}
+}
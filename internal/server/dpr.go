@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	queryDPR = "dpr"
+
+	maxDPR = 4
+)
+
+// client hints of the pixel ratio of the screen, the Sec-CH- one of current browsers first
+var dprHints = []string{"Sec-CH-DPR", "DPR"}
+
+// parseDPR reads ?dpr, the pixel multiplier of the screen scaling w and h
+func parseDPR(value string) (float64, error) {
+	dpr, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(dpr) || dpr < 1 || dpr > maxDPR {
+		return 0, errors.New("dpr must be a number between 1 and 4")
+	}
+	return dpr, nil
+}
+
+// contentDPR is the Content-DPR of the image q requests, "" when ?dpr doesn't scale it, without w or h
+// it is only sent along with the image, redirects and errors carry none
+func contentDPR(q url.Values) string {
+	if !q.Has(queryWidth) && !q.Has(queryHeight) {
+		return ""
+	}
+	dpr, err := parseDPR(q.Get(queryDPR))
+	if err != nil {
+		return ""
+	}
+	return strconv.FormatFloat(dpr, 'f', -1, 64)
+}
+
+// dprHint is the pixel ratio the client hints of r advertise, as a value of ?dpr, "" when they advertise none
+// it is clamped to what ?dpr allows and rounded to the nearest half, so that screens sharing a density share their variants
+func dprHint(r *http.Request) string {
+	for _, name := range dprHints {
+		value := r.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		dpr, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(dpr) || dpr <= 0 {
+			return ""
+		}
+		dpr = math.Round(min(max(dpr, 1), maxDPR)*2) / 2
+		return strconv.FormatFloat(dpr, 'f', -1, 64)
+	}
+	return ""
+}
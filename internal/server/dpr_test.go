@@ -0,0 +1,156 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestDPRHint(t *testing.T) {
+	tt := []struct {
+		testName string
+		headers  map[string]string
+		// desired value of ?dpr
+		want string
+	}{
+		{testName: "none"},
+		{testName: "Sec-CH-DPR", headers: map[string]string{"Sec-CH-DPR": "2"}, want: "2"},
+		{testName: "legacy DPR", headers: map[string]string{"DPR": "3"}, want: "3"},
+		{testName: "Sec-CH-DPR first", headers: map[string]string{"Sec-CH-DPR": "2", "DPR": "3"}, want: "2"},
+		{testName: "rounded to a half", headers: map[string]string{"Sec-CH-DPR": "2.625"}, want: "2.5"},
+		{testName: "clamped below", headers: map[string]string{"Sec-CH-DPR": "0.75"}, want: "1"},
+		{testName: "clamped above", headers: map[string]string{"Sec-CH-DPR": "8"}, want: "4"},
+		{testName: "not a number", headers: map[string]string{"Sec-CH-DPR": "retina"}},
+		{testName: "negative", headers: map[string]string{"Sec-CH-DPR": "-2"}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/imagePNG.png", nil)
+			for name, value := range tc.headers {
+				r.Header.Set(name, value)
+			}
+			assertEqual(t, dprHint(r), tc.want)
+		})
+	}
+}
+
+func TestDPR(t *testing.T) {
+	tt := []struct {
+		testName    string
+		clientHints bool
+		inline      bool
+		target      string
+		hint        string
+		// desired response
+		statusCode int
+		location   string
+		contentDPR string
+		vary       string
+	}{
+		{
+			testName:   "explicit dpr",
+			inline:     true,
+			target:     "/imagePNG.png?w=100&dpr=2",
+			statusCode: http.StatusOK,
+			contentDPR: "2",
+		},
+		{
+			testName:   "stored variant",
+			inline:     true,
+			target:     "/imagePNG.png?w=300&h=450&dpr=2",
+			statusCode: http.StatusOK,
+			contentDPR: "2",
+		},
+		{
+			testName:   "redirect",
+			target:     "/imagePNG.png?w=100&dpr=2",
+			statusCode: http.StatusSeeOther,
+			location:   "w200h0.png",
+		},
+		{
+			testName:   "original without w or h",
+			inline:     true,
+			target:     "/imagePNG.png?dpr=2",
+			statusCode: http.StatusOK,
+		},
+		{
+			testName:   "missing original",
+			inline:     true,
+			target:     "/missing.png?w=100&dpr=2",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			testName:   "hint ignored without CLIENT_HINTS",
+			target:     "/imagePNG.png?w=100",
+			hint:       "2",
+			statusCode: http.StatusSeeOther,
+			location:   "w100h0.png",
+		},
+		{
+			testName:    "hint",
+			clientHints: true,
+			inline:      true,
+			target:      "/imagePNG.png?w=100&h=50",
+			hint:        "1.5",
+			statusCode:  http.StatusOK,
+			contentDPR:  "1.5",
+			vary:        "Sec-CH-DPR, DPR",
+		},
+		{
+			testName:    "no hint",
+			clientHints: true,
+			target:      "/imagePNG.png?w=100",
+			statusCode:  http.StatusSeeOther,
+			location:    "w100h0.png",
+			vary:        "Sec-CH-DPR, DPR",
+		},
+		{
+			testName:    "explicit dpr wins over the hint",
+			clientHints: true,
+			inline:      true,
+			target:      "/imagePNG.png?w=100&dpr=1",
+			hint:        "3",
+			statusCode:  http.StatusOK,
+			contentDPR:  "1",
+		},
+		{
+			testName:   "invalid dpr",
+			target:     "/imagePNG.png?w=100&dpr=5",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				ClientHints:    tc.clientHints,
+			}
+			if tc.inline {
+				sev.ServeMode = envvar.ServeModeInline
+			}
+			ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.hint != "" {
+				req.Header.Set("Sec-CH-DPR", tc.hint)
+			}
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.location != "" {
+				assertEqual(t, rr.Header().Get("Location"), "https://test.test/"+path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", tc.location))
+			}
+			assertEqual(t, rr.Header().Get("Content-DPR"), tc.contentDPR)
+			assertEqual(t, rr.Header().Get("Vary"), tc.vary)
+		})
+	}
+}
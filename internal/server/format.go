@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"slices"
+	"strings"
+)
+
+const (
+	formatJPEG = "jpeg"
+	formatPNG  = "png"
+	formatWebP = "webp"
+	formatICO  = "ico"
+	// originals only, browsers don't render it so it is never an output
+	formatHEIF = "heif"
+	// originals only, resized one frame at a time, see decodeFrame
+	formatGIF = "gif"
+	// not a format of its own, ?fm=auto picks the smallest of the candidate formats
+	formatAuto = "auto"
+)
+
+const defaultWebPQuality = 90
+
+type encodeOptions struct {
+	// 0 to 100, ignored when lossless
+	webpQuality  int
+	webpLossless bool
+	// 1 to 100, 0 keeps the default of image/jpeg
+	jpegQuality int
+	// lower the quality until the output fits in this many bytes, 0 keeps it as is
+	maxBytes int
+	// lower the quality while the output stays this similar to the image encoded, 0 keeps it as is, see encodeAuto
+	autoSSIM float64
+	// frames of an ico, defaultICOSizes when empty
+	icoSizes []int
+	// trade CPU for a smaller png, see encodePNG
+	optimizePNG bool
+	// ICC profile embedded in a jpeg or png, see withICCProfile, "" embeds none
+	icc string
+}
+
+// codec is what this server knows of an image format, looked up by name, extension or magic bytes instead of switching on the format
+// decoders and encoders that only some builds have, like webp in cgo builds, are attached to their format at init
+type codec struct {
+	// format name, the one image.Decode reports
+	name string
+	// file extensions and values of ?fm naming it, lowercase
+	extensions []string
+	mime       string
+	// originals may have its extensions, whether this build decodes them or answers that it can't
+	original bool
+	// never an output, whatever the build
+	inputOnly bool
+
+	// prefix of its encoded images, '?' matching any byte like image.RegisterFormat, read with decode and decodeConfig
+	// formats without decode may still be decoded by a package registering itself with image.RegisterFormat, like libheif
+	magic        string
+	decode       func(io.Reader) (image.Image, error)
+	decodeConfig func(io.Reader) (image.Config, error)
+	// nil when this build doesn't encode it
+	encode func(w io.Writer, img image.Image, opts encodeOptions) error
+}
+
+// codecs are the formats this server knows of, in the order fm and the capabilities list them
+var codecs = []*codec{
+	{
+		name: formatJPEG, extensions: []string{"jpeg", "jpg"}, mime: "image/jpeg", original: true,
+		magic: "\xff\xd8", decode: jpeg.Decode, decodeConfig: jpeg.DecodeConfig, encode: encodeJPEG,
+	},
+	{
+		name: formatPNG, extensions: []string{"png"}, mime: "image/png", original: true,
+		magic: "\x89PNG\r\n\x1a\n", decode: png.Decode, decodeConfig: png.DecodeConfig,
+		encode: func(w io.Writer, img image.Image, opts encodeOptions) error {
+			return encodePNG(w, img, opts.optimizePNG)
+		},
+	},
+	{name: formatWebP, extensions: []string{"webp"}, mime: "image/webp"},
+	{
+		name: formatICO, extensions: []string{"ico"}, mime: "image/x-icon",
+		encode: func(w io.Writer, img image.Image, opts encodeOptions) error {
+			return encodeICO(w, img, opts.icoSizes)
+		},
+	},
+	{
+		name: formatGIF, extensions: []string{"gif"}, mime: "image/gif", original: true, inputOnly: true,
+		magic: "GIF8?a", decode: gif.Decode, decodeConfig: gif.DecodeConfig,
+	},
+	{name: formatHEIF, extensions: []string{"heic", "heif"}, mime: "image/heif", original: true, inputOnly: true},
+}
+
+// registerCodec adds a format, or replaces the one of the same name
+func registerCodec(c codec) {
+	for i, known := range codecs {
+		if known.name == c.name {
+			codecs[i] = &c
+			return
+		}
+	}
+	codecs = append(codecs, &c)
+}
+
+// registerEncoder attaches encode to the format name, which this build then encodes
+func registerEncoder(name string, encode func(w io.Writer, img image.Image, opts encodeOptions) error) {
+	if c := codecOf(name); c != nil {
+		c.encode = encode
+	}
+}
+
+// registerDecoder attaches decode and decodeConfig to the format name, sniffed by magic
+func registerDecoder(name string, magic string, decode func(io.Reader) (image.Image, error), decodeConfig func(io.Reader) (image.Config, error)) {
+	if c := codecOf(name); c != nil {
+		c.magic, c.decode, c.decodeConfig = magic, decode, decodeConfig
+	}
+}
+
+// codecOf is the codec of the format name, nil for an unknown one
+func codecOf(name string) *codec {
+	for _, c := range codecs {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// sniffCodec is the codec whose magic bytes the image read from br starts with, nil when none has
+func sniffCodec(br *bufio.Reader) *codec {
+	for _, c := range codecs {
+		if c.decode == nil {
+			continue
+		}
+		head, _ := br.Peek(len(c.magic))
+		if matchMagic(c.magic, head) {
+			return c
+		}
+	}
+	return nil
+}
+
+func matchMagic(magic string, b []byte) bool {
+	if len(b) != len(magic) {
+		return false
+	}
+	for i := range b {
+		if magic[i] != '?' && magic[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeSniffed decodes br like image.Decode with the codec its magic bytes name,
+// handing the formats no codec decodes to image.Decode
+func decodeSniffed(br *bufio.Reader) (image.Image, string, error) {
+	c := sniffCodec(br)
+	if c == nil {
+		return image.Decode(br)
+	}
+	img, err := c.decode(br)
+	return img, c.name, err
+}
+
+// decodeConfigSniffed is decodeSniffed for image.DecodeConfig
+func decodeConfigSniffed(br *bufio.Reader) (image.Config, string, error) {
+	c := sniffCodec(br)
+	if c == nil {
+		return image.DecodeConfig(br)
+	}
+	cfg, err := c.decodeConfig(br)
+	return cfg, c.name, err
+}
+
+// mimeType maps the format name reported by image.Decode to the MIME type of the encoded output
+func mimeType(format string) string {
+	if c := codecOf(format); c != nil {
+		return c.mime
+	}
+	return "application/octet-stream"
+}
+
+// inputOnly tells whether format is only ever decoded from originals, never encoded into an output
+func inputOnly(format string) bool {
+	c := codecOf(format)
+	return c != nil && c.inputOnly
+}
+
+// outputSupported tells whether this build encodes format
+func outputSupported(format string) bool {
+	c := codecOf(format)
+	return c != nil && c.encode != nil
+}
+
+// outputFormats are the formats this build encodes, in the order fm lists them
+func outputFormats() []string {
+	var formats []string
+	for _, c := range codecs {
+		if c.encode != nil {
+			formats = append(formats, c.name)
+		}
+	}
+	return formats
+}
+
+// originalExtensions are the extensions of the originals this server resizes, lowercase
+func originalExtensions() []string {
+	var exts []string
+	for _, c := range codecs {
+		if c.original {
+			exts = append(exts, c.extensions...)
+		}
+	}
+	return exts
+}
+
+// formatFromExtension maps a file extension, or the value of ?fm, to the format name used by image.Decode
+func formatFromExtension(ext string) string {
+	ext = strings.ToLower(ext)
+	for _, c := range codecs {
+		if slices.Contains(c.extensions, ext) {
+			return c.name
+		}
+	}
+	return ""
+}
+
+func encodeJPEG(w io.Writer, img image.Image, opts encodeOptions) error {
+	if opts.jpegQuality != 0 {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: opts.jpegQuality})
+	}
+	return jpeg.Encode(w, img, nil)
+}
+
+func encode(w io.Writer, img image.Image, format string, opts encodeOptions) error {
+	c := codecOf(format)
+	if c == nil || c.encode == nil {
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+	return c.encode(withICCProfile(w, format, opts.icc), img, opts)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+// fakeMagic starts the images of a format registered by the tests only,
+// followed by their width and height and their RGBA pixels
+const fakeMagic = "FAKE"
+
+func encodeFake(w io.Writer, img image.Image, opts encodeOptions) error {
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			rgba.Set(x, y, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	if _, err := io.WriteString(w, fakeMagic); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, [2]uint16{uint16(b.Dx()), uint16(b.Dy())}); err != nil {
+		return err
+	}
+	_, err := w.Write(rgba.Pix)
+	return err
+}
+
+func decodeFakeConfig(r io.Reader) (image.Config, error) {
+	head := make([]byte, len(fakeMagic)+4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return image.Config{}, err
+	}
+	if string(head[:len(fakeMagic)]) != fakeMagic {
+		return image.Config{}, errors.New("not a fake image")
+	}
+	w, h := binary.BigEndian.Uint16(head[len(fakeMagic):]), binary.BigEndian.Uint16(head[len(fakeMagic)+2:])
+	return image.Config{ColorModel: color.RGBAModel, Width: int(w), Height: int(h)}, nil
+}
+
+func decodeFake(r io.Reader) (image.Image, error) {
+	cfg, err := decodeFakeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, cfg.Width, cfg.Height))
+	if _, err := io.ReadFull(r, img.Pix); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// registerFakeCodec registers the fake format for the test only
+func registerFakeCodec(t *testing.T) {
+	saved := slices.Clone(codecs)
+	t.Cleanup(func() {
+		codecs = saved
+	})
+	registerCodec(codec{
+		name: "fake", extensions: []string{"fake"}, mime: "image/x-fake", original: true,
+		magic: fakeMagic, decode: decodeFake, decodeConfig: decodeFakeConfig, encode: encodeFake,
+	})
+}
+
+func TestRegisteredCodec(t *testing.T) {
+	registerFakeCodec(t)
+
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	var original bytes.Buffer
+	if err := encodeFake(&original, image.NewRGBA(image.Rect(0, 0, 40, 20)), encodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired key and content type of the variant, and its size
+		key         string
+		contentType string
+		width       int
+		height      int
+	}{
+		{testName: "original in the format", target: "/photo.fake?w=10", key: "photo.fake/w10h0.fake", contentType: "image/x-fake", width: 10, height: 5},
+		{testName: "output in the format", target: "/imageJPEG.jpeg?w=10&fm=fake", key: "imageJPEG.jpeg/w10h0.fake", contentType: "image/x-fake", width: 10, height: 10},
+		{testName: "original in the format converted", target: "/photo.fake?h=10&fm=png", key: "photo.fake/w0h10.png", contentType: "image/png", width: 20, height: 10},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ssc.storage[path.Join(sev.FolderOriginal, "photo.fake")] = stubObject{data: original.Bytes(), contentType: "image/x-fake"}
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, http.StatusSeeOther)
+			key := path.Join(sev.FolderResized, tc.key)
+			assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(key))
+			object, ok := ssc.storage[key]
+			if !ok {
+				t.Fatalf("want variant %q uploaded", key)
+			}
+			assertEqual(t, object.contentType, tc.contentType)
+			cfg, format, err := decodeConfigSniffed(bufio.NewReader(bytes.NewReader(object.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, format, formatFromExtension(path.Ext(tc.key)[1:]))
+			assertEqual(t, cfg.Width, tc.width)
+			assertEqual(t, cfg.Height, tc.height)
+		})
+	}
+
+	t.Run("capabilities", func(t *testing.T) {
+		ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+		rr := httptest.NewRecorder()
+		ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, capabilitiesPath, nil))
+
+		body := rr.Body.String()
+		if !strings.Contains(body, `"fake"]`) || strings.Count(body, `"fake"`) != 2 {
+			t.Errorf("want fake listed as an input and an output format, got %s", body)
+		}
+	})
+}
+
+func TestSniffCodec(t *testing.T) {
+	var jpegImage, pngImage bytes.Buffer
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	if err := encode(&jpegImage, img, formatJPEG, encodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := encode(&pngImage, img, formatPNG, encodeOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		testName string
+		data     []byte
+		want     string
+	}{
+		{testName: "jpeg", data: jpegImage.Bytes(), want: formatJPEG},
+		{testName: "png", data: pngImage.Bytes(), want: formatPNG},
+		{testName: "gif", data: []byte("GIF89a\x01\x00"), want: formatGIF},
+		{testName: "gif87a", data: []byte("GIF87a\x01\x00"), want: formatGIF},
+		{testName: "unknown", data: []byte("BM\x00\x00"), want: ""},
+		{testName: "shorter than any magic", data: []byte("G"), want: ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			var got string
+			if c := sniffCodec(bufio.NewReader(bytes.NewReader(tc.data))); c != nil {
+				got = c.name
+			}
+			assertEqual(t, got, tc.want)
+		})
+	}
+}
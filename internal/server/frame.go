@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bufio"
+	"image"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// the bytes introducing the blocks of a gif
+const (
+	gifExtension       = 0x21
+	gifImageDescriptor = 0x2c
+)
+
+// decodeFrame decodes the frame at index of an animated gif, along with the number of frames the gif has
+// the frame is drawn over the ones before it as their disposal methods leave them, the way browsers show it,
+// so it has the size of the whole gif rather than of the area it updates
+//
+// every frame of the gif is decoded, the ones after index included
+func decodeFrame(r io.Reader, index int) (image.Image, int, error) {
+	g, err := gif.DecodeAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if index >= len(g.Image) {
+		return nil, len(g.Image), nil
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	for i, frame := range g.Image[:index+1] {
+		var disposal byte
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+		var previous *image.NRGBA
+		if disposal == gif.DisposalPrevious && i < index {
+			previous = image.NewNRGBA(canvas.Bounds())
+			copy(previous.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+		if i == index {
+			break
+		}
+		switch disposal {
+		case gif.DisposalBackground:
+			// browsers clear the area of the frame rather than fill it with the background color
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return canvas, len(g.Image), nil
+}
+
+// moreGIFFrames tells whether the gif read by br, past the frame decoded last, has another frame,
+// skipping the extensions in between, like the graphic control of the next frame, up to its image descriptor or trailer
+func moreGIFFrames(br *bufio.Reader) bool {
+	for {
+		b, err := br.ReadByte()
+		if err != nil || b != gifExtension {
+			return err == nil && b == gifImageDescriptor
+		}
+		// the label of the extension, and then its sub-blocks up to the empty one
+		if _, err := br.ReadByte(); err != nil {
+			return false
+		}
+		for {
+			n, err := br.ReadByte()
+			if err != nil {
+				return false
+			}
+			if n == 0 {
+				break
+			}
+			if _, err := br.Discard(int(n)); err != nil {
+				return false
+			}
+		}
+	}
+}
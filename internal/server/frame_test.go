@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+var (
+	red   = color.NRGBA{R: 0xff, A: 0xff}
+	green = color.NRGBA{G: 0xff, A: 0xff}
+	blue  = color.NRGBA{B: 0xff, A: 0xff}
+)
+
+// newAnimatedGIF encodes a 20x10 gif of 3 frames: the whole of it red,
+// then its left half blue, disposed of with disposal, then its right half green
+func newAnimatedGIF(t *testing.T, disposal byte) []byte {
+	t.Helper()
+	frame := func(r image.Rectangle, c color.Color) *image.Paletted {
+		img := image.NewPaletted(r, palette.Plan9)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				img.Set(x, y, c)
+			}
+		}
+		return img
+	}
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			frame(image.Rect(0, 0, 20, 10), red),
+			frame(image.Rect(0, 0, 10, 10), blue),
+			frame(image.Rect(10, 0, 20, 10), green),
+		},
+		Delay:    []int{10, 10, 10},
+		Disposal: []byte{gif.DisposalNone, disposal, gif.DisposalNone},
+		Config:   image.Config{Width: 20, Height: 10},
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeFrame(t *testing.T) {
+	transparent := color.NRGBA{}
+
+	tt := []struct {
+		testName string
+		disposal byte
+		index    int
+		// desired colors of the left and right halves
+		left  color.NRGBA
+		right color.NRGBA
+	}{
+		{testName: "first frame", index: 0, left: red, right: red},
+		{testName: "frame drawn over the first", index: 1, left: blue, right: red},
+		{testName: "frame kept", disposal: gif.DisposalNone, index: 2, left: blue, right: green},
+		{testName: "frame cleared", disposal: gif.DisposalBackground, index: 2, left: transparent, right: green},
+		{testName: "frame restored to the previous one", disposal: gif.DisposalPrevious, index: 2, left: red, right: green},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			img, frames, err := decodeFrame(bytes.NewReader(newAnimatedGIF(t, tc.disposal)), tc.index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, frames, 3)
+			assertEqual(t, img.Bounds(), image.Rect(0, 0, 20, 10))
+			assertEqual(t, color.NRGBAModel.Convert(img.At(2, 5)).(color.NRGBA), tc.left)
+			assertEqual(t, color.NRGBAModel.Convert(img.At(17, 5)).(color.NRGBA), tc.right)
+		})
+	}
+
+	img, frames, err := decodeFrame(bytes.NewReader(newAnimatedGIF(t, gif.DisposalNone)), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, img, nil)
+	assertEqual(t, frames, 3)
+}
+
+func TestMoreGIFFrames(t *testing.T) {
+	var still bytes.Buffer
+	if err := gif.Encode(&still, image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		testName string
+		data     []byte
+		// desired answer past the first frame
+		want bool
+	}{
+		{testName: "animated", data: newAnimatedGIF(t, gif.DisposalNone), want: true},
+		{testName: "still", data: still.Bytes()},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			br := bufio.NewReaderSize(bytes.NewReader(tc.data), exifHeadSize)
+			if _, _, err := decodeImage(br); err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, moreGIFFrames(br), tc.want)
+		})
+	}
+}
+
+func TestFrame(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code, and body or key of the variant
+		statusCode int
+		body       string
+		key        string
+		// desired colors of the left and right halves of the variant
+		left  color.NRGBA
+		right color.NRGBA
+	}{
+		{
+			testName:   "first frame by default",
+			target:     "/anim.gif?w=10",
+			statusCode: http.StatusSeeOther,
+			key:        path.Join(sev.FolderResized, "anim.gif", "w10h0.png"),
+			left:       red,
+			right:      red,
+		},
+		{
+			testName:   "frame 0 is the first frame",
+			target:     "/anim.gif?w=10&frame=0",
+			statusCode: http.StatusSeeOther,
+			key:        path.Join(sev.FolderResized, "anim.gif", "w10h0.png"),
+			left:       red,
+			right:      red,
+		},
+		{
+			testName:   "last frame",
+			target:     "/anim.gif?w=10&frame=2",
+			statusCode: http.StatusSeeOther,
+			key:        path.Join(sev.FolderResized, "anim.gif", "w10h0-frame2.png"),
+			left:       blue,
+			right:      green,
+		},
+		{
+			testName:   "frame converted into jpeg",
+			target:     "/anim.gif?w=10&frame=1&fm=jpeg",
+			statusCode: http.StatusSeeOther,
+			key:        path.Join(sev.FolderResized, "anim.gif", "w10h0-frame1.jpeg"),
+		},
+		{
+			testName:   "frame out of range",
+			target:     "/anim.gif?w=10&frame=3",
+			statusCode: http.StatusBadRequest,
+			body:       "frame 3 is out of range, the original has 3 frames",
+		},
+		{
+			testName:   "frame of a still original",
+			target:     "/imageJPEG.jpeg?w=10&frame=1",
+			statusCode: http.StatusBadRequest,
+			body:       "frame is out of range, only gif originals have more than one frame",
+		},
+		{
+			testName:   "negative frame",
+			target:     "/anim.gif?w=10&frame=-1",
+			statusCode: http.StatusBadRequest,
+			body:       `frame must be a non-negative integer, got "-1"`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ssc.storage[path.Join(sev.FolderOriginal, "anim.gif")] = stubObject{data: newAnimatedGIF(t, gif.DisposalNone), contentType: "image/gif"}
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(tc.key))
+			img, _, err := image.Decode(bytes.NewReader(ssc.storage[tc.key].data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, img.Bounds(), image.Rect(0, 0, 10, 5))
+			if tc.left.A != 0 {
+				assertEqual(t, color.NRGBAModel.Convert(img.At(1, 2)).(color.NRGBA), tc.left)
+				assertEqual(t, color.NRGBAModel.Convert(img.At(8, 2)).(color.NRGBA), tc.right)
+			}
+		})
+	}
+}
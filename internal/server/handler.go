@@ -1,172 +1,131 @@
 package server
 
 import (
-	"bytes"
 	"errors"
-	"fmt"
-	"image"
-	"image/jpeg"
-	"image/png"
+	"io"
 	"log/slog"
 	"net/http"
-	"path/filepath"
-	"regexp"
-	"strconv"
 	"strings"
 
-	"github.com/disintegration/gift"
 	"github.com/obzva/image-server/internal/envvar"
 	"github.com/obzva/image-server/internal/storage"
 )
 
 const (
 	errStrInvalidImagePath = "invalid image path"
-
-	queryWidth  = "w"
-	queryHeight = "h"
-)
-
-var (
-	imagePathRegex = regexp.MustCompile(`^[^/]+\.(jpeg|jpg|png)$`)
+	errStrHEIFUnsupported  = "heic and heif originals require a server built with -tags heif"
 )
 
-func handler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar) func(w http.ResponseWriter, r *http.Request) {
+func handler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, o options) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// check image path
-		path := r.PathValue(slug)
-		if !imagePathRegex.MatchString(path) {
-			http.Error(w, errStrInvalidImagePath, http.StatusBadRequest)
-			return
+		imagePath := r.PathValue(slug)
+		q := r.URL.Query()
+		// every unknown param would otherwise be a way to ask for the same variant through another URL
+		if envVar.StrictParams {
+			if unknown := unknownParams(q, imageParams); len(unknown) > 0 {
+				http.Error(w, "unknown query params: "+strings.Join(unknown, ", "), http.StatusBadRequest)
+				return
+			}
 		}
-		splitPath := strings.Split(path, ".")
-		imageName := splitPath[0]
-		imageFormat := splitPath[1]
-
-		// check if this image exists
-		originalKey := filepath.Join(envVar.FolderOriginal, path)
-		originalOK, err := storageClient.CheckObject(r.Context(), originalKey)
-		if err != nil {
-			logger.Error(err.Error())
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if _, ext, ok := parsePassthroughName(imagePath, envVar.PassthroughExtensions); ok {
+			servePassthrough(w, r, logger, storageClient, envVar, imagePath, ext)
 			return
 		}
-		if !originalOK {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		// resizeVariant checks it too, but the download filename is taken from it before
+		if _, _, ok := parseImageName(imagePath); !ok {
+			http.Error(w, errStrInvalidImagePath, http.StatusBadRequest)
 			return
 		}
 
-		width := 0
-		height := 0
-
-		// check query params: w & h
-		q := r.URL.Query()
-		if q.Has(queryWidth) {
-			qWidth, err := strconv.Atoi(q.Get(queryWidth))
-			if err != nil {
-				http.Error(w, "failed converting w into integer", http.StatusBadRequest)
-				return
+		// ?dpr wins over the client hints, whose responses vary with them
+		if envVar.ClientHints && !q.Has(queryDPR) {
+			w.Header().Add("Vary", strings.Join(dprHints, ", "))
+			if hint := dprHint(r); hint != "" {
+				q.Set(queryDPR, hint)
 			}
-			if qWidth <= 0 {
-				http.Error(w, "if specified, w must be larger than 0", http.StatusBadRequest)
-				return
+		}
+
+		// fm=auto picks among the formats the client accepts, so the variant redirected to or served varies with Accept,
+		// presets naming it included
+		ctx := r.Context()
+		expanded, err := expandPreset(o.presets, q)
+		if err == nil && expanded.Get(queryFormat) == formatAuto {
+			w.Header().Add("Vary", "Accept")
+			if accept := r.Header.Values("Accept"); len(accept) > 0 {
+				ctx = withAccept(ctx, strings.Join(accept, ","))
 			}
-			width = qWidth
 		}
-		if q.Has(queryHeight) {
-			qHeight, err := strconv.Atoi(q.Get(queryHeight))
+
+		if debugRequested(q) {
+			report, err := debugVariant(ctx, logger, storageClient, envVar, o, imagePath, q)
 			if err != nil {
-				http.Error(w, "failed converting h into integer", http.StatusBadRequest)
+				var se *statusError
+				if !errors.As(err, &se) {
+					se = newStatusError(http.StatusInternalServerError)
+				}
+				http.Error(w, se.message, se.code)
 				return
 			}
-			if qHeight <= 0 {
-				http.Error(w, "if specified, h must be larger than 0", http.StatusBadRequest)
-				return
-			}
-			height = qHeight
-		}
-
-		// if they are requesting original image then redirect to S3 object URL
-		if width == 0 && height == 0 {
-			http.Redirect(w, r, storageClient.ObjectURL(originalKey), http.StatusSeeOther)
+			writeDebugReport(w, r, logger, report)
 			return
 		}
 
-		// check if resized image already exists
-		resizedKey := filepath.Join(envVar.FolderResized, imageName, fmt.Sprintf("w%dh%d.%s", width, height, imageFormat))
-		resizedOK, err := storageClient.CheckObject(r.Context(), resizedKey)
-		if err != nil {
-			logger.Error(err.Error())
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		// an invalid value is answered by resizeVariant
+		if noCache, _ := noCacheRequested(q); noCache && !noCacheAuthorized(envVar, r) {
+			http.Error(w, "nocache requires a valid bearer token", http.StatusForbidden)
 			return
 		}
 
-		// if resized image already exists
-		if resizedOK {
-			http.Redirect(w, r, storageClient.ObjectURL(resizedKey), http.StatusSeeOther)
-			return
+		// a redirect can't carry Content-Disposition, so downloads are always served inline
+		filename := downloadFilename(q, imagePath)
+		dpr := contentDPR(expanded)
+		var iw *imageWriter
+		var inline func(contentType string, cacheControl string) io.Writer
+		if envVar.ServeMode == envvar.ServeModeInline || filename != "" {
+			inline = func(contentType string, cacheControl string) io.Writer {
+				iw = &imageWriter{w: w, contentType: contentType, cacheControl: cacheControl, filename: filename, contentDPR: dpr}
+				return iw
+			}
 		}
 
-		// else, let's resize it and upload it
-		// first download the original image
-		body, contentType, err := storageClient.DownloadObject(r.Context(), originalKey)
+		if r.Method == http.MethodHead {
+			ctx = withHeadOnly(ctx)
+		}
+		v, err := resizeVariant(ctx, logger, storageClient, envVar, o, imagePath, q, inline)
 		if err != nil {
-			if errors.Is(err, storage.ErrNotFound) {
-				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-				return
+			if iw != nil && iw.started {
+				// part of the image is already on its way, cut the response short rather than let it pass for a whole one
+				panic(http.ErrAbortHandler)
 			}
-			if errors.Is(err, storage.ErrForbidden) {
-				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-				return
+			var se *statusError
+			if !errors.As(err, &se) {
+				se = newStatusError(http.StatusInternalServerError)
 			}
-			logger.Error(err.Error())
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			http.Error(w, se.message, se.code)
 			return
 		}
-		defer body.Close()
 
-		// make it image.Image
-		src, format, err := image.Decode(body)
-		if err != nil {
-			logger.Error(err.Error())
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if v.streamed {
 			return
 		}
-
-		// resize image
-		g := gift.New(gift.Resize(width, height, gift.LanczosResampling))
-		dst := image.NewRGBA(g.Bounds(src.Bounds()))
-		g.Draw(dst, src)
-		var buf bytes.Buffer
-		switch format {
-		case "jpeg":
-			err = jpeg.Encode(&buf, dst, nil)
-			if err != nil {
-				logger.Error(err.Error())
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
-			}
-		case "png":
-			err = png.Encode(&buf, dst)
-			if err != nil {
-				logger.Error(err.Error())
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-				return
-			}
+		if v.pending && (inline != nil || v.key == "") {
+			// the headers the variant will be served with once a GET produces it, without a length it doesn't have yet
+			setImageHeaders(w, v.contentType, v.cacheControl, filename, dpr)
+			w.WriteHeader(http.StatusOK)
+			return
 		}
-
-		// upload resized image
-		err = storageClient.UploadObject(r.Context(), resizedKey, &buf, contentType)
-		if err != nil {
-			if errors.Is(err, storage.ErrBadRequest) {
-				http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
-				return
+		if inline == nil {
+			// redirect to the original or resized image in the bucket, which caches keep as long as the image itself
+			if v.cacheControl != "" {
+				w.Header().Set("Cache-Control", v.cacheControl)
 			}
-			logger.Error(err.Error())
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			http.Redirect(w, r, storageClient.ObjectURL(v.key), redirectStatus(envVar))
 			return
 		}
-
-		// redirect to the new resized image
-		http.Redirect(w, r, storageClient.ObjectURL(resizedKey), http.StatusSeeOther)
+		if v.standIn {
+			// the original answered in place of the variant isn't scaled
+			dpr = ""
+		}
+		serveObject(w, r, logger, storageClient, v.key, v.cacheControl, filename, dpr)
 	}
 }
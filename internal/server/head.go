@@ -0,0 +1,17 @@
+package server
+
+import (
+	"context"
+)
+
+type headOnlyKey struct{}
+
+// withHeadOnly marks ctx as answering a HEAD request, whose variants are looked up but never produced
+func withHeadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, headOnlyKey{}, true)
+}
+
+func headOnly(ctx context.Context) bool {
+	head, _ := ctx.Value(headOnlyKey{}).(bool)
+	return head
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestHead(t *testing.T) {
+	tt := []struct {
+		testName  string
+		serveMode string
+		target    string
+		// desired status code of both requests
+		statusCode int
+		// whether HEAD produced the variant, which only GET does, or downloaded anything,
+		// the header of an original to tell whether a size alone is its very size included
+		produced   bool
+		downloaded bool
+	}{
+		{testName: "original", target: "/imagePNG.png", statusCode: http.StatusSeeOther},
+		{testName: "stored variant", target: "/imagePNG.png?w=600&h=900", statusCode: http.StatusSeeOther},
+		{testName: "variant not stored yet", target: "/imagePNG.png?w=100", statusCode: http.StatusSeeOther, downloaded: true},
+		{testName: "converted variant not stored yet", target: "/imagePNG.png?w=100&fm=jpeg", statusCode: http.StatusSeeOther},
+		{testName: "missing original", target: "/missing.png?w=100", statusCode: http.StatusNotFound},
+		{testName: "invalid params", target: "/imagePNG.png?w=abc", statusCode: http.StatusBadRequest},
+		{testName: "original inline", serveMode: envvar.ServeModeInline, target: "/imagePNG.png", statusCode: http.StatusOK, downloaded: true},
+		{testName: "stored variant inline", serveMode: envvar.ServeModeInline, target: "/imageJPEG.jpeg?w=600&h=900", statusCode: http.StatusOK, downloaded: true},
+		{testName: "variant not stored yet inline", serveMode: envvar.ServeModeInline, target: "/imageJPEG.jpeg?w=100&fm=png", statusCode: http.StatusOK},
+		{testName: "download of a variant not stored yet", target: "/imagePNG.png?w=100&fm=jpeg&download=1", statusCode: http.StatusOK},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				ServeMode:      tc.serveMode,
+			}
+			serve := func(method string) (*httptest.ResponseRecorder, *stubStorageClient) {
+				ssc := newStubStorageClient(sev)
+				ss := New(slogt.New(t), ssc, sev)
+				rr := httptest.NewRecorder()
+				ss.ServeHTTP(rr, httptest.NewRequest(method, tc.target, nil))
+				return rr, ssc
+			}
+			head, ssc := serve(http.MethodHead)
+			get, _ := serve(http.MethodGet)
+
+			assertEqual(t, head.Code, tc.statusCode)
+			assertEqual(t, get.Code, tc.statusCode)
+			for _, header := range []string{"Location", "Content-Type", "Cache-Control", "Content-Disposition"} {
+				assertEqual(t, head.Header().Get(header), get.Header().Get(header))
+			}
+			if tc.statusCode == http.StatusOK {
+				assertEqual(t, head.Body.Len(), 0)
+				assertEqual(t, get.Body.Len() > 0, true)
+			}
+			assertEqual(t, ssc.execution[exeKeyUpload], tc.produced)
+			assertEqual(t, ssc.execution[exeKeyDownload], tc.downloaded)
+		})
+	}
+}
+
+func TestHeadAuto(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		AutoFormats:    []string{formatPNG, formatJPEG},
+	}
+	ssc := newStubStorageClient(sev)
+	ss := New(slogt.New(t), ssc, sev)
+
+	// the format is only picked once the variant is encoded
+	rr := httptest.NewRecorder()
+	ss.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, "/imagePNG.png?w=100&fm=auto", nil))
+	assertEqual(t, rr.Code, http.StatusOK)
+	assertEqual(t, rr.Header().Get("Location"), "")
+	assertEqual(t, rr.Header().Get("Content-Type"), "")
+	assertEqual(t, ssc.execution[exeKeyUpload], false)
+}
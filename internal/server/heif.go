@@ -0,0 +1,10 @@
+//go:build heif && cgo
+
+package server
+
+// the decoder wraps libheif, so heic and heif originals are only decoded by builds tagged heif,
+// after adding it with go get github.com/strukturag/libheif-go
+// go.mod doesn't require it yet and no test decodes a heic original, so builds of this tag are untested
+import _ "github.com/strukturag/libheif-go"
+
+const heifSupported = true
@@ -0,0 +1,5 @@
+//go:build !(heif && cgo)
+
+package server
+
+const heifSupported = false
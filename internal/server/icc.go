@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+const iccSRGB = "srgb"
+
+// srgbProfile is an ICC v2 display profile of sRGB, embedded in outputs requested with ?icc=srgb
+var srgbProfile = buildSRGBProfile()
+
+// buildSRGBProfile builds the sRGB profile from the primaries and transfer function of IEC 61966-2-1,
+// adapted to the D50 white point of the profile connection space, like the sRGB profiles of color-managed systems
+func buildSRGBProfile() []byte {
+	xyz := func(x, y, z float64) []byte {
+		b := append([]byte("XYZ "), 0, 0, 0, 0)
+		for _, v := range []float64{x, y, z} {
+			b = binary.BigEndian.AppendUint32(b, uint32(int32(math.Round(v*65536))))
+		}
+		return b
+	}
+
+	// the inverse of the sRGB companding, shared by the three channels
+	const points = 1024
+	trc := append([]byte("curv"), 0, 0, 0, 0)
+	trc = binary.BigEndian.AppendUint32(trc, points)
+	for i := range points {
+		v := float64(i) / (points - 1)
+		if v <= 0.04045 {
+			v /= 12.92
+		} else {
+			v = math.Pow((v+0.055)/1.055, 2.4)
+		}
+		trc = binary.BigEndian.AppendUint16(trc, uint16(math.Round(v*65535)))
+	}
+
+	description := "sRGB"
+	desc := append([]byte("desc"), 0, 0, 0, 0)
+	desc = binary.BigEndian.AppendUint32(desc, uint32(len(description)+1))
+	desc = append(desc, description...)
+	// the null ending the ASCII description, then empty Unicode and ScriptCode descriptions
+	desc = append(desc, make([]byte, 1+4+4+2+1+67)...)
+
+	cprt := append([]byte("text"), 0, 0, 0, 0)
+	cprt = append(cprt, "No copyright, use freely"...)
+	cprt = append(cprt, 0)
+
+	tags := []struct {
+		signature string
+		data      []byte
+	}{
+		{"desc", desc},
+		{"cprt", cprt},
+		{"wtpt", xyz(0.9642, 1, 0.8249)},
+		{"rXYZ", xyz(0.4360, 0.2225, 0.0139)},
+		{"gXYZ", xyz(0.3851, 0.7169, 0.0971)},
+		{"bXYZ", xyz(0.1431, 0.0606, 0.7141)},
+		{"rTRC", trc},
+		{"gTRC", trc},
+		{"bTRC", trc},
+	}
+
+	const headerSize = 128
+	tagTable := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var data []byte
+	offsets := map[*byte]int{}
+	offset := headerSize + 4 + 12*len(tags)
+	for _, tag := range tags {
+		// the channels point at the same curve
+		at, ok := offsets[&tag.data[0]]
+		if !ok {
+			at = offset + len(data)
+			offsets[&tag.data[0]] = at
+			data = append(data, tag.data...)
+			// every tag starts on a 4-byte boundary
+			for len(data)%4 != 0 {
+				data = append(data, 0)
+			}
+		}
+		tagTable = append(tagTable, tag.signature...)
+		tagTable = binary.BigEndian.AppendUint32(tagTable, uint32(at))
+		tagTable = binary.BigEndian.AppendUint32(tagTable, uint32(len(tag.data)))
+	}
+
+	header := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(header[0:], uint32(headerSize+len(tagTable)+len(data)))
+	// version 2.1
+	binary.BigEndian.PutUint32(header[8:], 0x02100000)
+	copy(header[12:], "mntr")
+	copy(header[16:], "RGB ")
+	copy(header[20:], "XYZ ")
+	// creation date, 2026-01-01
+	binary.BigEndian.PutUint16(header[24:], 2026)
+	binary.BigEndian.PutUint16(header[26:], 1)
+	binary.BigEndian.PutUint16(header[28:], 1)
+	copy(header[36:], "acsp")
+	// the D50 illuminant of the profile connection space
+	copy(header[68:], xyz(0.9642, 1, 0.8249)[8:])
+
+	profile := append(header, tagTable...)
+	return append(profile, data...)
+}
+
+// jpegICCSegment is the APP2 segment carrying profile in a jpeg, right after its start of image marker
+// profiles larger than a segment would be split in several of them, srgbProfile never is
+func jpegICCSegment(profile []byte) []byte {
+	payload := append([]byte("ICC_PROFILE\x00"), 1, 1)
+	payload = append(payload, profile...)
+	segment := []byte{0xFF, 0xE2}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(2+len(payload)))
+	return append(segment, payload...)
+}
+
+// pngICCChunk is the iCCP chunk carrying profile in a png, right after its IHDR chunk
+func pngICCChunk(name string, profile []byte) []byte {
+	data := append([]byte(name), 0, 0)
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write(profile)
+	zw.Close()
+	data = append(data, compressed.Bytes()...)
+
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, "iCCP"...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+const (
+	// the start of image marker
+	jpegHeadSize = 2
+	// the signature and the IHDR chunk, of 13 bytes of data
+	pngHeadSize = 8 + 4 + 4 + 13 + 4
+)
+
+// insertWriter writes insert into the stream written to w once at bytes went through,
+// so that encoders streaming their output get a chunk of their format added where it belongs
+type insertWriter struct {
+	w      io.Writer
+	at     int
+	insert []byte
+	n      int
+}
+
+func (iw *insertWriter) Write(b []byte) (int, error) {
+	if iw.n >= iw.at || iw.n+len(b) < iw.at {
+		iw.n += len(b)
+		return iw.w.Write(b)
+	}
+	head := iw.at - iw.n
+	if _, err := iw.w.Write(b[:head]); err != nil {
+		return 0, err
+	}
+	if _, err := iw.w.Write(iw.insert); err != nil {
+		return head, err
+	}
+	n, err := iw.w.Write(b[head:])
+	iw.n += head + n
+	return head + n, err
+}
+
+// withICCProfile embeds the ICC profile named icc into the output of format written to w, w itself when icc is empty
+func withICCProfile(w io.Writer, format string, icc string) io.Writer {
+	if icc != iccSRGB {
+		return w
+	}
+	switch format {
+	case formatJPEG:
+		return &insertWriter{w: w, at: jpegHeadSize, insert: jpegICCSegment(srgbProfile)}
+	case formatPNG:
+		return &insertWriter{w: w, at: pngHeadSize, insert: pngICCChunk("sRGB", srgbProfile)}
+	}
+	return w
+}
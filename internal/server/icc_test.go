@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestSRGBProfile(t *testing.T) {
+	p := srgbProfile
+	assertEqual(t, int(binary.BigEndian.Uint32(p)), len(p))
+	assertEqual(t, string(p[12:24]), "mntrRGB XYZ ")
+	assertEqual(t, string(p[36:40]), "acsp")
+
+	count := int(binary.BigEndian.Uint32(p[128:]))
+	assertEqual(t, count, 9)
+	for i := range count {
+		entry := p[132+12*i:]
+		offset, size := int(binary.BigEndian.Uint32(entry[4:])), int(binary.BigEndian.Uint32(entry[8:]))
+		assertEqual(t, offset%4, 0)
+		assertEqual(t, offset+size <= len(p), true)
+	}
+}
+
+// embeddedICCProfile reads the ICC profile embedded in a jpeg or png, nil when it has none
+func embeddedICCProfile(t *testing.T, data []byte) []byte {
+	t.Helper()
+	if bytes.HasPrefix(data, []byte{0xFF, 0xD8}) {
+		// the segment is written right after the start of image marker
+		if !bytes.HasPrefix(data[2:], []byte{0xFF, 0xE2}) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint16(data[4:]))
+		payload := data[6 : 4+size]
+		if !bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00\x01\x01")) {
+			t.Fatal("APP2 segment without an ICC profile")
+		}
+		return payload[14:]
+	}
+	for i := 8; i+8 <= len(data); {
+		size := int(binary.BigEndian.Uint32(data[i:]))
+		chunk := string(data[i+4 : i+8])
+		if chunk == "IDAT" {
+			return nil
+		}
+		if chunk == "iCCP" {
+			_, compressed, _ := bytes.Cut(data[i+8:i+8+size], []byte{0, 0})
+			zr, err := zlib.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			profile, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return profile
+		}
+		i += 12 + size
+	}
+	return nil
+}
+
+func TestICC(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code, and body or key of the variant
+		statusCode int
+		body       string
+		key        string
+		profile    bool
+	}{
+		{
+			testName:   "jpeg",
+			target:     "/imageJPEG.jpeg?w=100&icc=srgb",
+			statusCode: http.StatusSeeOther,
+			key:        path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0-icc_srgb.jpeg"),
+			profile:    true,
+		},
+		{
+			testName:   "png",
+			target:     "/imagePNG.png?w=100&icc=srgb",
+			statusCode: http.StatusSeeOther,
+			key:        path.Join(sev.FolderResized, "imagePNG.png", "w100h0-icc_srgb.png"),
+			profile:    true,
+		},
+		{
+			testName:   "optimized png",
+			target:     "/imagePNG.png?w=100&icc=srgb&optimize_png=1",
+			statusCode: http.StatusSeeOther,
+			key:        path.Join(sev.FolderResized, "imagePNG.png", "w100h0-opt-icc_srgb.png"),
+			profile:    true,
+		},
+		{
+			testName:   "no profile by default",
+			target:     "/imageJPEG.jpeg?w=100",
+			statusCode: http.StatusSeeOther,
+			key:        path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0.jpeg"),
+		},
+		{
+			testName:   "unknown profile",
+			target:     "/imageJPEG.jpeg?w=100&icc=p3",
+			statusCode: http.StatusBadRequest,
+			body:       "icc must be srgb",
+		},
+		{
+			testName:   "ico output",
+			target:     "/imageJPEG.jpeg?w=100&fm=ico&icc=srgb",
+			statusCode: http.StatusBadRequest,
+			body:       "icc requires a jpeg or png output",
+		},
+		{
+			testName:   "fallback format",
+			target:     "/imageJPEG.jpeg?w=100&fm=png&fallback_format=jpeg&icc=srgb",
+			statusCode: http.StatusBadRequest,
+			body:       "icc can't be combined with fallback_format",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(tc.key))
+			data := ssc.storage[tc.key].data
+			// the output is still an image its decoder reads
+			if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			profile := embeddedICCProfile(t, data)
+			assertEqual(t, profile != nil, tc.profile)
+			if tc.profile {
+				assertEqual(t, bytes.Equal(profile, srgbProfile), true)
+			}
+		})
+	}
+}
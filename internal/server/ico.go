@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+)
+
+const (
+	maxICOSize   = 256
+	maxICOFrames = 8
+)
+
+var defaultICOSizes = []int{16, 32, 48}
+
+// parseICOSizes reads a list like "16,32,48" into sorted, distinct sizes
+func parseICOSizes(s string) ([]int, error) {
+	errInvalid := errors.New("sizes must be a comma separated list of up to 8 integers between 1 and 256")
+	var sizes []int
+	for _, field := range strings.Split(s, ",") {
+		size, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || size < 1 || size > maxICOSize {
+			return nil, errInvalid
+		}
+		sizes = append(sizes, size)
+	}
+	slices.Sort(sizes)
+	sizes = slices.Compact(sizes)
+	if len(sizes) > maxICOFrames {
+		return nil, errInvalid
+	}
+	return sizes, nil
+}
+
+// encodeICO packs one png frame per size into an ICO file
+// every frame is square, with img fitted into it and centered on a transparent background
+func encodeICO(w io.Writer, img image.Image, sizes []int) error {
+	if len(sizes) == 0 {
+		sizes = defaultICOSizes
+	}
+
+	frames := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		g := gift.New(gift.ResizeToFit(size, size, gift.LanczosResampling))
+		fitted := g.Bounds(img.Bounds())
+		frame := image.NewNRGBA(image.Rect(0, 0, size, size))
+		g.DrawAt(frame, img, image.Pt((size-fitted.Dx())/2, (size-fitted.Dy())/2), gift.CopyOperator)
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, frame); err != nil {
+			return err
+		}
+		frames[i] = buf.Bytes()
+	}
+
+	// ICONDIR header, followed by one 16 bytes ICONDIRENTRY per frame and then the frames themselves
+	const headerSize, entrySize = 6, 16
+	var header bytes.Buffer
+	binary.Write(&header, binary.LittleEndian, [3]uint16{0, 1, uint16(len(sizes))})
+	offset := headerSize + entrySize*len(sizes)
+	for i, size := range sizes {
+		// 0 stands for 256 pixels
+		dim := uint8(size % maxICOSize)
+		binary.Write(&header, binary.LittleEndian, struct {
+			Width, Height, Colors, Reserved uint8
+			Planes, BitCount                uint16
+			Size, Offset                    uint32
+		}{dim, dim, 0, 0, 1, 32, uint32(len(frames[i])), uint32(offset)})
+		offset += len(frames[i])
+	}
+
+	if _, err := w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
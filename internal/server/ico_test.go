@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestICO(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		ServeMode:      envvar.ServeModeInline,
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code and body
+		statusCode int
+		body       string
+		// desired key of the uploaded ico and sizes of its frames
+		resizedKey string
+		sizes      []int
+	}{
+		{
+			testName:   "sizes without ico output",
+			target:     "/imagePNG.png?sizes=16",
+			statusCode: http.StatusBadRequest,
+			body:       "sizes requires fm=ico",
+		},
+		{
+			testName:   "size out of range",
+			target:     "/imagePNG.png?fm=ico&sizes=16,257",
+			statusCode: http.StatusBadRequest,
+			body:       "sizes must be a comma separated list of up to 8 integers between 1 and 256",
+		},
+		{
+			testName:   "not a size",
+			target:     "/imagePNG.png?fm=ico&sizes=16,,32",
+			statusCode: http.StatusBadRequest,
+			body:       "sizes must be a comma separated list of up to 8 integers between 1 and 256",
+		},
+		{
+			testName:   "default sizes",
+			target:     "/imagePNG.png?fm=ico",
+			resizedKey: path.Join(sev.FolderResized, "imagePNG.png", "w0h0.ico"),
+			sizes:      []int{16, 32, 48},
+		},
+		{
+			testName:   "default sizes in any order share their key",
+			target:     "/imagePNG.png?fm=ico&sizes=48,16,32,16",
+			resizedKey: path.Join(sev.FolderResized, "imagePNG.png", "w0h0.ico"),
+			sizes:      []int{16, 32, 48},
+		},
+		{
+			testName:   "custom sizes",
+			target:     "/imageJPEG.jpeg?w=100&h=50&fm=ico&sizes=256,64",
+			resizedKey: path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h50-sizes64_256.ico"),
+			sizes:      []int{64, 256},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			if tc.statusCode != 0 {
+				assertEqual(t, rr.Code, tc.statusCode)
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+
+			assertEqual(t, rr.Code, http.StatusOK)
+			assertEqual(t, rr.Header().Get("Content-Type"), "image/x-icon")
+			object, ok := ssc.storage[tc.resizedKey]
+			assertEqual(t, ok, true)
+			assertEqual(t, object.contentType, "image/x-icon")
+
+			data := rr.Body.Bytes()
+			var header [3]uint16
+			if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &header); err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, header, [3]uint16{0, 1, uint16(len(tc.sizes))})
+			for i, size := range tc.sizes {
+				entry := data[6+16*i : 6+16*(i+1)]
+				assertEqual(t, int(entry[0]), size%256)
+				assertEqual(t, int(entry[1]), size%256)
+				length := binary.LittleEndian.Uint32(entry[8:12])
+				offset := binary.LittleEndian.Uint32(entry[12:16])
+
+				frame, err := png.Decode(bytes.NewReader(data[offset : offset+length]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertEqual(t, frame.Bounds(), image.Rect(0, 0, size, size))
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+const (
+	immutablePath = "/i/"
+	// pattern value of the {hash}.{ext} file of an immutable path
+	immutableFile = "file"
+	// Cache-Control of every immutable path, whose content never changes
+	immutableCacheControl = "public, max-age=31536000, immutable"
+)
+
+// immutableTarget is what an immutable path stands for, stored under immutableKey
+type immutableTarget struct {
+	Image string `json:"image"`
+	// of the original the path was built for, as ObjectMetadata returned it
+	Version string `json:"version"`
+	Query   string `json:"query"`
+}
+
+type immutableVersionKey struct{}
+
+// withImmutableVersion marks ctx as resolving an immutable path built for the original at version,
+// which resizeVariant answers 404 once the original is replaced and keys the variants of, VERSIONED_KEYS or not
+func withImmutableVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, immutableVersionKey{}, version)
+}
+
+func immutableVersion(ctx context.Context) (string, bool) {
+	version, ok := ctx.Value(immutableVersionKey{}).(string)
+	return version, ok
+}
+
+// immutableQuery keeps the params of q that change the variant, in the order url.Values.Encode sorts them into
+// presets must be expanded before, so that a preset changed later doesn't change what an immutable path stands for
+func immutableQuery(q url.Values) string {
+	kept := url.Values{}
+	for key, values := range q {
+		if slices.Contains(imageParams, key) && !slices.Contains([]string{queryPreset, queryDebug, queryNoCache, queryDownload}, key) {
+			kept[key] = values
+		}
+	}
+	return kept.Encode()
+}
+
+// immutableHash names the variant of the image at imagePath and version requested by query for tenant,
+// shared by the paths built by immutableURLHandler and the requests resolving them
+func immutableHash(tenant string, imagePath string, version string, query string) string {
+	sum := sha256.Sum256([]byte(tenant + "\n" + imagePath + "\n" + version + "?" + query))
+	return hex.EncodeToString(sum[:16])
+}
+
+// immutableKey is the object recording what the immutable path named after hash stands for,
+// kept with the variants, like "immutable/{hash}" in the resized folder
+func immutableKey(folderResized string, hash string) string {
+	return path.Join(folderResized, "immutable", hash)
+}
+
+// immutableExt is the extension of the immutable path of the variant requested by p
+func immutableExt(p params) string {
+	return strings.ToLower(p.resizedExt)
+}
+
+// immutableURLHandler answers with the immutable path of the variant of an image requested by the query,
+// any query param applying like it would on GET /{image}
+//
+// the path is recorded in the bucket, so that GET /i/{hash}.{ext} can produce the variant when it is first asked for
+func immutableURLHandler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, o options) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// check image path
+		imagePath := r.PathValue(slug)
+		_, imageFormat, ok := parseImageName(imagePath)
+		if !ok {
+			http.Error(w, errStrInvalidImagePath, http.StatusBadRequest)
+			return
+		}
+
+		q, err := expandPreset(o.presets, r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p, err := parseParams(q, imageFormat, envVar.AllowedFormats, envVar.MaxDimension, envResampling(envVar), envQualityConfig(envVar))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if p.auto {
+			// the format picked depends on the Accept header of every request, which a path cached forever can't vary with
+			http.Error(w, "fm=auto has no immutable path", http.StatusBadRequest)
+			return
+		}
+
+		// no path is recorded for an image that isn't there, and the path of an original replaced under the same key is another
+		originalKey := originalKey(envVar.FolderOriginal, imagePath)
+		_, version, err := storageClient.ObjectMetadata(r.Context(), originalKey)
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				http.Error(w, se.message, se.code)
+				return
+			}
+			logger.ErrorContext(r.Context(), "checking original image", "key", originalKey, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		query := immutableQuery(q)
+		hash := immutableHash(tenant(r.Context()), imagePath, version, query)
+		key := immutableKey(envVar.FolderResized, hash)
+		ok, err = storageClient.CheckObject(r.Context(), key)
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				http.Error(w, se.message, se.code)
+				return
+			}
+			logger.ErrorContext(r.Context(), "checking immutable path", "key", key, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			data, err := json.Marshal(immutableTarget{Image: imagePath, Version: version, Query: query})
+			if err != nil {
+				logger.ErrorContext(r.Context(), "encoding immutable path", "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if err := storageClient.UploadObject(r.Context(), key, bytes.NewReader(data), "application/json"); err != nil {
+				if se := storageStatus(err); se != nil {
+					http.Error(w, se.message, se.code)
+					return
+				}
+				logger.ErrorContext(r.Context(), "recording immutable path", "key", key, "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		u := pathPrefix(r) + immutablePath + hash + "." + immutableExt(p)
+		if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Header().Set("Content-Length", strconv.Itoa(len(u)))
+			w.Write([]byte(u))
+			return
+		}
+		data, err := json.Marshal(struct {
+			URL string `json:"url"`
+		}{u})
+		if err != nil {
+			logger.ErrorContext(r.Context(), "encoding immutable path response", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}
+}
+
+// immutableHandler answers GET /i/{hash}.{ext} with the variant its path stands for, produced on the first request,
+// always served rather than redirected to and cached for a year
+// paths never built by immutableURLHandler, built for another tenant or for an original since replaced are answered 404
+func immutableHandler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, o options) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hash, ext, ok := strings.Cut(r.PathValue(immutableFile), ".")
+		if !ok || len(hash) != 32 || strings.Trim(hash, "0123456789abcdef") != "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		key := immutableKey(envVar.FolderResized, hash)
+		body, _, err := storageClient.DownloadObject(r.Context(), key)
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				http.Error(w, se.message, se.code)
+				return
+			}
+			logger.ErrorContext(r.Context(), "resolving immutable path", "key", key, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		var target immutableTarget
+		err = json.NewDecoder(body).Decode(&target)
+		body.Close()
+		if err != nil {
+			logger.ErrorContext(r.Context(), "resolving immutable path", "key", key, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		q, err := url.ParseQuery(target.Query)
+		if err != nil || immutableHash(tenant(r.Context()), target.Image, target.Version, target.Query) != hash {
+			http.NotFound(w, r)
+			return
+		}
+		_, imageFormat, ok := parseImageName(target.Image)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		p, err := parseParams(q, imageFormat, envVar.AllowedFormats, envVar.MaxDimension, envResampling(envVar), envQualityConfig(envVar))
+		if err != nil || immutableExt(p) != ext {
+			// the path was built with settings, like ALLOWED_FORMATS, that changed since
+			http.NotFound(w, r)
+			return
+		}
+
+		var iw *imageWriter
+		inline := func(contentType string, _ string) io.Writer {
+			iw = &imageWriter{w: w, contentType: contentType, cacheControl: immutableCacheControl}
+			return iw
+		}
+		ctx := withImmutableVersion(r.Context(), target.Version)
+		if r.Method == http.MethodHead {
+			ctx = withHeadOnly(ctx)
+		}
+		v, err := resizeVariant(ctx, logger, storageClient, envVar, o, target.Image, q, inline)
+		if err != nil {
+			if iw != nil && iw.started {
+				// part of the image is already on its way, cut the response short rather than let it pass for a whole one
+				panic(http.ErrAbortHandler)
+			}
+			var se *statusError
+			if !errors.As(err, &se) {
+				se = newStatusError(http.StatusInternalServerError)
+			}
+			http.Error(w, se.message, se.code)
+			return
+		}
+		if v.streamed {
+			return
+		}
+		if v.pending {
+			// the headers the variant will be served with once a GET produces it
+			setImageHeaders(w, v.contentType, immutableCacheControl, "", "")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		cacheControl := immutableCacheControl
+		if v.standIn {
+			// the path must not stand for the original for good
+			cacheControl = v.cacheControl
+		}
+		serveObject(w, r, logger, storageClient, v.key, cacheControl, "", "")
+	}
+}
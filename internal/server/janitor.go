@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+// Janitor deletes the resized variants nobody asked for in maxAge
+//
+// a variant was last used when it was last served or created since startup, as recorded in memory,
+// or else when it was last modified in the bucket, so variants untouched since startup age from their creation
+// originals and deduplicated blobs, which links may still stand for, are never deleted, nor the records of immutable paths
+type Janitor struct {
+	maxAge time.Duration
+	now    func() time.Time
+
+	mu sync.Mutex
+	// last use of every variant served since startup, by URL so that buckets don't share their keys
+	lastUsed map[string]time.Time
+}
+
+func NewJanitor(maxAge time.Duration) *Janitor {
+	return &Janitor{
+		maxAge:   maxAge,
+		now:      time.Now,
+		lastUsed: make(map[string]time.Time),
+	}
+}
+
+// record marks a use of the variant at url
+func (j *Janitor) record(url string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.lastUsed[url] = j.now()
+}
+
+// sweep deletes every stale variant of the bucket of storageClient, variants that fail to be deleted are retried on the next run
+func (j *Janitor) sweep(ctx context.Context, logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar) {
+	objects, err := storageClient.ListObjects(ctx, envVar.FolderResized+"/")
+	if err != nil {
+		logger.Error("listing resized images", "folder", envVar.FolderResized, "error", err)
+		return
+	}
+
+	j.mu.Lock()
+	// uses that old protect nothing anymore, whether or not their variant is still around
+	for url, lastUsed := range j.lastUsed {
+		if j.now().Sub(lastUsed) > j.maxAge {
+			delete(j.lastUsed, url)
+		}
+	}
+	j.mu.Unlock()
+
+	blobs := path.Join(envVar.FolderResized, "blobs") + "/"
+	immutable := path.Join(envVar.FolderResized, "immutable") + "/"
+	for _, object := range objects {
+		if strings.HasPrefix(object.Key, blobs) || strings.HasPrefix(object.Key, immutable) || envVar.FolderOriginal != "" && strings.HasPrefix(object.Key, envVar.FolderOriginal+"/") {
+			continue
+		}
+		url := storageClient.ObjectURL(object.Key)
+
+		j.mu.Lock()
+		lastUsed := object.LastModified
+		if used, ok := j.lastUsed[url]; ok && used.After(lastUsed) {
+			lastUsed = used
+		}
+		stale := j.now().Sub(lastUsed) > j.maxAge
+		j.mu.Unlock()
+		if !stale {
+			continue
+		}
+
+		err := storageClient.DeleteObject(ctx, object.Key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			logger.Error("deleting stale resized image", "key", object.Key, "error", err)
+			continue
+		}
+		logger.Debug("deleted stale resized image", "key", object.Key, "last_used", lastUsed)
+
+		j.mu.Lock()
+		delete(j.lastUsed, url)
+		j.mu.Unlock()
+	}
+}
+
+// Run deletes stale variants of the bucket of storageClient every interval until ctx is done
+func (j *Janitor) Run(ctx context.Context, logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.sweep(ctx, logger, storageClient, envVar)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestJanitor(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-resized-folder/originals",
+		FolderResized:  "stub-resized-folder",
+	}
+	now := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) time.Time {
+		return now.Add(-time.Duration(days) * 24 * time.Hour)
+	}
+
+	ssc := newStubStorageClient(sev)
+	stale := path.Join(sev.FolderResized, "imagePNG.png", "w100h0.png")
+	fresh := path.Join(sev.FolderResized, "imagePNG.png", "w200h0.png")
+	served := path.Join(sev.FolderResized, "imagePNG.png", "w250h0.png")
+	blob := path.Join(sev.FolderResized, "blobs", "abc.png")
+	immutable := immutableKey(sev.FolderResized, strings.Repeat("0", 32))
+	original := path.Join(sev.FolderOriginal, "old.png")
+	ssc.storage[stale] = stubObject{lastModified: daysAgo(8)}
+	ssc.storage[fresh] = stubObject{lastModified: daysAgo(2)}
+	ssc.storage[served] = stubObject{lastModified: daysAgo(30)}
+	ssc.storage[blob] = stubObject{lastModified: daysAgo(30)}
+	ssc.storage[immutable] = stubObject{lastModified: daysAgo(30)}
+	ssc.storage[original] = stubObject{lastModified: daysAgo(30)}
+
+	j := NewJanitor(7 * 24 * time.Hour)
+	j.now = func() time.Time { return daysAgo(1) }
+	ss := New(slogt.New(t), ssc, sev, WithJanitor(j))
+
+	// served a day ago, so its last use is recorded even though it was created long ago
+	rr := httptest.NewRecorder()
+	ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/imagePNG.png?w=250", nil))
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+
+	j.now = func() time.Time { return now }
+	j.sweep(context.Background(), slogt.New(t), ssc, sev)
+
+	for key, kept := range map[string]bool{stale: false, fresh: true, served: true, blob: true, immutable: true, original: true} {
+		_, ok := ssc.storage[key]
+		if ok != kept {
+			t.Errorf("%s: got kept %t; want %t", key, ok, kept)
+		}
+	}
+	// the originals the stub starts with were modified at the zero time, and they are all kept
+	_, ok := ssc.storage[path.Join(sev.FolderOriginal, "imagePNG.png")]
+	assertEqual(t, ok, true)
+}
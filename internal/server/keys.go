@@ -0,0 +1,80 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+// storage keys are always joined with forward slashes, whatever the OS separator is
+
+func originalKey(folder string, imagePath string) string {
+	return path.Join(folder, imagePath)
+}
+
+// resizedFolder is the folder holding every resized variant of an original
+// it is named after the full image path ("img.jpg") so that "img.jpg" and "img.png" don't share their variants,
+// unless the legacy layout named after the image name only ("img") is configured
+// the variants of a tenant are kept in a folder of their own, "tenants/{tenant}", so that they can be purged at once
+func resizedFolder(envVar *envvar.EnvVar, tenant string, imagePath string, imageName string) string {
+	folder := envVar.FolderResized
+	if tenant != "" {
+		folder = path.Join(folder, "tenants", tenant)
+	}
+	if envVar.ResizedLayout == envvar.ResizedLayoutName {
+		return path.Join(folder, imageName)
+	}
+	return path.Join(folder, imagePath)
+}
+
+// resizedKey names a variant after its dimensions followed by every other transform applied to it, like "w100h0-q80.webp"
+func resizedKey(folder string, width, height int, ext string, transforms ...string) string {
+	name := fmt.Sprintf("w%dh%d", width, height)
+	for _, t := range transforms {
+		name += "-" + t
+	}
+	return path.Join(folder, name+"."+ext)
+}
+
+// variantKey is the key of the variant p requests of an original at version, "" leaving the version out
+// the version comes last, and isn't part of p since it doesn't make the variant requested any more than the original
+func variantKey(folder string, p params, version string) string {
+	transforms := p.keyTransforms()
+	if version != "" {
+		transforms = append(slices.Clip(transforms), versionTransform(version))
+	}
+	return resizedKey(folder, p.width, p.height, p.resizedExt, transforms...)
+}
+
+// versionTransform names the version of an original in the keys of its variants, like "v3f2a9c0e",
+// a short hash since ETags and version IDs are long and may hold characters keys shouldn't
+func versionTransform(version string) string {
+	sum := sha256.Sum256([]byte(version))
+	return "v" + hex.EncodeToString(sum[:4])
+}
+
+// parseResizedKey reads back the name of a variant built by resizedKey, ok is false for any other object
+func parseResizedKey(key string) (width, height int, ext string, transforms []string, ok bool) {
+	name := path.Base(key)
+	ext = path.Ext(name)
+	if len(ext) < 2 {
+		return 0, 0, "", nil, false
+	}
+	name, ext = strings.TrimSuffix(name, ext), ext[1:]
+	if i := strings.IndexByte(name, '-'); i >= 0 {
+		name, transforms = name[:i], strings.Split(name[i+1:], "-")
+		if slices.Contains(transforms, "") {
+			return 0, 0, "", nil, false
+		}
+	}
+	var rest string
+	if n, _ := fmt.Sscanf(name, "w%dh%d%s", &width, &height, &rest); n != 2 || width < 0 || height < 0 || name != fmt.Sprintf("w%dh%d", width, height) {
+		return 0, 0, "", nil, false
+	}
+	return width, height, ext, transforms, true
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestKeys(t *testing.T) {
+	assertEqual(t, originalKey("originals/nested", "photo.jpg"), "originals/nested/photo.jpg")
+	assertEqual(t, originalKey("", "photo.jpg"), "photo.jpg")
+
+	ev := &envvar.EnvVar{FolderResized: "resized/nested"}
+	assertEqual(t, resizedKey(resizedFolder(ev, "", "photo.jpg", "photo"), 100, 0, "jpg"), "resized/nested/photo.jpg/w100h0.jpg")
+	ev.ResizedLayout = envvar.ResizedLayoutName
+	assertEqual(t, resizedKey(resizedFolder(ev, "", "photo.jpg", "photo"), 100, 0, "jpg"), "resized/nested/photo/w100h0.jpg")
+	assertEqual(t, resizedKey(resizedFolder(ev, "acme", "photo.jpg", "photo"), 100, 0, "jpg"), "resized/nested/tenants/acme/photo/w100h0.jpg")
+	ev.ResizedLayout = ""
+	assertEqual(t, resizedKey(resizedFolder(ev, "acme", "photo.jpg", "photo"), 100, 0, "jpg"), "resized/nested/tenants/acme/photo.jpg/w100h0.jpg")
+}
+
+func TestParseResizedKey(t *testing.T) {
+	tt := []struct {
+		key string
+		// desired params read back from the key
+		width      int
+		height     int
+		ext        string
+		transforms string
+		ok         bool
+	}{
+		{key: "resized/photo.jpg/w100h0.jpg", width: 100, ext: "jpg", ok: true},
+		{key: "resized/photo.jpg/w0h600.webp", height: 600, ext: "webp", ok: true},
+		{key: "resized/photo.jpg/w100h100-q80-pad000000ff.webp", width: 100, height: 100, ext: "webp", transforms: "q80,pad000000ff", ok: true},
+		{key: "resized/photo.jpg/blurhash-x4y3.txt"},
+		{key: "resized/photo.jpg/w100h0"},
+		{key: "resized/photo.jpg/w100h0x.jpg"},
+		{key: "resized/photo.jpg/w0100h0.jpg"},
+		{key: "resized/photo.jpg/w100h0-.jpg"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.key, func(t *testing.T) {
+			width, height, ext, transforms, ok := parseResizedKey(tc.key)
+			assertEqual(t, ok, tc.ok)
+			assertEqual(t, width, tc.width)
+			assertEqual(t, height, tc.height)
+			assertEqual(t, ext, tc.ext)
+			assertEqual(t, strings.Join(transforms, ","), tc.transforms)
+		})
+	}
+}
+
+func TestVersionedKeys(t *testing.T) {
+	v1, v2 := versionTransform("etag1"), versionTransform("etag2")
+	assertEqual(t, len(v1), len("v")+8)
+	assertEqual(t, v1 != v2, true)
+
+	tt := []struct {
+		testName  string
+		versioned bool
+		target    string
+		// desired Location of the original at etag1, and then at etag2
+		location1 string
+		location2 string
+	}{
+		{testName: "versioned", versioned: true, target: "/imageJPEG.jpeg?w=100", location1: "stub-resized-folder/imageJPEG.jpeg/w100h0-" + v1 + ".jpeg", location2: "stub-resized-folder/imageJPEG.jpeg/w100h0-" + v2 + ".jpeg"},
+		{testName: "versioned after the other transforms", versioned: true, target: "/imageJPEG.jpeg?w=100&fm=png&m=nearest", location1: "stub-resized-folder/imageJPEG.jpeg/w100h0-mnearest-" + v1 + ".png", location2: "stub-resized-folder/imageJPEG.jpeg/w100h0-mnearest-" + v2 + ".png"},
+		{testName: "original", versioned: true, target: "/imageJPEG.jpeg", location1: "stub-original-folder/imageJPEG.jpeg", location2: "stub-original-folder/imageJPEG.jpeg"},
+		{testName: "unversioned", target: "/imageJPEG.jpeg?w=100", location1: "stub-resized-folder/imageJPEG.jpeg/w100h0.jpeg", location2: "stub-resized-folder/imageJPEG.jpeg/w100h0.jpeg"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				VersionedKeys:  tc.versioned,
+			}
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+			key := path.Join(sev.FolderOriginal, "imageJPEG.jpeg")
+
+			for _, version := range []struct {
+				etag     string
+				location string
+			}{{"etag1", tc.location1}, {"etag2", tc.location2}} {
+				// the original replaced under the same key
+				original := ssc.storage[key]
+				original.version = version.etag
+				ssc.storage[key] = original
+
+				rr := httptest.NewRecorder()
+				ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+				assertEqual(t, rr.Code, http.StatusSeeOther)
+				assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(version.location))
+			}
+		})
+	}
+}
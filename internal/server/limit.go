@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"slices"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+// limitVariants is checked before a variant of the image whose variants are kept in folder is produced,
+// listing the folder to count them against VARIANT_LIMIT
+// under the limit, or when the variant requested is stored already and only produced again, it returns ""
+// over it, it returns the stored variant nearest to one of candidates with VARIANT_LIMIT_ACTION=nearest,
+// along with the key serving it, the blob it links to with DEDUP, and 429 otherwise
+// every error it returns is a *statusError
+func limitVariants(ctx context.Context, logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, folder string, candidates []params, version string) (nearest string, servedKey string, err error) {
+	objects, err := storageClient.ListObjects(ctx, folder+"/")
+	if err != nil {
+		if se := storageStatus(err); se != nil {
+			return "", "", se
+		}
+		logger.ErrorContext(ctx, "listing resized images", "folder", folder, "error", err)
+		return "", "", newStatusError(http.StatusInternalServerError)
+	}
+
+	var stored []string
+	for _, object := range objects {
+		// nested keys belong to another image, like "dir/img.jpg" under the folder of "dir"
+		if _, _, _, _, ok := parseResizedKey(object.Key); ok && path.Dir(object.Key) == folder {
+			stored = append(stored, object.Key)
+		}
+	}
+	if len(stored) < envVar.VariantLimit {
+		return "", "", nil
+	}
+	for _, c := range candidates {
+		if slices.Contains(stored, variantKey(folder, c, version)) {
+			return "", "", nil
+		}
+	}
+
+	if envVar.VariantLimitAction == envvar.VariantLimitNearest {
+		if nearest = nearestVariant(stored, folder, candidates, version); nearest != "" {
+			logger.InfoContext(ctx, "variant limit reached, answering the nearest variant", "folder", folder, "limit", envVar.VariantLimit, "key", nearest)
+			servedKey = nearest
+			if envVar.Dedup {
+				servedKey, err = storageClient.ResolveObject(ctx, nearest)
+				if err != nil {
+					if se := storageStatus(err); se != nil {
+						return "", "", se
+					}
+					logger.ErrorContext(ctx, "resolving resized image", "key", nearest, "error", err)
+					return "", "", newStatusError(http.StatusInternalServerError)
+				}
+			}
+			return nearest, servedKey, nil
+		}
+	}
+	logger.WarnContext(ctx, "variant limit reached, refusing variant", "folder", folder, "limit", envVar.VariantLimit)
+	return "", "", &statusError{code: http.StatusTooManyRequests, message: fmt.Sprintf("this image already has %d variants, request one of their sizes instead", envVar.VariantLimit)}
+}
+
+// nearestVariant picks among the stored keys the variant of a candidate in another size, "" when there is none
+// it differs from the candidate only in width and height, the same of them left to the aspect ratio, so that it looks the same,
+// the smallest one at least as large as requested, since browsers scale it down, or else the largest
+func nearestVariant(stored []string, folder string, candidates []params, version string) string {
+	var nearest string
+	var nearestW, nearestH int
+	for _, c := range candidates {
+		covers := func(w, h int) bool {
+			return w >= c.width && h >= c.height
+		}
+		area := func(w, h int) int {
+			return max(w, 1) * max(h, 1)
+		}
+		better := func(w, h int) bool {
+			if nearest == "" {
+				return true
+			}
+			if covers(w, h) != covers(nearestW, nearestH) {
+				return covers(w, h)
+			}
+			if covers(w, h) {
+				return area(w, h) < area(nearestW, nearestH)
+			}
+			return area(w, h) > area(nearestW, nearestH)
+		}
+
+		_, _, wantExt, wantTransforms, _ := parseResizedKey(variantKey(folder, c, version))
+		for _, key := range stored {
+			w, h, ext, transforms, _ := parseResizedKey(key)
+			if ext != wantExt || !slices.Equal(transforms, wantTransforms) || (w == 0) != (c.width == 0) || (h == 0) != (c.height == 0) {
+				continue
+			}
+			if better(w, h) {
+				nearest, nearestW, nearestH = key, w, h
+			}
+		}
+	}
+	return nearest
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestVariantLimit(t *testing.T) {
+	tt := []struct {
+		testName string
+		limit    int
+		action   string
+		target   string
+		// desired response status code, and key redirected to or body
+		statusCode int
+		key        string
+		body       string
+		// whether a variant was produced
+		upload bool
+	}{
+		{testName: "under the limit", limit: 3, target: "/imageJPEG.jpeg?w=100", statusCode: http.StatusSeeOther, key: "w100h0.jpeg", upload: true},
+		{testName: "nested keys aren't counted", limit: 3, target: "/imageJPEG.jpeg?w=100&h=150", statusCode: http.StatusSeeOther, key: "w100h150.jpeg", upload: true},
+		{testName: "stored variant at the limit", limit: 2, target: "/imageJPEG.jpeg?w=600&h=900", statusCode: http.StatusSeeOther, key: "w600h900.jpeg"},
+		{testName: "rejected", limit: 2, target: "/imageJPEG.jpeg?w=100&h=150", statusCode: http.StatusTooManyRequests, body: "this image already has 2 variants, request one of their sizes instead"},
+		{testName: "rejected by default action", limit: 2, action: "", target: "/imageJPEG.jpeg?w=400&h=600", statusCode: http.StatusTooManyRequests, body: "this image already has 2 variants, request one of their sizes instead"},
+		{testName: "nearest larger", limit: 2, action: envvar.VariantLimitNearest, target: "/imageJPEG.jpeg?w=200&h=300", statusCode: http.StatusSeeOther, key: "w300h450.jpeg"},
+		{testName: "smallest larger", limit: 2, action: envvar.VariantLimitNearest, target: "/imageJPEG.jpeg?w=400&h=600", statusCode: http.StatusSeeOther, key: "w600h900.jpeg"},
+		{testName: "largest when none is larger", limit: 2, action: envvar.VariantLimitNearest, target: "/imageJPEG.jpeg?w=800&h=1200", statusCode: http.StatusSeeOther, key: "w600h900.jpeg"},
+		{testName: "nearest of another aspect ratio", limit: 2, action: envvar.VariantLimitNearest, target: "/imageJPEG.jpeg?w=400", statusCode: http.StatusTooManyRequests, body: "this image already has 2 variants, request one of their sizes instead"},
+		{testName: "nearest in another format", limit: 2, action: envvar.VariantLimitNearest, target: "/imageJPEG.jpeg?w=400&h=600&fm=png", statusCode: http.StatusTooManyRequests, body: "this image already has 2 variants, request one of their sizes instead"},
+		{testName: "nearest with other transforms", limit: 2, action: envvar.VariantLimitNearest, target: "/imageJPEG.jpeg?w=400&h=600&quality=high", statusCode: http.StatusTooManyRequests, body: "this image already has 2 variants, request one of their sizes instead"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:         "stub-bucket",
+				FolderOriginal:     "stub-original-folder",
+				FolderResized:      "stub-resized-folder",
+				VariantLimit:       tc.limit,
+				VariantLimitAction: tc.action,
+			}
+			ssc := newStubStorageClient(sev)
+			ssc.storage[path.Join(sev.FolderResized, "imageJPEG.jpeg", "w300h450.jpeg")] = newStubObject("jpeg", 300, 450)
+			// a variant of another image, "imageJPEG.jpeg/nested.jpeg"
+			ssc.storage[path.Join(sev.FolderResized, "imageJPEG.jpeg", "nested.jpeg", "w10h10.jpeg")] = newStubObject("jpeg", 10, 10)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, ssc.execution[exeKeyUpload], tc.upload)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(path.Join(sev.FolderResized, "imageJPEG.jpeg", tc.key)))
+		})
+	}
+}
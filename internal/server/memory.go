@@ -0,0 +1,49 @@
+package server
+
+import (
+	"image"
+	"sync/atomic"
+)
+
+// MemoryBudget bounds the memory estimated to be taken by the resizes in flight,
+// refusing new resizes once it is spent rather than letting a burst of large originals run the process out of memory
+//
+// resizes are estimated at 4 bytes per pixel of the original they decode and of the variant they draw,
+// a coarse count that leaves out encoding buffers and the rest of the process
+type MemoryBudget struct {
+	maxBytes int64
+	inFlight atomic.Int64
+}
+
+func NewMemoryBudget(maxBytes int64) *MemoryBudget {
+	return &MemoryBudget{maxBytes: maxBytes}
+}
+
+// acquire counts n more bytes in flight unless that would spend more than the budget,
+// a resize alone is always let through, however large, so that no original is refused for good
+func (mb *MemoryBudget) acquire(n int64) bool {
+	for {
+		inFlight := mb.inFlight.Load()
+		if inFlight > 0 && inFlight+n > mb.maxBytes {
+			return false
+		}
+		if mb.inFlight.CompareAndSwap(inFlight, inFlight+n) {
+			return true
+		}
+	}
+}
+
+// release gives back n bytes counted by acquire
+func (mb *MemoryBudget) release(n int64) {
+	mb.inFlight.Add(-n)
+}
+
+// resizeBytes estimates the memory a resize of an original of bounds into a variant of size takes,
+// leaving the original out when it is already decoded
+func resizeBytes(bounds image.Rectangle, size image.Point, decoded bool) int64 {
+	n := int64(size.X) * int64(size.Y) * 4
+	if !decoded {
+		n += int64(bounds.Dx()) * int64(bounds.Dy()) * 4
+	}
+	return n
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestMemoryBudgetAcquire(t *testing.T) {
+	mb := NewMemoryBudget(100)
+
+	// a resize alone goes through even when larger than the budget
+	assertEqual(t, mb.acquire(150), true)
+	assertEqual(t, mb.acquire(1), false)
+	mb.release(150)
+
+	assertEqual(t, mb.acquire(60), true)
+	assertEqual(t, mb.acquire(40), true)
+	assertEqual(t, mb.acquire(1), false)
+	mb.release(40)
+	assertEqual(t, mb.acquire(30), true)
+	mb.release(30)
+	mb.release(60)
+	assertEqual(t, mb.inFlight.Load(), int64(0))
+}
+
+func TestResizeBytes(t *testing.T) {
+	bounds := image.Rect(0, 0, 300, 200)
+	assertEqual(t, resizeBytes(bounds, image.Pt(150, 100), false), int64(300*200*4+150*100*4))
+	// an original already decoded takes no more memory
+	assertEqual(t, resizeBytes(bounds, image.Pt(150, 100), true), int64(150*100*4))
+}
+
+func TestMemoryBudget(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	ssc := newStubStorageClient(sev)
+	// room for a single resize of the 300 x 300 originals
+	mb := NewMemoryBudget(500_000)
+	ss := New(slogt.New(t), ssc, sev, WithMemoryBudget(mb))
+
+	get := func(target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		return rr
+	}
+
+	// another resize is in flight
+	assertEqual(t, mb.acquire(300*300*4), true)
+	rr := get("/imagePNG.png?w=100")
+	assertEqual(t, rr.Code, http.StatusServiceUnavailable)
+	assertEqual(t, ssc.execution[exeKeyUpload], false)
+
+	// originals answered as they are take no budget
+	rr = get("/imagePNG.png")
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+
+	mb.release(300 * 300 * 4)
+	rr = get("/imagePNG.png?w=100")
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+	assertEqual(t, ssc.execution[exeKeyUpload], true)
+	assertEqual(t, mb.inFlight.Load(), int64(0))
+
+	// nor do variants already stored
+	assertEqual(t, mb.acquire(300*300*4), true)
+	rr = get("/imagePNG.png?w=100")
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseImageName splits an image path like "photo.v2.jpg" into its name ("photo.v2") and extension ("jpg"),
+// one of originalExtensions
+// matching is case-insensitive ("photo.JPG" is a jpeg too), but the extension is returned with its original casing
+// since S3 object keys are case-sensitive
+//
+// the extension is everything after the last dot, so "a.jpg.bmp" is rejected for its "bmp" extension
+// while "a.bmp.jpg" is accepted with the name "a.bmp"
+// the name must be a non-empty, valid UTF-8 string without slashes, backslashes or control characters
+func parseImageName(path string) (name string, ext string, ok bool) {
+	return parseName(path, originalExtensions())
+}
+
+// parsePassthroughName is parseImageName for the originals with one of exts, which aren't resized but answered as they are
+func parsePassthroughName(path string, exts []string) (name string, ext string, ok bool) {
+	return parseName(path, exts)
+}
+
+// parseName splits path into its name and extension, the lowercased extension being one of exts
+func parseName(path string, exts []string) (name string, ext string, ok bool) {
+	i := strings.LastIndexByte(path, '.')
+	if i <= 0 {
+		return "", "", false
+	}
+	name, ext = path[:i], path[i+1:]
+
+	if !slices.Contains(exts, strings.ToLower(ext)) {
+		return "", "", false
+	}
+	if !utf8.ValidString(name) {
+		return "", "", false
+	}
+	for _, r := range name {
+		if r == '/' || r == '\\' || r < 0x20 || r == 0x7f {
+			return "", "", false
+		}
+	}
+
+	return name, ext, true
+}
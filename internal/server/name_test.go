@@ -0,0 +1,71 @@
+package server
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestParseImageName(t *testing.T) {
+	tt := []struct {
+		path string
+		name string
+		ext  string
+		ok   bool
+	}{
+		{path: "photo.jpg", name: "photo", ext: "jpg", ok: true},
+		{path: "photo.jpeg", name: "photo", ext: "jpeg", ok: true},
+		{path: "photo.png", name: "photo", ext: "png", ok: true},
+		{path: "사진.png", name: "사진", ext: "png", ok: true},
+		{path: "IMG_0001.HEIC", name: "IMG_0001", ext: "HEIC", ok: true},
+		{path: "photo.heif", name: "photo", ext: "heif", ok: true},
+		{path: "anim.gif", name: "anim", ext: "gif", ok: true},
+		{path: "a.bmp.jpg", name: "a.bmp", ext: "jpg", ok: true},
+		{path: "a..jpg", name: "a.", ext: "jpg", ok: true},
+		{path: "a.jpg.bmp"},
+		{path: "a.jpg."},
+		{path: ".jpg"},
+		{path: "photo"},
+		{path: "photo.JPG", name: "photo", ext: "JPG", ok: true},
+		{path: "photo.Jpeg", name: "photo", ext: "Jpeg", ok: true},
+		{path: "photo.PNG", name: "photo", ext: "PNG", ok: true},
+		{path: "photo.jpg?w=100"},
+		{path: "dir/photo.jpg"},
+		{path: "dir\\photo.jpg"},
+		{path: "photo\n.jpg"},
+		{path: "\xff.jpg"},
+		{path: ""},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.path, func(t *testing.T) {
+			name, ext, ok := parseImageName(tc.path)
+			assertEqual(t, ok, tc.ok)
+			assertEqual(t, name, tc.name)
+			assertEqual(t, ext, tc.ext)
+		})
+	}
+}
+
+func FuzzParseImageName(f *testing.F) {
+	for _, seed := range []string{"photo.jpg", "사진.png", "a.jpg.bmp", "a..jpg", "a.jpg.", ".png", "photo.JPG", "photo.jpg?w=1"} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, path string) {
+		name, ext, ok := parseImageName(path)
+		if !ok {
+			return
+		}
+		if name+"."+ext != path {
+			t.Errorf("%q split into %q and %q", path, name, ext)
+		}
+		if name == "" || !utf8.ValidString(name) || strings.ContainsAny(name, "/\\") {
+			t.Errorf("%q produced invalid name %q", path, name)
+		}
+		if !slices.Contains(originalExtensions(), strings.ToLower(ext)) {
+			t.Errorf("%q produced unsupported extension %q", path, ext)
+		}
+	})
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+const queryNoCache = "nocache"
+
+// noCacheRequested tells whether ?nocache asks to regenerate the variant even when it is stored
+func noCacheRequested(q url.Values) (bool, error) {
+	if !q.Has(queryNoCache) {
+		return false, nil
+	}
+	noCache, err := strconv.ParseBool(q.Get(queryNoCache))
+	if err != nil {
+		return false, errors.New("nocache must be a boolean")
+	}
+	return noCache, nil
+}
+
+// noCacheAuthorized checks the bearer token of r against the configured one
+// regenerating costs as much as a cache miss every time, so it is refused when no token is configured
+func noCacheAuthorized(envVar *envvar.EnvVar, r *http.Request) bool {
+	return bearerAuthorized(r, envVar.NoCacheToken)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+
+	"github.com/disintegration/gift"
+)
+
+// exifHeadSize is how much of an original is searched for its Exif segment,
+// which follows the start of a jpeg and is at most 64KB long
+const exifHeadSize = 1 << 17
+
+const exifTagOrientation = 0x0112
+
+// exifOrientation reads the Exif orientation of the jpeg starting with head, 1 (upright) when it has none
+func exifOrientation(head []byte) int {
+	if len(head) < 4 || head[0] != 0xFF || head[1] != 0xD8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(head); {
+		if head[i] != 0xFF {
+			return 1
+		}
+		marker := head[i+1]
+		if marker == 0xFF {
+			// fill byte before a marker
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 {
+			// the image data starts, the Exif segment only comes before it
+			return 1
+		}
+		size := int(head[i+2])<<8 | int(head[i+3])
+		if size < 2 {
+			return 1
+		}
+		segment := head[i+4 : min(i+2+size, len(head))]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// tiffOrientation reads the orientation tag of the first IFD of the TIFF structure of an Exif segment
+func tiffOrientation(t []byte) int {
+	if len(t) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(t[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := uint64(order.Uint32(t[4:8]))
+	if ifd < 8 || ifd+2 > uint64(len(t)) {
+		return 1
+	}
+	entries := int(order.Uint16(t[ifd:]))
+	for k := range entries {
+		e := int(ifd) + 2 + k*12
+		if e+12 > len(t) {
+			return 1
+		}
+		if order.Uint16(t[e:]) != exifTagOrientation {
+			continue
+		}
+		o := int(order.Uint16(t[e+8:]))
+		if o < 1 || o > 8 {
+			return 1
+		}
+		return o
+	}
+	return 1
+}
+
+// orientationFilter turns the pixels of an image stored in orientation o upright, nil when they already are
+//
+// orientations 5 to 8 turn the image by a quarter, swapping its width and height
+func orientationFilter(o int) gift.Filter {
+	switch o {
+	case 2:
+		return gift.FlipHorizontal()
+	case 3:
+		return gift.Rotate180()
+	case 4:
+		return gift.FlipVertical()
+	case 5:
+		return gift.Transpose()
+	case 6:
+		// gift rotates counter-clockwise, 270 of them make a quarter turn clockwise
+		return gift.Rotate270()
+	case 7:
+		return gift.Transverse()
+	case 8:
+		return gift.Rotate90()
+	}
+	return nil
+}
+
+// orient turns img, stored in orientation o, upright
+func orient(img image.Image, o int) image.Image {
+	f := orientationFilter(o)
+	if f == nil {
+		return img
+	}
+	g := gift.New(f)
+	dst := image.NewRGBA(g.Bounds(img.Bounds()))
+	g.Draw(dst, img)
+	return dst
+}
+
+// decodeConfig reads the size of an original like image.DecodeConfig,
+// in the orientation decodeImage turns it into, so that w and h always apply to the image as it is displayed
+func decodeConfig(r io.Reader) (image.Config, string, error) {
+	br := bufio.NewReaderSize(r, exifHeadSize)
+	head, _ := br.Peek(exifHeadSize)
+	o := exifOrientation(head)
+	cfg, format, err := decodeConfigSniffed(br)
+	if err != nil {
+		return cfg, format, err
+	}
+	if format == formatJPEG && o >= 5 {
+		cfg.Width, cfg.Height = cfg.Height, cfg.Width
+	}
+	return cfg, format, nil
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+var (
+	quadrantRed   = color.RGBA{255, 0, 0, 255}
+	quadrantGreen = color.RGBA{0, 255, 0, 255}
+	quadrantBlue  = color.RGBA{0, 0, 255, 255}
+	quadrantWhite = color.RGBA{255, 255, 255, 255}
+)
+
+// newOrientedJPEG encodes a width x height jpeg stored with red, green, blue and white quadrants
+// from its top left to its bottom right, tagged with the Exif orientation o unless it is 0
+func newOrientedJPEG(t *testing.T, width, height int, o int, order binary.ByteOrder) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for i, c := range []color.RGBA{quadrantRed, quadrantGreen, quadrantBlue, quadrantWhite} {
+		x, y := i%2*width/2, i/2*height/2
+		draw.Draw(img, image.Rect(x, y, x+width/2, y+height/2), image.NewUniform(c), image.Point{}, draw.Src)
+	}
+	var b bytes.Buffer
+	if err := jpeg.Encode(&b, img, &jpeg.Options{Quality: 95}); err != nil {
+		t.Fatal(err)
+	}
+	if o == 0 {
+		return b.Bytes()
+	}
+
+	// a TIFF header and a single IFD holding the orientation
+	var tiff bytes.Buffer
+	if order == binary.LittleEndian {
+		tiff.WriteString("II")
+	} else {
+		tiff.WriteString("MM")
+	}
+	binary.Write(&tiff, order, uint16(42))
+	binary.Write(&tiff, order, uint32(8))
+	binary.Write(&tiff, order, uint16(1))
+	binary.Write(&tiff, order, []uint16{exifTagOrientation, 3})
+	binary.Write(&tiff, order, uint32(1))
+	binary.Write(&tiff, order, []uint16{uint16(o), 0})
+	binary.Write(&tiff, order, uint32(0))
+
+	segment := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	data := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	data = binary.BigEndian.AppendUint16(data, uint16(len(segment)+2))
+	data = append(data, segment...)
+	return append(data, b.Bytes()[2:]...)
+}
+
+// quadrantAt names the quadrant color closest to the pixel of img at x, y
+func quadrantAt(img image.Image, x, y int) color.RGBA {
+	r, g, b, _ := img.At(x, y).RGBA()
+	var closest color.RGBA
+	best := -1
+	for _, c := range []color.RGBA{quadrantRed, quadrantGreen, quadrantBlue, quadrantWhite} {
+		dr, dg, db := int(r>>8)-int(c.R), int(g>>8)-int(c.G), int(b>>8)-int(c.B)
+		d := dr*dr + dg*dg + db*db
+		if best < 0 || d < best {
+			closest, best = c, d
+		}
+	}
+	return closest
+}
+
+func TestDecodeOrientation(t *testing.T) {
+	tt := []struct {
+		testName    string
+		orientation int
+		order       binary.ByteOrder
+		// desired size and quadrants at the top corners, as displayed
+		width, height     int
+		topLeft, topRight color.RGBA
+	}{
+		{testName: "no exif", width: 64, height: 32, topLeft: quadrantRed, topRight: quadrantGreen},
+		{testName: "1 upright", orientation: 1, order: binary.BigEndian, width: 64, height: 32, topLeft: quadrantRed, topRight: quadrantGreen},
+		{testName: "2 mirrored", orientation: 2, order: binary.BigEndian, width: 64, height: 32, topLeft: quadrantGreen, topRight: quadrantRed},
+		{testName: "3 upside down", orientation: 3, order: binary.BigEndian, width: 64, height: 32, topLeft: quadrantWhite, topRight: quadrantBlue},
+		{testName: "4 flipped", orientation: 4, order: binary.BigEndian, width: 64, height: 32, topLeft: quadrantBlue, topRight: quadrantWhite},
+		{testName: "5 transposed", orientation: 5, order: binary.BigEndian, width: 32, height: 64, topLeft: quadrantRed, topRight: quadrantBlue},
+		{testName: "6 turned clockwise", orientation: 6, order: binary.BigEndian, width: 32, height: 64, topLeft: quadrantBlue, topRight: quadrantRed},
+		{testName: "7 transversed", orientation: 7, order: binary.BigEndian, width: 32, height: 64, topLeft: quadrantWhite, topRight: quadrantGreen},
+		{testName: "8 turned counter-clockwise", orientation: 8, order: binary.BigEndian, width: 32, height: 64, topLeft: quadrantGreen, topRight: quadrantWhite},
+		{testName: "little endian", orientation: 6, order: binary.LittleEndian, width: 32, height: 64, topLeft: quadrantBlue, topRight: quadrantRed},
+		{testName: "out of range", orientation: 9, order: binary.BigEndian, width: 64, height: 32, topLeft: quadrantRed, topRight: quadrantGreen},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			data := newOrientedJPEG(t, 64, 32, tc.orientation, tc.order)
+
+			cfg, _, err := decodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, cfg.Width, tc.width)
+			assertEqual(t, cfg.Height, tc.height)
+
+			img, _, err := decodeImage(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, img.Bounds().Size(), image.Pt(tc.width, tc.height))
+			assertEqual(t, quadrantAt(img, 2, 2), tc.topLeft)
+			assertEqual(t, quadrantAt(img, tc.width-3, 2), tc.topRight)
+		})
+	}
+}
+
+func TestExifOrientationMalformed(t *testing.T) {
+	data := newOrientedJPEG(t, 64, 32, 6, binary.BigEndian)
+
+	tt := []struct {
+		testName string
+		head     []byte
+	}{
+		{testName: "empty", head: nil},
+		{testName: "png", head: []byte("\x89PNG\r\n\x1a\n")},
+		// cut in the middle of the IFD entry
+		{testName: "truncated", head: data[:30]},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			assertEqual(t, exifOrientation(tc.head), 1)
+		})
+	}
+}
+
+func TestResizeOrientation(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	ssc := newStubStorageClient(sev)
+	// a portrait photo stored landscape, with the camera turned
+	ssc.storage[path.Join(sev.FolderOriginal, "portrait.jpeg")] = stubObject{
+		data:         newOrientedJPEG(t, 96, 64, 6, binary.BigEndian),
+		contentType:  "image/jpeg",
+		lastModified: time.Now(),
+	}
+	ss := New(slogt.New(t), ssc, sev)
+	folder := path.Join(sev.FolderResized, "portrait.jpeg")
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response
+		statusCode int
+		key        string
+		width      int
+		height     int
+	}{
+		{testName: "width of the portrait", target: "/portrait.jpeg?w=32", statusCode: http.StatusSeeOther, key: path.Join(folder, "w32h0.jpeg"), width: 32, height: 48},
+		{testName: "height of the portrait", target: "/portrait.jpeg?h=48", statusCode: http.StatusSeeOther, key: path.Join(folder, "w0h48.jpeg"), width: 32, height: 48},
+		// the portrait is 64 wide, as large as the stored image is high
+		{testName: "capped at the width of the portrait", target: "/portrait.jpeg?w=80&upscale=0", statusCode: http.StatusSeeOther, key: path.Join(sev.FolderOriginal, "portrait.jpeg")},
+		{testName: "size of the portrait", target: "/portrait.jpeg?w=64&h=96", statusCode: http.StatusSeeOther, key: path.Join(sev.FolderOriginal, "portrait.jpeg")},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(tc.key))
+			if tc.width == 0 {
+				return
+			}
+			img, err := jpeg.Decode(bytes.NewReader(ssc.storage[tc.key].data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, img.Bounds().Size(), image.Pt(tc.width, tc.height))
+			// the variant carries no Exif, its pixels are upright
+			assertEqual(t, quadrantAt(img, 2, 2), quadrantBlue)
+		})
+	}
+}
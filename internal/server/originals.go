@@ -0,0 +1,156 @@
+package server
+
+import (
+	"container/list"
+	"image"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/obzva/image-server/internal/storage"
+)
+
+// OriginalCache keeps decoded originals, so resizing the same original again skips its download and decode
+// the images it returns are shared between requests and must not be drawn onto
+type OriginalCache interface {
+	Get(key string) (img image.Image, format string, ok bool)
+	Add(key string, img image.Image, format string)
+}
+
+// originalCacheKey keys the decoded original at key in an OriginalCache
+// by URL, since the same key in another bucket is another original, by version, since an original replaced under
+// the same key is another original too, and by the frame of an animated one
+func originalCacheKey(storageClient storage.Client, key string, version string, frame int) string {
+	cacheKey := storageClient.ObjectURL(key)
+	if version != "" {
+		cacheKey += "@" + version
+	}
+	if frame > 0 {
+		cacheKey += "#" + queryFrame + strconv.Itoa(frame)
+	}
+	return cacheKey
+}
+
+// MemoryOriginalCache is an OriginalCache holding up to maxBytes of decoded pixels, each original for up to ttl
+// the least recently used originals are dropped first once it is full
+type MemoryOriginalCache struct {
+	maxBytes int64
+	ttl      time.Duration
+	now      func() time.Time
+
+	mu    sync.Mutex
+	bytes int64
+	// most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type cachedOriginal struct {
+	key     string
+	img     image.Image
+	format  string
+	bytes   int64
+	expires time.Time
+}
+
+func NewMemoryOriginalCache(maxBytes int64, ttl time.Duration) *MemoryOriginalCache {
+	return &MemoryOriginalCache{
+		maxBytes: maxBytes,
+		ttl:      ttl,
+		now:      time.Now,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *MemoryOriginalCache) Get(key string) (image.Image, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return nil, "", false
+	}
+	co := e.Value.(*cachedOriginal)
+	if !c.now().Before(co.expires) {
+		c.remove(e)
+		c.evictions.Add(1)
+		c.misses.Add(1)
+		return nil, "", false
+	}
+	c.lru.MoveToFront(e)
+	c.hits.Add(1)
+	return co.img, co.format, true
+}
+
+func (c *MemoryOriginalCache) Add(key string, img image.Image, format string) {
+	size := imageBytes(img)
+	if size > c.maxBytes {
+		// it would push out everything else and still not fit
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+	c.entries[key] = c.lru.PushFront(&cachedOriginal{key: key, img: img, format: format, bytes: size, expires: c.now().Add(c.ttl)})
+	c.bytes += size
+	for c.bytes > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.evictions.Add(1)
+	}
+}
+
+// Stats counts the lookups that found their original and the ones that didn't since startup
+func (c *MemoryOriginalCache) Stats() storage.CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return storage.CacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Entries:   len(c.entries),
+		Bytes:     c.bytes,
+	}
+}
+
+func (c *MemoryOriginalCache) remove(e *list.Element) {
+	co := c.lru.Remove(e).(*cachedOriginal)
+	delete(c.entries, co.key)
+	c.bytes -= co.bytes
+}
+
+// imageBytes is the memory taken by the pixels of img
+func imageBytes(img image.Image) int64 {
+	switch img := img.(type) {
+	case *image.RGBA:
+		return int64(len(img.Pix))
+	case *image.NRGBA:
+		return int64(len(img.Pix))
+	case *image.RGBA64:
+		return int64(len(img.Pix))
+	case *image.NRGBA64:
+		return int64(len(img.Pix))
+	case *image.Gray:
+		return int64(len(img.Pix))
+	case *image.Gray16:
+		return int64(len(img.Pix))
+	case *image.Paletted:
+		return int64(len(img.Pix))
+	case *image.YCbCr:
+		return int64(len(img.Y) + len(img.Cb) + len(img.Cr))
+	case *image.CMYK:
+		return int64(len(img.Pix))
+	}
+	size := img.Bounds().Size()
+	return int64(size.X) * int64(size.Y) * 4
+}
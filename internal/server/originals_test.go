@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestMemoryOriginalCache(t *testing.T) {
+	// 10 x 10 RGBA images take 400 bytes each
+	newImage := func() image.Image {
+		return image.NewRGBA(image.Rect(0, 0, 10, 10))
+	}
+
+	t.Run("least recently used is dropped first", func(t *testing.T) {
+		c := NewMemoryOriginalCache(800, time.Minute)
+		c.Add("a", newImage(), "png")
+		c.Add("b", newImage(), "png")
+		_, _, ok := c.Get("a")
+		assertEqual(t, ok, true)
+		c.Add("c", newImage(), "png")
+
+		_, _, ok = c.Get("b")
+		assertEqual(t, ok, false)
+		_, format, ok := c.Get("a")
+		assertEqual(t, ok, true)
+		assertEqual(t, format, "png")
+		_, _, ok = c.Get("c")
+		assertEqual(t, ok, true)
+
+		stats := c.Stats()
+		assertEqual(t, stats.Hits, int64(3))
+		assertEqual(t, stats.Misses, int64(1))
+		assertEqual(t, stats.Evictions, int64(1))
+		assertEqual(t, stats.Entries, 2)
+		assertEqual(t, stats.Bytes, int64(800))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		c := NewMemoryOriginalCache(800, time.Minute)
+		now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+		c.now = func() time.Time { return now }
+		c.Add("a", newImage(), "png")
+
+		now = now.Add(59 * time.Second)
+		_, _, ok := c.Get("a")
+		assertEqual(t, ok, true)
+		now = now.Add(time.Second)
+		_, _, ok = c.Get("a")
+		assertEqual(t, ok, false)
+		assertEqual(t, c.bytes, int64(0))
+	})
+
+	t.Run("larger than the whole cache", func(t *testing.T) {
+		c := NewMemoryOriginalCache(300, time.Minute)
+		c.Add("a", newImage(), "png")
+		_, _, ok := c.Get("a")
+		assertEqual(t, ok, false)
+	})
+
+	t.Run("added again", func(t *testing.T) {
+		c := NewMemoryOriginalCache(800, time.Minute)
+		c.Add("a", newImage(), "png")
+		c.Add("a", newImage(), "jpeg")
+		assertEqual(t, c.bytes, int64(400))
+		_, format, _ := c.Get("a")
+		assertEqual(t, format, "jpeg")
+	})
+}
+
+func TestOriginalCache(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	originalKey := path.Join(sev.FolderOriginal, "imagePNG.png")
+
+	for _, target := range []string{"/imagePNG.png?w=100", "/imagePNG.png?w=1000&upscale=0"} {
+		t.Run(target, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev, WithOriginalCache(NewMemoryOriginalCache(1<<20, time.Minute)))
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/imagePNG.png?w=50", nil))
+			assertEqual(t, rr.Code, http.StatusSeeOther)
+			assertEqual(t, ssc.execution[exeKeyDownload], true)
+
+			// another size of the same original is resized from the cache, only its existence is checked
+			ssc.execution[exeKeyDownload] = false
+			ssc.keys = nil
+			rr = httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+			assertEqual(t, rr.Code, http.StatusSeeOther)
+			assertEqual(t, ssc.execution[exeKeyDownload], false)
+			assertEqual(t, slices.Contains(ssc.keys, originalKey), true)
+		})
+	}
+}
+
+func TestOriginalCacheReplacedOriginal(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		VersionedKeys:  true,
+	}
+	originalKey := path.Join(sev.FolderOriginal, "imagePNG.png")
+	ssc := newStubStorageClient(sev)
+	ss := New(slogt.New(t), ssc, sev, WithOriginalCache(NewMemoryOriginalCache(1<<20, time.Minute)))
+
+	// the transparent original at etag1, then replaced under the same key by an opaque red one at etag2
+	red := image.NewRGBA(image.Rect(0, 0, 300, 300))
+	draw.Draw(red, red.Bounds(), image.NewUniform(color.RGBA{R: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	var b bytes.Buffer
+	if err := png.Encode(&b, red); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []struct {
+		etag string
+		data []byte
+		want color.Color
+	}{{"etag1", ssc.storage[originalKey].data, color.RGBA{}}, {"etag2", b.Bytes(), color.RGBA{R: 0xff, A: 0xff}}} {
+		original := ssc.storage[originalKey]
+		original.data, original.version = version.data, version.etag
+		ssc.storage[originalKey] = original
+
+		rr := httptest.NewRecorder()
+		ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/imagePNG.png?w=100", nil))
+		assertEqual(t, rr.Code, http.StatusSeeOther)
+		key := strings.TrimPrefix(rr.Header().Get("Location"), ssc.ObjectURL("")+"/")
+		img, err := png.Decode(bytes.NewReader(ssc.storage[key].data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, color.RGBAModel.Convert(img.At(50, 50)), version.want)
+	}
+}
+
+// BenchmarkOriginalCache resizes a 2000 x 2000 jpeg original to a new width on every iteration
+func BenchmarkOriginalCache(b *testing.B) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("cached=%t", cached), func(b *testing.B) {
+			ssc := newStubStorageClient(sev)
+			ssc.storage[path.Join(sev.FolderOriginal, "large.jpeg")] = newStubObject("jpeg", 2000, 2000)
+			var opts []Option
+			if cached {
+				opts = append(opts, WithOriginalCache(NewMemoryOriginalCache(64<<20, time.Minute)))
+			}
+			ss := New(slogt.New(b), ssc, sev, opts...)
+
+			for i := range b.N {
+				rr := httptest.NewRecorder()
+				ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/large.jpeg?w=%d", 100+i%1000), nil))
+				if rr.Code != http.StatusSeeOther {
+					b.Fatalf("got status %d", rr.Code)
+				}
+			}
+		})
+	}
+}
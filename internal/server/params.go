@@ -0,0 +1,596 @@
+package server
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	queryWidth        = "w"
+	queryHeight       = "h"
+	queryFormat       = "fm"
+	queryFallback     = "fallback_format"
+	queryWebPQuality  = "webp_quality"
+	queryWebPLossless = "webp_lossless"
+	queryICOSizes     = "sizes"
+	queryMaxBytes     = "max_bytes"
+	querySubsample    = "subsample"
+	queryOptimizePNG  = "optimize_png"
+	queryICC          = "icc"
+	queryUpscale      = "upscale"
+	queryPad          = "pad"
+	queryBackground   = "bg"
+	queryWatermark    = "watermark"
+	queryWmPosition   = "wm_pos"
+	queryWmOpacity    = "wm_opacity"
+	queryText         = "text"
+	queryTextPosition = "text_pos"
+	queryTextSize     = "text_size"
+	queryTextColor    = "text_color"
+	queryFrame        = "frame"
+	queryScale        = "scale"
+)
+
+// maxScale bounds ?scale, whose outputs are still bounded by the max dimension once the original is read
+const maxScale = 8
+
+// params are the transforms requested in the query of an image request
+type params struct {
+	width  int
+	height int
+	// keep the output from getting larger than the original, see withinBounds
+	noUpscale bool
+
+	// format the variant is encoded in, named by fm or else by the extension of the original,
+	// whatever format the original turns out to be decoded from, "" until fm=auto picks it
+	outputFormat string
+	// pick the smallest output among the configured candidate formats
+	auto bool
+	// extension of the resized key
+	resizedExt string
+	encode     encodeOptions
+	// names the encode options in the resized key, like "q80", dropped along with them by fallback
+	encodeTransform string
+
+	// produced instead of outputFormat when it can't be encoded
+	fallbackFormat string
+	// outputFormat is already the fallback since the requested format isn't supported
+	fellBack bool
+
+	// fit the image within width x height and fill the rest with background
+	pad        bool
+	background color.NRGBA
+
+	// overlay the configured watermark image
+	watermark        bool
+	watermarkPos     string
+	watermarkOpacity float64
+
+	// burn a caption onto the image
+	text         string
+	textPosition string
+	textSize     int
+	textColor    color.NRGBA
+
+	// frame of an animated gif resized instead of its first one, see decodeFrame
+	frame int
+
+	// crop the borders of the original in a uniform color before anything else, see trimmed
+	trim          bool
+	trimTolerance int
+
+	// enlarge the original by this integer factor with nearest neighbor resampling, 0 or 1 for none
+	scale int
+
+	// filters of the resize, named in the resized key by resampleTransform when a dimension is requested
+	resampling        resampling
+	resampleTransform string
+
+	// every transform other than the dimensions and the encode options, named as in the resized key
+	transforms []string
+}
+
+// requested tells whether anything but the original image was asked for
+func (p params) requested(imageFormat string) bool {
+	return p.width != 0 || p.height != 0 || p.resizedExt != imageFormat || len(p.keyTransforms()) != 0
+}
+
+// keyTransforms names every transform in the resized key, encode options first and the filters last
+func (p params) keyTransforms() []string {
+	transforms := p.transforms
+	if p.encodeTransform != "" {
+		transforms = append([]string{p.encodeTransform}, transforms...)
+	}
+	if p.resampleTransform != "" {
+		transforms = append(slices.Clip(transforms), p.resampleTransform)
+	}
+	return transforms
+}
+
+// withOutputFormat switches the output to format, variants in the format of the original keep its extension
+func (p params) withOutputFormat(format string, imageFormat string) params {
+	p.outputFormat = format
+	p.resizedExt = imageFormat
+	if format != formatFromExtension(imageFormat) {
+		p.resizedExt = format
+	}
+	return p
+}
+
+// fallback switches the output to the fallback format, keyed by the format actually produced
+func (p params) fallback(imageFormat string) params {
+	p = p.withOutputFormat(p.fallbackFormat, imageFormat)
+	p.fallbackFormat = ""
+	p.fellBack = true
+	p.encode = encodeOptions{}
+	p.encodeTransform = ""
+	return p
+}
+
+// parseDimension reads the value of the w or h query param named key, an integer of 0 or more
+// the error names the param and its value, since 100.5 or -1 look like dimensions at first sight
+func parseDimension(key string, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", key, value)
+	}
+	return n, nil
+}
+
+// formatAllowed tells whether format is among allowedFormats, which allows every format when empty
+func formatAllowed(allowedFormats []string, format string) bool {
+	return len(allowedFormats) == 0 || slices.Contains(allowedFormats, format)
+}
+
+// parseParams reads the query of a request for the image with extension imageFormat
+// the returned error is meant to be sent back to the client with 400 Bad Request
+//
+// outputs are limited to allowedFormats and w and h to maxDimension, 0 for no limit, see envvar.EnvVar,
+// resized with the filters of defaults unless ?m overrides them, and encoded with the qualities ?quality names in qualities
+func parseParams(q url.Values, imageFormat string, allowedFormats []string, maxDimension int, defaults resampling, qualities qualityConfig) (params, error) {
+	var p params
+
+	// check query params: w & h
+	// 0 stands for an omitted dimension, like the batch items do: w=0&h=300 keeps the aspect ratio,
+	// and w=0&h=0 keeps the size of the original
+	if q.Has(queryWidth) {
+		width, err := parseDimension(queryWidth, q.Get(queryWidth))
+		if err != nil {
+			return p, err
+		}
+		p.width = width
+	}
+	if q.Has(queryHeight) {
+		height, err := parseDimension(queryHeight, q.Get(queryHeight))
+		if err != nil {
+			return p, err
+		}
+		p.height = height
+	}
+
+	// check query param: dpr
+	// w and h are scaled by the pixel ratio of the screen, so the key names the size actually produced
+	// and w=200 shares its variant with w=100&dpr=2
+	if q.Has(queryDPR) {
+		dpr, err := parseDPR(q.Get(queryDPR))
+		if err != nil {
+			return p, err
+		}
+		p.width = int(math.Round(float64(p.width) * dpr))
+		p.height = int(math.Round(float64(p.height) * dpr))
+	}
+
+	// rejected before anything is downloaded or allocated for it
+	if maxDimension > 0 && p.width > maxDimension {
+		return p, fmt.Errorf("w must be at most %d", maxDimension)
+	}
+	if maxDimension > 0 && p.height > maxDimension {
+		return p, fmt.Errorf("h must be at most %d", maxDimension)
+	}
+
+	// check query param: upscale
+	if q.Has(queryUpscale) {
+		upscale, err := strconv.ParseBool(q.Get(queryUpscale))
+		if err != nil {
+			return p, errors.New("upscale must be a boolean")
+		}
+		p.noUpscale = !upscale
+	}
+
+	// check query params: trim & trim_tolerance
+	// the size of the trimmed original is only known once decoded, too late to resolve upscale=0 into the key
+	trim, tolerance, err := parseTrim(q)
+	if err != nil {
+		return p, err
+	}
+	if trim {
+		if p.noUpscale {
+			return p, errors.New("trim can't be combined with upscale=0")
+		}
+		p.trim, p.trimTolerance = true, tolerance
+		p.transforms = append(p.transforms, trimTransform(tolerance))
+	}
+
+	// check query param: scale
+	// the size of the output is only known from the original, so its key names the factor like "w0h0-scale2"
+	if q.Has(queryScale) {
+		scale, err := strconv.Atoi(q.Get(queryScale))
+		if err != nil || scale < 1 || scale > maxScale {
+			return p, fmt.Errorf("scale must be an integer between 1 and %d, got %q", maxScale, q.Get(queryScale))
+		}
+		if p.width != 0 || p.height != 0 || p.noUpscale {
+			return p, errors.New("scale can't be combined with w, h or upscale=0")
+		}
+		if scale > 1 {
+			p.scale = scale
+			p.transforms = append(p.transforms, queryScale+strconv.Itoa(scale))
+		}
+	}
+
+	// check query param: m
+	// a request keeping the size of the original resizes nothing, so its key doesn't name the filters
+	p.resampling = defaults
+	if q.Has(queryResampling) {
+		rs, err := parseResampling(q.Get(queryResampling))
+		if err != nil {
+			return p, err
+		}
+		p.resampling = rs
+	}
+	if p.width != 0 || p.height != 0 {
+		p.resampleTransform = p.resampling.transform()
+	}
+
+	// check query param: fm
+	// without it the output keeps the format the extension of the original names
+	sourceFormat := formatFromExtension(imageFormat)
+	if q.Get(queryFormat) == formatAuto {
+		// the extension is only known once the smallest candidate is picked
+		p.auto = true
+		p.transforms = append(p.transforms, formatAuto)
+	} else if q.Has(queryFormat) {
+		p.outputFormat = formatFromExtension(q.Get(queryFormat))
+		if inputOnly(p.outputFormat) || p.outputFormat == "" && slices.Contains(otherImageFormats, strings.ToLower(q.Get(queryFormat))) {
+			return p, errOutputUnsupported(q.Get(queryFormat))
+		}
+		if p.outputFormat == "" {
+			return p, errors.New("fm must be one of jpeg, jpg, png, webp, ico or auto")
+		}
+		if !formatAllowed(allowedFormats, p.outputFormat) {
+			return p, fmt.Errorf("fm=%s is not allowed on this server", q.Get(queryFormat))
+		}
+	} else if inputOnly(sourceFormat) || !formatAllowed(allowedFormats, sourceFormat) {
+		// originals in a format that isn't allowed, or that can't be an output like heif, are converted,
+		// into the first allowed one this server can encode, jpeg when every format is allowed
+		// or png for gifs, whose transparency jpeg would lose
+		candidates := allowedFormats
+		if len(candidates) == 0 {
+			candidates = []string{formatJPEG}
+			if sourceFormat == formatGIF {
+				candidates = []string{formatPNG}
+			}
+		}
+		for _, format := range candidates {
+			if outputSupported(format) {
+				p.outputFormat = format
+				break
+			}
+		}
+		if p.outputFormat == "" {
+			return p, errors.New("none of the allowed formats is supported by this server")
+		}
+	} else {
+		p.outputFormat = sourceFormat
+	}
+	// variants in the format of the original share their key with the ones requested without fm
+	p.resizedExt = imageFormat
+	if !p.auto && p.outputFormat != sourceFormat {
+		p.resizedExt = p.outputFormat
+	}
+
+	// check query param: frame
+	// 0 is the first frame, which every original has and which is resized by default
+	if q.Has(queryFrame) {
+		frame, err := strconv.Atoi(q.Get(queryFrame))
+		if err != nil || frame < 0 {
+			return p, fmt.Errorf("frame must be a non-negative integer, got %q", q.Get(queryFrame))
+		}
+		if frame > 0 && sourceFormat != formatGIF {
+			return p, errors.New("frame is out of range, only gif originals have more than one frame")
+		}
+		p.frame = frame
+		if frame > 0 {
+			p.transforms = append(p.transforms, "frame"+strconv.Itoa(frame))
+		}
+	}
+
+	// check query param: fallback_format
+	if q.Has(queryFallback) {
+		if p.auto {
+			return p, errors.New("fallback_format can't be combined with fm=auto")
+		}
+		if !q.Has(queryFormat) {
+			return p, errors.New("fallback_format requires fm")
+		}
+		p.fallbackFormat = formatFromExtension(q.Get(queryFallback))
+		if p.fallbackFormat == "" || inputOnly(p.fallbackFormat) || !outputSupported(p.fallbackFormat) {
+			return p, errors.New("fallback_format must be one of jpeg, jpg, png or ico, or webp when the server supports it")
+		}
+		if !formatAllowed(allowedFormats, p.fallbackFormat) {
+			return p, fmt.Errorf("fallback_format=%s is not allowed on this server", q.Get(queryFallback))
+		}
+	}
+
+	// check query params: webp_quality & webp_lossless
+	p.encode.webpQuality = defaultWebPQuality
+	if q.Has(queryWebPQuality) || q.Has(queryWebPLossless) {
+		if p.outputFormat != formatWebP {
+			return p, errors.New("webp_quality and webp_lossless require fm=webp")
+		}
+		if q.Has(queryWebPLossless) {
+			lossless, err := strconv.ParseBool(q.Get(queryWebPLossless))
+			if err != nil {
+				return p, errors.New("webp_lossless must be a boolean")
+			}
+			p.encode.webpLossless = lossless
+		}
+		if q.Has(queryWebPQuality) {
+			if p.encode.webpLossless {
+				return p, errors.New("webp_quality can't be combined with webp_lossless")
+			}
+			quality, err := strconv.Atoi(q.Get(queryWebPQuality))
+			if err != nil || quality < 0 || quality > 100 {
+				return p, errors.New("webp_quality must be an integer between 0 and 100")
+			}
+			p.encode.webpQuality = quality
+		}
+		if p.encode.webpLossless {
+			p.encodeTransform = "lossless"
+		} else if p.encode.webpQuality != defaultWebPQuality {
+			p.encodeTransform = "q" + strconv.Itoa(p.encode.webpQuality)
+		}
+	}
+
+	// check query param: sizes
+	if q.Has(queryICOSizes) {
+		if p.outputFormat != formatICO {
+			return p, errors.New("sizes requires fm=ico")
+		}
+		sizes, err := parseICOSizes(q.Get(queryICOSizes))
+		if err != nil {
+			return p, err
+		}
+		if !slices.Equal(sizes, defaultICOSizes) {
+			p.encode.icoSizes = sizes
+			var names []string
+			for _, size := range sizes {
+				names = append(names, strconv.Itoa(size))
+			}
+			p.encodeTransform = "sizes" + strings.Join(names, "_")
+		}
+	}
+
+	if !p.auto && !outputSupported(p.outputFormat) {
+		if p.fallbackFormat == "" {
+			return p, errOutputUnsupported(q.Get(queryFormat))
+		}
+		p = p.fallback(imageFormat)
+	}
+	effectiveFormat := p.outputFormat
+	if p.auto {
+		// any candidate may turn out to be jpeg
+		effectiveFormat = formatJPEG
+	}
+
+	// check query param: quality
+	// a label and the number it maps to share their variant, since the key names the number
+	if q.Has(queryQuality) {
+		if p.auto || effectiveFormat != formatJPEG && effectiveFormat != formatWebP || p.encode.webpLossless {
+			return p, errors.New("quality requires a jpeg or lossy webp output")
+		}
+		if q.Has(queryWebPQuality) || q.Has(queryMaxBytes) {
+			return p, errors.New("quality can't be combined with webp_quality or max_bytes")
+		}
+		if q.Get(queryQuality) == qualityAuto {
+			p.encode.autoSSIM = qualities.autoSSIM
+			p.encodeTransform = qualities.autoTransform()
+		} else {
+			quality, err := qualities.parseQuality(q.Get(queryQuality), effectiveFormat)
+			if err != nil {
+				return p, err
+			}
+			p.encode = p.encode.withQuality(effectiveFormat, quality)
+			if quality != defaultQuality(effectiveFormat) {
+				p.encodeTransform = "q" + strconv.Itoa(quality)
+			}
+		}
+	}
+
+	// check query param: max_bytes
+	// checked after the fallback was resolved, since only lossy formats have a quality to lower
+	if q.Has(queryMaxBytes) {
+		if p.auto || effectiveFormat != formatJPEG && effectiveFormat != formatWebP || p.encode.webpLossless {
+			return p, errors.New("max_bytes requires a jpeg or lossy webp output")
+		}
+		if q.Has(queryWebPQuality) {
+			return p, errors.New("max_bytes can't be combined with webp_quality")
+		}
+		maxBytes, err := strconv.Atoi(q.Get(queryMaxBytes))
+		if err != nil || maxBytes <= 0 {
+			return p, errors.New("max_bytes must be an integer larger than 0")
+		}
+		p.encode.maxBytes = maxBytes
+		p.encodeTransform = "max" + strconv.Itoa(maxBytes)
+	}
+
+	// check query param: subsample
+	// image/jpeg always encodes colors with 4:2:0 chroma subsampling and has no option for it,
+	// so 420 is the default it already is, keyed like no subsample at all, and 444 is refused rather than ignored
+	if q.Has(querySubsample) {
+		if p.auto || effectiveFormat != formatJPEG {
+			return p, errors.New("subsample requires a jpeg output")
+		}
+		switch q.Get(querySubsample) {
+		case "420":
+		case "444":
+			return p, errors.New("subsample=444 is not supported by this server, jpeg is always encoded with 4:2:0 chroma subsampling")
+		default:
+			return p, errors.New("subsample must be 420 or 444")
+		}
+	}
+
+	// check query param: optimize_png
+	if q.Has(queryOptimizePNG) {
+		optimize, err := strconv.ParseBool(q.Get(queryOptimizePNG))
+		if err != nil {
+			return p, errors.New("optimize_png must be a boolean")
+		}
+		if optimize {
+			if p.auto || effectiveFormat != formatPNG {
+				return p, errors.New("optimize_png requires a png output")
+			}
+			p.encode.optimizePNG = true
+			p.encodeTransform = "opt"
+		}
+	}
+
+	// check query param: icc
+	// named among the transforms rather than the encode options, which hold a single one in the key
+	if q.Has(queryICC) {
+		if q.Get(queryICC) != iccSRGB {
+			return p, errors.New("icc must be srgb")
+		}
+		if p.auto || effectiveFormat != formatJPEG && effectiveFormat != formatPNG {
+			return p, errors.New("icc requires a jpeg or png output")
+		}
+		if p.fallbackFormat != "" {
+			// the fallback drops the encode options of the format given up on
+			return p, errors.New("icc can't be combined with fallback_format")
+		}
+		p.encode.icc = iccSRGB
+		p.transforms = append(p.transforms, "icc_"+iccSRGB)
+	}
+
+	// check query params: pad & bg
+	if q.Has(queryPad) {
+		pad, err := strconv.ParseBool(q.Get(queryPad))
+		if err != nil {
+			return p, errors.New("pad must be a boolean")
+		}
+		p.pad = pad
+	}
+	if p.pad {
+		if p.width == 0 || p.height == 0 {
+			return p, errors.New("pad requires both w and h")
+		}
+		// jpeg has no alpha channel, so it is padded with white unless told otherwise
+		p.background = color.NRGBA{}
+		if effectiveFormat == formatJPEG {
+			p.background = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+		}
+		if q.Has(queryBackground) {
+			bg, err := parseHexColor(queryBackground, q.Get(queryBackground))
+			if err != nil {
+				return p, err
+			}
+			p.background = bg
+		}
+		p.transforms = append(p.transforms, "pad"+hexColor(p.background))
+	} else if q.Has(queryBackground) {
+		return p, errors.New("bg requires pad=1")
+	}
+
+	// check query params: watermark, wm_pos & wm_opacity
+	if q.Has(queryWatermark) {
+		watermark, err := strconv.ParseBool(q.Get(queryWatermark))
+		if err != nil {
+			return p, errors.New("watermark must be a boolean")
+		}
+		p.watermark = watermark
+	}
+	if p.watermark {
+		p.watermarkPos = defaultWatermarkPosition
+		if q.Has(queryWmPosition) {
+			p.watermarkPos = q.Get(queryWmPosition)
+			if _, ok := overlayPositions[p.watermarkPos]; !ok {
+				return p, errors.New("wm_pos must be one of center, north, south, east, west, northeast, northwest, southeast or southwest")
+			}
+		}
+		p.watermarkOpacity = 1
+		if q.Has(queryWmOpacity) {
+			opacity, err := strconv.ParseFloat(q.Get(queryWmOpacity), 64)
+			if err != nil || opacity < 0 || opacity > 1 {
+				return p, errors.New("wm_opacity must be a number between 0 and 1")
+			}
+			p.watermarkOpacity = opacity
+		}
+		p.transforms = append(p.transforms, fmt.Sprintf("wm_%s_%d", p.watermarkPos, int(p.watermarkOpacity*100+0.5)))
+	} else if q.Has(queryWmPosition) || q.Has(queryWmOpacity) {
+		return p, errors.New("wm_pos and wm_opacity require watermark=1")
+	}
+
+	// check query params: text, text_pos, text_size & text_color
+	if q.Has(queryText) {
+		text, err := sanitizeText(q.Get(queryText))
+		if err != nil {
+			return p, err
+		}
+		p.text = text
+		p.textPosition = defaultTextPosition
+		if q.Has(queryTextPosition) {
+			p.textPosition = q.Get(queryTextPosition)
+			if _, ok := overlayPositions[p.textPosition]; !ok {
+				return p, errors.New("text_pos must be one of center, north, south, east, west, northeast, northwest, southeast or southwest")
+			}
+		}
+		p.textSize = defaultTextSize
+		if q.Has(queryTextSize) {
+			size, err := strconv.Atoi(q.Get(queryTextSize))
+			if err != nil || size < 1 || size > maxTextSize {
+				return p, errors.New("text_size must be an integer between 1 and 8")
+			}
+			p.textSize = size
+		}
+		p.textColor = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+		if q.Has(queryTextColor) {
+			c, err := parseHexColor(queryTextColor, q.Get(queryTextColor))
+			if err != nil {
+				return p, err
+			}
+			p.textColor = c
+		}
+		p.transforms = append(p.transforms, fmt.Sprintf("text_%s_%s_%d_%s", textHash(p.text), p.textPosition, p.textSize, hexColor(p.textColor)))
+	} else if q.Has(queryTextPosition) || q.Has(queryTextSize) || q.Has(queryTextColor) {
+		return p, errors.New("text_pos, text_size and text_color require text")
+	}
+
+	return p, nil
+}
+
+func hexColor(c color.NRGBA) string {
+	return fmt.Sprintf("%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// parseHexColor reads colors like "ff8800" or, with alpha, "ff880080" from the query param named key
+func parseHexColor(key string, s string) (color.NRGBA, error) {
+	errInvalid := fmt.Errorf("%s must be a hex color like ffffff or ffffff80", key)
+	if len(s) != 6 && len(s) != 8 {
+		return color.NRGBA{}, errInvalid
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return color.NRGBA{}, errInvalid
+	}
+	c := color.NRGBA{R: b[0], G: b[1], B: b[2], A: 0xff}
+	if len(b) == 4 {
+		c.A = b[3]
+	}
+	return c, nil
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+// transformParams are the params of an image request that change its output, refused on passed through originals
+var transformParams = slices.DeleteFunc(slices.Clone(imageParams), func(key string) bool {
+	return key == queryDownload
+})
+
+// servePassthrough answers the original at imagePath, in one of envvar.EnvVar.PassthroughExtensions like svg or pdf, as it is,
+// redirecting to it or serving it like any other original, but never resizing or converting it
+func servePassthrough(w http.ResponseWriter, r *http.Request, logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, imagePath string, ext string) {
+	q := r.URL.Query()
+	var transforms []string
+	for key := range q {
+		if slices.Contains(transformParams, key) {
+			transforms = append(transforms, key)
+		}
+	}
+	if len(transforms) > 0 {
+		slices.Sort(transforms)
+		http.Error(w, strings.ToLower(ext)+" originals are answered as they are, without "+strings.Join(transforms, ", "), http.StatusBadRequest)
+		return
+	}
+
+	key := originalKey(envVar.FolderOriginal, imagePath)
+	metadata, _, err := storageClient.ObjectMetadata(r.Context(), key)
+	if err != nil {
+		if se := storageStatus(err); se != nil {
+			http.Error(w, se.message, se.code)
+			return
+		}
+		logger.ErrorContext(r.Context(), "checking original", "key", key, "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	cacheControl, _ := imageCacheControls(r.Context(), logger, envVar, key, metadata)
+
+	filename := downloadFilename(q, imagePath)
+	if envVar.ServeMode != envvar.ServeModeInline && filename == "" {
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		http.Redirect(w, r, storageClient.ObjectURL(key), redirectStatus(envVar))
+		return
+	}
+	// svg may carry scripts, which must not run on the origin of this server
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	serveObject(w, r, logger, storageClient, key, cacheControl, filename, "")
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestPassthrough(t *testing.T) {
+	const svg = `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><rect width="10" height="10"/></svg>`
+
+	tt := []struct {
+		testName    string
+		target      string
+		serveMode   string
+		passthrough []string
+		// desired response status code, body, and Location or Content-Type header
+		statusCode  int
+		body        string
+		location    string
+		contentType string
+	}{
+		{
+			testName:    "redirect to the svg",
+			target:      "/logo.svg",
+			passthrough: []string{"svg"},
+			statusCode:  http.StatusSeeOther,
+			location:    "logo.svg",
+		},
+		{
+			testName:    "extension in another case",
+			target:      "/LOGO.SVG",
+			passthrough: []string{"svg"},
+			statusCode:  http.StatusSeeOther,
+			location:    "LOGO.SVG",
+		},
+		{
+			testName:    "serve the svg",
+			target:      "/logo.svg",
+			serveMode:   envvar.ServeModeInline,
+			passthrough: []string{"svg"},
+			statusCode:  http.StatusOK,
+			body:        svg,
+			contentType: "image/svg+xml",
+		},
+		{
+			testName:    "download the svg",
+			target:      "/logo.svg?download=1",
+			passthrough: []string{"svg"},
+			statusCode:  http.StatusOK,
+			body:        svg,
+			contentType: "image/svg+xml",
+		},
+		{
+			testName:    "resize params",
+			target:      "/logo.svg?w=100&fm=png",
+			passthrough: []string{"svg"},
+			statusCode:  http.StatusBadRequest,
+			body:        "svg originals are answered as they are, without fm, w",
+		},
+		{
+			testName:    "missing original",
+			target:      "/missing.svg",
+			passthrough: []string{"svg"},
+			statusCode:  http.StatusNotFound,
+			body:        http.StatusText(http.StatusNotFound),
+		},
+		{
+			testName:   "extension not passed through",
+			target:     "/logo.svg",
+			statusCode: http.StatusBadRequest,
+			body:       errStrInvalidImagePath,
+		},
+		{
+			testName:    "raster originals are still resized",
+			target:      "/imagePNG.png?w=100",
+			passthrough: []string{"svg"},
+			statusCode:  http.StatusSeeOther,
+			location:    path.Join("stub-resized-folder", "imagePNG.png", "w100h0.png"),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:            "stub-bucket",
+				FolderOriginal:        "stub-original-folder",
+				FolderResized:         "stub-resized-folder",
+				ServeMode:             tc.serveMode,
+				PassthroughExtensions: tc.passthrough,
+			}
+			ssc := newStubStorageClient(sev)
+			for _, name := range []string{"logo.svg", "LOGO.SVG"} {
+				ssc.storage[path.Join(sev.FolderOriginal, name)] = stubObject{data: []byte(svg), contentType: "binary/octet-stream"}
+			}
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+			}
+			if tc.location != "" {
+				key := tc.location
+				if !strings.HasPrefix(key, sev.FolderResized) {
+					key = path.Join(sev.FolderOriginal, key)
+				}
+				assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(key))
+			}
+			if tc.contentType != "" {
+				assertEqual(t, rr.Header().Get("Content-Type"), tc.contentType)
+				assertEqual(t, rr.Header().Get("Content-Security-Policy"), "sandbox")
+			}
+		})
+	}
+}
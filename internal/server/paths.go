@@ -0,0 +1,51 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+// cleanPaths answers the requests whose path isn't clean, like "//photo.jpg", "/photo.jpg/" or "/./photo.jpg",
+// as mode says, before they are routed
+//
+// a clean path has no repeated slash, no trailing slash but the one of "/", and no "." or ".." segment,
+// which the routes would otherwise answer with 404 or a redirect depending on where the slashes are
+func cleanPaths(mode string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clean := cleanPath(r.URL.Path)
+		if clean == r.URL.Path {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		u := new(url.URL)
+		*u = *r.URL
+		u.Path = clean
+		if u.RawPath != "" {
+			u.RawPath = cleanPath(u.RawPath)
+		}
+		switch mode {
+		case envvar.MalformedPathsReject:
+			http.Error(w, fmt.Sprintf("malformed path %q, request %q instead", r.URL.Path, clean), http.StatusBadRequest)
+		case envvar.MalformedPathsRedirect:
+			http.Redirect(w, r, u.RequestURI(), http.StatusMovedPermanently)
+		default:
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = u
+			next.ServeHTTP(w, r2)
+		}
+	})
+}
+
+// cleanPath is p with its repeated and trailing slashes and its dot segments resolved, "/" when nothing is left
+func cleanPath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return path.Clean(p)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestCleanPaths(t *testing.T) {
+	original := "https://test.test/" + path.Join("stub-bucket", "stub-original-folder", "imageJPEG.jpeg")
+	tt := []struct {
+		testName string
+		mode     string
+		target   string
+		// desired response status code, and Location or start of the body
+		statusCode int
+		location   string
+		body       string
+	}{
+		{testName: "clean", target: "/imageJPEG.jpeg", statusCode: http.StatusSeeOther, location: original},
+		{testName: "leading double slash", target: "//imageJPEG.jpeg", statusCode: http.StatusSeeOther, location: original},
+		{testName: "trailing slash", target: "/imageJPEG.jpeg/", statusCode: http.StatusSeeOther, location: original},
+		{testName: "trailing double slash", target: "/imageJPEG.jpeg//", statusCode: http.StatusSeeOther, location: original},
+		{testName: "dot segment", target: "/./imageJPEG.jpeg", statusCode: http.StatusSeeOther, location: original},
+		{testName: "double slash before a route", target: "/imageJPEG.jpeg//variants", statusCode: http.StatusOK, body: `{"variants":[{"key":"stub-resized-folder/imageJPEG.jpeg/`},
+		{testName: "root", target: "//", statusCode: http.StatusOK, body: usage},
+		{testName: "redirected", mode: envvar.MalformedPathsRedirect, target: "//imageJPEG.jpeg/?w=100", statusCode: http.StatusMovedPermanently, location: "/imageJPEG.jpeg?w=100"},
+		{testName: "clean path not redirected", mode: envvar.MalformedPathsRedirect, target: "/imageJPEG.jpeg", statusCode: http.StatusSeeOther, location: original},
+		{testName: "rejected", mode: envvar.MalformedPathsReject, target: "/imageJPEG.jpeg/", statusCode: http.StatusBadRequest, body: `malformed path "/imageJPEG.jpeg/", request "/imageJPEG.jpeg" instead`},
+		{testName: "rejected double slash", mode: envvar.MalformedPathsReject, target: "/a//imageJPEG.jpeg", statusCode: http.StatusBadRequest, body: `malformed path "/a//imageJPEG.jpeg", request "/a/imageJPEG.jpeg" instead`},
+		{testName: "clean path not rejected", mode: envvar.MalformedPathsReject, target: "/imageJPEG.jpeg", statusCode: http.StatusSeeOther, location: original},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				MalformedPaths: tc.mode,
+			}
+			ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.location != "" {
+				assertEqual(t, rr.Header().Get("Location"), tc.location)
+			}
+			if tc.body != "" {
+				assertEqual(t, strings.HasPrefix(rr.Body.String(), tc.body), true)
+			}
+		})
+	}
+}
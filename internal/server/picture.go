@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+const (
+	queryPictureFormats = "formats"
+	queryPictureSizes   = "sizes"
+	queryPictureAlt     = "alt"
+
+	maxPictureFormats = 4
+	// of sizes and alt
+	maxPictureAttr = 512
+)
+
+// pictureTemplate lists a <source> per format, the <img> of browsers supporting none of them showing the last one
+var pictureTemplate = template.Must(template.New("picture").Parse(`<picture>
+{{- range .Sources}}
+  <source type="{{.Type}}" srcset="{{.Srcset}}"{{if $.Sizes}} sizes="{{$.Sizes}}"{{end}}>
+{{- end}}
+  <img src="{{.Src}}" srcset="{{.Srcset}}"{{if .Sizes}} sizes="{{.Sizes}}"{{end}} alt="{{.Alt}}">
+</picture>
+`))
+
+type pictureSource struct {
+	Type   string
+	Srcset string
+	// the URL of its largest width
+	Src string
+}
+
+type picture struct {
+	Sources []pictureSource
+	Src     string
+	Srcset  string
+	Sizes   string
+	Alt     string
+}
+
+// parsePictureFormats reads a comma separated list of output formats, deduplicated in the order they are listed
+func parsePictureFormats(value string) ([]string, error) {
+	errInvalid := fmt.Errorf("formats must be a comma separated list of up to %d of jpeg, jpg, png, webp or ico", maxPictureFormats)
+	var formats, seen []string
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		// ?fm=auto only picks its format once it is requested, while a <source> names it
+		format := formatFromExtension(s)
+		if format == "" || inputOnly(format) {
+			return nil, errInvalid
+		}
+		// jpg and jpeg are the same source
+		if !slices.Contains(seen, format) {
+			seen = append(seen, format)
+			formats = append(formats, s)
+		}
+	}
+	if len(formats) > maxPictureFormats {
+		return nil, errInvalid
+	}
+	return formats, nil
+}
+
+// pictureHandler answers with the markup of a <picture> showing the image at every width of ?widths in every format of ?formats,
+// any other query param but sizes and alt, set as attributes, applying to every one of them like it would on GET /{image}
+//
+// like a lazy srcset, the markup points at the image requests of this server, which resize every variant once it is asked for
+// ?preload=1 adds a Link header preloading the first <source>
+func pictureHandler(logger *slog.Logger, envVar *envvar.EnvVar, o options) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// check image path
+		imagePath := r.PathValue(slug)
+		_, imageFormat, ok := parseImageName(imagePath)
+		if !ok {
+			http.Error(w, errStrInvalidImagePath, http.StatusBadRequest)
+			return
+		}
+
+		q := r.URL.Query()
+		widths, err := parseSrcsetWidths(q.Get(querySrcsetWidths))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.Has(queryWidth) || q.Has(queryHeight) || q.Has(queryFormat) || q.Has(queryFallback) {
+			http.Error(w, "widths and formats can't be combined with w, h, fm or fallback_format", http.StatusBadRequest)
+			return
+		}
+		// the format of the image itself by default, ?fm left out
+		formats := []string{""}
+		if q.Has(queryPictureFormats) {
+			formats, err = parsePictureFormats(q.Get(queryPictureFormats))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		pic := picture{Sizes: q.Get(queryPictureSizes), Alt: q.Get(queryPictureAlt)}
+		if len(pic.Sizes) > maxPictureAttr || len(pic.Alt) > maxPictureAttr {
+			http.Error(w, fmt.Sprintf("sizes and alt must be at most %d bytes long", maxPictureAttr), http.StatusBadRequest)
+			return
+		}
+		preload, err := parsePreload(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.Del(querySrcsetWidths)
+		q.Del(queryPreload)
+		q.Del(queryPictureFormats)
+		q.Del(queryPictureSizes)
+		q.Del(queryPictureAlt)
+
+		for _, format := range formats {
+			var source pictureSource
+			candidates := make([]string, 0, len(widths))
+			for _, width := range widths {
+				wq := maps.Clone(q)
+				wq.Set(queryWidth, strconv.Itoa(width))
+				if format != "" {
+					wq.Set(queryFormat, format)
+				}
+				// the same params are checked again when each variant is requested, but an invalid one fails the whole picture now
+				p, err := checkImageQuery(envVar, o, imageFormat, wq)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				source.Type = mimeType(p.outputFormat)
+				source.Src = imageURL(r, imagePath, wq)
+				candidates = append(candidates, source.Src+" "+strconv.Itoa(width)+"w")
+			}
+			source.Srcset = strings.Join(candidates, ", ")
+			pic.Sources = append(pic.Sources, source)
+		}
+		// the <img> shows the last format at the largest width
+		pic.Src = pic.Sources[len(pic.Sources)-1].Src
+		pic.Srcset = pic.Sources[len(pic.Sources)-1].Srcset
+		if preload {
+			// only the first <source>, which browsers supporting its type pick, since a Link per source would have them fetch every type they support,
+			// and browsers that don't support it skip the preload
+			first := pic.Sources[0]
+			w.Header().Add("Link", preloadLink(first.Src, first.Srcset, pic.Sizes, first.Type))
+		}
+
+		var buf bytes.Buffer
+		if err := pictureTemplate.Execute(&buf, pic); err != nil {
+			logger.ErrorContext(r.Context(), "rendering picture markup", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+		w.Write(buf.Bytes())
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+func TestPicture(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// whether it requires webp output
+		webp bool
+		// desired response status code and body
+		statusCode int
+		body       string
+	}{
+		{
+			testName:   "formats and widths",
+			target:     "/imageJPEG.jpeg/picture?widths=640,320&formats=webp,jpg,jpeg&sizes=(max-width:+600px)+100vw,+50vw&alt=A+photo&q=80",
+			webp:       true,
+			statusCode: http.StatusOK,
+			body: `<picture>
+  <source type="image/webp" srcset="/imageJPEG.jpeg?fm=webp&amp;q=80&amp;w=320 320w, /imageJPEG.jpeg?fm=webp&amp;q=80&amp;w=640 640w" sizes="(max-width: 600px) 100vw, 50vw">
+  <source type="image/jpeg" srcset="/imageJPEG.jpeg?fm=jpg&amp;q=80&amp;w=320 320w, /imageJPEG.jpeg?fm=jpg&amp;q=80&amp;w=640 640w" sizes="(max-width: 600px) 100vw, 50vw">
+  <img src="/imageJPEG.jpeg?fm=jpg&amp;q=80&amp;w=640" srcset="/imageJPEG.jpeg?fm=jpg&amp;q=80&amp;w=320 320w, /imageJPEG.jpeg?fm=jpg&amp;q=80&amp;w=640 640w" sizes="(max-width: 600px) 100vw, 50vw" alt="A photo">
+</picture>`,
+		},
+		{
+			testName:   "format of the image by default",
+			target:     "/shard/imagePNG.png/picture?widths=320",
+			statusCode: http.StatusOK,
+			body: `<picture>
+  <source type="image/png" srcset="/shard/imagePNG.png?w=320 320w">
+  <img src="/shard/imagePNG.png?w=320" srcset="/shard/imagePNG.png?w=320 320w" alt="">
+</picture>`,
+		},
+		{
+			testName:   "escaped alt",
+			target:     "/imageJPEG.jpeg/picture?widths=320&alt=%22%3E%3Cscript%3Ealert(1)%3C/script%3E",
+			statusCode: http.StatusOK,
+			body: `<picture>
+  <source type="image/jpeg" srcset="/imageJPEG.jpeg?w=320 320w">
+  <img src="/imageJPEG.jpeg?w=320" srcset="/imageJPEG.jpeg?w=320 320w" alt="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;">
+</picture>`,
+		},
+		{
+			testName:   "missing widths",
+			target:     "/imageJPEG.jpeg/picture?formats=webp",
+			statusCode: http.StatusBadRequest,
+			body:       "widths must be a comma separated list of up to 10 integers between 1 and 4096",
+		},
+		{
+			testName:   "auto format",
+			target:     "/imageJPEG.jpeg/picture?widths=320&formats=auto",
+			statusCode: http.StatusBadRequest,
+			body:       "formats must be a comma separated list of up to 4 of jpeg, jpg, png, webp or ico",
+		},
+		{
+			testName:   "too many formats",
+			target:     "/imageJPEG.jpeg/picture?widths=320&formats=webp,png,jpeg,ico,gif",
+			statusCode: http.StatusBadRequest,
+			body:       "formats must be a comma separated list of up to 4 of jpeg, jpg, png, webp or ico",
+		},
+		{
+			testName:   "widths combined with fm",
+			target:     "/imageJPEG.jpeg/picture?widths=320&fm=png",
+			statusCode: http.StatusBadRequest,
+			body:       "widths and formats can't be combined with w, h, fm or fallback_format",
+		},
+		{
+			testName:   "alt too long",
+			target:     "/imageJPEG.jpeg/picture?widths=320&alt=" + strings.Repeat("a", 513),
+			statusCode: http.StatusBadRequest,
+			body:       "sizes and alt must be at most 512 bytes long",
+		},
+		{
+			testName:   "invalid param",
+			target:     "/imageJPEG.jpeg/picture?widths=320&formats=png&optimize_png=yes",
+			statusCode: http.StatusBadRequest,
+			body:       "optimize_png must be a boolean",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			if tc.webp && !outputSupported(formatWebP) {
+				t.Skip("webp output requires a cgo build")
+			}
+			ssc := newStubStorageClient(sev)
+			shard := newStubStorageClient(&envvar.EnvVar{BucketName: "shard-bucket", FolderOriginal: sev.FolderOriginal, FolderResized: sev.FolderResized})
+			ss := New(slogt.New(t), ssc, sev, WithBuckets(map[string]storage.Client{"shard": shard}))
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+)
+
+// maxPaletteSize is the number of colors a paletted png can hold
+const maxPaletteSize = 256
+
+// encodePNG encodes img as png, spending more CPU on a smaller output when optimize is set
+//
+// image/png already drops the alpha channel of opaque images, optimizing adds the best zlib level
+// and stores images of up to 256 colors, like icons, logos and screenshots, as paletted
+func encodePNG(w io.Writer, img image.Image, optimize bool) error {
+	if !optimize {
+		return png.Encode(w, img)
+	}
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	return enc.Encode(w, paletted(img))
+}
+
+// paletted returns img as an image.Paletted when it has at most maxPaletteSize colors, img itself otherwise
+// colors that 8 bits per channel can't hold exactly, from 16-bit originals, keep img as it is, so nothing is lost
+func paletted(img image.Image) image.Image {
+	if _, ok := img.(*image.Paletted); ok {
+		return img
+	}
+	b := img.Bounds()
+	index := make(map[color.NRGBA]uint8, maxPaletteSize)
+	var palette color.Palette
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			px := img.At(x, y)
+			c := color.NRGBAModel.Convert(px).(color.NRGBA)
+			if !sameColor(c, px) {
+				return img
+			}
+			if _, ok := index[c]; ok {
+				continue
+			}
+			if len(palette) == maxPaletteSize {
+				return img
+			}
+			index[c] = uint8(len(palette))
+			palette = append(palette, c)
+		}
+	}
+
+	p := image.NewPaletted(b, palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			p.SetColorIndex(x, y, index[c])
+		}
+	}
+	return p
+}
+
+// sameColor compares a and b as 16-bit premultiplied colors, the way every image.Image reports them
+func sameColor(a, b color.Color) bool {
+	ar, ag, ab, aa := a.RGBA()
+	br, bg, bb, ba := b.RGBA()
+	return ar == br && ag == bg && ab == bb && aa == ba
+}
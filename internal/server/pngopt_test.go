@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestOptimizePNG(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code, and body or Location header of redirection
+		statusCode int
+		body       string
+		location   string
+	}{
+		{
+			testName:   "png original",
+			target:     "/imagePNG.png?w=100&optimize_png=1",
+			statusCode: http.StatusSeeOther,
+			location:   path.Join(sev.FolderResized, "imagePNG.png", "w100h0-opt.png"),
+		},
+		{
+			testName:   "png output",
+			target:     "/imageJPEG.jpeg?w=100&fm=png&optimize_png=1",
+			statusCode: http.StatusSeeOther,
+			location:   path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0-opt.png"),
+		},
+		{
+			// shares its variant with the request without it
+			testName:   "not optimized",
+			target:     "/imagePNG.png?w=100&optimize_png=0",
+			statusCode: http.StatusSeeOther,
+			location:   path.Join(sev.FolderResized, "imagePNG.png", "w100h0.png"),
+		},
+		{
+			testName:   "jpeg output",
+			target:     "/imageJPEG.jpeg?w=100&optimize_png=1",
+			statusCode: http.StatusBadRequest,
+			body:       "optimize_png requires a png output",
+		},
+		{
+			testName:   "auto format",
+			target:     "/imagePNG.png?w=100&fm=auto&optimize_png=1",
+			statusCode: http.StatusBadRequest,
+			body:       "optimize_png requires a png output",
+		},
+		{
+			testName:   "not a boolean",
+			target:     "/imagePNG.png?w=100&optimize_png=max",
+			statusCode: http.StatusBadRequest,
+			body:       "optimize_png must be a boolean",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+			}
+			if tc.location != "" {
+				assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(tc.location))
+				_, err := png.Decode(bytes.NewReader(ssc.storage[tc.location].data))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodePNGLossless(t *testing.T) {
+	// a flat graphic of a few colors, one of them translucent
+	flat := image.NewNRGBA(image.Rect(0, 0, 120, 80))
+	for y := range 80 {
+		for x := range 120 {
+			c := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+			switch {
+			case (x/10+y/10)%2 == 0:
+				c = color.NRGBA{R: 30, G: 90, B: 200, A: 255}
+			case x > 60:
+				c = color.NRGBA{R: 220, G: 40, B: 40, A: 128}
+			}
+			flat.SetNRGBA(x, y, c)
+		}
+	}
+	// more colors than a palette holds
+	gradient := image.NewNRGBA(image.Rect(0, 0, 300, 2))
+	for x := range 300 {
+		gradient.SetNRGBA(x, 0, color.NRGBA{R: uint8(x), G: uint8(x / 2), B: 0, A: 255})
+		gradient.SetNRGBA(x, 1, color.NRGBA{R: uint8(x), G: 0, B: uint8(x / 2), A: 255})
+	}
+	// 16 bits per channel, which 8 bits can't hold
+	deep := image.NewNRGBA64(image.Rect(0, 0, 4, 4))
+	deep.SetNRGBA64(1, 1, color.NRGBA64{R: 0x1234, G: 0x5678, B: 0x9abc, A: 0xffff})
+
+	tt := []struct {
+		testName string
+		img      image.Image
+		// desired type of the decoded output
+		paletted bool
+	}{
+		{testName: "flat graphic", img: flat, paletted: true},
+		{testName: "too many colors", img: gradient},
+		{testName: "16 bits", img: deep},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			var plain, optimized bytes.Buffer
+			if err := encodePNG(&plain, tc.img, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := encodePNG(&optimized, tc.img, true); err != nil {
+				t.Fatal(err)
+			}
+			if tc.paletted {
+				assertEqual(t, optimized.Len() < plain.Len(), true)
+			}
+
+			want, err := png.Decode(&plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := png.Decode(&optimized)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, ok := got.(*image.Paletted)
+			assertEqual(t, ok, tc.paletted)
+			b := want.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					wc := color.NRGBA64Model.Convert(want.At(x, y))
+					gc := color.NRGBA64Model.Convert(got.At(x, y))
+					if wc != gc {
+						t.Fatalf("pixel at %d, %d is %v, want %v", x, y, gc, wc)
+					}
+				}
+			}
+		})
+	}
+}
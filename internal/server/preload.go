@@ -0,0 +1,41 @@
+package server
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const queryPreload = "preload"
+
+// parsePreload reads ?preload, which asks the srcset and picture endpoints for a Link header preloading their variants,
+// so that a page rendered with them can pass it on and browsers start fetching the image before parsing the markup
+func parsePreload(q url.Values) (bool, error) {
+	if !q.Has(queryPreload) {
+		return false, nil
+	}
+	preload, err := strconv.ParseBool(q.Get(queryPreload))
+	if err != nil {
+		return false, errors.New("preload must be a boolean")
+	}
+	return preload, nil
+}
+
+// preloadLink is the value of a Link header preloading the responsive image of srcset and sizes, "" leaving sizes out,
+// of the MIME type mime, "" leaving it out, with href for browsers that don't support imagesrcset
+func preloadLink(href, srcset, sizes, mime string) string {
+	link := "<" + href + ">; rel=preload; as=image; imagesrcset=" + quoteLinkParam(srcset)
+	if sizes != "" {
+		link += "; imagesizes=" + quoteLinkParam(sizes)
+	}
+	if mime != "" {
+		link += "; type=" + quoteLinkParam(mime)
+	}
+	return link
+}
+
+// quoteLinkParam quotes a Link header param value, which commas and spaces would otherwise end
+func quoteLinkParam(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestPreloadLinks(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// whether it requires webp output
+		webp bool
+		// desired response status code, Link header and body
+		statusCode int
+		link       string
+		body       string
+	}{
+		{
+			testName:   "srcset",
+			target:     "/imageJPEG.jpeg/srcset?widths=640,320&preload=1&q=80",
+			statusCode: http.StatusOK,
+			link:       `</imageJPEG.jpeg?q=80&w=640>; rel=preload; as=image; imagesrcset="/imageJPEG.jpeg?q=80&w=320 320w, /imageJPEG.jpeg?q=80&w=640 640w"`,
+			body:       "/imageJPEG.jpeg?q=80&w=320 320w, /imageJPEG.jpeg?q=80&w=640 640w",
+		},
+		{
+			testName:   "eager srcset",
+			target:     "/imageJPEG.jpeg/srcset?widths=100,200&eager=1&preload=true",
+			statusCode: http.StatusOK,
+			link: "<https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w200h0.jpeg") + `>; rel=preload; as=image; imagesrcset="` +
+				"https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w100h0.jpeg") + " 100w, " +
+				"https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w200h0.jpeg") + ` 200w"`,
+		},
+		{
+			testName:   "srcset without preload",
+			target:     "/imageJPEG.jpeg/srcset?widths=320&preload=0",
+			statusCode: http.StatusOK,
+			body:       "/imageJPEG.jpeg?w=320 320w",
+		},
+		{
+			testName:   "picture preloads its first source",
+			target:     "/imageJPEG.jpeg/picture?widths=640,320&formats=webp,jpeg&sizes=(max-width:+600px)+100vw,+50vw&preload=1",
+			webp:       true,
+			statusCode: http.StatusOK,
+			link:       `</imageJPEG.jpeg?fm=webp&w=640>; rel=preload; as=image; imagesrcset="/imageJPEG.jpeg?fm=webp&w=320 320w, /imageJPEG.jpeg?fm=webp&w=640 640w"; imagesizes="(max-width: 600px) 100vw, 50vw"; type="image/webp"`,
+		},
+		{
+			testName:   "picture img keeps the last source",
+			target:     "/imageJPEG.jpeg/picture?widths=320&formats=webp,png&preload=1",
+			webp:       true,
+			statusCode: http.StatusOK,
+			link:       `</imageJPEG.jpeg?fm=webp&w=320>; rel=preload; as=image; imagesrcset="/imageJPEG.jpeg?fm=webp&w=320 320w"; type="image/webp"`,
+			body: `<picture>
+  <source type="image/webp" srcset="/imageJPEG.jpeg?fm=webp&amp;w=320 320w">
+  <source type="image/png" srcset="/imageJPEG.jpeg?fm=png&amp;w=320 320w">
+  <img src="/imageJPEG.jpeg?fm=png&amp;w=320" srcset="/imageJPEG.jpeg?fm=png&amp;w=320 320w" alt="">
+</picture>`,
+		},
+		{
+			testName:   "invalid preload",
+			target:     "/imageJPEG.jpeg/picture?widths=320&preload=maybe",
+			statusCode: http.StatusBadRequest,
+			body:       "preload must be a boolean",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			if tc.webp && !outputSupported(formatWebP) {
+				t.Skip("webp output requires a cgo build")
+			}
+			ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, rr.Header().Get("Link"), tc.link)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+			}
+		})
+	}
+}
+
+func TestQuoteLinkParam(t *testing.T) {
+	assertEqual(t, quoteLinkParam(`/a.jpeg?alt="x" 320w`), `"/a.jpeg?alt=\"x\" 320w"`)
+	assertEqual(t, quoteLinkParam(`a\b`), `"a\\b"`)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sync/atomic"
+)
+
+const queryPreset = "t"
+
+// presetQueries are the query params a preset may bundle, every transform and encode option of an image request
+var presetQueries = []string{
+	queryWidth, queryHeight, queryTrim, queryTrimTolerance, queryScale, queryResampling, queryFormat, queryFallback, queryQuality, queryWebPQuality, queryWebPLossless, queryICOSizes,
+	queryMaxBytes, querySubsample, queryOptimizePNG, queryICC, queryUpscale, queryPad, queryBackground, queryWatermark, queryWmPosition,
+	queryWmOpacity, queryText, queryTextPosition, queryTextSize, queryTextColor,
+}
+
+var presetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Presets names bundles of query params, requested with ?t=[NAME] in place of the params they bundle
+// the file they are loaded from is a JSON object of presets by name, each an object of query params, like
+//
+//	{"productCard": {"w": 400, "h": 400, "pad": true, "fm": "webp", "webp_quality": 80}}
+type Presets struct {
+	path    string
+	presets atomic.Pointer[map[string]url.Values]
+}
+
+// LoadPresets reads the presets of the file at path
+func LoadPresets(path string) (*Presets, error) {
+	ps := &Presets{path: path}
+	if err := ps.Reload(); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+// Reload reads the file again, the presets loaded before are kept when it is invalid
+func (ps *Presets) Reload() error {
+	data, err := os.ReadFile(ps.path)
+	if err != nil {
+		return fmt.Errorf("reading presets: %w", err)
+	}
+	presets, err := parsePresets(data)
+	if err != nil {
+		return fmt.Errorf("parsing presets %q: %w", ps.path, err)
+	}
+	ps.presets.Store(&presets)
+	return nil
+}
+
+func parsePresets(data []byte) (map[string]url.Values, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var raw map[string]map[string]any
+	if err := dec.Decode(&raw); err != nil {
+		return nil, err
+	}
+
+	presets := make(map[string]url.Values, len(raw))
+	for name, params := range raw {
+		if !presetNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("preset name %q must only hold letters, digits, _ and -", name)
+		}
+		q := make(url.Values, len(params))
+		for key, value := range params {
+			if !slices.Contains(presetQueries, key) {
+				return nil, fmt.Errorf("preset %q: %q is not a transform query param", name, key)
+			}
+			switch value := value.(type) {
+			case string:
+				q.Set(key, value)
+			case json.Number:
+				q.Set(key, value.String())
+			case bool:
+				q.Set(key, fmt.Sprint(value))
+			default:
+				return nil, fmt.Errorf("preset %q: %q must be a string, a number or a boolean", name, key)
+			}
+		}
+		presets[name] = q
+	}
+	return presets, nil
+}
+
+// expandPreset replaces ?t in q with the params of the preset it names, params in q override the ones of the preset
+// the returned error is meant to be sent back to the client with 400 Bad Request
+func expandPreset(presets *Presets, q url.Values) (url.Values, error) {
+	if !q.Has(queryPreset) {
+		return q, nil
+	}
+	name := q.Get(queryPreset)
+	var preset url.Values
+	if presets != nil {
+		preset = (*presets.presets.Load())[name]
+	}
+	if preset == nil {
+		return nil, fmt.Errorf("t=%s is not a known preset", name)
+	}
+
+	expanded := make(url.Values, len(preset)+len(q))
+	for key, values := range preset {
+		expanded[key] = slices.Clone(values)
+	}
+	for key, values := range q {
+		if key != queryPreset {
+			expanded[key] = values
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestParsePresets(t *testing.T) {
+	tt := []struct {
+		testName string
+		data     string
+		// desired query of the card preset
+		want    string
+		wantErr bool
+	}{
+		{testName: "strings, numbers and booleans", data: `{"card": {"w": 400, "pad": true, "fm": "webp", "wm_opacity": 0.5}}`, want: "fm=webp&pad=true&w=400&wm_opacity=0.5"},
+		{testName: "not a transform", data: `{"card": {"nocache": true}}`, wantErr: true},
+		{testName: "nested preset", data: `{"card": {"t": "other"}}`, wantErr: true},
+		{testName: "not a scalar", data: `{"card": {"w": [400]}}`, wantErr: true},
+		{testName: "invalid name", data: `{"product card": {"w": 400}}`, wantErr: true},
+		{testName: "not JSON", data: `card: {w: 400}`, wantErr: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			presets, err := parsePresets([]byte(tc.data))
+			assertEqual(t, err != nil, tc.wantErr)
+			assertEqual(t, presets["card"].Encode(), tc.want)
+		})
+	}
+}
+
+func TestPresets(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	file := filepath.Join(t.TempDir(), "presets.json")
+	if err := os.WriteFile(file, []byte(`{"card": {"w": 100, "h": 100, "fm": "png"}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	presets, err := LoadPresets(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss := New(slogt.New(t), newStubStorageClient(sev), sev, WithPresets(presets))
+
+	get := func(target string) *httptest.ResponseRecorder {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		return rr
+	}
+	location := func(name string) string {
+		return "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", name)
+	}
+
+	// presets share their variants with the same params requested one by one
+	rr := get("/imageJPEG.jpeg?t=card")
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+	assertEqual(t, rr.Header().Get("Location"), location("w100h100.png"))
+
+	// params of the request override the ones of the preset
+	rr = get("/imageJPEG.jpeg?t=card&w=50")
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+	assertEqual(t, rr.Header().Get("Location"), location("w50h100.png"))
+
+	rr = get("/imageJPEG.jpeg?t=hero")
+	assertEqual(t, rr.Code, http.StatusBadRequest)
+	assertEqual(t, strings.TrimSpace(rr.Body.String()), "t=hero is not a known preset")
+
+	// a broken file keeps the presets loaded before
+	if err := os.WriteFile(file, []byte(`{"hero": {"w": "oops"`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, presets.Reload() != nil, true)
+	assertEqual(t, get("/imageJPEG.jpeg?t=card").Code, http.StatusSeeOther)
+
+	if err := os.WriteFile(file, []byte(`{"hero": {"w": 200}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, presets.Reload(), nil)
+	rr = get("/imageJPEG.jpeg?t=hero")
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+	assertEqual(t, rr.Header().Get("Location"), location("w200h0.jpeg"))
+	assertEqual(t, get("/imageJPEG.jpeg?t=card").Code, http.StatusBadRequest)
+
+	// without presets every t is unknown
+	ss = New(slogt.New(t), newStubStorageClient(sev), sev)
+	assertEqual(t, get("/imageJPEG.jpeg?t=hero").Code, http.StatusBadRequest)
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+const queryQuality = "quality"
+
+// qualityAuto is the value of ?quality searching the lowest quality whose output still looks like the image encoded, see encodeAuto
+const qualityAuto = "auto"
+
+// a binary search over qualities 1 to 100 settles within 7 encodes
+const maxQualitySearchSteps = 7
+
+// qualityConfig is what ?quality names besides a number: the qualities of the labels of jpeg and webp, see envvar.QualityLabels,
+// and the similarity quality=auto targets
+type qualityConfig struct {
+	jpeg     map[string]int
+	webp     map[string]int
+	autoSSIM float64
+}
+
+var defaultQualityConfig = qualityConfig{jpeg: envvar.DefaultJPEGQualityLabels, webp: envvar.DefaultWebPQualityLabels, autoSSIM: envvar.DefaultQualityAutoSSIM}
+
+// envQualityConfig is the config of QUALITY_LABELS_JPEG, QUALITY_LABELS_WEBP and QUALITY_AUTO_SSIM
+func envQualityConfig(envVar *envvar.EnvVar) qualityConfig {
+	qc := defaultQualityConfig
+	// left empty by the tests building envvar.EnvVar by hand
+	if envVar.JPEGQualityLabels != nil {
+		qc.jpeg = envVar.JPEGQualityLabels
+	}
+	if envVar.WebPQualityLabels != nil {
+		qc.webp = envVar.WebPQualityLabels
+	}
+	if envVar.QualityAutoSSIM > 0 {
+		qc.autoSSIM = envVar.QualityAutoSSIM
+	}
+	return qc
+}
+
+// parseQuality reads a label of qc or else an integer between 1 and 100 as a quality of format
+func (qc qualityConfig) parseQuality(value, format string) (int, error) {
+	if slices.Contains(envvar.QualityLabels, value) {
+		if format == formatWebP {
+			return qc.webp[value], nil
+		}
+		return qc.jpeg[value], nil
+	}
+	quality, err := strconv.Atoi(value)
+	if err != nil || quality < 1 || quality > 100 {
+		return 0, fmt.Errorf("quality must be %s, one of %v or an integer between 1 and 100, got %q", qualityAuto, envvar.QualityLabels, value)
+	}
+	return quality, nil
+}
+
+// autoTransform names quality=auto in the resized key by the similarity it targets, like "qauto950" for 0.95,
+// since the quality it settles on is only known once encoded
+func (qc qualityConfig) autoTransform() string {
+	return "q" + qualityAuto + strconv.Itoa(int(math.Round(qc.autoSSIM*1000)))
+}
+
+// defaultQuality is the quality of format encoded without ?quality, which the resized keys leave out
+func defaultQuality(format string) int {
+	if format == formatWebP {
+		return defaultWebPQuality
+	}
+	return jpeg.DefaultQuality
+}
+
+// withQuality sets the lossy quality of format, 1 to 100
+func (opts encodeOptions) withQuality(format string, quality int) encodeOptions {
+	switch format {
+	case formatJPEG:
+		opts.jpegQuality = quality
+	case formatWebP:
+		opts.webpQuality = quality
+	}
+	return opts
+}
+
+// encodeWithin binary searches the highest quality whose output fits in opts.maxBytes
+// when not even the lowest quality fits, the smallest output encoded is returned instead
+func encodeWithin(img image.Image, format string, opts encodeOptions) (data []byte, quality int, err error) {
+	var smallest []byte
+	var smallestQuality int
+	lo, hi := 1, 100
+	for i := 0; i < maxQualitySearchSteps && lo <= hi; i++ {
+		q := (lo + hi) / 2
+		var buf bytes.Buffer
+		if err := encode(&buf, img, format, opts.withQuality(format, q)); err != nil {
+			return nil, 0, err
+		}
+		if smallest == nil || buf.Len() < len(smallest) {
+			smallest, smallestQuality = buf.Bytes(), q
+		}
+		if buf.Len() <= opts.maxBytes {
+			data, quality = buf.Bytes(), q
+			lo = q + 1
+		} else {
+			hi = q - 1
+		}
+	}
+	if data == nil {
+		return smallest, smallestQuality, nil
+	}
+	return data, quality, nil
+}
+
+// encodeAuto binary searches the lowest quality whose output is still opts.autoSSIM similar to img, see ssim
+// when not even the highest quality tried is, its output is returned instead
+func encodeAuto(img image.Image, format string, opts encodeOptions) (data []byte, quality int, similarity float64, err error) {
+	var highest []byte
+	var highestQuality int
+	var highestSimilarity float64
+	lo, hi := 1, 100
+	for i := 0; i < maxQualitySearchSteps && lo <= hi; i++ {
+		q := (lo + hi) / 2
+		var buf bytes.Buffer
+		if err := encode(&buf, img, format, opts.withQuality(format, q)); err != nil {
+			return nil, 0, 0, err
+		}
+		decoded, _, err := image.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		s := ssim(img, decoded)
+		if q > highestQuality {
+			highest, highestQuality, highestSimilarity = buf.Bytes(), q, s
+		}
+		if s >= opts.autoSSIM {
+			data, quality, similarity = buf.Bytes(), q, s
+			hi = q - 1
+		} else {
+			lo = q + 1
+		}
+	}
+	if data == nil {
+		return highest, highestQuality, highestSimilarity, nil
+	}
+	return data, quality, similarity, nil
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestQuality(t *testing.T) {
+	tt := []struct {
+		testName string
+		// QUALITY_LABELS_JPEG, the defaults when nil
+		jpegLabels map[string]int
+		// QUALITY_AUTO_SSIM, the default when 0
+		autoSSIM float64
+		target   string
+		// whether it requires webp output
+		webp bool
+		// desired response status code, and body or key of the variant
+		statusCode int
+		body       string
+		key        string
+	}{
+		{testName: "label", target: "/photo.jpeg?w=100&quality=high", statusCode: http.StatusSeeOther, key: "w100h0-q85.jpeg"},
+		{testName: "number the label maps to", target: "/photo.jpeg?w=100&quality=85", statusCode: http.StatusSeeOther, key: "w100h0-q85.jpeg"},
+		{testName: "default quality", target: "/photo.jpeg?w=100&quality=medium", statusCode: http.StatusSeeOther, key: "w100h0.jpeg"},
+		{testName: "configured label", jpegLabels: map[string]int{"low": 20}, target: "/photo.jpeg?w=100&quality=low", statusCode: http.StatusSeeOther, key: "w100h0-q20.jpeg"},
+		{testName: "webp label", webp: true, target: "/photo.jpeg?w=100&fm=webp&quality=low", statusCode: http.StatusSeeOther, key: "w100h0-q50.webp"},
+		{testName: "webp label shared with webp_quality", webp: true, target: "/photo.jpeg?w=100&fm=webp&webp_quality=50", statusCode: http.StatusSeeOther, key: "w100h0-q50.webp"},
+		{testName: "unknown label", target: "/photo.jpeg?w=100&quality=ultra", statusCode: http.StatusBadRequest, body: `quality must be auto, one of [low medium high max] or an integer between 1 and 100, got "ultra"`},
+		{testName: "number out of range", target: "/photo.jpeg?w=100&quality=101", statusCode: http.StatusBadRequest, body: `quality must be auto, one of [low medium high max] or an integer between 1 and 100, got "101"`},
+		{testName: "auto", target: "/photo.jpeg?w=100&quality=auto", statusCode: http.StatusSeeOther, key: "w100h0-qauto950.jpeg"},
+		{testName: "configured auto", autoSSIM: 0.9, target: "/photo.jpeg?w=100&quality=auto", statusCode: http.StatusSeeOther, key: "w100h0-qauto900.jpeg"},
+		{testName: "webp auto", webp: true, target: "/photo.jpeg?w=100&fm=webp&quality=auto", statusCode: http.StatusSeeOther, key: "w100h0-qauto950.webp"},
+		{testName: "png output", target: "/photo.jpeg?w=100&fm=png&quality=high", statusCode: http.StatusBadRequest, body: "quality requires a jpeg or lossy webp output"},
+		{testName: "with max_bytes", target: "/photo.jpeg?w=100&quality=high&max_bytes=1000", statusCode: http.StatusBadRequest, body: "quality can't be combined with webp_quality or max_bytes"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			if tc.webp && !outputSupported(formatWebP) {
+				t.Skip("webp output requires a cgo build")
+			}
+			sev := &envvar.EnvVar{
+				BucketName:        "stub-bucket",
+				FolderOriginal:    "stub-original-folder",
+				FolderResized:     "stub-resized-folder",
+				JPEGQualityLabels: tc.jpegLabels,
+				QualityAutoSSIM:   tc.autoSSIM,
+			}
+			ssc := newStubStorageClient(sev)
+			ssc.storage[path.Join(sev.FolderOriginal, "photo.jpeg")] = newStubObject("jpeg", 200, 200)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			key := path.Join(sev.FolderResized, "photo.jpeg", tc.key)
+			assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(key))
+			if _, ok := ssc.storage[key]; !ok {
+				t.Errorf("want variant %q uploaded", key)
+			}
+		})
+	}
+}
+
+func TestEncodeAuto(t *testing.T) {
+	img := gradient(64, 64)
+
+	tt := []struct {
+		testName string
+		format   string
+		target   float64
+	}{
+		{testName: "jpeg", format: formatJPEG, target: 0.95},
+		{testName: "jpeg strict", format: formatJPEG, target: 0.99},
+		{testName: "jpeg loose", format: formatJPEG, target: 0.5},
+	}
+	if outputSupported(formatWebP) {
+		tt = append(tt, struct {
+			testName string
+			format   string
+			target   float64
+		}{testName: "webp", format: formatWebP, target: 0.95})
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			data, quality, similarity, err := encodeAuto(img, tc.format, encodeOptions{autoSSIM: tc.target})
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, _, err := image.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := ssim(img, decoded); got != similarity {
+				t.Errorf("got similarity %v, the output has %v", similarity, got)
+			}
+			if similarity < tc.target {
+				t.Errorf("got similarity %v at quality %d, want at least %v", similarity, quality, tc.target)
+			}
+			// the quality right below the one settled on must fall short, or the search stopped before settling,
+			// which maxQualitySearchSteps halvings of 1 to 100 always do
+			if quality > 1 {
+				var buf bytes.Buffer
+				if err := encode(&buf, img, tc.format, encodeOptions{}.withQuality(tc.format, quality-1)); err != nil {
+					t.Fatal(err)
+				}
+				lower, _, err := image.Decode(&buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s := ssim(img, lower); s >= tc.target {
+					t.Errorf("quality %d is already %v similar, want the search to settle below %d", quality-1, s, quality)
+				}
+			}
+		})
+	}
+}
+
+func TestSSIM(t *testing.T) {
+	img := gradient(32, 32)
+	assertEqual(t, ssim(img, img), 1.0)
+
+	flat := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	if s := ssim(img, flat); s >= 0.5 {
+		t.Errorf("got %v comparing a gradient with a flat image, want less than 0.5", s)
+	}
+
+	// a jpeg decodes into its Y plane, compared with the luma of the RGBA it was encoded from
+	var buf bytes.Buffer
+	if err := encode(&buf, img, formatJPEG, encodeOptions{jpegQuality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, _, err := image.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := ssim(img, decoded); s < 0.99 {
+		t.Errorf("got %v for a jpeg at quality 100, want at least 0.99", s)
+	}
+}
+
+// gradient is a w by h image with detail in both directions, which lossy encoders blur
+func gradient(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: uint8((x*y + x*7) % 256), A: 255})
+		}
+	}
+	return img
+}
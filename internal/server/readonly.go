@@ -0,0 +1,19 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+const errStrReadOnly = "this server is read-only, it only answers originals"
+
+// refuseReadOnly answers 403 Forbidden instead of next on read-only servers, for the routes writing to the bucket
+func refuseReadOnly(envVar *envvar.EnvVar, next http.HandlerFunc) http.HandlerFunc {
+	if !envVar.ReadOnly {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, errStrReadOnly, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestReadOnly(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		ReadOnly:       true,
+	}
+
+	tt := []struct {
+		testName string
+		method   string
+		target   string
+		body     string
+		// desired response status code, and body or Location header of redirection
+		statusCode int
+		errBody    string
+		location   string
+	}{
+		{
+			testName:   "original",
+			target:     "/imageJPEG.jpeg",
+			statusCode: http.StatusSeeOther,
+			location:   path.Join(sev.FolderOriginal, "imageJPEG.jpeg"),
+		},
+		{
+			testName:   "zero dimensions stand for the original",
+			target:     "/imageJPEG.jpeg?w=0&h=0",
+			statusCode: http.StatusSeeOther,
+			location:   path.Join(sev.FolderOriginal, "imageJPEG.jpeg"),
+		},
+		{
+			testName:   "missing original",
+			target:     "/missing.jpeg",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			testName:   "invalid params are still answered as such",
+			target:     "/imageJPEG.jpeg?w=abc",
+			statusCode: http.StatusBadRequest,
+			errBody:    `w must be a non-negative integer, got "abc"`,
+		},
+		{
+			testName:   "resize",
+			target:     "/imageJPEG.jpeg?w=100",
+			statusCode: http.StatusForbidden,
+			errBody:    errStrReadOnly,
+		},
+		{
+			// stored variants aren't answered either, nothing but originals is
+			testName:   "stored variant",
+			target:     "/imageJPEG.jpeg?w=600&h=900",
+			statusCode: http.StatusForbidden,
+			errBody:    errStrReadOnly,
+		},
+		{
+			testName:   "conversion",
+			target:     "/imageJPEG.jpeg?fm=png",
+			statusCode: http.StatusForbidden,
+			errBody:    errStrReadOnly,
+		},
+		{
+			testName:   "sprite sheet",
+			method:     http.MethodPost,
+			target:     spritePath,
+			body:       `{"images": ["imageJPEG.jpeg"], "width": 10, "height": 10}`,
+			statusCode: http.StatusForbidden,
+			errBody:    errStrReadOnly,
+		},
+		{
+			testName:   "blurhash",
+			target:     "/imageJPEG.jpeg/blurhash",
+			statusCode: http.StatusForbidden,
+			errBody:    errStrReadOnly,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			method := tc.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(method, tc.target, strings.NewReader(tc.body)))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.errBody != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.errBody)
+			}
+			if tc.location != "" {
+				assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(tc.location))
+			}
+			assertEqual(t, ssc.execution[exeKeyDownload], false)
+			assertEqual(t, ssc.execution[exeKeyUpload], false)
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// Reloadable serves every request with the latest handler swapped in, built by New from the config of the moment
+// a request keeps the handler it started with, so it sees a single config from start to end
+type Reloadable struct {
+	h atomic.Pointer[http.Handler]
+}
+
+func NewReloadable(h http.Handler) *Reloadable {
+	var rl Reloadable
+	rl.h.Store(&h)
+	return &rl
+}
+
+// Swap serves the requests from now on with h
+func (rl *Reloadable) Swap(h http.Handler) {
+	rl.h.Store(&h)
+}
+
+func (rl *Reloadable) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	(*rl.h.Load()).ServeHTTP(w, r)
+}
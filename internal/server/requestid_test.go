@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestRequestID(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName  string
+		requestID string
+		// desired request ID, a new one when empty
+		propagated string
+	}{
+		{testName: "no request id"},
+		{testName: "propagated request id", requestID: "req-42", propagated: "req-42"},
+		{testName: "invalid request id", requestID: "req 42\x7f"},
+		{testName: "too long request id", requestID: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			// a broken original logs a warning of its own, along with the line of the request
+			ssc.storage[path.Join(sev.FolderOriginal, "broken.jpeg")] = stubObject{
+				data:         []byte("not an image"),
+				contentType:  "image/jpeg",
+				lastModified: time.Now(),
+			}
+			var logs bytes.Buffer
+			ss := New(slog.New(slog.NewJSONHandler(&logs, nil)), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/broken.jpeg?w=100", nil)
+			if tc.requestID != "" {
+				req.Header.Set(headerRequestID, tc.requestID)
+			}
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, http.StatusUnprocessableEntity)
+			id := rr.Header().Get(headerRequestID)
+			if tc.propagated != "" {
+				assertEqual(t, id, tc.propagated)
+			} else {
+				assertEqual(t, validRequestID(id), true)
+				assertEqual(t, id != tc.requestID, true)
+			}
+
+			var messages []string
+			for line := range strings.Lines(logs.String()) {
+				var record struct {
+					Msg       string `json:"msg"`
+					RequestID string `json:"request_id"`
+				}
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatal(err)
+				}
+				assertEqual(t, record.RequestID, id)
+				messages = append(messages, record.Msg)
+			}
+			assertEqual(t, strings.Join(messages, ", "), "original image is not a valid image, request")
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"slices"
+
+	"github.com/disintegration/gift"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+const queryResampling = "m"
+
+// defaultResampling is the filter every resize used before it could be configured, which the resized keys leave out
+const defaultResampling = "lanczos"
+
+var resamplingFilters = map[string]gift.Resampling{
+	"lanczos": gift.LanczosResampling,
+	"cubic":   gift.CubicResampling,
+	"linear":  gift.LinearResampling,
+	"box":     gift.BoxResampling,
+	"nearest": gift.NearestNeighborResampling,
+}
+
+// lanczosResampling resizes either way with the default filter
+var lanczosResampling = resampling{down: defaultResampling, up: defaultResampling}
+
+// resampling names the filters of a resize that shrinks the original and of one that enlarges it, see envvar.Resamplings
+type resampling struct {
+	down string
+	up   string
+}
+
+// envResampling is the resampling of the requests without ?m
+func envResampling(envVar *envvar.EnvVar) resampling {
+	rs := lanczosResampling
+	// left empty by the tests building envvar.EnvVar by hand
+	if envVar.ResampleDown != "" {
+		rs.down = envVar.ResampleDown
+	}
+	if envVar.ResampleUp != "" {
+		rs.up = envVar.ResampleUp
+	}
+	return rs
+}
+
+// parseResampling reads ?m, the filter of the request whichever way it resizes
+func parseResampling(value string) (resampling, error) {
+	if !slices.Contains(envvar.Resamplings, value) {
+		return resampling{}, fmt.Errorf("m must be one of %v, got %q", envvar.Resamplings, value)
+	}
+	return resampling{down: value, up: value}, nil
+}
+
+// pick names the filter of a resize from a size to another, one enlarging either side counting as enlarging
+func (rs resampling) pick(from, to image.Point) string {
+	if to.X > from.X || to.Y > from.Y {
+		return rs.up
+	}
+	return rs.down
+}
+
+// filter is the filter pick names
+func (rs resampling) filter(from, to image.Point) gift.Resampling {
+	if f, ok := resamplingFilters[rs.pick(from, to)]; ok {
+		return f
+	}
+	return gift.LanczosResampling
+}
+
+// transform names rs in the resized key, like "mnearest" or "mlanczos_nearest" when the filters differ,
+// "" for the default filters so that the keys of variants resized before stay the same
+func (rs resampling) transform() string {
+	switch {
+	case rs.down == defaultResampling && rs.up == defaultResampling:
+		return ""
+	case rs.down == rs.up:
+		return queryResampling + rs.down
+	default:
+		return queryResampling + rs.down + "_" + rs.up
+	}
+}
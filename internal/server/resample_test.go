@@ -0,0 +1,124 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestResamplingFilter(t *testing.T) {
+	rs := resampling{down: "box", up: "nearest"}
+	small, large := image.Pt(10, 10), image.Pt(20, 20)
+
+	assertEqual(t, rs.pick(large, small), "box")
+	assertEqual(t, rs.pick(small, large), "nearest")
+	// a side enlarged is enough to enlarge
+	assertEqual(t, rs.pick(small, image.Pt(5, 20)), "nearest")
+	assertEqual(t, rs.pick(small, small), "box")
+
+	assertEqual(t, lanczosResampling.transform(), "")
+	assertEqual(t, resampling{down: "cubic", up: "cubic"}.transform(), "mcubic")
+	assertEqual(t, rs.transform(), "mbox_nearest")
+
+	for _, name := range envvar.Resamplings {
+		_, ok := resamplingFilters[name]
+		assertEqual(t, ok, true)
+	}
+}
+
+// newCheckerPNG encodes a size x size png of black and white squares of cell pixels
+func newCheckerPNG(t *testing.T, size, cell int) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := range size {
+		for x := range size {
+			c := color.NRGBA{A: 0xff}
+			if (x/cell+y/cell)%2 == 1 {
+				c = color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResampling(t *testing.T) {
+	tt := []struct {
+		testName string
+		down     string
+		up       string
+		target   string
+		// desired response status code, and body or key of the variant
+		statusCode int
+		body       string
+		key        string
+		// whether every pixel of the variant is still black or white, as only nearest keeps them
+		sharp bool
+	}{
+		{testName: "enlarged with lanczos by default", target: "/pixels.png?w=16", statusCode: http.StatusSeeOther, key: "w16h0.png"},
+		{testName: "enlarged with the configured filter", up: "nearest", target: "/pixels.png?w=16", statusCode: http.StatusSeeOther, key: "w16h0-mlanczos_nearest.png", sharp: true},
+		{testName: "shrunk with the configured filter", down: "box", up: "nearest", target: "/pixels.png?w=2", statusCode: http.StatusSeeOther, key: "w2h0-mbox_nearest.png"},
+		{testName: "enlarged with the filter of the request", target: "/pixels.png?w=16&m=nearest", statusCode: http.StatusSeeOther, key: "w16h0-mnearest.png", sharp: true},
+		{testName: "shrunk with the filter of the request", up: "cubic", target: "/pixels.png?w=2&m=nearest", statusCode: http.StatusSeeOther, key: "w2h0-mnearest.png", sharp: true},
+		{testName: "filter of the request set to the default", up: "nearest", target: "/pixels.png?w=16&m=lanczos", statusCode: http.StatusSeeOther, key: "w16h0.png"},
+		{testName: "nothing resized", up: "nearest", target: "/pixels.png?m=nearest&fm=jpeg", statusCode: http.StatusSeeOther, key: "w0h0.jpeg"},
+		{testName: "invalid filter", target: "/pixels.png?w=16&m=bicubic", statusCode: http.StatusBadRequest, body: `m must be one of [lanczos cubic linear box nearest], got "bicubic"`},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				ResampleDown:   tc.down,
+				ResampleUp:     tc.up,
+			}
+			ssc := newStubStorageClient(sev)
+			// 4 x 4 squares of 2 pixels
+			ssc.storage[path.Join(sev.FolderOriginal, "pixels.png")] = stubObject{data: newCheckerPNG(t, 8, 2), contentType: "image/png"}
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			key := path.Join(sev.FolderResized, "pixels.png", tc.key)
+			assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(key))
+			img, _, err := image.Decode(bytes.NewReader(ssc.storage[key].data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasSuffix(tc.key, ".png") {
+				return
+			}
+			sharp := true
+			b := img.Bounds()
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					if r, _, _, _ := img.At(x, y).RGBA(); r != 0 && r != 0xffff {
+						sharp = false
+					}
+				}
+			}
+			assertEqual(t, sharp, tc.sharp)
+		})
+	}
+}
@@ -0,0 +1,604 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// statusError is an error answered to the client with its status code
+type statusError struct {
+	code    int
+	message string
+}
+
+func (se *statusError) Error() string {
+	return se.message
+}
+
+func newStatusError(code int) *statusError {
+	return &statusError{code: code, message: http.StatusText(code)}
+}
+
+// storageStatus answers the errors of storage calls that the bucket answered or the breaker refused:
+// 404 for a missing object, 403 for a denied one and 503 while storage is unavailable
+// any other error is nil, for the caller to log and answer with 500
+func storageStatus(err error) *statusError {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return newStatusError(http.StatusNotFound)
+	case errors.Is(err, storage.ErrForbidden):
+		return newStatusError(http.StatusForbidden)
+	case errors.Is(err, storage.ErrUnavailable):
+		return newStatusError(http.StatusServiceUnavailable)
+	}
+	return nil
+}
+
+// variant is the object answering an image request, the original itself when nothing else was requested
+type variant struct {
+	key string
+	// the variant was just produced and already streamed into the response
+	streamed bool
+	// Cache-Control of the response, set by the original or else the default
+	cacheControl string
+	// the original answered instead of a variant that failed to be produced, see originalOnError
+	standIn bool
+	// the variant isn't stored yet and was left to the GET of a HEAD request, see withHeadOnly
+	// key is where it will be stored and contentType what it will be encoded into, both "" for fm=auto
+	pending     bool
+	contentType string
+}
+
+// writeCounter counts the bytes written through it
+type writeCounter struct {
+	w io.Writer
+	n int
+}
+
+func (wc *writeCounter) Write(b []byte) (int, error) {
+	n, err := wc.w.Write(b)
+	wc.n += n
+	return n, err
+}
+
+// resizeVariant finds or produces the variant of the image at imagePath requested by q
+// every error it returns is a *statusError
+//
+// a produced variant is encoded straight into its upload without being held in memory
+// when inline is set, the encoded bytes are teed into the writer it returns for their content type as well
+func resizeVariant(ctx context.Context, logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, o options, imagePath string, q url.Values, inline func(contentType string, cacheControl string) io.Writer) (variant, error) {
+	span := trace.SpanFromContext(ctx)
+	if envVar.DetachGeneration {
+		// a client leaving doesn't cancel the download, resize and upload of its variant, which the next one would only redo,
+		// still bounded by the memory budget and the upload limiter like any other
+		var cancel context.CancelFunc
+		ctx, cancel = detach(ctx, envVar.DetachTimeout)
+		defer cancel()
+	}
+
+	// check image path
+	span.SetAttributes(attribute.String("image.slug", imagePath))
+	imageName, imageFormat, ok := parseImageName(imagePath)
+	if !ok {
+		return variant{}, &statusError{code: http.StatusBadRequest, message: errStrInvalidImagePath}
+	}
+	if formatFromExtension(imageFormat) == formatHEIF && !heifSupported {
+		return variant{}, &statusError{code: http.StatusNotImplemented, message: errStrHEIFUnsupported}
+	}
+
+	// check if this image exists
+	originalKey := originalKey(envVar.FolderOriginal, imagePath)
+	stopCheck := startPhase(ctx, "check")
+	defer stopCheck()
+	metadata, version, err := storageClient.ObjectMetadata(ctx, originalKey)
+	if err != nil {
+		if se := storageStatus(err); se != nil {
+			return variant{}, se
+		}
+		logger.ErrorContext(ctx, "checking original image", "key", originalKey, "error", err)
+		return variant{}, newStatusError(http.StatusInternalServerError)
+	}
+	builtFor, immutable := immutableVersion(ctx)
+	if immutable && version != builtFor {
+		// the immutable path stands for the original it was built for, which was replaced since
+		return variant{}, newStatusError(http.StatusNotFound)
+	}
+	// kept apart from version, which only names variants with VERSIONED_KEYS
+	originalVersion := version
+	originalCacheControl, resizedCacheControl := imageCacheControls(ctx, logger, envVar, originalKey, metadata)
+	// produce only knows the content type of what it streams, always a resized variant
+	var inlineVariant func(contentType string) io.Writer
+	if inline != nil {
+		inlineVariant = func(contentType string) io.Writer {
+			if envVar.DetachGeneration {
+				return &detachedWriter{w: inline(contentType, resizedCacheControl)}
+			}
+			return inline(contentType, resizedCacheControl)
+		}
+	}
+
+	q, err = expandPreset(o.presets, q)
+	if err != nil {
+		return variant{}, &statusError{code: http.StatusBadRequest, message: err.Error()}
+	}
+	p, err := parseParams(q, imageFormat, envVar.AllowedFormats, envVar.MaxDimension, envResampling(envVar), envQualityConfig(envVar))
+	if err != nil {
+		return variant{}, &statusError{code: http.StatusBadRequest, message: err.Error()}
+	}
+	noCache, err := noCacheRequested(q)
+	if err != nil {
+		return variant{}, &statusError{code: http.StatusBadRequest, message: err.Error()}
+	}
+	if noCache {
+		// the stored variant is replaced by the one produced, the conditional upload would keep it
+		ctx = storage.WithOverwrite(ctx)
+	}
+	if p.watermark && o.watermark == nil {
+		return variant{}, &statusError{code: http.StatusBadRequest, message: "watermark is not configured on this server"}
+	}
+
+	// refused before anything is downloaded, even a size of the original's, which is only known once it is
+	if envVar.ReadOnly && p.requested(imageFormat) {
+		return variant{}, &statusError{code: http.StatusForbidden, message: errStrReadOnly}
+	}
+
+	if p.fellBack {
+		logger.InfoContext(ctx, "using fallback format", "image", imagePath, "requested", q.Get(queryFormat), "format", p.outputFormat)
+	}
+
+	// the original is downloaded at most once, to read its size for upscale=0 or to resize it
+	var original io.Reader
+	var originalBody io.ReadCloser
+	var source *sourceReader
+	defer func() {
+		if originalBody != nil {
+			originalBody.Close()
+		}
+	}()
+	downloadOriginal := func() error {
+		stopDownload := startPhase(ctx, "download")
+		body, _, err := storageClient.DownloadObject(storage.WithVersion(ctx, originalVersion), originalKey)
+		stopDownload()
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				return se
+			}
+			logger.ErrorContext(ctx, "downloading original image", "key", originalKey, "error", err)
+			return newStatusError(http.StatusInternalServerError)
+		}
+		source = &sourceReader{r: body}
+		originalBody, original = body, source
+		return nil
+	}
+
+	// the decoded original, when the cache of decoded originals holds it
+	cacheKey := originalCacheKey(storageClient, originalKey, originalVersion, p.frame)
+	var src image.Image
+	var format string
+	lookedUp := false
+	lookupOriginal := func() {
+		if o.originals == nil || lookedUp {
+			return
+		}
+		lookedUp = true
+		src, format, _ = o.originals.Get(cacheKey)
+		span.SetAttributes(attribute.Bool("image.original_cached", src != nil))
+	}
+
+	// the size of the original, read from its header unless the cache already holds it decoded
+	var bounds image.Rectangle
+	originalBounds := func() (image.Rectangle, error) {
+		if !bounds.Empty() {
+			return bounds, nil
+		}
+		lookupOriginal()
+		if src != nil {
+			bounds = src.Bounds()
+			return bounds, nil
+		}
+		if original == nil {
+			if err := downloadOriginal(); err != nil {
+				return bounds, err
+			}
+		}
+		// the header read here is decoded again along with the rest of the original
+		var header bytes.Buffer
+		cfg, _, err := decodeConfig(io.TeeReader(original, &header))
+		if err != nil {
+			return bounds, decodeFailure(ctx, logger, originalKey, source, err)
+		}
+		original = io.MultiReader(&header, original)
+		bounds = image.Rect(0, 0, cfg.Width, cfg.Height)
+		return bounds, nil
+	}
+
+	if p.noUpscale && (p.width != 0 || p.height != 0) {
+		bounds, err := originalBounds()
+		if err != nil {
+			return variant{}, err
+		}
+		p = p.withinBounds(bounds)
+	}
+
+	span.SetAttributes(attribute.Int("image.width", p.width), attribute.Int("image.height", p.height))
+
+	// if they are requesting original image then answer with the original
+	if !p.requested(imageFormat) {
+		return variant{key: originalKey, cacheControl: originalCacheControl}, nil
+	}
+
+	// check if resized image already exists
+	folder := resizedFolder(envVar, tenant(ctx), imagePath, imageName)
+	// the variants of an immutable path, cached for good, must not be the ones of a previous original
+	if !envVar.VersionedKeys && !immutable {
+		version = ""
+	}
+	keyOf := func(p params) string {
+		return variantKey(folder, p, version)
+	}
+	candidates, err := variantCandidates(envVar, p, imageFormat)
+	if err != nil {
+		return variant{}, err
+	}
+	candidates, err = acceptedCandidates(ctx, candidates)
+	if err != nil {
+		return variant{}, err
+	}
+	var resizedKey string
+	var resizedOK bool
+	// the key answering the request, the blob a deduplicated variant links to
+	var servedKey string
+	for _, c := range candidates {
+		resizedKey = keyOf(c)
+		servedKey = resizedKey
+		if noCache {
+			break
+		}
+		if envVar.Dedup {
+			servedKey, err = storageClient.ResolveObject(ctx, resizedKey)
+			resizedOK = err == nil
+			if errors.Is(err, storage.ErrNotFound) {
+				err = nil
+			}
+		} else {
+			resizedOK, err = storageClient.CheckObject(ctx, resizedKey)
+		}
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				return variant{}, se
+			}
+			logger.ErrorContext(ctx, "checking resized image", "key", resizedKey, "error", err)
+			return variant{}, newStatusError(http.StatusInternalServerError)
+		}
+		if resizedOK {
+			break
+		}
+	}
+
+	stopCheck()
+	span.SetAttributes(attribute.Bool("image.cache_hit", resizedOK))
+
+	// if resized image already exists
+	if resizedOK {
+		if o.budget != nil {
+			o.budget.record(storageClient, folder, resizedKey)
+		}
+		if o.janitor != nil {
+			o.janitor.record(storageClient.ObjectURL(resizedKey))
+		}
+		return variant{key: servedKey, cacheControl: resizedCacheControl}, nil
+	}
+
+	// a variant of the very size of the original with nothing else requested would only duplicate it
+	// its size is only known from the original, so this is checked once no variant answered
+	if sized := p; sized.width != 0 || sized.height != 0 {
+		sized.width, sized.height = 0, 0
+		sized.resampleTransform = ""
+		if !sized.requested(imageFormat) {
+			bounds, err := originalBounds()
+			if err != nil {
+				return variant{}, err
+			}
+			if outputSize(bounds, p) == bounds.Size() {
+				logger.DebugContext(ctx, "requested size is the one of the original", "key", originalKey)
+				return variant{key: originalKey, cacheControl: originalCacheControl}, nil
+			}
+		}
+	}
+
+	// w and h are checked against the max dimension while parsing, a scaled size only once the original is read
+	if p.scale > 1 && envVar.MaxDimension > 0 {
+		bounds, err := originalBounds()
+		if err != nil {
+			return variant{}, err
+		}
+		if size := outputSize(bounds, p); size.X > envVar.MaxDimension || size.Y > envVar.MaxDimension {
+			return variant{}, &statusError{code: http.StatusBadRequest, message: fmt.Sprintf("scale=%d gives a %dx%d image, larger than the max dimension %d", p.scale, size.X, size.Y, envVar.MaxDimension)}
+		}
+	}
+
+	// checked before a HEAD request too, since its GET would be answered the same
+	if envVar.VariantLimit > 0 {
+		nearest, servedKey, err := limitVariants(ctx, logger, storageClient, envVar, folder, candidates, version)
+		if err != nil {
+			return variant{}, err
+		}
+		if nearest != "" {
+			if o.budget != nil {
+				o.budget.record(storageClient, folder, nearest)
+			}
+			if o.janitor != nil {
+				o.janitor.record(storageClient.ObjectURL(nearest))
+			}
+			return variant{key: servedKey, cacheControl: resizedCacheControl}, nil
+		}
+	}
+
+	if headOnly(ctx) {
+		if p.auto {
+			return variant{pending: true, cacheControl: resizedCacheControl}, nil
+		}
+		return variant{key: resizedKey, pending: true, contentType: mimeType(p.outputFormat), cacheControl: resizedCacheControl}, nil
+	}
+
+	// else, let's resize it and upload it
+	lookupOriginal()
+	if o.memory != nil {
+		bounds, err := originalBounds()
+		if err != nil {
+			return variant{}, err
+		}
+		n := resizeBytes(bounds, outputSize(bounds, p), src != nil)
+		if !o.memory.acquire(n) {
+			logger.WarnContext(ctx, "memory budget spent, refusing resize", "key", originalKey, "bytes", n)
+			return variant{}, &statusError{code: http.StatusServiceUnavailable, message: "too many images being resized, try again later"}
+		}
+		defer o.memory.release(n)
+	}
+	if src == nil {
+		// first download the original image
+		if original == nil {
+			if err := downloadOriginal(); err != nil {
+				return variant{}, err
+			}
+		}
+
+		// make it image.Image
+		stopDecode := startPhase(ctx, "decode")
+		var frames int
+		if p.frame > 0 {
+			src, frames, err = decodeFrame(original, p.frame)
+			format = formatGIF
+		} else {
+			// decodeImage reads through br, which bufio.NewReaderSize returns as is, so that the frames after the first are left in it
+			br := bufio.NewReaderSize(original, exifHeadSize)
+			src, format, err = decodeImage(br)
+			if err == nil && format == formatGIF && moreGIFFrames(br) {
+				// none of the encoders, webp included, encodes animation
+				logger.InfoContext(ctx, "animated gif resized into a still image of its first frame, animation can't be encoded", "key", originalKey, "format", p.outputFormat)
+			}
+		}
+		stopDecode()
+		if err != nil {
+			return variant{}, decodeFailure(ctx, logger, originalKey, source, err)
+		}
+		if src == nil {
+			return variant{}, &statusError{code: http.StatusBadRequest, message: fmt.Sprintf("frame %d is out of range, the original has %d frames", p.frame, frames)}
+		}
+		if o.originals != nil {
+			o.originals.Add(cacheKey, src, format)
+		}
+	}
+
+	outputFormat := p.outputFormat
+
+	// resize image
+	stopResize := startPhase(ctx, "resize")
+	dst := render(src, p, o.watermark)
+	stopResize()
+	encodeOutput := func(w io.Writer) error {
+		return encode(w, dst, outputFormat, p.encode)
+	}
+	if p.encode.maxBytes > 0 {
+		// the key names the budget, the quality it took is only known once encoded
+		encodeOutput = func(w io.Writer) error {
+			data, quality, err := encodeWithin(dst, outputFormat, p.encode)
+			if err != nil {
+				return err
+			}
+			span.SetAttributes(attribute.Int("image.quality", quality))
+			logger.DebugContext(ctx, "targeted output size", "key", resizedKey, "quality", quality, "bytes", len(data), "max_bytes", p.encode.maxBytes)
+			_, err = w.Write(data)
+			return err
+		}
+	}
+	if p.encode.autoSSIM > 0 {
+		// the key names the similarity targeted, the quality it took is only known once encoded
+		encodeOutput = func(w io.Writer) error {
+			data, quality, similarity, err := encodeAuto(dst, outputFormat, p.encode)
+			if err != nil {
+				return err
+			}
+			span.SetAttributes(attribute.Int("image.quality", quality))
+			logger.DebugContext(ctx, "targeted output similarity", "key", resizedKey, "quality", quality, "ssim", similarity, "target_ssim", p.encode.autoSSIM)
+			_, err = w.Write(data)
+			return err
+		}
+	}
+	if p.auto {
+		// every candidate is encoded in memory to compare their sizes
+		var smallest []byte
+		for _, c := range candidates {
+			var buf bytes.Buffer
+			if err := encode(&buf, dst, c.outputFormat, c.encode); err != nil {
+				logger.WarnContext(ctx, "encoding resized image candidate", "format", c.outputFormat, "error", err)
+				continue
+			}
+			if smallest == nil || buf.Len() < len(smallest) {
+				smallest = buf.Bytes()
+				p = c
+			}
+		}
+		if smallest == nil {
+			logger.ErrorContext(ctx, "encoding resized image", "key", resizedKey, "error", "every candidate format failed")
+			return originalOnError(envVar, originalKey)
+		}
+		outputFormat = p.outputFormat
+		resizedKey = keyOf(p)
+		logger.DebugContext(ctx, "chose the smallest format", "key", resizedKey, "format", outputFormat, "bytes", len(smallest))
+		encodeOutput = func(w io.Writer) error {
+			_, err := w.Write(smallest)
+			return err
+		}
+	}
+
+	produceVariant := func(key string, contentType string, write func(w io.Writer) error) (error, error, bool) {
+		if !envVar.Dedup {
+			servedKey = key
+			return produce(ctx, storageClient, o.uploads, key, contentType, write, inlineVariant)
+		}
+		target, encodeErr, uploadErr, streamed := produceDeduplicated(ctx, storageClient, o.uploads, envVar.FolderResized, key, contentType, write, inlineVariant)
+		servedKey = target
+		return encodeErr, uploadErr, streamed
+	}
+
+	encodeErr, uploadErr, streamed := produceVariant(resizedKey, mimeType(outputFormat), encodeOutput)
+	if encodeErr != nil && p.fallbackFormat != "" && !streamed {
+		// the cache is keyed by the format actually produced
+		logger.WarnContext(ctx, "encoding resized image, using fallback format", "key", resizedKey, "format", p.fallbackFormat, "error", encodeErr)
+		p = p.fallback(imageFormat)
+		outputFormat = p.outputFormat
+		resizedKey = keyOf(p)
+		encodeErr, uploadErr, streamed = produceVariant(resizedKey, mimeType(outputFormat), func(w io.Writer) error {
+			return encode(w, dst, outputFormat, p.encode)
+		})
+	}
+	if encodeErr != nil {
+		logger.ErrorContext(ctx, "encoding resized image", "key", resizedKey, "error", encodeErr)
+		if streamed {
+			// part of the variant is already in the response
+			return variant{}, newStatusError(http.StatusInternalServerError)
+		}
+		return originalOnError(envVar, originalKey)
+	}
+	if errors.Is(uploadErr, errUploadQueueFull) {
+		logger.WarnContext(ctx, "waited too long to upload resized image", "key", resizedKey, "served", streamed)
+		if !streamed {
+			return variant{}, &statusError{code: http.StatusServiceUnavailable, message: "too many images being uploaded, try again later"}
+		}
+		// answered without being stored, the next request produces it again
+		return variant{streamed: true}, nil
+	}
+	if uploadErr != nil && streamed {
+		logger.WarnContext(ctx, "uploading resized image, served without storing it", "key", resizedKey, "error", uploadErr)
+		// answered without being stored, the next request produces it again
+		return variant{streamed: true}, nil
+	}
+	if uploadErr != nil {
+		if errors.Is(uploadErr, storage.ErrBadRequest) {
+			return variant{}, newStatusError(http.StatusBadRequest)
+		}
+		if se := storageStatus(uploadErr); se != nil {
+			return variant{}, se
+		}
+		logger.ErrorContext(ctx, "uploading resized image", "key", resizedKey, "error", uploadErr)
+		return variant{}, newStatusError(http.StatusInternalServerError)
+	}
+	if o.budget != nil {
+		o.budget.record(storageClient, folder, resizedKey)
+	}
+	if o.janitor != nil {
+		o.janitor.record(storageClient.ObjectURL(resizedKey))
+	}
+
+	return variant{key: servedKey, streamed: inline != nil, cacheControl: resizedCacheControl}, nil
+}
+
+// variantCandidates lists the params of every variant that may answer p, a single one unless fm=auto
+// fm=auto stores the variant under the extension of whichever candidate came out smaller
+func variantCandidates(envVar *envvar.EnvVar, p params, imageFormat string) ([]params, error) {
+	if !p.auto {
+		return []params{p}, nil
+	}
+	var candidates []params
+	for _, format := range envVar.AutoFormats {
+		if !outputSupported(format) || !formatAllowed(envVar.AllowedFormats, format) {
+			continue
+		}
+		candidates = append(candidates, p.withOutputFormat(format, imageFormat))
+	}
+	if len(candidates) == 0 {
+		return nil, &statusError{code: http.StatusBadRequest, message: "fm=auto has no candidate format this server can encode and allows"}
+	}
+	return candidates, nil
+}
+
+// originalOnError answers a variant that failed to be produced with its original when ON_ERROR=original, and with 500 otherwise
+// the original stands in for the variant only until it is requested again, so it isn't cached
+func originalOnError(envVar *envvar.EnvVar, originalKey string) (variant, error) {
+	if envVar.OnError != envvar.OnErrorOriginal {
+		return variant{}, newStatusError(http.StatusInternalServerError)
+	}
+	return variant{key: originalKey, cacheControl: "no-store", standIn: true}, nil
+}
+
+// produce writes the output of write through a pipe into the upload of key, and into the writer returned by inline if set
+// streamed tells whether any byte reached that writer, after which the response can't be taken back
+//
+// content type follows the encoded output, not the one stored with the original
+func produce(ctx context.Context, storageClient storage.Client, uploads *UploadLimiter, key string, contentType string, write func(w io.Writer) error, inline func(contentType string) io.Writer) (encodeErr error, uploadErr error, streamed bool) {
+	if uploads != nil {
+		if !uploads.tryAcquire() {
+			return produceQueued(ctx, storageClient, uploads, key, contentType, write, inline)
+		}
+		defer uploads.release()
+	}
+
+	pr, pw := io.Pipe()
+	encoded := make(chan error, 1)
+	go func() {
+		stopEncode := startPhase(ctx, "encode")
+		err := write(pw)
+		stopEncode()
+		pw.CloseWithError(err)
+		encoded <- err
+	}()
+
+	var body io.Reader = pr
+	var wc *writeCounter
+	if inline != nil {
+		wc = &writeCounter{w: inline(contentType)}
+		body = io.TeeReader(pr, wc)
+	}
+	stopUpload := startPhase(ctx, "upload")
+	uploadErr = storageClient.UploadObject(ctx, key, body, contentType)
+	stopUpload()
+	if uploadErr == nil {
+		// an upload skipped because the object exists may not read the body, the response still needs all of it
+		_, uploadErr = io.Copy(io.Discard, body)
+	} else if wc != nil {
+		// and so does a response whose upload failed, answered without the variant being stored
+		io.Copy(io.Discard, body)
+	}
+	// an upload giving up halfway leaves the encoder blocked on the pipe, closing it lets the encoder return
+	pr.Close()
+	encodeErr = <-encoded
+	if errors.Is(encodeErr, io.ErrClosedPipe) {
+		// the encoder was cut short by the upload, not failing on its own
+		encodeErr = nil
+	}
+	return encodeErr, uploadErr, wc != nil && wc.n > 0
+}
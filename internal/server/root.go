@@ -0,0 +1,37 @@
+package server
+
+import (
+	"io"
+	"net/http"
+)
+
+const usage = `image-server
+
+GET /{image}?w=[WIDTH]&h=[HEIGHT]&fm=[FORMAT]   resize and convert an original image
+GET /{image}/blurhash                           BlurHash of an original image
+GET /{image}/srcset?widths=[WIDTH,...]          srcset of resized variants
+GET /{image}/picture?widths=[WIDTH,...]         <picture> markup of resized variants
+GET /{image}/variants                           resized variants stored for an image
+POST /sprites                                   pack images into a sprite sheet
+POST /batch                                     resize many images at once
+GET /capabilities                               formats resized from and into
+`
+
+// rootHandler answers / with a short usage message
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, usage)
+}
+
+// defaultImageHandler answers / with the image named name, resized by the query like GET /{image} would
+func defaultImageHandler(name string, images http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.SetPathValue(slug, name)
+		images.ServeHTTP(w, r)
+	})
+}
+
+// faviconHandler keeps the favicon browsers ask for on their own from reaching the image handler
+func faviconHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestRoot(t *testing.T) {
+	tt := []struct {
+		testName     string
+		defaultImage string
+		target       string
+		// desired response status code, and Location or body
+		statusCode int
+		key        string
+		body       string
+	}{
+		{testName: "usage", target: "/", statusCode: http.StatusOK, body: usage},
+		{testName: "usage ignores the query", target: "/?w=100", statusCode: http.StatusOK, body: usage},
+		{testName: "default image", defaultImage: "imagePNG.png", target: "/", statusCode: http.StatusSeeOther, key: path.Join("stub-original-folder", "imagePNG.png")},
+		{testName: "default image resized", defaultImage: "imagePNG.png", target: "/?w=100", statusCode: http.StatusSeeOther, key: path.Join("stub-resized-folder", "imagePNG.png", "w100h0.png")},
+		{testName: "default image with invalid params", defaultImage: "imagePNG.png", target: "/?w=abc", statusCode: http.StatusBadRequest},
+		{testName: "missing default image", defaultImage: "noexist.png", target: "/", statusCode: http.StatusNotFound},
+		{testName: "other images still answered", defaultImage: "imagePNG.png", target: "/imageJPEG.jpeg?w=100", statusCode: http.StatusSeeOther, key: path.Join("stub-resized-folder", "imageJPEG.jpeg", "w100h0.jpeg")},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				DefaultImage:   tc.defaultImage,
+			}
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.key != "" {
+				assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(tc.key))
+			}
+			if tc.body != "" {
+				assertEqual(t, rr.Body.String(), tc.body)
+			}
+		})
+	}
+}
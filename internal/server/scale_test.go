@@ -0,0 +1,89 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestScale(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		MaxDimension:   20,
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code, and body or key and size of the variant
+		statusCode int
+		body       string
+		key        string
+		size       int
+	}{
+		{testName: "doubled", target: "/pixels.png?scale=2", statusCode: http.StatusSeeOther, key: "w0h0-scale2.png", size: 6},
+		{testName: "tripled into jpeg", target: "/pixels.png?scale=3&fm=jpeg", statusCode: http.StatusSeeOther, key: "w0h0-scale3.jpeg", size: 9},
+		{testName: "largest factor", target: "/pixels.png?scale=6", statusCode: http.StatusSeeOther, key: "w0h0-scale6.png", size: 18},
+		{testName: "scale 1 is the original", target: "/pixels.png?scale=1", statusCode: http.StatusSeeOther, key: path.Join(sev.FolderOriginal, "pixels.png")},
+		{testName: "larger than the max dimension", target: "/pixels.png?scale=7", statusCode: http.StatusBadRequest, body: "scale=7 gives a 21x21 image, larger than the max dimension 20"},
+		{testName: "above the max factor", target: "/pixels.png?scale=9", statusCode: http.StatusBadRequest, body: `scale must be an integer between 1 and 8, got "9"`},
+		{testName: "not an integer", target: "/pixels.png?scale=1.5", statusCode: http.StatusBadRequest, body: `scale must be an integer between 1 and 8, got "1.5"`},
+		{testName: "with w", target: "/pixels.png?scale=2&w=10", statusCode: http.StatusBadRequest, body: "scale can't be combined with w, h or upscale=0"},
+		{testName: "with upscale=0", target: "/pixels.png?scale=2&upscale=0", statusCode: http.StatusBadRequest, body: "scale can't be combined with w, h or upscale=0"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			// 3 x 3 squares of a pixel
+			ssc.storage[path.Join(sev.FolderOriginal, "pixels.png")] = stubObject{data: newCheckerPNG(t, 3, 1), contentType: "image/png"}
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			if tc.size == 0 {
+				assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(tc.key))
+				assertEqual(t, ssc.execution[exeKeyUpload], false)
+				return
+			}
+			key := path.Join(sev.FolderResized, "pixels.png", tc.key)
+			assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(key))
+			img, _, err := image.Decode(bytes.NewReader(ssc.storage[key].data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, img.Bounds(), image.Rect(0, 0, tc.size, tc.size))
+			if !strings.HasSuffix(tc.key, ".png") {
+				return
+			}
+			// every pixel keeps the color of the pixel of the original it was scaled from
+			scale := tc.size / 3
+			for y := range tc.size {
+				for x := range tc.size {
+					want := uint32(0)
+					if (x/scale+y/scale)%2 == 1 {
+						want = 0xffff
+					}
+					if r, _, _, _ := img.At(x, y).RGBA(); r != want {
+						t.Fatalf("pixel (%d, %d) has red %d, want %d", x, y, r, want)
+					}
+				}
+			}
+		})
+	}
+}
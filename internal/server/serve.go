@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+	"golang.org/x/net/http/httpguts"
+)
+
+const (
+	queryDownload = "download"
+
+	maxDownloadFilenameLength = 128
+	// defaultDownloadFilename names the attachment when neither ?download nor the image path leave a filename
+	defaultDownloadFilename = "image"
+)
+
+// downloadFilename resolves ?download into the filename of the attachment, "" when the image isn't downloaded
+//
+// "1" or "true" names the attachment after the requested image, any other value is used as the filename
+// after replacing everything but ASCII letters, digits, dots, dashes and underscores,
+// falling back to the image path and then to "image" when nothing is left of it
+func downloadFilename(q url.Values, imagePath string) string {
+	value := q.Get(queryDownload)
+	switch value {
+	case "", "0", "false":
+		return ""
+	case "1", "true":
+		value = imagePath
+	}
+
+	for _, name := range []string{value, imagePath} {
+		if filename := sanitizeFilename(name); filename != "" {
+			return filename
+		}
+	}
+	return defaultDownloadFilename
+}
+
+// sanitizeFilename keeps ASCII letters, digits, dots, dashes and underscores of name, without leading dots,
+// "" when nothing is left
+func sanitizeFilename(name string) string {
+	filename := strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+	filename = strings.TrimLeft(filename, ".")
+	if len(filename) > maxDownloadFilenameLength {
+		filename = filename[len(filename)-maxDownloadFilenameLength:]
+	}
+	return filename
+}
+
+// redirectStatus defaults to 303 See Other, some clients only follow 302 Found or 307 Temporary Redirect properly
+func redirectStatus(envVar *envvar.EnvVar) int {
+	if envVar.RedirectStatus == 0 {
+		return http.StatusSeeOther
+	}
+	return envVar.RedirectStatus
+}
+
+// metaCacheControl is the user metadata of an original setting the Cache-Control of its images, like max-age=60 for avatars
+const metaCacheControl = "cache-control"
+
+// imageCacheControls are the Cache-Control of the images of an original, of the original itself and of its resized variants:
+// the one the original sets for all of its images, or else CACHE_CONTROL, or else the ones built from the directives of each kind
+func imageCacheControls(ctx context.Context, logger *slog.Logger, envVar *envvar.EnvVar, originalKey string, metadata map[string]string) (original string, resized string) {
+	value := strings.TrimSpace(metadata[metaCacheControl])
+	if value != "" {
+		if httpguts.ValidHeaderFieldValue(value) {
+			return value, value
+		}
+		logger.WarnContext(ctx, "invalid cache-control metadata, using the default", "key", originalKey, "value", value)
+	}
+	if envVar.CacheControl != "" {
+		return envVar.CacheControl, envVar.CacheControl
+	}
+	return buildCacheControl(envVar.CacheOriginal), buildCacheControl(envVar.CacheResized)
+}
+
+// buildCacheControl is the public Cache-Control with the directives of cd, "" when it leaves them all out
+func buildCacheControl(cd envvar.CacheDirectives) string {
+	var directives []string
+	if cd.MaxAge > 0 {
+		directives = append(directives, "max-age="+strconv.Itoa(cd.MaxAge))
+	}
+	// shared caches, like CDNs, keep the image for s-maxage instead of max-age
+	if cd.SMaxAge > 0 {
+		directives = append(directives, "s-maxage="+strconv.Itoa(cd.SMaxAge))
+	}
+	if cd.StaleWhileRevalidate > 0 {
+		directives = append(directives, "stale-while-revalidate="+strconv.Itoa(cd.StaleWhileRevalidate))
+	}
+	if len(directives) == 0 {
+		return ""
+	}
+	return "public, " + strings.Join(directives, ", ")
+}
+
+func setImageHeaders(w http.ResponseWriter, contentType string, cacheControl string, filename string, contentDPR string) {
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	if cacheControl != "" {
+		w.Header().Set("Cache-Control", cacheControl)
+	}
+	if filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+	if contentDPR != "" {
+		w.Header().Set("Content-DPR", contentDPR)
+	}
+}
+
+// imageWriter streams a variant into the response as it is encoded, sending the headers with its first bytes
+type imageWriter struct {
+	w            http.ResponseWriter
+	contentType  string
+	cacheControl string
+	filename     string
+	contentDPR   string
+	started      bool
+}
+
+func (iw *imageWriter) Write(b []byte) (int, error) {
+	if !iw.started {
+		setImageHeaders(iw.w, iw.contentType, iw.cacheControl, iw.filename, iw.contentDPR)
+		iw.started = true
+	}
+	return iw.w.Write(b)
+}
+
+// objectContentType is the content type of the object at key starting with head,
+// sniffed from head, or else named by the extension of key, or else the one stored with it
+func objectContentType(key string, stored string, head []byte) string {
+	if sniffed := http.DetectContentType(head); strings.HasPrefix(sniffed, "image/") {
+		return sniffed
+	}
+	if format := formatFromExtension(strings.TrimPrefix(path.Ext(key), ".")); format != "" {
+		return mimeType(format)
+	}
+	// passed through originals, like image/svg+xml for svg, which isn't sniffed
+	if t := mime.TypeByExtension(path.Ext(key)); t != "" {
+		return t
+	}
+	return stored
+}
+
+// serveObject streams a stored object into the response instead of redirecting to it
+func serveObject(w http.ResponseWriter, r *http.Request, logger *slog.Logger, storageClient storage.Client, key string, cacheControl string, filename string, contentDPR string) {
+	body, contentType, err := storageClient.DownloadObject(r.Context(), key)
+	if err != nil {
+		if se := storageStatus(err); se != nil {
+			http.Error(w, se.message, se.code)
+			return
+		}
+		logger.ErrorContext(r.Context(), "downloading image", "key", key, "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	// the content type stored with an original may be missing or wrong, so the bytes themselves are trusted first
+	br := bufio.NewReaderSize(body, 512)
+	head, _ := br.Peek(512)
+	setImageHeaders(w, objectContentType(key, contentType, head), cacheControl, filename, contentDPR)
+	if r.Method == http.MethodHead {
+		// only the start of the object was read, to sniff its content type
+		return
+	}
+	if _, err := io.Copy(w, br); err != nil {
+		logger.WarnContext(r.Context(), "streaming image", "key", key, "error", err)
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"image"
 	"log/slog"
 	"net/http"
 
@@ -11,10 +12,141 @@ import (
 
 const slug = "image"
 
-func New(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar) http.Handler {
+const (
+	spritePath = "/sprites"
+	batchPath  = "/batch"
+	copyPath   = "/admin/copy"
+	statsPath  = "/admin/stats"
+)
+
+// Option configures what New can't read from the env vars, like images loaded at startup
+type Option func(*options)
+
+type options struct {
+	watermark image.Image
+	budget    *VariantBudget
+	originals OriginalCache
+	memory    *MemoryBudget
+	uploads   *UploadLimiter
+	presets   *Presets
+	janitor   *Janitor
+	buckets   map[string]storage.Client
+	caches    map[string]CacheStatser
+}
+
+// WithWatermark sets the image overlaid on outputs requested with ?watermark=1
+func WithWatermark(watermark image.Image) Option {
+	return func(o *options) {
+		o.watermark = watermark
+	}
+}
+
+// WithVariantBudget records the use of every resized variant so that budget can evict the least used ones
+func WithVariantBudget(budget *VariantBudget) Option {
+	return func(o *options) {
+		o.budget = budget
+	}
+}
+
+// WithOriginalCache keeps the originals decoded for resizing in cache, for the next resizes of the same originals
+func WithOriginalCache(cache OriginalCache) Option {
+	return func(o *options) {
+		o.originals = cache
+	}
+}
+
+// WithMemoryBudget refuses resizes with 503 Service Unavailable while the ones in flight take up budget
+func WithMemoryBudget(budget *MemoryBudget) Option {
+	return func(o *options) {
+		o.memory = budget
+	}
+}
+
+// WithUploadLimiter bounds the uploads of new variants in flight with uploads
+func WithUploadLimiter(uploads *UploadLimiter) Option {
+	return func(o *options) {
+		o.uploads = uploads
+	}
+}
+
+// WithPresets expands ?t=[NAME] into the query params of the preset it names
+func WithPresets(presets *Presets) Option {
+	return func(o *options) {
+		o.presets = presets
+	}
+}
+
+// WithJanitor records the use of every resized variant so that janitor only deletes the ones unused for long
+func WithJanitor(janitor *Janitor) Option {
+	return func(o *options) {
+		o.janitor = janitor
+	}
+}
+
+// WithCacheStats reports the counters of cache at GET /admin/stats under name
+func WithCacheStats(name string, cache CacheStatser) Option {
+	return func(o *options) {
+		if o.caches == nil {
+			o.caches = make(map[string]CacheStatser)
+		}
+		o.caches[name] = cache
+	}
+}
+
+// WithBuckets serves the buckets configured in envvar.EnvVar.Buckets through their clients, by the name selecting them
+func WithBuckets(buckets map[string]storage.Client) Option {
+	return func(o *options) {
+		o.buckets = buckets
+	}
+}
+
+func New(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, opts ...Option) http.Handler {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	logger = slog.New(requestIDHandler{logger.Handler()})
+
+	var h http.Handler = newMux(logger, storageClient, envVar, o)
+	if len(o.buckets) > 0 {
+		buckets := make(map[string]http.Handler, len(o.buckets))
+		for name, client := range o.buckets {
+			buckets[name] = newMux(logger, client, envVar, o)
+		}
+		h = selectBucket(envVar.TrustedProxies, h, buckets)
+	}
+
+	return withClientIP(envVar.TrustedProxies, withRequestID(logRequests(logger, withHeaders(envVar.ExtraHeaders, withTenant(envVar.TenantHeader, envVar.TrustedProxies, cleanPaths(envVar.MalformedPaths, h))))))
+}
+
+// newMux routes the requests answered from the bucket of storageClient
+func newMux(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, o options) http.Handler {
 	mux := http.NewServeMux()
 
-	mux.HandleFunc(fmt.Sprintf("GET /{%s}", slug), handler(logger, storageClient, envVar))
+	images := timeRequests(envVar.TimingAllowOrigin, http.HandlerFunc(handler(logger, storageClient, envVar, o)))
+	if envVar.DefaultImage != "" {
+		mux.Handle("GET /{$}", defaultImageHandler(envVar.DefaultImage, images))
+	} else {
+		mux.HandleFunc("GET /{$}", rootHandler)
+	}
+	mux.HandleFunc("GET /favicon.ico", faviconHandler)
+	mux.HandleFunc("GET "+capabilitiesPath, capabilitiesHandler(logger, envVar))
+	mux.Handle(fmt.Sprintf("GET /{%s}", slug), images)
+	mux.HandleFunc(fmt.Sprintf("GET /{%s}/blurhash", slug), refuseReadOnly(envVar, blurHashHandler(logger, storageClient, envVar)))
+	mux.HandleFunc(fmt.Sprintf("GET /{%s}/srcset", slug), srcsetHandler(logger, storageClient, envVar, o))
+	mux.HandleFunc(fmt.Sprintf("GET /{%s}/picture", slug), pictureHandler(logger, envVar, o))
+	mux.HandleFunc(fmt.Sprintf("GET /{%s}/variants", slug), variantsHandler(logger, storageClient, envVar))
+	mux.HandleFunc(fmt.Sprintf("GET /{%s}/compare", slug), compareHandler(logger, storageClient, envVar, o))
+	mux.HandleFunc(fmt.Sprintf("GET /{%s}/immutable", slug), refuseReadOnly(envVar, immutableURLHandler(logger, storageClient, envVar, o)))
+	mux.HandleFunc("POST "+spritePath, refuseReadOnly(envVar, spriteHandler(logger, storageClient, envVar)))
+	mux.HandleFunc("POST "+batchPath, batchHandler(logger, storageClient, envVar, o))
+	mux.HandleFunc("POST "+copyPath, refuseReadOnly(envVar, copyHandler(logger, storageClient, envVar)))
+	mux.HandleFunc("GET "+statsPath, statsHandler(envVar, o))
+
+	// immutable paths are routed apart, "/i/{file}" would conflict with "/{image}/blurhash" and the likes
+	root := http.NewServeMux()
+	root.Handle("/", mux)
+	root.HandleFunc("GET "+immutablePath+"{"+immutableFile+"}", immutableHandler(logger, storageClient, envVar, o))
 
-	return mux
+	return traceRequests(root)
 }
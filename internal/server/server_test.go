@@ -3,8 +3,12 @@ package server
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/jpeg"
 	"image/png"
 	"io"
@@ -12,15 +16,25 @@ import (
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
-	"path/filepath"
+	"net/netip"
+	"net/url"
+	"path"
 	"slices"
 	"strconv"
 	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/buckket/go-blurhash"
 	"github.com/neilotoole/slogt"
 	"github.com/obzva/image-server/internal/envvar"
 	"github.com/obzva/image-server/internal/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 type stubImageBody struct {
@@ -32,8 +46,14 @@ func (sib *stubImageBody) Close() error {
 }
 
 type stubObject struct {
-	body        io.ReadCloser
+	data        []byte
 	contentType string
+	// key of the object a link stands for
+	link         string
+	lastModified time.Time
+	metadata     map[string]string
+	// ETag or version ID answered by ObjectMetadata
+	version string
 }
 
 func newStubObject(format string, width, height int) stubObject {
@@ -54,7 +74,7 @@ func newStubObject(format string, width, height int) stubObject {
 	}
 
 	return stubObject{
-		body:        sib,
+		data:        b.Bytes(),
 		contentType: "image/" + format,
 	}
 }
@@ -63,6 +83,8 @@ type stubStorageClient struct {
 	storage    map[string]stubObject
 	bucketName string
 	execution  map[string]bool
+	// every key the handler asked for
+	keys []string
 }
 
 const (
@@ -82,36 +104,49 @@ func newStubStorageClient(envVar *envvar.EnvVar) *stubStorageClient {
 	ssc.execution[exeKeyDownload] = false
 	ssc.execution[exeKeyUpload] = false
 
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "imageJPEG.jpeg")] = newStubObject("jpeg", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "imageJPEG-2.jpeg")] = newStubObject("jpeg", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "imageJPEG-3.jpeg")] = newStubObject("jpeg", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderResized, "imageJPEG", "w600h900.jpeg")] = newStubObject("jpeg", 600, 900)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "imageJPG.jpg")] = newStubObject("jpeg", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "imageJPG-2.jpg")] = newStubObject("jpeg", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "imageJPG-3.jpg")] = newStubObject("jpeg", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderResized, "imageJPG", "w600h900.jpg")] = newStubObject("jpeg", 600, 900)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "imagePNG.png")] = newStubObject("png", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "imagePNG-2.png")] = newStubObject("png", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "imagePNG-3.png")] = newStubObject("png", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderResized, "imagePNG", "w600h900.png")] = newStubObject("png", 600, 900)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "ratioJPEG.jpeg")] = newStubObject("jpeg", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderResized, "ratioJPEG", "w600h0.jpeg")] = newStubObject("jpeg", 600, 600)
-	ssc.storage[filepath.Join(envVar.FolderResized, "ratioJPEG", "w0h600.jpeg")] = newStubObject("jpeg", 600, 600)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "ratioJPG.jpg")] = newStubObject("jpg", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderResized, "ratioJPG", "w600h0.jpg")] = newStubObject("jpg", 600, 600)
-	ssc.storage[filepath.Join(envVar.FolderResized, "ratioJPG", "w0h600.jpg")] = newStubObject("jpg", 600, 600)
-	ssc.storage[filepath.Join(envVar.FolderOriginal, "ratioPNG.png")] = newStubObject("png", 300, 300)
-	ssc.storage[filepath.Join(envVar.FolderResized, "ratioPNG", "w600h0.png")] = newStubObject("png", 600, 600)
-	ssc.storage[filepath.Join(envVar.FolderResized, "ratioPNG", "w0h600.png")] = newStubObject("png", 600, 600)
+	ssc.storage[path.Join(envVar.FolderOriginal, "imageJPEG.jpeg")] = newStubObject("jpeg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderOriginal, "imageJPEG-2.jpeg")] = newStubObject("jpeg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderOriginal, "imageJPEG-3.jpeg")] = newStubObject("jpeg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderResized, "imageJPEG.jpeg", "w600h900.jpeg")] = newStubObject("jpeg", 600, 900)
+	ssc.storage[path.Join(envVar.FolderOriginal, "imageJPG.jpg")] = newStubObject("jpeg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderOriginal, "imageJPG-2.jpg")] = newStubObject("jpeg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderOriginal, "imageJPG-3.jpg")] = newStubObject("jpeg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderResized, "imageJPG.jpg", "w600h900.jpg")] = newStubObject("jpeg", 600, 900)
+	ssc.storage[path.Join(envVar.FolderOriginal, "imagePNG.png")] = newStubObject("png", 300, 300)
+	ssc.storage[path.Join(envVar.FolderOriginal, "imagePNG-2.png")] = newStubObject("png", 300, 300)
+	ssc.storage[path.Join(envVar.FolderOriginal, "imagePNG-3.png")] = newStubObject("png", 300, 300)
+	ssc.storage[path.Join(envVar.FolderResized, "imagePNG.png", "w600h900.png")] = newStubObject("png", 600, 900)
+	ssc.storage[path.Join(envVar.FolderOriginal, "ratioJPEG.jpeg")] = newStubObject("jpeg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderResized, "ratioJPEG.jpeg", "w600h0.jpeg")] = newStubObject("jpeg", 600, 600)
+	ssc.storage[path.Join(envVar.FolderResized, "ratioJPEG.jpeg", "w0h600.jpeg")] = newStubObject("jpeg", 600, 600)
+	ssc.storage[path.Join(envVar.FolderOriginal, "ratioJPG.jpg")] = newStubObject("jpg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderResized, "ratioJPG.jpg", "w600h0.jpg")] = newStubObject("jpg", 600, 600)
+	ssc.storage[path.Join(envVar.FolderResized, "ratioJPG.jpg", "w0h600.jpg")] = newStubObject("jpg", 600, 600)
+	ssc.storage[path.Join(envVar.FolderOriginal, "ratioPNG.png")] = newStubObject("png", 300, 300)
+	ssc.storage[path.Join(envVar.FolderResized, "ratioPNG.png", "w600h0.png")] = newStubObject("png", 600, 600)
+	ssc.storage[path.Join(envVar.FolderResized, "ratioPNG.png", "w0h600.png")] = newStubObject("png", 600, 600)
+	ssc.storage[path.Join(envVar.FolderOriginal, "upperJPEG.JPEG")] = newStubObject("jpeg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderOriginal, "upperJPG.JPG")] = newStubObject("jpeg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderOriginal, "upperPNG.PNG")] = newStubObject("png", 300, 300)
+	ssc.storage[path.Join(envVar.FolderOriginal, "twin.jpg")] = newStubObject("jpeg", 300, 300)
+	ssc.storage[path.Join(envVar.FolderOriginal, "twin.png")] = newStubObject("png", 300, 300)
+	// original stored without a proper content type, and a .jpg that actually holds png data
+	mislabeled := newStubObject("jpeg", 300, 300)
+	mislabeled.contentType = "binary/octet-stream"
+	ssc.storage[path.Join(envVar.FolderOriginal, "mislabeled.jpeg")] = mislabeled
+	converted := newStubObject("png", 300, 300)
+	converted.contentType = "image/jpeg"
+	ssc.storage[path.Join(envVar.FolderOriginal, "converted.jpg")] = converted
 	return ssc
 }
 
 func (sc *stubStorageClient) ObjectURL(objectKey string) string {
-	return "https://test.test/" + filepath.Join(sc.bucketName, objectKey)
+	return "https://test.test/" + path.Join(sc.bucketName, objectKey)
 }
 
 func (sc *stubStorageClient) CheckObject(ctx context.Context, objectKey string) (bool, error) {
 	sc.execution[exeKeyCheck] = true
+	sc.keys = append(sc.keys, objectKey)
 	_, ok := sc.storage[objectKey]
 	if !ok {
 		return false, nil
@@ -119,25 +154,85 @@ func (sc *stubStorageClient) CheckObject(ctx context.Context, objectKey string)
 	return true, nil
 }
 
+func (sc *stubStorageClient) ObjectMetadata(ctx context.Context, objectKey string) (map[string]string, string, error) {
+	sc.execution[exeKeyCheck] = true
+	sc.keys = append(sc.keys, objectKey)
+	object, ok := sc.storage[objectKey]
+	if !ok {
+		return nil, "", storage.ErrNotFound
+	}
+	return object.metadata, object.version, nil
+}
+
 func (sc *stubStorageClient) DownloadObject(ctx context.Context, objectKey string) (body io.ReadCloser, contentType string, err error) {
 	sc.execution[exeKeyDownload] = true
+	sc.keys = append(sc.keys, objectKey)
 	object, ok := sc.storage[objectKey]
 	if !ok {
 		return nil, "", storage.ErrNotFound
 	}
-	return object.body, object.contentType, nil
+	// every download reads the object from the start
+	return &stubImageBody{Buffer: bytes.NewBuffer(object.data)}, object.contentType, nil
 }
 
 func (sc *stubStorageClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
 	sc.execution[exeKeyUpload] = true
-	img, format, err := image.Decode(body)
+	sc.keys = append(sc.keys, objectKey)
+	data, err := io.ReadAll(body)
 	if err != nil {
 		return err
 	}
-	sc.storage[objectKey] = newStubObject(format, img.Bounds().Dx(), img.Bounds().Dy())
+	sc.storage[objectKey] = stubObject{data: data, contentType: contentType, lastModified: time.Now()}
+	return nil
+}
+
+func (sc *stubStorageClient) CopyObject(ctx context.Context, srcKey string, dstKey string) error {
+	sc.keys = append(sc.keys, dstKey)
+	object, ok := sc.storage[srcKey]
+	if !ok {
+		return storage.ErrNotFound
+	}
+	sc.storage[dstKey] = object
+	return nil
+}
+
+func (sc *stubStorageClient) DeleteObject(ctx context.Context, objectKey string) error {
+	sc.keys = append(sc.keys, objectKey)
+	delete(sc.storage, objectKey)
+	return nil
+}
+
+func (sc *stubStorageClient) ListObjects(ctx context.Context, prefix string) ([]storage.Object, error) {
+	var objects []storage.Object
+	for key, object := range sc.storage {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, storage.Object{Key: key, LastModified: object.lastModified})
+		}
+	}
+	slices.SortFunc(objects, func(a, b storage.Object) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return objects, nil
+}
+
+func (sc *stubStorageClient) LinkObject(ctx context.Context, objectKey string, targetKey string) error {
+	sc.keys = append(sc.keys, objectKey)
+	sc.storage[objectKey] = stubObject{link: targetKey}
 	return nil
 }
 
+func (sc *stubStorageClient) ResolveObject(ctx context.Context, objectKey string) (string, error) {
+	sc.keys = append(sc.keys, objectKey)
+	object, ok := sc.storage[objectKey]
+	if !ok {
+		return "", storage.ErrNotFound
+	}
+	if object.link != "" {
+		return object.link, nil
+	}
+	return objectKey, nil
+}
+
 func TestHandler(t *testing.T) {
 	// stub logger
 	sl := slogt.New(t, slogt.Factory(func(w io.Writer) slog.Handler {
@@ -173,6 +268,8 @@ func TestHandler(t *testing.T) {
 		location string
 		// check executions
 		executions []string
+		// desired content type of the uploaded resized image
+		contentType string
 	}{
 		{
 			testName:   "check invalid image path",
@@ -186,6 +283,12 @@ func TestHandler(t *testing.T) {
 			statusCode: http.StatusBadRequest,
 			body:       errStrInvalidImagePath,
 		},
+		{
+			testName:   "check invalid image path before naming its download",
+			imageSlug:  "...?download=1",
+			statusCode: http.StatusBadRequest,
+			body:       errStrInvalidImagePath,
+		},
 		{
 			testName:   "image doesn't exist",
 			imageSlug:  "noexist.jpeg",
@@ -195,19 +298,19 @@ func TestHandler(t *testing.T) {
 		{
 			testName:   "redirect to original jpeg image",
 			imageSlug:  "imageJPEG.jpeg",
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderOriginal, "imageJPEG.jpeg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderOriginal, "imageJPEG.jpeg"),
 			executions: []string{exeKeyCheck},
 		},
 		{
 			testName:   "redirect to original jpg image",
 			imageSlug:  "imageJPG.jpg",
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderOriginal, "imageJPG.jpg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderOriginal, "imageJPG.jpg"),
 			executions: []string{exeKeyCheck},
 		},
 		{
 			testName:   "redirect to original png image",
 			imageSlug:  "imagePNG.png",
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderOriginal, "imagePNG.png"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderOriginal, "imagePNG.png"),
 			executions: []string{exeKeyCheck},
 		},
 		{
@@ -215,7 +318,7 @@ func TestHandler(t *testing.T) {
 			imageSlug:  "imageJPEG.jpeg",
 			width:      600,
 			height:     900,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imageJPEG", "w600h900.jpeg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w600h900.jpeg"),
 			executions: []string{exeKeyCheck},
 		},
 		{
@@ -223,7 +326,7 @@ func TestHandler(t *testing.T) {
 			imageSlug:  "imageJPG.jpg",
 			width:      600,
 			height:     900,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imageJPG", "w600h900.jpg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPG.jpg", "w600h900.jpg"),
 			executions: []string{exeKeyCheck},
 		},
 		{
@@ -231,91 +334,91 @@ func TestHandler(t *testing.T) {
 			imageSlug:  "imagePNG.png",
 			width:      600,
 			height:     900,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imagePNG", "w600h900.png"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w600h900.png"),
 			executions: []string{exeKeyCheck},
 		},
 		{
 			testName:   "redirect to already-resized jpeg image without height query",
 			imageSlug:  "ratioJPEG.jpeg",
 			width:      600,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "ratioJPEG", "w600h0.jpeg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "ratioJPEG.jpeg", "w600h0.jpeg"),
 			executions: []string{exeKeyCheck},
 		},
 		{
 			testName:   "redirect to already-resized jpg image without height query",
 			imageSlug:  "ratioJPG.jpg",
 			width:      600,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "ratioJPG", "w600h0.jpg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "ratioJPG.jpg", "w600h0.jpg"),
 			executions: []string{exeKeyCheck},
 		},
 		{
 			testName:   "redirect to already-resized png image without height query",
 			imageSlug:  "ratioPNG.png",
 			width:      600,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "ratioPNG", "w600h0.png"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "ratioPNG.png", "w600h0.png"),
 			executions: []string{exeKeyCheck},
 		},
 		{
 			testName:   "redirect to already-resized jpeg image without width query",
 			imageSlug:  "ratioJPEG.jpeg",
 			height:     600,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "ratioJPEG", "w0h600.jpeg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "ratioJPEG.jpeg", "w0h600.jpeg"),
 			executions: []string{exeKeyCheck},
 		},
 		{
 			testName:   "redirect to already-resized jpg image without width query",
 			imageSlug:  "ratioJPG.jpg",
 			height:     600,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "ratioJPG", "w0h600.jpg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "ratioJPG.jpg", "w0h600.jpg"),
 			executions: []string{exeKeyCheck},
 		},
 		{
 			testName:   "redirect to already-resized png image without width query",
 			imageSlug:  "ratioPNG.png",
 			height:     600,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "ratioPNG", "w0h600.png"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "ratioPNG.png", "w0h600.png"),
 			executions: []string{exeKeyCheck},
 		},
 		{
 			testName:   "resize the original image and redirect to the resized jpeg image without height query",
 			imageSlug:  "imageJPEG.jpeg",
 			width:      1200,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imageJPEG", "w1200h0.jpeg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w1200h0.jpeg"),
 			executions: []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
 		},
 		{
 			testName:   "resize the original image and redirect to the resized jpg image without height query",
 			imageSlug:  "imageJPG.jpg",
 			width:      1200,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imageJPG", "w1200h0.jpg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPG.jpg", "w1200h0.jpg"),
 			executions: []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
 		},
 		{
 			testName:   "resize the original image and redirect to the resized png image without height query",
 			imageSlug:  "imagePNG.png",
 			width:      1200,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imagePNG", "w1200h0.png"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w1200h0.png"),
 			executions: []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
 		},
 		{
 			testName:   "resize the original image and redirect to the resized jpeg image without width query",
 			imageSlug:  "imageJPEG-2.jpeg",
 			height:     1200,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imageJPEG-2", "w0h1200.jpeg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG-2.jpeg", "w0h1200.jpeg"),
 			executions: []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
 		},
 		{
 			testName:  "resize the original image and redirect to the resized jpg image without width query",
 			imageSlug: "imageJPG-2.jpg",
 			height:    1200,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imageJPG-2", "w0h1200.jpg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPG-2.jpg", "w0h1200.jpg"),
 			executions: []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
 		},
 		{
 			testName:  "resize the original image and redirect to the resized png image without width query",
 			imageSlug: "imagePNG-2.png",
 			height:    1200,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imagePNG-2", "w0h1200.png"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG-2.png", "w0h1200.png"),
 			executions: []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
 		},
 		{
@@ -323,7 +426,7 @@ func TestHandler(t *testing.T) {
 			imageSlug:  "imageJPEG-3.jpeg",
 			width: 900,
 			height:     1200,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imageJPEG-3", "w900h1200.jpeg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG-3.jpeg", "w900h1200.jpeg"),
 			executions: []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
 		},
 		{
@@ -331,7 +434,7 @@ func TestHandler(t *testing.T) {
 			imageSlug: "imageJPG-3.jpg",
 			width: 900,
 			height:    1200,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imageJPG-3", "w900h1200.jpg"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPG-3.jpg", "w900h1200.jpg"),
 			executions: []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
 		},
 		{
@@ -339,13 +442,86 @@ func TestHandler(t *testing.T) {
 			imageSlug: "imagePNG-3.png",
 			width: 900,
 			height:    1200,
-			location:   "https://test.test/" + filepath.Join(sev.BucketName, sev.FolderResized, "imagePNG-3", "w900h1200.png"),
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG-3.png", "w900h1200.png"),
 			executions: []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
 		},
+		{
+			testName:   "uppercase extension of an original is matched case-insensitively",
+			imageSlug:  "upperJPG.JPG",
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderOriginal, "upperJPG.JPG"),
+			executions: []string{exeKeyCheck},
+		},
+		{
+			testName:   "original key keeps its casing",
+			imageSlug:  "upperJPG.jpg",
+			statusCode: http.StatusNotFound,
+			body:       http.StatusText(http.StatusNotFound),
+		},
+		{
+			testName:    "resize the original image with uppercase JPEG extension",
+			imageSlug:   "upperJPEG.JPEG",
+			width:       100,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "upperJPEG.JPEG", "w100h0.JPEG"),
+			executions:  []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
+			contentType: "image/jpeg",
+		},
+		{
+			testName:    "resize the original image with uppercase JPG extension",
+			imageSlug:   "upperJPG.JPG",
+			width:       100,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "upperJPG.JPG", "w100h0.JPG"),
+			executions:  []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
+			contentType: "image/jpeg",
+		},
+		{
+			testName:    "resize the original image with uppercase PNG extension",
+			imageSlug:   "upperPNG.PNG",
+			width:       100,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "upperPNG.PNG", "w100h0.PNG"),
+			executions:  []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
+			contentType: "image/png",
+		},
+		{
+			testName:    "resize the jpg original sharing its name with a png original",
+			imageSlug:   "twin.jpg",
+			width:       100,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "twin.jpg", "w100h0.jpg"),
+			executions:  []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
+			contentType: "image/jpeg",
+		},
+		{
+			testName:    "resize the png original sharing its name with a jpg original",
+			imageSlug:   "twin.png",
+			width:       100,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "twin.png", "w100h0.png"),
+			executions:  []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
+			contentType: "image/png",
+		},
+		{
+			testName:    "store the resized image with the content type of the encoded output, not the original's",
+			imageSlug:   "mislabeled.jpeg",
+			width:       100,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "mislabeled.jpeg", "w100h0.jpeg"),
+			executions:  []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
+			contentType: "image/jpeg",
+		},
+		{
+			// a .jpg variant is a jpeg, whatever the original turns out to be
+			testName:    "encode the resized image in the format of the extension, not of the decoded original",
+			imageSlug:   "converted.jpg",
+			width:       100,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "converted.jpg", "w100h0.jpg"),
+			executions:  []string{exeKeyCheck, exeKeyDownload, exeKeyUpload},
+			contentType: "image/jpeg",
+		},
 	}
 
 	for _, tc := range tt {
 		t.Run(tc.testName, func(t *testing.T) {
+			for e := range ssc.execution {
+				ssc.execution[e] = false
+			}
+
 			rr := httptest.NewRecorder()
 			req := httptest.NewRequest(http.MethodGet, "/"+tc.imageSlug, nil)
 			if tc.width != 0 || tc.height != 0 {
@@ -390,9 +566,12 @@ func TestHandler(t *testing.T) {
 					if slices.Contains(tc.executions, e) {
 						if e == exeKeyUpload {
 							splitSlug := strings.Split(tc.imageSlug, ".")
-							resizedKey := filepath.Join(sev.FolderResized, splitSlug[0], fmt.Sprintf("w%dh%d.%s", tc.width, tc.height, splitSlug[1]))
-							_, ok := ssc.storage[resizedKey]
+							resizedKey := path.Join(sev.FolderResized, tc.imageSlug, fmt.Sprintf("w%dh%d.%s", tc.width, tc.height, splitSlug[1]))
+							object, ok := ssc.storage[resizedKey]
 							assertEqual(t, ok, true)
+							if tc.contentType != "" {
+								assertEqual(t, object.contentType, tc.contentType)
+							}
 						}
 						assertEqual(t, ssc.execution[e], true)
 					} else {
@@ -402,11 +581,3098 @@ func TestHandler(t *testing.T) {
 			}
 		})
 	}
+
+	// storage keys use forward slashes whatever the OS separator is
+	for _, key := range ssc.keys {
+		if strings.Contains(key, "\\") {
+			t.Errorf("key %q contains a backslash", key)
+		}
+	}
 }
 
-func assertEqual[U comparable](t *testing.T, got, want U) {
-	t.Helper()
-	if got != want {
-		t.Errorf("got %v; want %v", got, want)
+func TestOutputFormat(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		webp     bool
+		// only meaningful on a server without webp support
+		noWebP bool
+		// desired response status code and body
+		statusCode int
+		body       string
+		// desired Location header of redirection
+		location string
+		// desired content type of the uploaded variant, if any
+		contentType string
+	}{
+		{
+			testName:   "unknown output format",
+			target:     "/imageJPEG.jpeg?w=100&fm=bogus",
+			statusCode: http.StatusBadRequest,
+			body:       "fm must be one of jpeg, jpg, png, webp, ico or auto",
+		},
+		{
+			testName:   "webp options without webp output",
+			target:     "/imageJPEG.jpeg?w=100&webp_quality=50",
+			statusCode: http.StatusBadRequest,
+			body:       "webp_quality and webp_lossless require fm=webp",
+		},
+		{
+			testName:   "webp quality out of range",
+			target:     "/imageJPEG.jpeg?w=100&fm=webp&webp_quality=101",
+			webp:       true,
+			statusCode: http.StatusBadRequest,
+			body:       "webp_quality must be an integer between 0 and 100",
+		},
+		{
+			testName:   "webp quality with lossless",
+			target:     "/imageJPEG.jpeg?w=100&fm=webp&webp_lossless=1&webp_quality=50",
+			webp:       true,
+			statusCode: http.StatusBadRequest,
+			body:       "webp_quality can't be combined with webp_lossless",
+		},
+		{
+			testName:   "invalid webp lossless",
+			target:     "/imageJPEG.jpeg?w=100&fm=webp&webp_lossless=maybe",
+			webp:       true,
+			statusCode: http.StatusBadRequest,
+			body:       "webp_lossless must be a boolean",
+		},
+		{
+			testName:   "fallback format without fm",
+			target:     "/imageJPEG.jpeg?w=100&fallback_format=png",
+			statusCode: http.StatusBadRequest,
+			body:       "fallback_format requires fm",
+		},
+		{
+			testName:   "unknown fallback format",
+			target:     "/imageJPEG.jpeg?w=100&fm=webp&fallback_format=gif",
+			statusCode: http.StatusBadRequest,
+			body:       "fallback_format must be one of jpeg, jpg, png or ico, or webp when the server supports it",
+		},
+		{
+			testName:    "fallback format unused when webp is supported",
+			target:      "/imagePNG.png?w=100&fm=webp&webp_quality=50&fallback_format=jpg",
+			webp:        true,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w100h0-q50.webp"),
+			contentType: "image/webp",
+		},
+		{
+			testName:    "fall back when webp is unsupported",
+			target:      "/imagePNG.png?w=100&fm=webp&webp_quality=50&fallback_format=jpg",
+			noWebP:      true,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w100h0.jpeg"),
+			contentType: "image/jpeg",
+		},
+		{
+			testName: "output format of the original redirects to the original",
+			target:   "/imageJPG.jpg?fm=jpeg",
+			location: "https://test.test/" + path.Join(sev.BucketName, sev.FolderOriginal, "imageJPG.jpg"),
+		},
+		{
+			testName:    "output format of the original shares the variant requested without fm",
+			target:      "/imageJPG.jpg?w=600&h=900&fm=jpeg",
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPG.jpg", "w600h900.jpg"),
+			contentType: "image/jpeg",
+		},
+		{
+			testName:    "convert the original without resizing it",
+			target:      "/imageJPG.jpg?fm=png",
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPG.jpg", "w0h0.png"),
+			contentType: "image/png",
+		},
+		{
+			testName:    "convert into webp",
+			target:      "/imagePNG.png?w=100&fm=webp",
+			webp:        true,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w100h0.webp"),
+			contentType: "image/webp",
+		},
+		{
+			testName:    "convert into lossy webp",
+			target:      "/imagePNG.png?w=100&fm=webp&webp_quality=50",
+			webp:        true,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w100h0-q50.webp"),
+			contentType: "image/webp",
+		},
+		{
+			testName:    "convert into lossless webp",
+			target:      "/imagePNG.png?w=100&fm=webp&webp_lossless=1",
+			webp:        true,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w100h0-lossless.webp"),
+			contentType: "image/webp",
+		},
+		{
+			testName:    "convert a png into jpeg",
+			target:      "/imagePNG.png?w=300&fm=jpeg",
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w300h0.jpeg"),
+			contentType: "image/jpeg",
+		},
+		{
+			testName:    "convert a jpeg into png",
+			target:      "/imageJPEG.jpeg?w=100&fm=png",
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w100h0.png"),
+			contentType: "image/png",
+		},
+		{
+			// converted.jpg is a png, fm names the format of its extension
+			testName:    "convert a mislabeled png into the format of its extension",
+			target:      "/converted.jpg?w=100&fm=jpeg",
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "converted.jpg", "w100h0.jpg"),
+			contentType: "image/jpeg",
+		},
+		{
+			testName:    "convert a mislabeled png into png",
+			target:      "/converted.jpg?w=100&fm=png",
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "converted.jpg", "w100h0.png"),
+			contentType: "image/png",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			if tc.webp && !outputSupported(formatWebP) {
+				t.Skip("webp output requires a cgo build")
+			}
+			if tc.noWebP && outputSupported(formatWebP) {
+				t.Skip("webp output is supported by cgo builds")
+			}
+
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			if tc.statusCode != 0 {
+				assertEqual(t, rr.Code, tc.statusCode)
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+
+			assertEqual(t, rr.Code, http.StatusSeeOther)
+			assertEqual(t, rr.Header().Get("Location"), tc.location)
+			if tc.contentType != "" {
+				key := strings.TrimPrefix(tc.location, "https://test.test/"+sev.BucketName+"/")
+				object, ok := ssc.storage[key]
+				assertEqual(t, ok, true)
+				assertEqual(t, object.contentType, tc.contentType)
+				// the bytes are in the format of the content type
+				_, format, err := image.DecodeConfig(bytes.NewReader(object.data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				assertEqual(t, mimeType(format), tc.contentType)
+			}
+		})
+	}
+}
+
+func TestPad(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		ServeMode:      envvar.ServeModeInline,
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code and body
+		statusCode int
+		body       string
+		// desired key of the uploaded variant
+		resizedKey string
+		// desired colors of the padding and of the fitted image
+		padding color.RGBA
+		image   color.RGBA
+	}{
+		{
+			testName:   "pad requires both dimensions",
+			target:     "/imageJPEG.jpeg?w=200&pad=1",
+			statusCode: http.StatusBadRequest,
+			body:       "pad requires both w and h",
+		},
+		{
+			testName:   "bg requires pad",
+			target:     "/imageJPEG.jpeg?w=200&h=100&bg=ffffff",
+			statusCode: http.StatusBadRequest,
+			body:       "bg requires pad=1",
+		},
+		{
+			testName:   "invalid bg",
+			target:     "/imageJPEG.jpeg?w=200&h=100&pad=1&bg=white",
+			statusCode: http.StatusBadRequest,
+			body:       "bg must be a hex color like ffffff or ffffff80",
+		},
+		{
+			testName:   "jpeg is padded with white by default",
+			target:     "/imageJPEG.jpeg?w=200&h=100&pad=1",
+			resizedKey: path.Join(sev.FolderResized, "imageJPEG.jpeg", "w200h100-padffffffff.jpeg"),
+			padding:    color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+			image:      color.RGBA{A: 0xff},
+		},
+		{
+			testName:   "png is padded with transparency by default",
+			target:     "/imagePNG.png?w=200&h=100&pad=1",
+			resizedKey: path.Join(sev.FolderResized, "imagePNG.png", "w200h100-pad00000000.png"),
+		},
+		{
+			testName:   "pad with the given bg",
+			target:     "/imageJPEG.jpeg?w=100&h=200&pad=1&bg=ff0000",
+			resizedKey: path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h200-padff0000ff.jpeg"),
+			padding:    color.RGBA{R: 0xff, A: 0xff},
+			image:      color.RGBA{A: 0xff},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			if tc.statusCode != 0 {
+				assertEqual(t, rr.Code, tc.statusCode)
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+
+			assertEqual(t, rr.Code, http.StatusOK)
+			_, ok := ssc.storage[tc.resizedKey]
+			assertEqual(t, ok, true)
+
+			img, _, err := image.Decode(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := img.Bounds()
+			center := img.At(b.Dx()/2, b.Dy()/2)
+			corner := img.At(2, 2)
+			assertColor(t, corner, tc.padding)
+			assertColor(t, center, tc.image)
+		})
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		ServeMode:      envvar.ServeModeInline,
+	}
+
+	red := image.NewRGBA(image.Rect(0, 0, 20, 20))
+	draw.Draw(red, red.Bounds(), image.NewUniform(color.RGBA{R: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	var b bytes.Buffer
+	if err := png.Encode(&b, red); err != nil {
+		t.Fatal(err)
+	}
+	ssc := newStubStorageClient(sev)
+	ssc.storage["watermark.png"] = stubObject{data: b.Bytes(), contentType: "image/png"}
+
+	watermark, err := LoadWatermark(context.Background(), ssc, "watermark.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadWatermark(context.Background(), ssc, "noexist.png"); err == nil {
+		t.Error("want error loading a missing watermark, got nil")
+	}
+
+	tt := []struct {
+		testName  string
+		target    string
+		watermark image.Image
+		// desired response status code and body
+		statusCode int
+		body       string
+		// desired key of the uploaded variant
+		resizedKey string
+		// desired colors in the corners
+		northwest color.RGBA
+		southeast color.RGBA
+	}{
+		{
+			testName:   "watermark isn't configured",
+			target:     "/imageJPEG.jpeg?w=100&watermark=1",
+			statusCode: http.StatusBadRequest,
+			body:       "watermark is not configured on this server",
+		},
+		{
+			testName:   "invalid position",
+			target:     "/imageJPEG.jpeg?w=100&watermark=1&wm_pos=top",
+			watermark:  watermark,
+			statusCode: http.StatusBadRequest,
+			body:       "wm_pos must be one of center, north, south, east, west, northeast, northwest, southeast or southwest",
+		},
+		{
+			testName:   "invalid opacity",
+			target:     "/imageJPEG.jpeg?w=100&watermark=1&wm_opacity=2",
+			watermark:  watermark,
+			statusCode: http.StatusBadRequest,
+			body:       "wm_opacity must be a number between 0 and 1",
+		},
+		{
+			testName:   "watermark options without watermark",
+			target:     "/imageJPEG.jpeg?w=100&wm_pos=north",
+			watermark:  watermark,
+			statusCode: http.StatusBadRequest,
+			body:       "wm_pos and wm_opacity require watermark=1",
+		},
+		{
+			testName:   "opaque watermark in the southeast by default",
+			target:     "/imageJPEG.jpeg?w=100&watermark=1",
+			watermark:  watermark,
+			resizedKey: path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0-wm_southeast_100.jpeg"),
+			northwest:  color.RGBA{A: 0xff},
+			southeast:  color.RGBA{R: 0xff, A: 0xff},
+		},
+		{
+			testName:   "half transparent watermark in the northwest",
+			target:     "/imageJPEG.jpeg?w=100&watermark=1&wm_pos=northwest&wm_opacity=0.5",
+			watermark:  watermark,
+			resizedKey: path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0-wm_northwest_50.jpeg"),
+			northwest:  color.RGBA{R: 0x80, A: 0xff},
+			southeast:  color.RGBA{A: 0xff},
+		},
+		{
+			testName:   "watermark larger than the output is scaled down",
+			target:     "/imageJPEG.jpeg?w=10&watermark=1",
+			watermark:  watermark,
+			resizedKey: path.Join(sev.FolderResized, "imageJPEG.jpeg", "w10h0-wm_southeast_100.jpeg"),
+			northwest:  color.RGBA{R: 0xff, A: 0xff},
+			southeast:  color.RGBA{R: 0xff, A: 0xff},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			var opts []Option
+			if tc.watermark != nil {
+				opts = append(opts, WithWatermark(tc.watermark))
+			}
+			ss := New(slogt.New(t), ssc, sev, opts...)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			if tc.statusCode != 0 {
+				assertEqual(t, rr.Code, tc.statusCode)
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+
+			assertEqual(t, rr.Code, http.StatusOK)
+			_, ok := ssc.storage[tc.resizedKey]
+			assertEqual(t, ok, true)
+
+			img, _, err := image.Decode(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := img.Bounds()
+			assertColor(t, img.At(b.Min.X+2, b.Min.Y+2), tc.northwest)
+			assertColor(t, img.At(b.Max.X-3, b.Max.Y-3), tc.southeast)
+		})
+	}
+}
+
+func TestText(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		ServeMode:      envvar.ServeModeInline,
+	}
+
+	tt := []struct {
+		testName string
+		query    url.Values
+		// desired response status code and body
+		statusCode int
+		body       string
+		// desired key of the uploaded variant
+		resizedKey string
+		// desired rows holding the caption
+		captionRows [2]int
+	}{
+		{
+			testName:   "too long",
+			query:      url.Values{"text": {strings.Repeat("a", 101)}},
+			statusCode: http.StatusBadRequest,
+			body:       "text must be at most 100 characters long",
+		},
+		{
+			testName:   "control characters",
+			query:      url.Values{"text": {"line\nbreak"}},
+			statusCode: http.StatusBadRequest,
+			body:       "text must not contain control characters",
+		},
+		{
+			testName:   "size out of range",
+			query:      url.Values{"text": {"Hi"}, "text_size": {"9"}},
+			statusCode: http.StatusBadRequest,
+			body:       "text_size must be an integer between 1 and 8",
+		},
+		{
+			testName:   "text options without text",
+			query:      url.Values{"text_pos": {"north"}},
+			statusCode: http.StatusBadRequest,
+			body:       "text_pos, text_size and text_color require text",
+		},
+		{
+			testName:    "caption in the south by default",
+			query:       url.Values{"text": {"Hi"}},
+			resizedKey:  path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0-text_"+textHash("Hi")+"_south_2_ffffffff.jpeg"),
+			captionRows: [2]int{60, 100},
+		},
+		{
+			testName:    "large red caption in the north",
+			query:       url.Values{"text": {"Hi"}, "text_pos": {"north"}, "text_size": {"4"}, "text_color": {"ff0000"}},
+			resizedKey:  path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0-text_"+textHash("Hi")+"_north_4_ff0000ff.jpeg"),
+			captionRows: [2]int{0, 60},
+		},
+		{
+			testName:    "long captions are hashed in the key",
+			query:       url.Values{"text": {strings.Repeat("a", 100)}, "text_size": {"1"}},
+			resizedKey:  path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0-text_"+textHash(strings.Repeat("a", 100))+"_south_1_ffffffff.jpeg"),
+			captionRows: [2]int{80, 100},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			tc.query.Set("w", "100")
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/imageJPEG.jpeg?"+tc.query.Encode(), nil)
+			ss.ServeHTTP(rr, req)
+
+			if tc.statusCode != 0 {
+				assertEqual(t, rr.Code, tc.statusCode)
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+
+			assertEqual(t, rr.Code, http.StatusOK)
+			_, ok := ssc.storage[tc.resizedKey]
+			assertEqual(t, ok, true)
+
+			img, _, err := image.Decode(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the original is black, so anything bright belongs to the caption
+			for y := 0; y < img.Bounds().Dy(); y++ {
+				for x := 0; x < img.Bounds().Dx(); x++ {
+					r, _, _, _ := img.At(x, y).RGBA()
+					if r>>8 > 0x80 && (y < tc.captionRows[0] || y >= tc.captionRows[1]) {
+						t.Fatalf("caption pixel at (%d, %d) outside rows %v", x, y, tc.captionRows)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeText(t *testing.T) {
+	text, err := sanitizeText("Café ☕")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, text, "Caf? ?")
+
+	if _, err := sanitizeText("   "); err == nil {
+		t.Error("want error for blank text, got nil")
+	}
+}
+
+func TestSprite(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		body     string
+		// desired response status code and body, the manifest is checked on 200
+		statusCode int
+		errBody    string
+		manifest   spriteManifest
+	}{
+		{
+			testName:   "not json",
+			body:       "images=a.jpg",
+			statusCode: http.StatusBadRequest,
+			errBody:    "invalid sprite request: invalid character 'i' looking for beginning of value",
+		},
+		{
+			testName:   "no images",
+			body:       `{"images": [], "width": 10, "height": 10}`,
+			statusCode: http.StatusBadRequest,
+			errBody:    "images must list at least one image",
+		},
+		{
+			testName:   "invalid image path",
+			body:       `{"images": ["a.bmp"], "width": 10, "height": 10}`,
+			statusCode: http.StatusBadRequest,
+			errBody:    `invalid image path: "a.bmp"`,
+		},
+		{
+			testName:   "cell too large",
+			body:       `{"images": ["imageJPEG.jpeg"], "width": 513, "height": 10}`,
+			statusCode: http.StatusBadRequest,
+			errBody:    "width and height must be integers between 1 and 512",
+		},
+		{
+			testName:   "missing image",
+			body:       `{"images": ["imageJPEG.jpeg", "missing.png"], "width": 10, "height": 10}`,
+			statusCode: http.StatusNotFound,
+			errBody:    `image "missing.png" not found`,
+		},
+		{
+			testName:   "square grid by default",
+			body:       `{"images": ["imageJPEG.jpeg", "imagePNG.png", "imageJPG.jpg"], "width": 50, "height": 40}`,
+			statusCode: http.StatusOK,
+			manifest: spriteManifest{
+				Width:  100,
+				Height: 80,
+				Cells: []spriteCell{
+					{Image: "imageJPEG.jpeg", X: 0, Y: 0, Width: 50, Height: 40},
+					{Image: "imagePNG.png", X: 50, Y: 0, Width: 50, Height: 40},
+					{Image: "imageJPG.jpg", X: 0, Y: 40, Width: 50, Height: 40},
+				},
+			},
+		},
+		{
+			testName:   "single row",
+			body:       `{"images": ["imageJPEG.jpeg", "imagePNG.png"], "width": 30, "height": 30, "columns": 5}`,
+			statusCode: http.StatusOK,
+			manifest: spriteManifest{
+				Width:  60,
+				Height: 30,
+				Cells: []spriteCell{
+					{Image: "imageJPEG.jpeg", X: 0, Y: 0, Width: 30, Height: 30},
+					{Image: "imagePNG.png", X: 30, Y: 0, Width: 30, Height: 30},
+				},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, spritePath, strings.NewReader(tc.body))
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.statusCode != http.StatusOK {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.errBody)
+				return
+			}
+			assertEqual(t, rr.Header().Get("Content-Type"), "application/json")
+
+			var m spriteManifest
+			if err := json.NewDecoder(rr.Body).Decode(&m); err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, m.Width, tc.manifest.Width)
+			assertEqual(t, m.Height, tc.manifest.Height)
+			assertEqual(t, slices.Equal(m.Cells, tc.manifest.Cells), true)
+
+			sheetKey := strings.TrimPrefix(m.URL, ssc.ObjectURL(""))
+			assertEqual(t, strings.HasPrefix(sheetKey, "/"+path.Join(sev.FolderResized, spriteFolder)+"/"), true)
+			sheet, ok := ssc.storage[strings.TrimPrefix(sheetKey, "/")]
+			assertEqual(t, ok, true)
+			assertEqual(t, sheet.contentType, "image/png")
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(sheet.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, cfg.Width, tc.manifest.Width)
+			assertEqual(t, cfg.Height, tc.manifest.Height)
+
+			// the same request reuses the stored sheet
+			for e := range ssc.execution {
+				ssc.execution[e] = false
+			}
+			rr = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodPost, spritePath, strings.NewReader(tc.body))
+			ss.ServeHTTP(rr, req)
+			assertEqual(t, rr.Code, http.StatusOK)
+			assertEqual(t, ssc.execution[exeKeyDownload], false)
+			assertEqual(t, ssc.execution[exeKeyUpload], false)
+		})
+	}
+}
+
+func TestFallback(t *testing.T) {
+	q := url.Values{"w": {"100"}, "fm": {"webp"}, "webp_lossless": {"1"}, "fallback_format": {"png"}, "pad": {"1"}, "h": {"100"}}
+	p, err := parseParams(q, "jpg", nil, 0, lanczosResampling, defaultQualityConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !outputSupported(formatWebP) {
+		// already resolved by parseParams
+		assertEqual(t, p.outputFormat, formatPNG)
+		return
+	}
+	assertEqual(t, slices.Equal(p.keyTransforms(), []string{"lossless", "pad00000000"}), true)
+
+	p = p.fallback("jpg")
+	assertEqual(t, p.outputFormat, formatPNG)
+	assertEqual(t, p.resizedExt, "png")
+	assertEqual(t, p.fallbackFormat, "")
+	assertEqual(t, p.encode.webpLossless, false)
+	// the encode options of the format given up on leave the key
+	assertEqual(t, slices.Equal(p.keyTransforms(), []string{"pad00000000"}), true)
+
+	// falling back to the format of the original keeps its extension
+	q.Set("fallback_format", "jpeg")
+	p, err = parseParams(q, "jpg", nil, 0, lanczosResampling, defaultQualityConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, p.fallback("jpg").resizedExt, "jpg")
+}
+
+func TestBatch(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:       "stub-bucket",
+		FolderOriginal:   "stub-original-folder",
+		FolderResized:    "stub-resized-folder",
+		BatchConcurrency: 1,
+		BatchTimeout:     time.Minute,
+	}
+
+	tt := []struct {
+		testName string
+		body     string
+		// desired response status code and body when the batch itself is rejected
+		statusCode int
+		errBody    string
+		results    []batchResult
+	}{
+		{
+			testName:   "not json",
+			body:       `{"name": "imageJPEG.jpeg"}`,
+			statusCode: http.StatusBadRequest,
+			errBody:    "invalid batch request: json: cannot unmarshal object into Go value of type []server.batchItem",
+		},
+		{
+			testName:   "empty batch",
+			body:       `[]`,
+			statusCode: http.StatusBadRequest,
+			errBody:    "batch must list between 1 and 100 images",
+		},
+		{
+			testName:   "partial results",
+			body:       `[{"name": "imageJPEG.jpeg", "w": 100}, {"name": "missing.png", "w": 10}, {"name": "imagePNG.png", "w": -1}, {"name": "a.bmp"}, {"name": "imageJPG.jpg"}, {"name": "imageJPEG.jpeg", "w": 600, "h": 900}, {"name": "imagePNG.png", "format": "jpg"}]`,
+			statusCode: http.StatusMultiStatus,
+			results: []batchResult{
+				{Name: "imageJPEG.jpeg", Status: http.StatusOK, URL: "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w100h0.jpeg")},
+				{Name: "missing.png", Status: http.StatusNotFound, Error: "Not Found"},
+				{Name: "imagePNG.png", Status: http.StatusBadRequest, Error: `w must be a non-negative integer, got "-1"`},
+				{Name: "a.bmp", Status: http.StatusBadRequest, Error: errStrInvalidImagePath},
+				{Name: "imageJPG.jpg", Status: http.StatusOK, URL: "https://test.test/" + path.Join(sev.BucketName, sev.FolderOriginal, "imageJPG.jpg")},
+				{Name: "imageJPEG.jpeg", Status: http.StatusOK, URL: "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w600h900.jpeg")},
+				{Name: "imagePNG.png", Status: http.StatusOK, URL: "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w0h0.jpeg")},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, batchPath, strings.NewReader(tc.body))
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.statusCode != http.StatusMultiStatus {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.errBody)
+				return
+			}
+
+			var results []batchResult
+			if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, len(results), len(tc.results))
+			for i := range results {
+				assertEqual(t, results[i], tc.results[i])
+			}
+		})
+	}
+}
+
+// slowStorageClient answers no check before the request is done
+type slowStorageClient struct {
+	*stubStorageClient
+}
+
+func (ssc *slowStorageClient) CheckObject(ctx context.Context, objectKey string) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func (ssc *slowStorageClient) ObjectMetadata(ctx context.Context, objectKey string) (map[string]string, string, error) {
+	<-ctx.Done()
+	return nil, "", ctx.Err()
+}
+
+func TestBatchTimeout(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:       "stub-bucket",
+		FolderOriginal:   "stub-original-folder",
+		FolderResized:    "stub-resized-folder",
+		BatchConcurrency: 1,
+		BatchTimeout:     10 * time.Millisecond,
+	}
+	ss := New(slogt.New(t), &slowStorageClient{newStubStorageClient(sev)}, sev)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, batchPath, strings.NewReader(`[{"name": "imageJPEG.jpeg", "w": 100}, {"name": "imagePNG.png", "w": 100}]`))
+	ss.ServeHTTP(rr, req)
+
+	assertEqual(t, rr.Code, http.StatusMultiStatus)
+	var results []batchResult
+	if err := json.NewDecoder(rr.Body).Decode(&results); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, len(results), 2)
+	for _, result := range results {
+		assertEqual(t, result.Status, http.StatusGatewayTimeout)
+		assertEqual(t, result.Error, "batch timed out")
+	}
+}
+
+func TestBlurHash(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	// the stub originals are blank, so their hash is the one of any blank image
+	blank, err := blurhash.Encode(5, 2, image.NewNRGBA(image.Rect(0, 0, 8, 8)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code and body
+		statusCode int
+		body       string
+	}{
+		{
+			testName:   "invalid image path",
+			target:     "/image.bmp/blurhash",
+			statusCode: http.StatusBadRequest,
+			body:       errStrInvalidImagePath,
+		},
+		{
+			testName:   "too many components",
+			target:     "/imagePNG.png/blurhash?x=10",
+			statusCode: http.StatusBadRequest,
+			body:       "x must be an integer between 1 and 9",
+		},
+		{
+			testName:   "missing original",
+			target:     "/missing.png/blurhash",
+			statusCode: http.StatusNotFound,
+			body:       "Not Found",
+		},
+		{
+			testName:   "blurhash",
+			target:     "/imagePNG.png/blurhash?x=5&y=2",
+			statusCode: http.StatusOK,
+			body:       `{"blurhash":"` + blank + `"}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+			if tc.statusCode != http.StatusOK {
+				return
+			}
+			assertEqual(t, rr.Header().Get("Content-Type"), "application/json")
+			cached, ok := ssc.storage[path.Join(sev.FolderResized, "imagePNG.png", "blurhash-x5y2.txt")]
+			assertEqual(t, ok, true)
+			assertEqual(t, string(cached.data), blank)
+
+			// the hash is computed once
+			ssc.keys = nil
+			rr = httptest.NewRecorder()
+			req = httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+			assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+			assertEqual(t, slices.Contains(ssc.keys, path.Join(sev.FolderOriginal, "imagePNG.png")), false)
+		})
+	}
+}
+
+func TestAutoFormat(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		AutoFormats:    []string{"jpeg", "png"},
+	}
+
+	// noise compresses poorly as png, while a blank image compresses poorly as jpeg
+	noise := image.NewNRGBA(image.Rect(0, 0, 300, 300))
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(i * 7919 % 251)
+	}
+	var noisePNG bytes.Buffer
+	if err := png.Encode(&noisePNG, noise); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code and body
+		statusCode int
+		body       string
+		// desired Location header of redirection and content type of the uploaded variant, if any
+		location    string
+		contentType string
+	}{
+		{
+			testName:   "auto with a fallback format",
+			target:     "/imagePNG.png?w=100&fm=auto&fallback_format=jpeg",
+			statusCode: http.StatusBadRequest,
+			body:       "fallback_format can't be combined with fm=auto",
+		},
+		{
+			testName:    "png is smaller for a blank image",
+			target:      "/imagePNG.png?w=100&fm=auto",
+			statusCode:  http.StatusSeeOther,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w100h0-auto.png"),
+			contentType: "image/png",
+		},
+		{
+			testName:    "jpeg is smaller for noise",
+			target:      "/noise.png?w=100&fm=auto",
+			statusCode:  http.StatusSeeOther,
+			location:    "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "noise.png", "w100h0-auto.jpeg"),
+			contentType: "image/jpeg",
+		},
+		{
+			testName:   "any stored candidate is a cache hit",
+			target:     "/imageJPEG.jpeg?w=600&h=900&fm=auto",
+			statusCode: http.StatusSeeOther,
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w600h900-auto.png"),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ssc.storage[path.Join(sev.FolderOriginal, "noise.png")] = stubObject{data: noisePNG.Bytes(), contentType: "image/png"}
+			ssc.storage[path.Join(sev.FolderResized, "imageJPEG.jpeg", "w600h900-auto.png")] = newStubObject("png", 600, 900)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.statusCode != http.StatusSeeOther {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			assertEqual(t, rr.Header().Get("Location"), tc.location)
+			if tc.contentType == "" {
+				assertEqual(t, ssc.execution[exeKeyUpload], false)
+				return
+			}
+			object := ssc.storage[strings.TrimPrefix(tc.location, "https://test.test/"+sev.BucketName+"/")]
+			assertEqual(t, object.contentType, tc.contentType)
+		})
+	}
+}
+
+func TestAllowedFormats(t *testing.T) {
+	tt := []struct {
+		testName       string
+		allowedFormats []string
+		autoFormats    []string
+		target         string
+		// desired response status code and body
+		statusCode int
+		body       string
+		// desired Location header of redirection
+		location string
+	}{
+		{
+			testName:   "every format allowed by default",
+			target:     "/imagePNG.png?w=100&fm=ico",
+			statusCode: http.StatusSeeOther,
+			location:   "w100h0.ico",
+		},
+		{
+			testName:       "allowed fm",
+			allowedFormats: []string{"jpeg"},
+			target:         "/imagePNG.png?w=100&fm=jpg",
+			statusCode:     http.StatusSeeOther,
+			location:       "w100h0.jpeg",
+		},
+		{
+			testName:       "fm outside of the allowed formats",
+			allowedFormats: []string{"jpeg"},
+			target:         "/imageJPEG.jpeg?w=100&fm=png",
+			statusCode:     http.StatusBadRequest,
+			body:           "fm=png is not allowed on this server",
+		},
+		{
+			testName:       "fallback_format outside of the allowed formats",
+			allowedFormats: []string{"jpeg", "webp"},
+			target:         "/imageJPEG.jpeg?w=100&fm=webp&fallback_format=png",
+			statusCode:     http.StatusBadRequest,
+			body:           "fallback_format=png is not allowed on this server",
+		},
+		{
+			testName:       "original in an allowed format",
+			allowedFormats: []string{"jpeg"},
+			target:         "/imageJPEG.jpeg?w=100",
+			statusCode:     http.StatusSeeOther,
+			location:       "w100h0.jpeg",
+		},
+		{
+			testName:       "original in a format outside of the allowed ones is converted",
+			allowedFormats: []string{"jpeg", "png"},
+			target:         "/imagePNG.png?w=100",
+			statusCode:     http.StatusSeeOther,
+			location:       "w100h0.png",
+		},
+		{
+			testName:       "converted even when served as is",
+			allowedFormats: []string{"jpeg"},
+			target:         "/imagePNG.png",
+			statusCode:     http.StatusSeeOther,
+			location:       "w0h0.jpeg",
+		},
+		{
+			testName:       "auto only picks among allowed formats",
+			allowedFormats: []string{"png"},
+			autoFormats:    []string{"jpeg", "png"},
+			target:         "/imagePNG.png?w=100&fm=auto",
+			statusCode:     http.StatusSeeOther,
+			location:       "w100h0-auto.png",
+		},
+		{
+			testName:       "auto without any allowed candidate",
+			allowedFormats: []string{"ico"},
+			autoFormats:    []string{"jpeg", "png"},
+			target:         "/imagePNG.png?w=100&fm=auto",
+			statusCode:     http.StatusBadRequest,
+			body:           "fm=auto has no candidate format this server can encode and allows",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				AutoFormats:    tc.autoFormats,
+				AllowedFormats: tc.allowedFormats,
+			}
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.statusCode != http.StatusSeeOther {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			imagePath := strings.TrimPrefix(req.URL.Path, "/")
+			assertEqual(t, rr.Header().Get("Location"), "https://test.test/"+path.Join(sev.BucketName, sev.FolderResized, imagePath, tc.location))
+		})
+	}
+}
+
+func TestUpscale(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	// every original is 300 x 300
+	tt := []struct {
+		testName string
+		query    string
+		// desired response status code and body
+		statusCode int
+		body       string
+		// desired key redirected to, relative to the resized folder of the image, or the original when empty
+		key string
+		// desired size of the uploaded variant, if any
+		width  int
+		height int
+	}{
+		{testName: "upscaled by default", query: "w=600", statusCode: http.StatusSeeOther, key: "w600h0.jpeg", width: 600, height: 600},
+		{testName: "not a boolean", query: "w=100&upscale=maybe", statusCode: http.StatusBadRequest, body: "upscale must be a boolean"},
+		{testName: "w below the original", query: "w=100&upscale=0", statusCode: http.StatusSeeOther, key: "w100h0.jpeg", width: 100, height: 100},
+		{testName: "w above the original", query: "w=600&upscale=0", statusCode: http.StatusSeeOther},
+		{testName: "h above the original", query: "h=900&upscale=0", statusCode: http.StatusSeeOther},
+		{testName: "above the original in another format", query: "w=600&fm=png&upscale=0", statusCode: http.StatusSeeOther, key: "w0h0.png", width: 300, height: 300},
+		{testName: "w and h below the original", query: "w=200&h=100&upscale=0", statusCode: http.StatusSeeOther, key: "w200h100.jpeg", width: 200, height: 100},
+		{testName: "w above and h below the original", query: "w=600&h=150&upscale=0", statusCode: http.StatusSeeOther, key: "w300h75.jpeg", width: 300, height: 75},
+		{testName: "w and h above the original", query: "w=600&h=900&upscale=0", statusCode: http.StatusSeeOther, key: "w200h300.jpeg", width: 200, height: 300},
+		{testName: "pad within the original", query: "w=200&h=100&pad=1&upscale=0", statusCode: http.StatusSeeOther, key: "w200h100-padffffffff.jpeg", width: 200, height: 100},
+		{testName: "pad above the original", query: "w=600&h=600&pad=1&upscale=0", statusCode: http.StatusSeeOther, key: "w600h600-padffffffff.jpeg", width: 600, height: 600},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/imageJPEG.jpeg?"+tc.query, nil)
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.statusCode != http.StatusSeeOther {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			if tc.key == "" {
+				assertEqual(t, rr.Header().Get("Location"), "https://test.test/"+path.Join(sev.BucketName, sev.FolderOriginal, "imageJPEG.jpeg"))
+				assertEqual(t, ssc.execution[exeKeyUpload], false)
+				return
+			}
+			key := path.Join(sev.FolderResized, "imageJPEG.jpeg", tc.key)
+			assertEqual(t, rr.Header().Get("Location"), "https://test.test/"+path.Join(sev.BucketName, key))
+			img, _, err := image.Decode(bytes.NewReader(ssc.storage[key].data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, img.Bounds().Dx(), tc.width)
+			assertEqual(t, img.Bounds().Dy(), tc.height)
+			if tc.key == "w600h600-padffffffff.jpeg" {
+				// the original is centered at its own size, leaving the background around it
+				assertColor(t, img.At(100, 100), color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff})
+				assertColor(t, img.At(300, 300), color.RGBA{A: 0xff})
+			}
+		})
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	// noise keeps jpeg from compressing well, so the quality matters
+	noise := image.NewNRGBA(image.Rect(0, 0, 300, 300))
+	for i := range noise.Pix {
+		noise.Pix[i] = uint8(i * 7919 % 251)
+	}
+	var noisePNG bytes.Buffer
+	if err := png.Encode(&noisePNG, noise); err != nil {
+		t.Fatal(err)
+	}
+	var lowest bytes.Buffer
+	if err := jpeg.Encode(&lowest, transform(noise, params{width: 100}), &jpeg.Options{Quality: 1}); err != nil {
+		t.Fatal(err)
+	}
+	var highest bytes.Buffer
+	if err := jpeg.Encode(&highest, transform(noise, params{width: 100}), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code and body
+		statusCode int
+		body       string
+		// desired key of the uploaded variant and the bytes it may take
+		key      string
+		maxBytes int
+	}{
+		{
+			testName:   "png has no quality",
+			target:     "/noise.png?w=100&max_bytes=5000",
+			statusCode: http.StatusBadRequest,
+			body:       "max_bytes requires a jpeg or lossy webp output",
+		},
+		{
+			testName:   "auto",
+			target:     "/noise.png?w=100&fm=auto&max_bytes=5000",
+			statusCode: http.StatusBadRequest,
+			body:       "max_bytes requires a jpeg or lossy webp output",
+		},
+		{
+			testName:   "not a size",
+			target:     "/noise.png?w=100&fm=jpeg&max_bytes=0",
+			statusCode: http.StatusBadRequest,
+			body:       "max_bytes must be an integer larger than 0",
+		},
+		{
+			testName:   "fits under the budget",
+			target:     "/noise.png?w=100&fm=jpeg&max_bytes=" + strconv.Itoa((lowest.Len()+highest.Len())/2),
+			statusCode: http.StatusSeeOther,
+			key:        path.Join(sev.FolderResized, "noise.png", "w100h0-max"+strconv.Itoa((lowest.Len()+highest.Len())/2)+".jpeg"),
+			maxBytes:   (lowest.Len() + highest.Len()) / 2,
+		},
+		{
+			testName:   "smallest output when nothing fits",
+			target:     "/noise.png?w=100&fm=jpeg&max_bytes=1",
+			statusCode: http.StatusSeeOther,
+			key:        path.Join(sev.FolderResized, "noise.png", "w100h0-max1.jpeg"),
+			maxBytes:   lowest.Len(),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ssc.storage[path.Join(sev.FolderOriginal, "noise.png")] = stubObject{data: noisePNG.Bytes(), contentType: "image/png"}
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.statusCode != http.StatusSeeOther {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			assertEqual(t, rr.Header().Get("Location"), "https://test.test/"+path.Join(sev.BucketName, tc.key))
+			object, ok := ssc.storage[tc.key]
+			assertEqual(t, ok, true)
+			if len(object.data) > tc.maxBytes {
+				t.Errorf("got %d bytes, want at most %d", len(object.data), tc.maxBytes)
+			}
+			// the highest quality under the budget is kept, not just any
+			if tc.maxBytes > lowest.Len() && len(object.data) <= lowest.Len() {
+				t.Errorf("got %d bytes, want more than the lowest quality's %d", len(object.data), lowest.Len())
+			}
+		})
+	}
+}
+
+func TestDebug(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		AutoFormats:    []string{"jpeg", "png"},
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code and body on errors
+		statusCode int
+		body       string
+		report     debugReport
+	}{
+		{
+			testName:   "invalid params",
+			target:     "/imagePNG.png?debug=1&w=abc",
+			statusCode: http.StatusBadRequest,
+			body:       `w must be a non-negative integer, got "abc"`,
+		},
+		{
+			testName:   "missing original",
+			target:     "/missing.png?debug=1",
+			statusCode: http.StatusNotFound,
+			body:       "Not Found",
+		},
+		{
+			testName:   "original",
+			target:     "/imageJPG.jpg?debug=1",
+			statusCode: http.StatusOK,
+			report: debugReport{
+				OriginalKey:    path.Join(sev.FolderOriginal, "imageJPG.jpg"),
+				OriginalWidth:  300,
+				OriginalHeight: 300,
+				Width:          300,
+				Height:         300,
+				Format:         "jpeg",
+			},
+		},
+		{
+			testName:   "cached variant",
+			target:     "/imageJPEG.jpeg?debug=true&w=600&h=900",
+			statusCode: http.StatusOK,
+			report: debugReport{
+				OriginalKey:    path.Join(sev.FolderOriginal, "imageJPEG.jpeg"),
+				OriginalWidth:  300,
+				OriginalHeight: 300,
+				Resized:        true,
+				Width:          600,
+				Height:         900,
+				Format:         "jpeg",
+				Variants: []debugVariantKey{
+					{Key: path.Join(sev.FolderResized, "imageJPEG.jpeg", "w600h900.jpeg"), Format: "jpeg", CacheHit: true},
+				},
+			},
+		},
+		{
+			testName:   "auto variant keeping the aspect ratio",
+			target:     "/imagePNG.png?debug=1&w=100&fm=auto&pad=0",
+			statusCode: http.StatusOK,
+			report: debugReport{
+				OriginalKey:    path.Join(sev.FolderOriginal, "imagePNG.png"),
+				OriginalWidth:  300,
+				OriginalHeight: 300,
+				Resized:        true,
+				Width:          100,
+				Height:         100,
+				Format:         "auto",
+				Transforms:     []string{"auto"},
+				Variants: []debugVariantKey{
+					{Key: path.Join(sev.FolderResized, "imagePNG.png", "w100h0-auto.jpeg"), Format: "jpeg"},
+					{Key: path.Join(sev.FolderResized, "imagePNG.png", "w100h0-auto.png"), Format: "png"},
+				},
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.statusCode != http.StatusOK {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			assertEqual(t, rr.Header().Get("Content-Type"), "application/json")
+			// nothing is produced
+			assertEqual(t, ssc.execution[exeKeyUpload], false)
+
+			want, err := json.Marshal(tc.report)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, rr.Body.String(), string(want))
+		})
+	}
+}
+
+// assertColor allows for the loss of lossy encoders
+func assertColor(t *testing.T, got color.Color, want color.RGBA) {
+	t.Helper()
+	r, g, b, a := got.RGBA()
+	gotRGBA := []uint32{r >> 8, g >> 8, b >> 8, a >> 8}
+	wantRGBA := []uint32{uint32(want.R), uint32(want.G), uint32(want.B), uint32(want.A)}
+	for i := range gotRGBA {
+		if max(gotRGBA[i], wantRGBA[i])-min(gotRGBA[i], wantRGBA[i]) > 8 {
+			t.Errorf("got color %v; want %v", gotRGBA, wantRGBA)
+			return
+		}
+	}
+}
+
+func TestDownloadFilename(t *testing.T) {
+	tt := []struct {
+		value     string
+		imagePath string
+		filename  string
+	}{
+		{value: "", filename: ""},
+		{value: "0", filename: ""},
+		{value: "false", filename: ""},
+		{value: "1", filename: "photo.jpg"},
+		{value: "true", filename: "photo.jpg"},
+		{value: "my photo.jpg", filename: "my_photo.jpg"},
+		{value: "../../etc/passwd", filename: "_.._etc_passwd"},
+		{value: "\"; evil=1", filename: "___evil_1"},
+		{value: "사진.jpg", filename: "__.jpg"},
+		{value: "...", filename: "photo.jpg"},
+		{value: "1", imagePath: "...", filename: "image"},
+		{value: "...", imagePath: "...", filename: "image"},
+		{value: strings.Repeat("a", 200) + ".jpg", filename: strings.Repeat("a", 124) + ".jpg"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.value+" "+tc.imagePath, func(t *testing.T) {
+			q := url.Values{}
+			if tc.value != "" {
+				q.Set(queryDownload, tc.value)
+			}
+			imagePath := tc.imagePath
+			if imagePath == "" {
+				imagePath = "photo.jpg"
+			}
+			assertEqual(t, downloadFilename(q, imagePath), tc.filename)
+		})
+	}
+}
+
+func TestServeInline(t *testing.T) {
+	tt := []struct {
+		testName  string
+		serveMode string
+		target    string
+		// desired response
+		contentType        string
+		contentDisposition string
+		width              int
+		height             int
+	}{
+		{
+			testName:           "download the original",
+			target:             "/imageJPEG.jpeg?download=1",
+			contentType:        "image/jpeg",
+			contentDisposition: "attachment; filename=imageJPEG.jpeg",
+			width:              300,
+			height:             300,
+		},
+		{
+			testName:           "download an already-resized image under a custom name",
+			target:             "/imagePNG.png?w=600&h=900&download=my+image.png",
+			contentType:        "image/png",
+			contentDisposition: "attachment; filename=my_image.png",
+			width:              600,
+			height:             900,
+		},
+		{
+			testName:           "download a freshly resized image",
+			target:             "/imagePNG.png?w=100&download=1",
+			contentType:        "image/png",
+			contentDisposition: "attachment; filename=imagePNG.png",
+			width:              100,
+			height:             100,
+		},
+		{
+			testName:    "serve the original inline",
+			serveMode:   envvar.ServeModeInline,
+			target:      "/imagePNG.png",
+			contentType: "image/png",
+			width:       300,
+			height:      300,
+		},
+		{
+			testName:    "serve a freshly resized image inline",
+			serveMode:   envvar.ServeModeInline,
+			target:      "/imageJPEG.jpeg?h=150",
+			contentType: "image/jpeg",
+			width:       150,
+			height:      150,
+		},
+		{
+			testName:    "serve a freshly resized jpg inline",
+			serveMode:   envvar.ServeModeInline,
+			target:      "/imageJPG.jpg?h=150",
+			contentType: "image/jpeg",
+			width:       150,
+			height:      150,
+		},
+		{
+			testName:    "serve an already-resized jpg inline",
+			serveMode:   envvar.ServeModeInline,
+			target:      "/imageJPG.jpg?w=600&h=900",
+			contentType: "image/jpeg",
+			width:       600,
+			height:      900,
+		},
+		{
+			testName:    "serve an already-resized jpeg inline",
+			serveMode:   envvar.ServeModeInline,
+			target:      "/imageJPEG.jpeg?w=600&h=900",
+			contentType: "image/jpeg",
+			width:       600,
+			height:      900,
+		},
+		{
+			testName:    "serve an already-resized png inline",
+			serveMode:   envvar.ServeModeInline,
+			target:      "/imagePNG.png?w=600&h=900",
+			contentType: "image/png",
+			width:       600,
+			height:      900,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				ServeMode:      tc.serveMode,
+			}
+			ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, http.StatusOK)
+			assertEqual(t, rr.Header().Get("Content-Type"), tc.contentType)
+			assertEqual(t, rr.Header().Get("Content-Disposition"), tc.contentDisposition)
+			img, _, err := image.Decode(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, img.Bounds().Dx(), tc.width)
+			assertEqual(t, img.Bounds().Dy(), tc.height)
+		})
+	}
+}
+
+func TestOriginalsAtBucketRoot(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:    "stub-bucket",
+		FolderResized: "stub-resized-folder",
+	}
+	ssc := newStubStorageClient(sev)
+	ss := New(slogt.New(t), ssc, sev)
+
+	// the stub only finds originals whose key has no leading slash
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/imageJPEG.jpeg", nil)
+	ss.ServeHTTP(rr, req)
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+	assertEqual(t, rr.Header().Get("Location"), "https://test.test/stub-bucket/imageJPEG.jpeg")
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/imagePNG.png?w=100", nil)
+	ss.ServeHTTP(rr, req)
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+	_, ok := ssc.storage["stub-resized-folder/imagePNG.png/w100h0.png"]
+	assertEqual(t, ok, true)
+}
+
+type unavailableStorageClient struct {
+	*stubStorageClient
+}
+
+func (usc *unavailableStorageClient) CheckObject(ctx context.Context, objectKey string) (bool, error) {
+	return false, storage.ErrUnavailable
+}
+
+func (usc *unavailableStorageClient) ObjectMetadata(ctx context.Context, objectKey string) (map[string]string, string, error) {
+	return nil, "", storage.ErrUnavailable
+}
+
+// failingUploadStorageClient reads read bytes of every upload before failing it
+type failingUploadStorageClient struct {
+	*stubStorageClient
+	read int64
+}
+
+func (fsc *failingUploadStorageClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	io.CopyN(io.Discard, body, fsc.read)
+	return errors.New("connection reset")
+}
+
+func TestStreamingUpload(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		ServeMode:      envvar.ServeModeInline,
+	}
+
+	t.Run("streamed into the response", func(t *testing.T) {
+		ssc := newStubStorageClient(sev)
+		ss := New(slogt.New(t), ssc, sev)
+
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/imagePNG.png?w=100", nil)
+		ss.ServeHTTP(rr, req)
+
+		assertEqual(t, rr.Code, http.StatusOK)
+		assertEqual(t, rr.Header().Get("Content-Type"), "image/png")
+		// the response and the upload are the same bytes
+		stored := ssc.storage[path.Join(sev.FolderResized, "imagePNG.png", "w100h0.png")]
+		assertEqual(t, bytes.Equal(rr.Body.Bytes(), stored.data), true)
+	})
+
+	// a failed upload still answers the whole variant, without storing it
+	for _, tc := range []struct {
+		testName string
+		read     int64
+		dedup    bool
+	}{
+		{testName: "upload failing before any byte", read: 0},
+		{testName: "upload failing halfway", read: 10},
+		{testName: "upload of a deduplicated variant failing", dedup: true},
+	} {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := *sev
+			sev.Dedup = tc.dedup
+			want := newStubStorageClient(&sev)
+			rr := httptest.NewRecorder()
+			New(slogt.New(t), want, &sev).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/imagePNG.png?w=100", nil))
+			wantBody := rr.Body.Bytes()
+
+			ssc := newStubStorageClient(&sev)
+			ss := New(slogt.New(t), &failingUploadStorageClient{stubStorageClient: ssc, read: tc.read}, &sev)
+
+			// the encoder blocked on the unread pipe must not hang the request
+			rr = httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/imagePNG.png?w=100", nil))
+
+			assertEqual(t, rr.Code, http.StatusOK)
+			assertEqual(t, rr.Header().Get("Content-Type"), "image/png")
+			assertEqual(t, bytes.Equal(rr.Body.Bytes(), wantBody), true)
+			_, stored := ssc.storage[path.Join(sev.FolderResized, "imagePNG.png", "w100h0.png")]
+			assertEqual(t, stored, false)
+		})
+	}
+}
+
+func TestStorageUnavailable(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	ss := New(slogt.New(t), &unavailableStorageClient{newStubStorageClient(sev)}, sev)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/imageJPEG.jpeg", nil)
+	ss.ServeHTTP(rr, req)
+
+	assertEqual(t, rr.Code, http.StatusServiceUnavailable)
+}
+
+func TestRedirectStatus(t *testing.T) {
+	tt := []struct {
+		redirectStatus int
+		want           int
+	}{
+		{redirectStatus: 0, want: http.StatusSeeOther},
+		{redirectStatus: http.StatusFound, want: http.StatusFound},
+		{redirectStatus: http.StatusTemporaryRedirect, want: http.StatusTemporaryRedirect},
+	}
+
+	for _, tc := range tt {
+		t.Run(strconv.Itoa(tc.redirectStatus), func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				RedirectStatus: tc.redirectStatus,
+			}
+			ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+			for _, target := range []string{"/imageJPEG.jpeg", "/imageJPEG.jpeg?w=100"} {
+				rr := httptest.NewRecorder()
+				ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+				assertEqual(t, rr.Code, tc.want)
+				assertEqual(t, rr.Header().Get("Location") != "", true)
+			}
+		})
+	}
+}
+
+// overwriteRecordingStorageClient records whether uploads were allowed to replace existing objects
+type overwriteRecordingStorageClient struct {
+	*stubStorageClient
+	overwrites []bool
+}
+
+func (osc *overwriteRecordingStorageClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	osc.overwrites = append(osc.overwrites, storage.Overwrites(ctx))
+	return osc.stubStorageClient.UploadObject(ctx, objectKey, body, contentType)
+}
+
+func TestNoCache(t *testing.T) {
+	tt := []struct {
+		testName      string
+		noCacheToken  string
+		authorization string
+		query         string
+		// desired response status code and body
+		statusCode int
+		body       string
+		// whether the corrupted variant is regenerated
+		regenerated bool
+	}{
+		{
+			testName:   "not configured",
+			query:      "nocache=1",
+			statusCode: http.StatusForbidden,
+			body:       "nocache requires a valid bearer token",
+		},
+		{
+			testName:      "wrong token",
+			noCacheToken:  "secret",
+			authorization: "Bearer guess",
+			query:         "nocache=1",
+			statusCode:    http.StatusForbidden,
+			body:          "nocache requires a valid bearer token",
+		},
+		{
+			testName:      "not a boolean",
+			noCacheToken:  "secret",
+			authorization: "Bearer secret",
+			query:         "nocache=maybe",
+			statusCode:    http.StatusBadRequest,
+			body:          "nocache must be a boolean",
+		},
+		{
+			testName:   "cache kept without nocache",
+			query:      "nocache=0",
+			statusCode: http.StatusSeeOther,
+		},
+		{
+			testName:      "regenerated",
+			noCacheToken:  "secret",
+			authorization: "Bearer secret",
+			query:         "nocache=1",
+			statusCode:    http.StatusSeeOther,
+			regenerated:   true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				NoCacheToken:   tc.noCacheToken,
+			}
+			osc := &overwriteRecordingStorageClient{stubStorageClient: newStubStorageClient(sev)}
+			key := path.Join(sev.FolderResized, "imageJPEG.jpeg", "w600h900.jpeg")
+			osc.storage[key] = stubObject{data: []byte("corrupted"), contentType: "image/jpeg"}
+			ss := New(slogt.New(t), osc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/imageJPEG.jpeg?w=600&h=900&"+tc.query, nil)
+			if tc.authorization != "" {
+				req.Header.Set("Authorization", tc.authorization)
+			}
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.statusCode != http.StatusSeeOther {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			assertEqual(t, rr.Header().Get("Location"), "https://test.test/"+path.Join(sev.BucketName, key))
+			if !tc.regenerated {
+				assertEqual(t, len(osc.overwrites), 0)
+				assertEqual(t, string(osc.storage[key].data), "corrupted")
+				return
+			}
+			assertEqual(t, slices.Equal(osc.overwrites, []bool{true}), true)
+			img, _, err := image.Decode(bytes.NewReader(osc.storage[key].data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, img.Bounds().Dx(), 600)
+			assertEqual(t, img.Bounds().Dy(), 900)
+		})
+	}
+}
+
+// the srcset endpoint doesn't check the bearer token, so its eager variants are never regenerated
+func TestSrcsetEagerNoCache(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		NoCacheToken:   "secret",
+	}
+	osc := &overwriteRecordingStorageClient{stubStorageClient: newStubStorageClient(sev)}
+	key := path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0.jpeg")
+	osc.storage[key] = stubObject{data: []byte("corrupted"), contentType: "image/jpeg"}
+	ss := New(slogt.New(t), osc, sev)
+
+	rr := httptest.NewRecorder()
+	ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/imageJPEG.jpeg/srcset?widths=100&eager=1&nocache=1", nil))
+
+	assertEqual(t, rr.Code, http.StatusOK)
+	assertEqual(t, strings.TrimSpace(rr.Body.String()), "https://test.test/"+path.Join(sev.BucketName, key)+" 100w")
+	assertEqual(t, len(osc.overwrites), 0)
+	assertEqual(t, string(osc.storage[key].data), "corrupted")
+}
+
+func TestDedup(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		Dedup:          true,
+	}
+	ssc := newStubStorageClient(sev)
+	ss := New(slogt.New(t), ssc, sev)
+
+	get := func(target string) string {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		assertEqual(t, rr.Code, http.StatusSeeOther)
+		return strings.TrimPrefix(rr.Header().Get("Location"), "https://test.test/"+sev.BucketName+"/")
+	}
+
+	countBlobs := func() int {
+		n := 0
+		for key := range ssc.storage {
+			if strings.HasPrefix(key, path.Join(sev.FolderResized, "blobs")+"/") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// both originals are the same blank image, so their variants are identical
+	blob := get("/imageJPEG.jpeg?w=10")
+	assertEqual(t, strings.HasPrefix(blob, path.Join(sev.FolderResized, "blobs")+"/"), true)
+	assertEqual(t, path.Ext(blob), ".jpeg")
+	assertEqual(t, ssc.storage[path.Join(sev.FolderResized, "imageJPEG.jpeg", "w10h0.jpeg")].link, blob)
+
+	assertEqual(t, countBlobs(), 1)
+
+	assertEqual(t, get("/imageJPEG-2.jpeg?w=10"), blob)
+	assertEqual(t, ssc.storage[path.Join(sev.FolderResized, "imageJPEG-2.jpeg", "w10h0.jpeg")].link, blob)
+	assertEqual(t, countBlobs(), 1)
+
+	// a stored link answers with its blob
+	ssc.execution[exeKeyUpload] = false
+	assertEqual(t, get("/imageJPEG.jpeg?w=10"), blob)
+	assertEqual(t, ssc.execution[exeKeyUpload], false)
+
+	// variants stored before dedup was turned on still answer
+	assertEqual(t, get("/imageJPEG.jpeg?w=600&h=900"), path.Join(sev.FolderResized, "imageJPEG.jpeg", "w600h900.jpeg"))
+}
+
+func TestRootAndFavicon(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	ssc := newStubStorageClient(sev)
+	ss := New(slogt.New(t), ssc, sev)
+
+	rr := httptest.NewRecorder()
+	ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assertEqual(t, rr.Code, http.StatusOK)
+	assertEqual(t, rr.Header().Get("Content-Type"), "text/plain; charset=utf-8")
+	assertEqual(t, rr.Body.String(), usage)
+
+	rr = httptest.NewRecorder()
+	ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/favicon.ico", nil))
+	assertEqual(t, rr.Code, http.StatusNoContent)
+	assertEqual(t, len(ssc.keys), 0)
+}
+
+func TestServerTiming(t *testing.T) {
+	tt := []struct {
+		testName          string
+		serveMode         string
+		timingAllowOrigin string
+		target            string
+		// desired phases in Server-Timing, in order
+		phases []string
+	}{
+		{
+			testName:          "resized",
+			timingAllowOrigin: "*",
+			target:            "/imageJPEG.jpeg?w=100",
+			phases:            []string{"check", "download", "decode", "resize", "encode", "upload"},
+		},
+		{
+			testName: "cache hit",
+			target:   "/imageJPEG.jpeg?w=600&h=900",
+			phases:   []string{"check"},
+		},
+		{
+			testName: "bad request",
+			target:   "/imageJPEG.jpeg?w=-1",
+			phases:   []string{"check"},
+		},
+		{
+			testName:  "streamed before encode and upload end",
+			serveMode: envvar.ServeModeInline,
+			target:    "/imageJPEG.jpeg?w=100",
+			phases:    []string{"check", "download", "decode", "resize"},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:        "stub-bucket",
+				FolderOriginal:    "stub-original-folder",
+				FolderResized:     "stub-resized-folder",
+				ServeMode:         tc.serveMode,
+				TimingAllowOrigin: tc.timingAllowOrigin,
+			}
+			ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			ss.ServeHTTP(rr, req)
+
+			var phases []string
+			for _, metric := range strings.Split(rr.Header().Get("Server-Timing"), ", ") {
+				name, dur, ok := strings.Cut(metric, ";dur=")
+				assertEqual(t, ok, true)
+				_, err := strconv.ParseFloat(dur, 64)
+				assertEqual(t, err, nil)
+				phases = append(phases, name)
+			}
+			if !slices.Equal(phases, tc.phases) {
+				t.Errorf("got phases %v, want %v", phases, tc.phases)
+			}
+			assertEqual(t, rr.Header().Get("Timing-Allow-Origin"), tc.timingAllowOrigin)
+		})
+	}
+}
+
+func TestBuckets(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	}
+
+	tt := []struct {
+		testName   string
+		target     string
+		remoteAddr string
+		bucket     string
+		// desired response status code and Location header of redirection
+		statusCode int
+		location   string
+	}{
+		{
+			testName:   "default bucket",
+			target:     "/imageJPEG.jpeg",
+			statusCode: http.StatusSeeOther,
+			location:   "https://test.test/" + path.Join("stub-bucket", sev.FolderOriginal, "imageJPEG.jpeg"),
+		},
+		{
+			testName:   "path prefix",
+			target:     "/shard/imageJPEG.jpeg?w=100",
+			statusCode: http.StatusSeeOther,
+			location:   "https://test.test/" + path.Join("shard-bucket", sev.FolderResized, "imageJPEG.jpeg", "w100h0.jpeg"),
+		},
+		{
+			testName:   "unknown path prefix",
+			target:     "/other/imageJPEG.jpeg",
+			statusCode: http.StatusNotFound,
+		},
+		{
+			testName:   "header from a trusted proxy",
+			target:     "/imageJPEG.jpeg",
+			remoteAddr: "10.0.0.2:51234",
+			bucket:     "shard",
+			statusCode: http.StatusSeeOther,
+			location:   "https://test.test/" + path.Join("shard-bucket", sev.FolderOriginal, "imageJPEG.jpeg"),
+		},
+		{
+			testName:   "header from anyone else is ignored",
+			target:     "/imageJPEG.jpeg",
+			remoteAddr: "198.51.100.1:51234",
+			bucket:     "shard",
+			statusCode: http.StatusSeeOther,
+			location:   "https://test.test/" + path.Join("stub-bucket", sev.FolderOriginal, "imageJPEG.jpeg"),
+		},
+		{
+			testName:   "unknown bucket in the header",
+			target:     "/imageJPEG.jpeg",
+			remoteAddr: "10.0.0.2:51234",
+			bucket:     "other",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			shard := newStubStorageClient(&envvar.EnvVar{BucketName: "shard-bucket", FolderOriginal: sev.FolderOriginal, FolderResized: sev.FolderResized})
+			ss := New(slogt.New(t), ssc, sev, WithBuckets(map[string]storage.Client{"shard": shard}))
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			if tc.bucket != "" {
+				req.Header.Set("X-Bucket", tc.bucket)
+			}
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, rr.Header().Get("Location"), tc.location)
+		})
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	ss := New(logger, newStubStorageClient(sev), sev)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/noexist.jpeg?w=100", nil)
+	ss.ServeHTTP(rr, req)
+
+	var entry struct {
+		Msg    string `json:"msg"`
+		Method string `json:"method"`
+		Path   string `json:"path"`
+		Query  string `json:"query"`
+		Status int    `json:"status"`
+	}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, entry.Msg, "request")
+	assertEqual(t, entry.Method, http.MethodGet)
+	assertEqual(t, entry.Path, "/noexist.jpeg")
+	assertEqual(t, entry.Query, "w=100")
+	assertEqual(t, entry.Status, http.StatusNotFound)
+}
+
+func TestTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevTP, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	ss := New(slogt.New(t), storage.NewTracingClient(newStubStorageClient(sev)), sev)
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/imagePNG.png?w=100", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ss.ServeHTTP(rr, req)
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = s
+		assertEqual(t, s.SpanContext.TraceID().String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	}
+
+	serverSpan, ok := spans["GET /{image}"]
+	assertEqual(t, ok, true)
+	assertEqual(t, serverSpan.Parent.SpanID().String(), "00f067aa0ba902b7")
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, a := range serverSpan.Attributes {
+		attrs[a.Key] = a.Value
+	}
+	assertEqual(t, attrs["image.slug"].AsString(), "imagePNG.png")
+	assertEqual(t, attrs["image.width"].AsInt64(), 100)
+	assertEqual(t, attrs["image.height"].AsInt64(), 0)
+	assertEqual(t, attrs["image.cache_hit"].AsBool(), false)
+
+	for _, name := range []string{"storage.CheckObject", "storage.DownloadObject", "storage.UploadObject"} {
+		s, ok := spans[name]
+		assertEqual(t, ok, true)
+		assertEqual(t, s.Parent.SpanID(), serverSpan.SpanContext.SpanID())
+	}
+}
+
+func assertEqual[U comparable](t *testing.T, got, want U) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestSrcset(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		accept   string
+		// desired response status code and body
+		statusCode int
+		body       string
+	}{
+		{
+			testName:   "widths are sorted and deduplicated",
+			target:     "/imageJPEG.jpeg/srcset?widths=640,320,640&f=webp",
+			statusCode: http.StatusOK,
+			body:       "/imageJPEG.jpeg?f=webp&w=320 320w, /imageJPEG.jpeg?f=webp&w=640 640w",
+		},
+		{
+			testName:   "bucket prefix",
+			target:     "/shard/imageJPEG.jpeg/srcset?widths=320",
+			statusCode: http.StatusOK,
+			body:       "/shard/imageJPEG.jpeg?w=320 320w",
+		},
+		{
+			testName:   "eager",
+			target:     "/imageJPEG.jpeg/srcset?widths=100,200&eager=1",
+			statusCode: http.StatusOK,
+			body: "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w100h0.jpeg") + " 100w, " +
+				"https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w200h0.jpeg") + " 200w",
+		},
+		{
+			testName:   "nocache is dropped",
+			target:     "/imageJPEG.jpeg/srcset?widths=320&nocache=1",
+			statusCode: http.StatusOK,
+			body:       "/imageJPEG.jpeg?w=320 320w",
+		},
+		{
+			testName:   "json",
+			target:     "/imageJPEG.jpeg/srcset?widths=320",
+			accept:     "application/json",
+			statusCode: http.StatusOK,
+			body:       `{"srcset":"/imageJPEG.jpeg?w=320 320w"}`,
+		},
+		{
+			testName:   "missing widths",
+			target:     "/imageJPEG.jpeg/srcset",
+			statusCode: http.StatusBadRequest,
+			body:       "widths must be a comma separated list of up to 10 integers between 1 and 4096",
+		},
+		{
+			testName:   "too many widths",
+			target:     "/imageJPEG.jpeg/srcset?widths=1,2,3,4,5,6,7,8,9,10,11",
+			statusCode: http.StatusBadRequest,
+			body:       "widths must be a comma separated list of up to 10 integers between 1 and 4096",
+		},
+		{
+			testName:   "width too large",
+			target:     "/imageJPEG.jpeg/srcset?widths=320,5000",
+			statusCode: http.StatusBadRequest,
+			body:       "widths must be a comma separated list of up to 10 integers between 1 and 4096",
+		},
+		{
+			testName:   "widths combined with w",
+			target:     "/imageJPEG.jpeg/srcset?widths=320&w=100",
+			statusCode: http.StatusBadRequest,
+			body:       "widths can't be combined with w or h",
+		},
+		{
+			testName:   "missing original",
+			target:     "/missing.jpeg/srcset?widths=320&eager=1",
+			statusCode: http.StatusNotFound,
+			body:       "Not Found",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			shard := newStubStorageClient(&envvar.EnvVar{BucketName: "shard-bucket", FolderOriginal: sev.FolderOriginal, FolderResized: sev.FolderResized})
+			ss := New(slogt.New(t), ssc, sev, WithBuckets(map[string]storage.Client{"shard": shard}))
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			if tc.accept != "" {
+				req.Header.Set("Accept", tc.accept)
+			}
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+		})
+	}
+}
+
+// brokenDownloadStorageClient fails every download after its first bytes
+type brokenDownloadStorageClient struct {
+	*stubStorageClient
+}
+
+func (bsc *brokenDownloadStorageClient) DownloadObject(ctx context.Context, objectKey string) (io.ReadCloser, string, error) {
+	body, contentType, err := bsc.stubStorageClient.DownloadObject(ctx, objectKey)
+	if err != nil {
+		return nil, "", err
+	}
+	return io.NopCloser(io.MultiReader(io.LimitReader(body, 10), iotest.ErrReader(errors.New("connection reset")))), contentType, nil
+}
+
+func TestInvalidOriginal(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		broken   bool
+		// desired response status code and body
+		statusCode int
+		body       string
+	}{
+		{testName: "zero bytes", target: "/empty.jpeg?w=100", statusCode: http.StatusUnprocessableEntity, body: errStrInvalidSource},
+		{testName: "truncated", target: "/truncated.png?w=100", statusCode: http.StatusUnprocessableEntity, body: errStrInvalidSource},
+		{testName: "garbage", target: "/garbage.jpeg?w=100", statusCode: http.StatusUnprocessableEntity, body: errStrInvalidSource},
+		{testName: "garbage with upscale=0", target: "/garbage.jpeg?w=100&upscale=0", statusCode: http.StatusUnprocessableEntity, body: errStrInvalidSource},
+		{testName: "blurhash of garbage", target: "/garbage.jpeg/blurhash", statusCode: http.StatusUnprocessableEntity, body: errStrInvalidSource},
+		{testName: "debug of garbage", target: "/garbage.jpeg?w=100&debug=1", statusCode: http.StatusUnprocessableEntity, body: errStrInvalidSource},
+		{testName: "download failing halfway", target: "/imagePNG.png?w=100", broken: true, statusCode: http.StatusInternalServerError, body: "Internal Server Error"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			valid := newStubObject("png", 300, 300)
+			ssc.storage[path.Join(sev.FolderOriginal, "empty.jpeg")] = stubObject{contentType: "image/jpeg"}
+			ssc.storage[path.Join(sev.FolderOriginal, "truncated.png")] = stubObject{data: valid.data[:len(valid.data)/2], contentType: "image/png"}
+			ssc.storage[path.Join(sev.FolderOriginal, "garbage.jpeg")] = stubObject{data: []byte("not an image at all"), contentType: "image/jpeg"}
+			var sc storage.Client = ssc
+			if tc.broken {
+				sc = &brokenDownloadStorageClient{ssc}
+			}
+			ss := New(slogt.New(t), sc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+			assertEqual(t, ssc.execution[exeKeyUpload], false)
+		})
+	}
+}
+
+func TestSubsample(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired response status code, and body or Location header of redirection
+		statusCode int
+		body       string
+		location   string
+	}{
+		{
+			testName:   "420 is the default",
+			target:     "/imageJPEG.jpeg?w=100&subsample=420",
+			statusCode: http.StatusSeeOther,
+			location:   "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imageJPEG.jpeg", "w100h0.jpeg"),
+		},
+		{
+			testName:   "444 is not supported",
+			target:     "/imageJPEG.jpeg?w=100&subsample=444",
+			statusCode: http.StatusBadRequest,
+			body:       "subsample=444 is not supported by this server, jpeg is always encoded with 4:2:0 chroma subsampling",
+		},
+		{
+			testName:   "unknown subsampling",
+			target:     "/imageJPEG.jpeg?w=100&subsample=422",
+			statusCode: http.StatusBadRequest,
+			body:       "subsample must be 420 or 444",
+		},
+		{
+			testName:   "png output",
+			target:     "/imageJPEG.jpeg?w=100&fm=png&subsample=420",
+			statusCode: http.StatusBadRequest,
+			body:       "subsample requires a jpeg output",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, rr.Header().Get("Location"), tc.location)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+			}
+		})
+	}
+}
+
+func TestVariants(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	url := func(key string) string {
+		return "https://test.test/" + path.Join(sev.BucketName, key)
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		dedup    bool
+		// desired response status code and body
+		statusCode int
+		body       string
+	}{
+		{
+			testName:   "invalid image path",
+			target:     "/image.bmp/variants",
+			statusCode: http.StatusBadRequest,
+			body:       errStrInvalidImagePath,
+		},
+		{
+			testName:   "no variants",
+			target:     "/imageJPEG-2.jpeg/variants",
+			statusCode: http.StatusOK,
+			body:       `{"variants":[]}`,
+		},
+		{
+			testName:   "variants",
+			target:     "/ratioPNG.png/variants",
+			statusCode: http.StatusOK,
+			body: `{"variants":[` +
+				`{"key":"stub-resized-folder/ratioPNG.png/w0h600.png","width":0,"height":600,"format":"png","transforms":[],"url":"` + url("stub-resized-folder/ratioPNG.png/w0h600.png") + `"},` +
+				`{"key":"stub-resized-folder/ratioPNG.png/w100h100-padffffffff.webp","width":100,"height":100,"format":"webp","transforms":["padffffffff"],"url":"` + url("stub-resized-folder/ratioPNG.png/w100h100-padffffffff.webp") + `"},` +
+				`{"key":"stub-resized-folder/ratioPNG.png/w600h0.png","width":600,"height":0,"format":"png","transforms":[],"url":"` + url("stub-resized-folder/ratioPNG.png/w600h0.png") + `"}` +
+				`]}`,
+		},
+		{
+			testName:   "deduplicated variants point at their blob",
+			target:     "/imagePNG-2.png/variants",
+			dedup:      true,
+			statusCode: http.StatusOK,
+			body:       `{"variants":[{"key":"stub-resized-folder/imagePNG-2.png/w100h0.png","width":100,"height":0,"format":"png","transforms":[],"url":"` + url("stub-resized-folder/blobs/abc.png") + `"}]}`,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ev := *sev
+			ev.Dedup = tc.dedup
+			ssc := newStubStorageClient(&ev)
+			ssc.storage[path.Join(sev.FolderResized, "ratioPNG.png", "w100h100-padffffffff.webp")] = newStubObject("png", 100, 100)
+			ssc.storage[path.Join(sev.FolderResized, "ratioPNG.png", "blurhash-x4y3.txt")] = stubObject{data: []byte("hash")}
+			ssc.storage[path.Join(sev.FolderResized, "ratioPNG.png.bak", "w100h0.png")] = newStubObject("png", 100, 100)
+			ssc.storage[path.Join(sev.FolderResized, "blobs", "abc.png")] = newStubObject("png", 100, 100)
+			ssc.storage[path.Join(sev.FolderResized, "imagePNG-2.png", "w100h0.png")] = stubObject{link: path.Join(sev.FolderResized, "blobs", "abc.png")}
+			ss := New(slogt.New(t), ssc, &ev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+		})
+	}
+}
+
+func TestOriginalSize(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		testName string
+		target   string
+		// desired Location header of redirection, and whether a variant is uploaded
+		location string
+		upload   bool
+	}{
+		{
+			testName: "w and h of the original",
+			target:   "/imagePNG.png?w=300&h=300",
+			location: "https://test.test/" + path.Join(sev.BucketName, sev.FolderOriginal, "imagePNG.png"),
+		},
+		{
+			testName: "w of the original",
+			target:   "/imagePNG.png?w=300",
+			location: "https://test.test/" + path.Join(sev.BucketName, sev.FolderOriginal, "imagePNG.png"),
+		},
+		{
+			testName: "another format",
+			target:   "/imagePNG.png?w=300&fm=jpeg",
+			location: "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w300h0.jpeg"),
+			upload:   true,
+		},
+		{
+			testName: "a transform",
+			target:   "/imagePNG.png?w=300&h=300&pad=1",
+			location: "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w300h300-pad00000000.png"),
+			upload:   true,
+		},
+		{
+			testName: "another size",
+			target:   "/imagePNG.png?w=300&h=200",
+			location: "https://test.test/" + path.Join(sev.BucketName, sev.FolderResized, "imagePNG.png", "w300h200.png"),
+			upload:   true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, http.StatusSeeOther)
+			assertEqual(t, rr.Header().Get("Location"), tc.location)
+			assertEqual(t, ssc.execution[exeKeyUpload], tc.upload)
+		})
+	}
+}
+
+func TestReloadable(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	ssc := newStubStorageClient(sev)
+	rl := NewReloadable(New(slogt.New(t), ssc, sev))
+
+	rr := httptest.NewRecorder()
+	rl.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/imageJPEG.jpeg", nil))
+	assertEqual(t, rr.Code, http.StatusSeeOther)
+
+	next := *sev
+	next.RedirectStatus = http.StatusTemporaryRedirect
+	rl.Swap(New(slogt.New(t), ssc, &next))
+
+	rr = httptest.NewRecorder()
+	rl.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/imageJPEG.jpeg", nil))
+	assertEqual(t, rr.Code, http.StatusTemporaryRedirect)
+}
+
+func TestExtraHeaders(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		ExtraHeaders:   http.Header{"X-Content-Type-Options": {"nosniff"}, "Cache-Tag": {"images"}},
+	}
+	ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+	for _, target := range []string{"/imageJPEG.jpeg?w=100", "/missing.jpeg", "/imageJPEG.jpeg?w=abc"} {
+		t.Run(target, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+			assertEqual(t, rr.Header().Get("X-Content-Type-Options"), "nosniff")
+			assertEqual(t, rr.Header().Get("Cache-Tag"), "images")
+		})
+	}
+}
+
+func TestInvalidDimensions(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+	tt := []struct {
+		target string
+		// desired response body
+		body string
+	}{
+		{target: "/imagePNG.png?w=100.5", body: `w must be a non-negative integer, got "100.5"`},
+		{target: "/imagePNG.png?h=100.5", body: `h must be a non-negative integer, got "100.5"`},
+		{target: "/imagePNG.png?w=-100", body: `w must be a non-negative integer, got "-100"`},
+		{target: "/imagePNG.png?w=100&h=-1", body: `h must be a non-negative integer, got "-1"`},
+		{target: "/imagePNG.png?w=wide", body: `w must be a non-negative integer, got "wide"`},
+		{target: "/imagePNG.png?h=", body: `h must be a non-negative integer, got ""`},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.target, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			assertEqual(t, rr.Code, http.StatusBadRequest)
+			assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+		})
+	}
+}
+
+func TestZeroDimensions(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		target string
+		// desired response status code, and Location header of redirection
+		statusCode int
+		location   string
+	}{
+		{target: "/imagePNG.png?w=0&h=150", statusCode: http.StatusSeeOther, location: path.Join(sev.FolderResized, "imagePNG.png", "w0h150.png")},
+		{target: "/imagePNG.png?w=150&h=0", statusCode: http.StatusSeeOther, location: path.Join(sev.FolderResized, "imagePNG.png", "w150h0.png")},
+		{target: "/imagePNG.png?w=0&h=0", statusCode: http.StatusSeeOther, location: path.Join(sev.FolderOriginal, "imagePNG.png")},
+		{target: "/imagePNG.png?w=0&h=0&fm=jpeg", statusCode: http.StatusSeeOther, location: path.Join(sev.FolderResized, "imagePNG.png", "w0h0.jpeg")},
+		{target: "/imagePNG.png?w=-1", statusCode: http.StatusBadRequest},
+		{target: "/imagePNG.png?h=-1", statusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.target, func(t *testing.T) {
+			ss := New(slogt.New(t), newStubStorageClient(sev), sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.location != "" {
+				assertEqual(t, rr.Header().Get("Location"), "https://test.test/"+path.Join(sev.BucketName, tc.location))
+			}
+		})
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	tt := []struct {
+		testName  string
+		serveMode string
+		target    string
+		metadata  string
+		// desired response
+		statusCode   int
+		cacheControl string
+	}{
+		{testName: "default on redirect", target: "/imagePNG.png?w=100", statusCode: http.StatusSeeOther, cacheControl: "public, max-age=86400"},
+		{testName: "metadata on redirect", target: "/imagePNG.png?w=100", metadata: "max-age=60", statusCode: http.StatusSeeOther, cacheControl: "max-age=60"},
+		{testName: "metadata on the original", target: "/imagePNG.png", metadata: "max-age=60", statusCode: http.StatusSeeOther, cacheControl: "max-age=60"},
+		{testName: "metadata on a stored variant", target: "/imagePNG.png?w=600&h=900", metadata: "max-age=60", statusCode: http.StatusSeeOther, cacheControl: "max-age=60"},
+		{testName: "invalid metadata", target: "/imagePNG.png?w=100", metadata: "max-age=60\x7f", statusCode: http.StatusSeeOther, cacheControl: "public, max-age=86400"},
+		{testName: "metadata when streamed", serveMode: envvar.ServeModeInline, target: "/imagePNG.png?w=100", metadata: "max-age=60", statusCode: http.StatusOK, cacheControl: "max-age=60"},
+		{testName: "metadata when served inline", serveMode: envvar.ServeModeInline, target: "/imagePNG.png?w=600&h=900", metadata: "max-age=60", statusCode: http.StatusOK, cacheControl: "max-age=60"},
+		{testName: "not on errors", target: "/missing.png?w=100", metadata: "max-age=60", statusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				ServeMode:      tc.serveMode,
+				CacheControl:   "public, max-age=86400",
+			}
+			ssc := newStubStorageClient(sev)
+			key := path.Join(sev.FolderOriginal, "imagePNG.png")
+			original := ssc.storage[key]
+			original.metadata = map[string]string{metaCacheControl: tc.metadata}
+			ssc.storage[key] = original
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, rr.Header().Get("Cache-Control"), tc.cacheControl)
+		})
+	}
+}
+
+func TestCacheDirectives(t *testing.T) {
+	original := envvar.CacheDirectives{MaxAge: 3600}
+	resized := envvar.CacheDirectives{MaxAge: 86400, SMaxAge: 31536000, StaleWhileRevalidate: 600}
+
+	tt := []struct {
+		testName     string
+		serveMode    string
+		cacheControl string
+		target       string
+		// desired Cache-Control
+		want string
+	}{
+		{testName: "original", target: "/imagePNG.png", want: "public, max-age=3600"},
+		{testName: "original at its own size", target: "/imagePNG.png?w=300", want: "public, max-age=3600"},
+		{testName: "new variant", target: "/imagePNG.png?w=100", want: "public, max-age=86400, s-maxage=31536000, stale-while-revalidate=600"},
+		{testName: "stored variant", target: "/imagePNG.png?w=600&h=900", want: "public, max-age=86400, s-maxage=31536000, stale-while-revalidate=600"},
+		{testName: "streamed variant", serveMode: envvar.ServeModeInline, target: "/imagePNG.png?w=100", want: "public, max-age=86400, s-maxage=31536000, stale-while-revalidate=600"},
+		{testName: "original served inline", serveMode: envvar.ServeModeInline, target: "/imagePNG.png", want: "public, max-age=3600"},
+		{testName: "CACHE_CONTROL overrides them", cacheControl: "no-store", target: "/imagePNG.png?w=100", want: "no-store"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				ServeMode:      tc.serveMode,
+				CacheControl:   tc.cacheControl,
+				CacheOriginal:  original,
+				CacheResized:   resized,
+			}
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Header().Get("Cache-Control"), tc.want)
+		})
+	}
+}
+
+func TestBuildCacheControl(t *testing.T) {
+	tt := []struct {
+		cd   envvar.CacheDirectives
+		want string
+	}{
+		{cd: envvar.CacheDirectives{}, want: ""},
+		{cd: envvar.CacheDirectives{MaxAge: 60}, want: "public, max-age=60"},
+		{cd: envvar.CacheDirectives{SMaxAge: 3600, StaleWhileRevalidate: 30}, want: "public, s-maxage=3600, stale-while-revalidate=30"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.want, func(t *testing.T) {
+			assertEqual(t, buildCacheControl(tc.cd), tc.want)
+		})
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	tt := []struct {
+		method string
+		target string
+	}{
+		{method: http.MethodPost, target: "/imagePNG.png"},
+		{method: http.MethodPut, target: "/imagePNG.png"},
+		{method: http.MethodDelete, target: "/imagePNG.png"},
+		{method: http.MethodPatch, target: "/imagePNG.png?w=100"},
+		// missing images too, the method is checked first
+		{method: http.MethodPost, target: "/missing.png"},
+		{method: http.MethodPost, target: "/imagePNG.png/srcset"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.method+" "+tc.target, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(tc.method, tc.target, nil))
+
+			assertEqual(t, rr.Code, http.StatusMethodNotAllowed)
+			assertEqual(t, rr.Header().Get("Allow"), "GET, HEAD")
+			// nothing reached the bucket
+			assertEqual(t, len(ssc.keys), 0)
+		})
+	}
+}
+
+func TestMaxDimension(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		MaxDimension:   500,
+	}
+
+	tt := []struct {
+		target string
+		// desired response
+		statusCode int
+		body       string
+	}{
+		{target: "/imagePNG.png?w=500", statusCode: http.StatusSeeOther},
+		{target: "/imagePNG.png?h=500", statusCode: http.StatusSeeOther},
+		{target: "/imagePNG.png?w=501", statusCode: http.StatusBadRequest, body: "w must be at most 500"},
+		{target: "/imagePNG.png?w=100&h=501", statusCode: http.StatusBadRequest, body: "h must be at most 500"},
+		{target: "/imagePNG.png?w=999999999", statusCode: http.StatusBadRequest, body: "w must be at most 500"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.target, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.statusCode == http.StatusBadRequest {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				// rejected before the original is downloaded
+				assertEqual(t, ssc.execution[exeKeyDownload], false)
+			}
+		})
+	}
+
+	// 0 lifts the limit
+	_, err := parseParams(url.Values{"w": {"999999999"}}, "png", nil, 0, lanczosResampling, defaultQualityConfig)
+	assertEqual(t, err, nil)
+}
+
+func TestHEIF(t *testing.T) {
+	// browsers don't render heic, so its variants default to jpeg, or to the first allowed format
+	p, err := parseParams(url.Values{"w": {"100"}}, "HEIC", nil, 0, lanczosResampling, defaultQualityConfig)
+	assertEqual(t, err, nil)
+	assertEqual(t, p.outputFormat, formatJPEG)
+	assertEqual(t, p.resizedExt, formatJPEG)
+	p, err = parseParams(url.Values{}, "heif", []string{formatPNG, formatJPEG}, 0, lanczosResampling, defaultQualityConfig)
+	assertEqual(t, err, nil)
+	assertEqual(t, p.outputFormat, formatPNG)
+	// even at its own size the original is never answered as is
+	assertEqual(t, p.requested("heif"), true)
+	_, err = parseParams(url.Values{"fm": {"heic"}}, "jpg", nil, 0, lanczosResampling, defaultQualityConfig)
+	assertEqual(t, err != nil, true)
+	_, err = parseParams(url.Values{"fm": {"png"}, "fallback_format": {"heif"}}, "jpg", nil, 0, lanczosResampling, defaultQualityConfig)
+	assertEqual(t, err != nil, true)
+
+	if heifSupported {
+		return
+	}
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+	ssc := newStubStorageClient(sev)
+	ssc.storage[path.Join(sev.FolderOriginal, "IMG_0001.HEIC")] = stubObject{data: []byte("heic"), contentType: "image/heic"}
+	ss := New(slogt.New(t), ssc, sev)
+
+	rr := httptest.NewRecorder()
+	ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/IMG_0001.HEIC?w=100", nil))
+	assertEqual(t, rr.Code, http.StatusNotImplemented)
+	assertEqual(t, strings.TrimSpace(rr.Body.String()), errStrHEIFUnsupported)
+	assertEqual(t, len(ssc.keys), 0)
+}
+
+func TestObjectContentType(t *testing.T) {
+	png := newStubObject("png", 1, 1).data
+	tt := []struct {
+		testName string
+		key      string
+		stored   string
+		head     []byte
+		want     string
+	}{
+		{testName: "sniffed over the stored type", key: "a.jpg", stored: "binary/octet-stream", head: png, want: "image/png"},
+		{testName: "sniffed over the extension", key: "a.jpg", stored: "image/jpeg", head: png, want: "image/png"},
+		{testName: "extension when the bytes say nothing", key: "a.jpeg", stored: "binary/octet-stream", head: []byte("??"), want: "image/jpeg"},
+		{testName: "stored type as a last resort", key: "a", stored: "image/avif", head: []byte("??"), want: "image/avif"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			assertEqual(t, objectContentType(tc.key, tc.stored, tc.head), tc.want)
+		})
+	}
+}
+
+func TestServeMislabeledOriginal(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		ServeMode:      envvar.ServeModeInline,
+	}
+
+	tt := []struct {
+		target string
+		// desired Content-Type of the original served as is
+		contentType string
+	}{
+		{target: "/mislabeled.jpeg", contentType: "image/jpeg"},
+		{target: "/converted.jpg", contentType: "image/png"},
+		{target: "/mislabeled.jpeg?w=300", contentType: "image/jpeg"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.target, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, http.StatusOK)
+			assertEqual(t, rr.Header().Get("Content-Type"), tc.contentType)
+			// the whole original, not only what was sniffed
+			original := ssc.storage[path.Join(sev.FolderOriginal, strings.SplitN(tc.target[1:], "?", 2)[0])]
+			assertEqual(t, bytes.Equal(rr.Body.Bytes(), original.data), true)
+		})
+	}
+}
+
+func TestStrictParams(t *testing.T) {
+	tt := []struct {
+		testName string
+		strict   bool
+		target   string
+		// desired response
+		statusCode int
+		body       string
+	}{
+		{testName: "lenient ignores unknown params", target: "/imagePNG.png?w=100&utm_source=mail", statusCode: http.StatusSeeOther},
+		{testName: "lenient ignores misspelled params", target: "/imagePNG.png?width=100", statusCode: http.StatusSeeOther},
+		{testName: "strict accepts known params", strict: true, target: "/imagePNG.png?w=100&h=80&fm=jpeg&dpr=2&download=1", statusCode: http.StatusOK},
+		{testName: "strict accepts no params", strict: true, target: "/imagePNG.png", statusCode: http.StatusSeeOther},
+		{testName: "strict rejects unknown params", strict: true, target: "/imagePNG.png?w=100&utm_source=mail&cb=1", statusCode: http.StatusBadRequest, body: "unknown query params: cb, utm_source"},
+		{testName: "strict rejects misspelled params", strict: true, target: "/imagePNG.png?width=100", statusCode: http.StatusBadRequest, body: "unknown query params: width"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				StrictParams:   tc.strict,
+			}
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.statusCode == http.StatusBadRequest {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				// rejected before anything reached the bucket
+				assertEqual(t, len(ssc.keys), 0)
+			}
+		})
+	}
+}
+
+func TestCopy(t *testing.T) {
+	original := path.Join("stub-original-folder", "imagePNG.png")
+	copied := path.Join("stub-original-folder", "copied.png")
+
+	tt := []struct {
+		testName   string
+		adminToken string
+		token      string
+		body       string
+		// desired response
+		statusCode int
+		// desired bucket afterwards
+		originalKept bool
+		copied       bool
+	}{
+		{testName: "copy", adminToken: "secret", token: "secret", body: `{"from": "` + original + `", "to": "` + copied + `"}`, statusCode: http.StatusNoContent, originalKept: true, copied: true},
+		{testName: "move", adminToken: "secret", token: "secret", body: `{"from": "` + original + `", "to": "` + copied + `", "move": true}`, statusCode: http.StatusNoContent, copied: true},
+		{testName: "missing source", adminToken: "secret", token: "secret", body: `{"from": "stub-original-folder/missing.png", "to": "` + copied + `"}`, statusCode: http.StatusNotFound, originalKept: true},
+		{testName: "same keys", adminToken: "secret", token: "secret", body: `{"from": "` + original + `", "to": "` + original + `", "move": true}`, statusCode: http.StatusBadRequest, originalKept: true},
+		{testName: "missing key", adminToken: "secret", token: "secret", body: `{"from": "` + original + `"}`, statusCode: http.StatusBadRequest, originalKept: true},
+		{testName: "unknown field", adminToken: "secret", token: "secret", body: `{"from": "` + original + `", "to": "` + copied + `", "force": true}`, statusCode: http.StatusBadRequest, originalKept: true},
+		{testName: "wrong token", adminToken: "secret", token: "guess", body: `{"from": "` + original + `", "to": "` + copied + `"}`, statusCode: http.StatusForbidden, originalKept: true},
+		{testName: "no token configured", body: `{"from": "` + original + `", "to": "` + copied + `"}`, statusCode: http.StatusForbidden, originalKept: true},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				AdminToken:     tc.adminToken,
+			}
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+			data := ssc.storage[original].data
+
+			req := httptest.NewRequest(http.MethodPost, copyPath, strings.NewReader(tc.body))
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			_, ok := ssc.storage[original]
+			assertEqual(t, ok, tc.originalKept)
+			object, ok := ssc.storage[copied]
+			assertEqual(t, ok, tc.copied)
+			if tc.copied {
+				assertEqual(t, bytes.Equal(object.data, data), true)
+			}
+		})
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		CacheControl:   "public, max-age=86400",
+	}
+	ssc := newStubStorageClient(sev)
+	ss := New(slogt.New(t), ssc, sev)
+
+	get := func(target string, tenantName string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		if tenantName != "" {
+			r = r.WithContext(context.WithValue(r.Context(), tenantKey{}, tenantName))
+		}
+		rr := httptest.NewRecorder()
+		ss.ServeHTTP(rr, r)
+		return rr
+	}
+
+	// the path only depends on the params that change the variant, in whatever order they come
+	rr := get("/imagePNG.png/immutable?w=100&fm=jpeg&download=1&utm_source=mail", "")
+	assertEqual(t, rr.Code, http.StatusOK)
+	u := rr.Body.String()
+	assertEqual(t, u, "/i/"+immutableHash("", "imagePNG.png", "", "fm=jpeg&w=100")+".jpeg")
+	assertEqual(t, get("/imagePNG.png/immutable?fm=jpeg&w=100", "").Body.String(), u)
+	var recorded immutableTarget
+	assertEqual(t, json.Unmarshal(ssc.storage[immutableKey(sev.FolderResized, immutableHash("", "imagePNG.png", "", "fm=jpeg&w=100"))].data, &recorded), nil)
+	assertEqual(t, recorded, immutableTarget{Image: "imagePNG.png", Query: "fm=jpeg&w=100"})
+
+	// a HEAD answers without producing the variant
+	rr = httptest.NewRecorder()
+	ss.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, u, nil))
+	assertEqual(t, rr.Code, http.StatusOK)
+	assertEqual(t, rr.Header().Get("Content-Type"), "image/jpeg")
+	assertEqual(t, rr.Header().Get("Cache-Control"), immutableCacheControl)
+	_, ok := ssc.storage[path.Join(sev.FolderResized, "imagePNG.png", "w100h0.jpeg")]
+	assertEqual(t, ok, false)
+
+	// the first request produces the variant, the next ones serve it
+	for range 2 {
+		rr = get(u, "")
+		assertEqual(t, rr.Code, http.StatusOK)
+		assertEqual(t, rr.Header().Get("Content-Type"), "image/jpeg")
+		assertEqual(t, rr.Header().Get("Cache-Control"), immutableCacheControl)
+		img, format, err := image.Decode(rr.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, format, "jpeg")
+		assertEqual(t, img.Bounds().Dx(), 100)
+	}
+	_, ok = ssc.storage[path.Join(sev.FolderResized, "imagePNG.png", "w100h0.jpeg")]
+	assertEqual(t, ok, true)
+
+	// the original itself has an immutable path too
+	rr = get("/imagePNG.png/immutable", "")
+	assertEqual(t, rr.Code, http.StatusOK)
+	rr = get(rr.Body.String(), "")
+	assertEqual(t, rr.Code, http.StatusOK)
+	assertEqual(t, rr.Header().Get("Cache-Control"), immutableCacheControl)
+
+	// JSON when the client accepts it
+	r := httptest.NewRequest(http.MethodGet, "/imagePNG.png/immutable?w=100&fm=jpeg", nil)
+	r.Header.Set("Accept", "application/json")
+	rr = httptest.NewRecorder()
+	ss.ServeHTTP(rr, r)
+	assertEqual(t, rr.Header().Get("Content-Type"), "application/json")
+	assertEqual(t, rr.Body.String(), `{"url":"`+u+`"}`)
+
+	tt := []struct {
+		testName string
+		target   string
+		tenant   string
+		// desired response
+		statusCode int
+	}{
+		{testName: "missing image", target: "/missing.png/immutable?w=100", statusCode: http.StatusNotFound},
+		{testName: "invalid params", target: "/imagePNG.png/immutable?w=abc", statusCode: http.StatusBadRequest},
+		{testName: "fm=auto varies with Accept", target: "/imagePNG.png/immutable?fm=auto", statusCode: http.StatusBadRequest},
+		{testName: "path never built", target: "/i/" + strings.Repeat("0", 32) + ".jpeg", statusCode: http.StatusNotFound},
+		{testName: "malformed hash", target: "/i/xyz.jpeg", statusCode: http.StatusNotFound},
+		{testName: "another extension", target: strings.TrimSuffix(u, ".jpeg") + ".png", statusCode: http.StatusNotFound},
+		{testName: "another tenant", target: u, tenant: "acme", statusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			assertEqual(t, get(tc.target, tc.tenant).Code, tc.statusCode)
+		})
+	}
+
+	t.Run("replaced original", func(t *testing.T) {
+		originalKey := path.Join(sev.FolderOriginal, "imagePNG.png")
+		replace := func(version string) {
+			original := ssc.storage[originalKey]
+			original.version = version
+			ssc.storage[originalKey] = original
+		}
+		replace("etag1")
+		u1 := get("/imagePNG.png/immutable?w=100&fm=jpeg", "").Body.String()
+		assertEqual(t, get(u1, "").Code, http.StatusOK)
+		// the variant is keyed by the version even without VERSIONED_KEYS, so the next original's path doesn't serve it
+		_, ok := ssc.storage[path.Join(sev.FolderResized, "imagePNG.png", "w100h0-"+versionTransform("etag1")+".jpeg")]
+		assertEqual(t, ok, true)
+
+		replace("etag2")
+		assertEqual(t, get(u1, "").Code, http.StatusNotFound)
+		u2 := get("/imagePNG.png/immutable?w=100&fm=jpeg", "").Body.String()
+		assertEqual(t, u2 != u1, true)
+		assertEqual(t, get(u2, "").Code, http.StatusOK)
+	})
+}
+
+// failingEncodeStorageClient fails the encoder of every variant it uploads through a pipe, like an encoder failing on its own
+// variants streamed inline are teed into the response and uploaded as usual
+type failingEncodeStorageClient struct {
+	*stubStorageClient
+}
+
+func (fsc *failingEncodeStorageClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	pr, ok := body.(*io.PipeReader)
+	if !ok {
+		return fsc.stubStorageClient.UploadObject(ctx, objectKey, body, contentType)
+	}
+	// the encoder writes into the other end
+	pr.CloseWithError(errors.New("unsupported color model"))
+	_, err := io.ReadAll(pr)
+	return err
+}
+
+func TestOnError(t *testing.T) {
+	tt := []struct {
+		testName string
+		onError  string
+		target   string
+		// desired response
+		statusCode   int
+		location     string
+		cacheControl string
+	}{
+		{testName: "fail by default", target: "/imagePNG.png?w=100", statusCode: http.StatusInternalServerError},
+		{testName: "fail", onError: envvar.OnErrorFail, target: "/imagePNG.png?w=100", statusCode: http.StatusInternalServerError},
+		{
+			testName:     "original",
+			onError:      envvar.OnErrorOriginal,
+			target:       "/imagePNG.png?w=100",
+			statusCode:   http.StatusSeeOther,
+			location:     "https://test.test/" + path.Join("stub-bucket", "stub-original-folder", "imagePNG.png"),
+			cacheControl: "no-store",
+		},
+		{
+			testName:     "original for a conversion",
+			onError:      envvar.OnErrorOriginal,
+			target:       "/imageJPEG.jpeg?fm=png",
+			statusCode:   http.StatusSeeOther,
+			location:     "https://test.test/" + path.Join("stub-bucket", "stub-original-folder", "imageJPEG.jpeg"),
+			cacheControl: "no-store",
+		},
+		{testName: "missing original", onError: envvar.OnErrorOriginal, target: "/missing.png?w=100", statusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				CacheControl:   "public, max-age=86400",
+				OnError:        tc.onError,
+			}
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), &failingEncodeStorageClient{ssc}, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, rr.Header().Get("Location"), tc.location)
+			assertEqual(t, rr.Header().Get("Cache-Control"), tc.cacheControl)
+			// nothing was stored in place of the variant
+			_, ok := ssc.storage[path.Join(sev.FolderResized, "imagePNG.png", "w100h0.png")]
+			assertEqual(t, ok, false)
+		})
+	}
+}
+
+func TestStorageStatus(t *testing.T) {
+	tt := []struct {
+		err error
+		// desired status code, 0 for none
+		code int
+	}{
+		{err: storage.ErrNotFound, code: http.StatusNotFound},
+		{err: storage.ErrForbidden, code: http.StatusForbidden},
+		{err: fmt.Errorf("downloading: %w", storage.ErrUnavailable), code: http.StatusServiceUnavailable},
+		{err: errors.New("connection reset")},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.err.Error(), func(t *testing.T) {
+			var code int
+			if se := storageStatus(tc.err); se != nil {
+				code = se.code
+				assertEqual(t, se.message, http.StatusText(se.code))
+			}
+			assertEqual(t, code, tc.code)
+		})
 	}
 }
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+const errStrInvalidSource = "source image is not a valid image"
+
+// sourceReader remembers why reading an original failed,
+// so a decode error caused by a bad original can be told apart from one caused by the bucket
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (sr *sourceReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		sr.err = err
+	}
+	return n, err
+}
+
+// decodeFailure is the error answered when decoding the original at key read through sr fails with err
+// a zero-byte, truncated or garbage original is the fault of the original, not of the server
+func decodeFailure(ctx context.Context, logger *slog.Logger, key string, sr *sourceReader, err error) *statusError {
+	if sr.err != nil {
+		logger.ErrorContext(ctx, "reading original image", "key", key, "error", sr.err)
+		return newStatusError(http.StatusInternalServerError)
+	}
+	logger.WarnContext(ctx, "original image is not a valid image", "key", key, "error", err)
+	return &statusError{code: http.StatusUnprocessableEntity, message: errStrInvalidSource}
+}
+
+// decodeImage decodes an original like image.Decode, converting CMYK jpegs from print workflows into RGBA
+// and turning jpegs upright by their Exif orientation, since the encoders don't carry Exif over to the variants
+//
+// image/jpeg already undoes the inverted CMYK of Adobe jpegs and converts YCCK into CMYK,
+// but gift and the encoders would otherwise convert every CMYK pixel on its own, each time they read it
+func decodeImage(r io.Reader) (image.Image, string, error) {
+	br := bufio.NewReaderSize(r, exifHeadSize)
+	head, _ := br.Peek(exifHeadSize)
+	o := exifOrientation(head)
+	img, format, err := decodeSniffed(br)
+	if err != nil {
+		return nil, "", err
+	}
+	if cmyk, ok := img.(*image.CMYK); ok {
+		rgba := image.NewRGBA(cmyk.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), cmyk, cmyk.Bounds().Min, draw.Src)
+		img = rgba
+	}
+	if format == formatJPEG {
+		img = orient(img, o)
+	}
+	return img, format, nil
+}
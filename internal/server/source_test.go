@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+// cmykJPEG encodes a baseline 8x8 jpeg of a single CMYK color, the way print workflows store it:
+// 4 components with an Adobe marker and inverted values, which image/jpeg can decode but not encode
+func cmykJPEG(c, m, y, k uint8) []byte {
+	var b bytes.Buffer
+	segment := func(marker byte, payload ...byte) {
+		b.Write([]byte{0xff, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)})
+		b.Write(payload)
+	}
+
+	b.Write([]byte{0xff, 0xd8})
+	// Adobe APP14 with transform 0: no color transform, so the components are CMYK
+	segment(0xee, 'A', 'd', 'o', 'b', 'e', 0, 100, 0, 0, 0, 0, 0)
+	// quantization table of ones, so the DC coefficient of a flat block is 8 times its level shifted value
+	segment(0xdb, append([]byte{0}, bytes.Repeat([]byte{1}, 64)...)...)
+	segment(0xc0, 8, 0, 8, 0, 8, 4, 1, 0x11, 0, 2, 0x11, 0, 3, 0x11, 0, 4, 0x11, 0)
+	// DC categories 0 to 11 coded on 4 bits each, and AC only ever ending the block
+	segment(0xc4, append([]byte{0x00, 0, 0, 0, 12, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11)...)
+	segment(0xc4, 0x10, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)
+	segment(0xda, 4, 1, 0x00, 2, 0x00, 3, 0x00, 4, 0x00, 0, 63, 0)
+
+	var bits uint32
+	var n uint
+	put := func(v uint32, size uint) {
+		bits, n = bits<<size|v&(1<<size-1), n+size
+		for n >= 8 {
+			octet := byte(bits >> (n - 8))
+			b.WriteByte(octet)
+			if octet == 0xff {
+				b.WriteByte(0)
+			}
+			n -= 8
+		}
+	}
+	for _, v := range []uint8{c, m, y, k} {
+		// Adobe stores CMYK inverted
+		dc := 8 * (int(255-v) - 128)
+		category := uint(0)
+		for a := max(dc, -dc); a > 0; a >>= 1 {
+			category++
+		}
+		put(uint32(category), 4)
+		if dc < 0 {
+			dc += 1<<category - 1
+		}
+		put(uint32(dc), category)
+		put(0, 1)
+	}
+	put(0xff, 7)
+	b.Write([]byte{0xff, 0xd9})
+	return b.Bytes()
+}
+
+func TestDecodeImageCMYK(t *testing.T) {
+	data := cmykJPEG(0, 255, 255, 0)
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fixture really is CMYK
+	assertEqual(t, img.ColorModel(), color.CMYKModel)
+
+	img, format, err = decodeImage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, format, formatJPEG)
+	assertEqual(t, img.ColorModel(), color.RGBAModel)
+	assertEqual(t, img.At(3, 3), color.Color(color.RGBA{R: 255, A: 255}))
+}
+
+func TestCMYK(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		ServeMode:      envvar.ServeModeInline,
+	}
+
+	tt := []struct {
+		testName string
+		cmyk     [4]uint8
+		want     color.RGBA
+	}{
+		{testName: "red", cmyk: [4]uint8{0, 255, 255, 0}, want: color.RGBA{R: 255, A: 255}},
+		{testName: "cyan", cmyk: [4]uint8{255, 0, 0, 0}, want: color.RGBA{G: 255, B: 255, A: 255}},
+		{testName: "black", cmyk: [4]uint8{0, 0, 0, 255}, want: color.RGBA{A: 255}},
+		{testName: "white", cmyk: [4]uint8{0, 0, 0, 0}, want: color.RGBA{R: 255, G: 255, B: 255, A: 255}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ssc.storage[path.Join(sev.FolderOriginal, "print.jpg")] = stubObject{data: cmykJPEG(tc.cmyk[0], tc.cmyk[1], tc.cmyk[2], tc.cmyk[3]), contentType: "image/jpeg"}
+			ss := New(slogt.New(t), ssc, sev)
+
+			// png keeps the colors exact
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/print.jpg?w=4&fm=png", nil))
+			assertEqual(t, rr.Code, http.StatusOK)
+
+			img, err := png.Decode(rr.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, img.Bounds().Dx(), 4)
+			r, g, b, a := img.At(2, 2).RGBA()
+			assertEqual(t, color.RGBA{R: uint8(r >> 8), G: uint8(g >> 8), B: uint8(b >> 8), A: uint8(a >> 8)}, tc.want)
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"log/slog"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/disintegration/gift"
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+const (
+	maxSpriteImages      = 64
+	maxSpriteCellSize    = 512
+	maxSpriteRequestSize = 64 << 10
+
+	// sprite sheets are kept in their own folder under the resized folder
+	// image folders always carry an extension, so "sprites" never collides with them
+	spriteFolder = "sprites"
+)
+
+type spriteRequest struct {
+	// image paths relative to the original folder, like the slug of GET /{image}
+	Images []string `json:"images"`
+	Width  int      `json:"width"`
+	Height int      `json:"height"`
+	// defaults to the smallest square grid holding every image
+	Columns int `json:"columns"`
+}
+
+type spriteCell struct {
+	Image  string `json:"image"`
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+type spriteManifest struct {
+	URL    string       `json:"url"`
+	Width  int          `json:"width"`
+	Height int          `json:"height"`
+	Cells  []spriteCell `json:"cells"`
+}
+
+// validate fills in the default column count
+func (sr *spriteRequest) validate() error {
+	if len(sr.Images) == 0 {
+		return errors.New("images must list at least one image")
+	}
+	if len(sr.Images) > maxSpriteImages {
+		return fmt.Errorf("images must list at most %d images", maxSpriteImages)
+	}
+	for _, imagePath := range sr.Images {
+		if _, _, ok := parseImageName(imagePath); !ok {
+			return fmt.Errorf("%s: %q", errStrInvalidImagePath, imagePath)
+		}
+	}
+	if sr.Width < 1 || sr.Width > maxSpriteCellSize || sr.Height < 1 || sr.Height > maxSpriteCellSize {
+		return fmt.Errorf("width and height must be integers between 1 and %d", maxSpriteCellSize)
+	}
+	if sr.Columns < 0 {
+		return errors.New("columns must not be negative")
+	}
+	if sr.Columns == 0 {
+		sr.Columns = int(math.Ceil(math.Sqrt(float64(len(sr.Images)))))
+	}
+	sr.Columns = min(sr.Columns, len(sr.Images))
+	return nil
+}
+
+// manifest lays the images out row by row, left to right
+func (sr spriteRequest) manifest() spriteManifest {
+	rows := (len(sr.Images) + sr.Columns - 1) / sr.Columns
+	m := spriteManifest{
+		Width:  sr.Columns * sr.Width,
+		Height: rows * sr.Height,
+		Cells:  make([]spriteCell, len(sr.Images)),
+	}
+	for i, imagePath := range sr.Images {
+		m.Cells[i] = spriteCell{
+			Image:  imagePath,
+			X:      i % sr.Columns * sr.Width,
+			Y:      i / sr.Columns * sr.Height,
+			Width:  sr.Width,
+			Height: sr.Height,
+		}
+	}
+	return m
+}
+
+// spriteKey names a sheet after a hash of its layout, so the same request always maps to the same sheet
+func spriteKey(folder string, sr spriteRequest) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%d\n%d\n", sr.Width, sr.Height, sr.Columns)
+	h.Write([]byte(strings.Join(sr.Images, "\n")))
+	return path.Join(folder, spriteFolder, "sprite-"+hex.EncodeToString(h.Sum(nil)[:8])+".png")
+}
+
+// spriteHandler packs several originals into one png sheet of fixed size cells
+// and answers with a JSON manifest of where each image ended up
+func spriteHandler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var sr spriteRequest
+		dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxSpriteRequestSize))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&sr); err != nil {
+			http.Error(w, "invalid sprite request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := sr.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m := sr.manifest()
+		sheetKey := spriteKey(envVar.FolderResized, sr)
+		m.URL = storageClient.ObjectURL(sheetKey)
+
+		// check if the sheet already exists
+		sheetOK, err := storageClient.CheckObject(r.Context(), sheetKey)
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				http.Error(w, se.message, se.code)
+				return
+			}
+			logger.ErrorContext(r.Context(), "checking sprite sheet", "key", sheetKey, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if !sheetOK {
+			sheet := image.NewRGBA(image.Rect(0, 0, m.Width, m.Height))
+			for _, cell := range m.Cells {
+				originalKey := originalKey(envVar.FolderOriginal, cell.Image)
+				body, _, err := storageClient.DownloadObject(r.Context(), originalKey)
+				if err != nil {
+					if errors.Is(err, storage.ErrNotFound) {
+						http.Error(w, fmt.Sprintf("image %q not found", cell.Image), http.StatusNotFound)
+						return
+					}
+					if se := storageStatus(err); se != nil {
+						http.Error(w, se.message, se.code)
+						return
+					}
+					logger.ErrorContext(r.Context(), "downloading original image", "key", originalKey, "error", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+				source := &sourceReader{r: body}
+				src, _, err := decodeImage(source)
+				body.Close()
+				if err != nil {
+					se := decodeFailure(r.Context(), logger, originalKey, source, err)
+					http.Error(w, se.message, se.code)
+					return
+				}
+
+				// fit the image into its cell, centered, leaving the rest transparent
+				g := gift.New(gift.ResizeToFit(cell.Width, cell.Height, gift.LanczosResampling))
+				fitted := g.Bounds(src.Bounds())
+				offset := image.Pt(cell.X+(cell.Width-fitted.Dx())/2, cell.Y+(cell.Height-fitted.Dy())/2)
+				g.DrawAt(sheet, src, offset, gift.CopyOperator)
+			}
+
+			var buf bytes.Buffer
+			if err := encode(&buf, sheet, formatPNG, encodeOptions{}); err != nil {
+				logger.ErrorContext(r.Context(), "encoding sprite sheet", "key", sheetKey, "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			err = storageClient.UploadObject(r.Context(), sheetKey, &buf, mimeType(formatPNG))
+			if err != nil {
+				if errors.Is(err, storage.ErrBadRequest) {
+					http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+					return
+				}
+				if se := storageStatus(err); se != nil {
+					http.Error(w, se.message, se.code)
+					return
+				}
+				logger.ErrorContext(r.Context(), "uploading sprite sheet", "key", sheetKey, "error", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		data, err := json.Marshal(m)
+		if err != nil {
+			logger.ErrorContext(r.Context(), "encoding sprite manifest", "key", sheetKey, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}
+}
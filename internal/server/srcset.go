@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+const (
+	querySrcsetWidths = "widths"
+	querySrcsetEager  = "eager"
+
+	maxSrcsetWidths = 10
+	maxSrcsetWidth  = 4096
+)
+
+// parseSrcsetWidths reads a comma separated list of widths, sorted and deduplicated
+func parseSrcsetWidths(value string) ([]int, error) {
+	errInvalid := fmt.Errorf("widths must be a comma separated list of up to %d integers between 1 and %d", maxSrcsetWidths, maxSrcsetWidth)
+	if value == "" {
+		return nil, errInvalid
+	}
+	var widths []int
+	for _, s := range strings.Split(value, ",") {
+		width, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || width < 1 || width > maxSrcsetWidth {
+			return nil, errInvalid
+		}
+		widths = append(widths, width)
+	}
+	slices.Sort(widths)
+	widths = slices.Compact(widths)
+	if len(widths) > maxSrcsetWidths {
+		return nil, errInvalid
+	}
+	return widths, nil
+}
+
+// srcsetHandler answers with a srcset listing the image at every width of ?widths,
+// any other query param applying to every width like it would on GET /{image}
+//
+// the srcset points at the image requests of this server, which resize every width once it is asked for,
+// or with ?eager=1 every width is resized right away and the srcset points at the variants in the bucket
+// ?preload=1 adds a Link header preloading the srcset
+func srcsetHandler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar, o options) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// check image path
+		imagePath := r.PathValue(slug)
+		_, imageFormat, ok := parseImageName(imagePath)
+		if !ok {
+			http.Error(w, errStrInvalidImagePath, http.StatusBadRequest)
+			return
+		}
+
+		q := r.URL.Query()
+		widths, err := parseSrcsetWidths(q.Get(querySrcsetWidths))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.Has(queryWidth) || q.Has(queryHeight) {
+			http.Error(w, "widths can't be combined with w or h", http.StatusBadRequest)
+			return
+		}
+		var eager bool
+		if q.Has(querySrcsetEager) {
+			eager, err = strconv.ParseBool(q.Get(querySrcsetEager))
+			if err != nil {
+				http.Error(w, "eager must be a boolean", http.StatusBadRequest)
+				return
+			}
+		}
+		preload, err := parsePreload(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		q.Del(querySrcsetWidths)
+		q.Del(querySrcsetEager)
+		q.Del(queryPreload)
+		// regenerating takes the bearer token only GET /{image} checks
+		q.Del(queryNoCache)
+
+		candidates := make([]string, 0, len(widths))
+		var largest string
+		for _, width := range widths {
+			wq := maps.Clone(q)
+			wq.Set(queryWidth, strconv.Itoa(width))
+
+			var u string
+			if eager {
+				v, err := resizeVariant(r.Context(), logger, storageClient, envVar, o, imagePath, wq, nil)
+				if err != nil {
+					var se *statusError
+					if !errors.As(err, &se) {
+						se = newStatusError(http.StatusInternalServerError)
+					}
+					http.Error(w, se.message, se.code)
+					return
+				}
+				u = storageClient.ObjectURL(v.key)
+			} else {
+				// the same params are checked again when each width is requested, but an invalid one fails the whole srcset now
+				if _, err := checkImageQuery(envVar, o, imageFormat, wq); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				u = imageURL(r, imagePath, wq)
+			}
+			candidates = append(candidates, u+" "+strconv.Itoa(width)+"w")
+			largest = u
+		}
+		srcset := strings.Join(candidates, ", ")
+		if preload {
+			w.Header().Add("Link", preloadLink(largest, srcset, "", ""))
+		}
+		writeSrcset(w, r, logger, srcset)
+	}
+}
+
+// checkImageQuery parses q like the image request with q would, without downloading anything
+func checkImageQuery(envVar *envvar.EnvVar, o options, imageFormat string, q url.Values) (params, error) {
+	expanded, err := expandPreset(o.presets, q)
+	if err != nil {
+		return params{}, err
+	}
+	return parseParams(expanded, imageFormat, envVar.AllowedFormats, envVar.MaxDimension, envResampling(envVar), envQualityConfig(envVar))
+}
+
+// imageURL is the URL of the image request of this server for imagePath with q, relative to its host
+func imageURL(r *http.Request, imagePath string, q url.Values) string {
+	return pathPrefix(r) + "/" + url.PathEscape(imagePath) + "?" + q.Encode()
+}
+
+// writeSrcset answers with JSON when the client accepts it, and with plain text otherwise
+func writeSrcset(w http.ResponseWriter, r *http.Request, logger *slog.Logger, srcset string) {
+	if !strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Length", strconv.Itoa(len(srcset)))
+		w.Write([]byte(srcset))
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		Srcset string `json:"srcset"`
+	}{srcset})
+	if err != nil {
+		logger.ErrorContext(r.Context(), "encoding srcset response", "error", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
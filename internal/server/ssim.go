@@ -0,0 +1,94 @@
+package server
+
+import "image"
+
+// ssimWindow is the side of the square windows ssim compares
+const ssimWindow = 8
+
+// the constants of SSIM keeping its ratios stable where the windows are dark or flat, for 8-bit values
+const (
+	ssimC1 = (0.01 * 255) * (0.01 * 255)
+	ssimC2 = (0.03 * 255) * (0.03 * 255)
+)
+
+// ssim is the structural similarity of the luma of a and b, 1 when they are the same,
+// averaged over the windows tiling the size they share
+// images smaller than a window are compared as a single window
+func ssim(a, b image.Image) float64 {
+	w := min(a.Bounds().Dx(), b.Bounds().Dx())
+	h := min(a.Bounds().Dy(), b.Bounds().Dy())
+	if w == 0 || h == 0 {
+		return 1
+	}
+	la, lb := luma(a, w, h), luma(b, w, h)
+	ww, wh := min(ssimWindow, w), min(ssimWindow, h)
+
+	var sum float64
+	var windows int
+	for y := 0; y+wh <= h; y += wh {
+		for x := 0; x+ww <= w; x += ww {
+			sum += ssimOf(la, lb, w, x, y, ww, wh)
+			windows++
+		}
+	}
+	return sum / float64(windows)
+}
+
+// ssimOf is the SSIM of the window of la and lb at x, y
+func ssimOf(la, lb []float64, stride, x, y, ww, wh int) float64 {
+	n := float64(ww * wh)
+	var meanA, meanB float64
+	for j := y; j < y+wh; j++ {
+		for i := x; i < x+ww; i++ {
+			meanA += la[j*stride+i]
+			meanB += lb[j*stride+i]
+		}
+	}
+	meanA /= n
+	meanB /= n
+	var varA, varB, cov float64
+	for j := y; j < y+wh; j++ {
+		for i := x; i < x+ww; i++ {
+			da, db := la[j*stride+i]-meanA, lb[j*stride+i]-meanB
+			varA += da * da
+			varB += db * db
+			cov += da * db
+		}
+	}
+	varA /= n
+	varB /= n
+	cov /= n
+	return (2*meanA*meanB + ssimC1) * (2*cov + ssimC2) / ((meanA*meanA + meanB*meanB + ssimC1) * (varA + varB + ssimC2))
+}
+
+// luma is the w by h top-left luma of img, 0 to 255, row by row
+// the Y plane of decoded jpegs is read as is rather than converted back from RGB
+func luma(img image.Image, w, h int) []float64 {
+	l := make([]float64, w*h)
+	b := img.Bounds()
+	switch img := img.(type) {
+	case *image.YCbCr:
+		for y := 0; y < h; y++ {
+			row := img.Y[img.YOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				l[y*w+x] = float64(row[x])
+			}
+		}
+	case *image.RGBA:
+		for y := 0; y < h; y++ {
+			row := img.Pix[img.PixOffset(b.Min.X, b.Min.Y+y):]
+			for x := 0; x < w; x++ {
+				p := row[x*4 : x*4+3]
+				l[y*w+x] = 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+			}
+		}
+	default:
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+				l[y*w+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+			}
+		}
+	}
+	return l
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+// CacheStatser is a cache whose counters are reported at GET /admin/stats
+type CacheStatser interface {
+	Stats() storage.CacheStats
+}
+
+type cacheStatsResponse struct {
+	Hits   int64 `json:"hits"`
+	Misses int64 `json:"misses"`
+	// of the lookups, 0 before the first one
+	HitRate   float64 `json:"hit_rate"`
+	Evictions int64   `json:"evictions"`
+	Entries   int     `json:"entries"`
+	Bytes     int64   `json:"bytes,omitempty"`
+}
+
+func newCacheStatsResponse(s storage.CacheStats) cacheStatsResponse {
+	res := cacheStatsResponse{
+		Hits:      s.Hits,
+		Misses:    s.Misses,
+		Evictions: s.Evictions,
+		Entries:   s.Entries,
+		Bytes:     s.Bytes,
+	}
+	if lookups := s.Hits + s.Misses; lookups > 0 {
+		res.HitRate = float64(s.Hits) / float64(lookups)
+	}
+	return res
+}
+
+// statsHandler answers with the counters of every cache configured, by their names
+func statsHandler(envVar *envvar.EnvVar, o options) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(envVar, r) {
+			http.Error(w, "reading stats requires a valid bearer token", http.StatusForbidden)
+			return
+		}
+
+		res := make(map[string]cacheStatsResponse, len(o.caches))
+		for name, cache := range o.caches {
+			res[name] = newCacheStatsResponse(cache.Stats())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+func TestStats(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		AdminToken:     "secret",
+	}
+	existence := storage.NewExistenceCacheClient(newStubStorageClient(sev), time.Minute, 0)
+	originals := NewMemoryOriginalCache(1<<20, time.Minute)
+	ss := New(slogt.New(t), existence, sev,
+		WithOriginalCache(originals),
+		WithCacheStats("existence_cache", existence),
+		WithCacheStats("original_cache", originals),
+	)
+
+	get := func(target string, token string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		ss.ServeHTTP(rr, req)
+		return rr
+	}
+	stats := func() map[string]cacheStatsResponse {
+		t.Helper()
+		rr := get(statsPath, "secret")
+		assertEqual(t, rr.Code, http.StatusOK)
+		assertEqual(t, rr.Header().Get("Content-Type"), "application/json")
+		var res map[string]cacheStatsResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	assertEqual(t, get(statsPath, "").Code, http.StatusForbidden)
+	assertEqual(t, get(statsPath, "wrong").Code, http.StatusForbidden)
+
+	res := stats()
+	assertEqual(t, len(res), 2)
+	assertEqual(t, res["original_cache"], cacheStatsResponse{})
+
+	// the first resize decodes the original, the second one finds it in cache
+	get("/imagePNG.png?w=100", "")
+	get("/imagePNG.png?w=120", "")
+	res = stats()
+	assertEqual(t, res["original_cache"].Hits, int64(1))
+	assertEqual(t, res["original_cache"].Misses, int64(1))
+	assertEqual(t, res["original_cache"].HitRate, 0.5)
+	assertEqual(t, res["original_cache"].Entries, 1)
+	assertEqual(t, res["original_cache"].Bytes, int64(300*300*4))
+
+	// the variant stored by the first request is checked once, then remembered
+	before := res["existence_cache"]
+	get("/imagePNG.png?w=100", "")
+	get("/imagePNG.png?w=100", "")
+	res = stats()
+	assertEqual(t, res["existence_cache"].Misses, before.Misses+1)
+	assertEqual(t, res["existence_cache"].Hits, before.Hits+1)
+	assertEqual(t, res["existence_cache"].Entries, before.Entries+1)
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net/url"
+	"slices"
+)
+
+// imageParams are the query params an image request knows, any other is ignored unless envvar.EnvVar.StrictParams is set
+var imageParams = []string{
+	queryWidth, queryHeight, queryDPR, queryUpscale, queryFrame, queryTrim, queryTrimTolerance, queryScale, queryResampling,
+	queryFormat, queryFallback, queryQuality, queryWebPQuality, queryWebPLossless, queryICOSizes, queryMaxBytes, querySubsample, queryOptimizePNG, queryICC,
+	queryPad, queryBackground,
+	queryWatermark, queryWmPosition, queryWmOpacity,
+	queryText, queryTextPosition, queryTextSize, queryTextColor,
+	queryPreset, queryDebug, queryNoCache, queryDownload,
+}
+
+// unknownParams lists the params of q not in known, sorted
+func unknownParams(q url.Values, known []string) []string {
+	var unknown []string
+	for key := range q {
+		if !slices.Contains(known, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	slices.Sort(unknown)
+	return unknown
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/netip"
+)
+
+const maxTenantLength = 64
+
+type tenantKey struct{}
+
+// tenant is the tenant whose variants ctx reads and writes, "" for the shared ones
+func tenant(ctx context.Context) string {
+	t, _ := ctx.Value(tenantKey{}).(string)
+	return t
+}
+
+// validTenant allows ASCII letters, digits, dashes and underscores, so a tenant always stands for a single folder
+func validTenant(t string) bool {
+	if t == "" || len(t) > maxTenantLength {
+		return false
+	}
+	for _, r := range t {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// withTenant reads the tenant of a request from header, only believed from trusted proxies which authenticated it
+// requests without one share the variants of every other request without one
+func withTenant(header string, trustedProxies []netip.Prefix, next http.Handler) http.Handler {
+	if header == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := r.Header.Get(header)
+		if t == "" || !fromTrustedProxy(r, trustedProxies) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !validTenant(t) {
+			http.Error(w, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, t)))
+	})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"path"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestTenants(t *testing.T) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		TenantHeader:   "X-Tenant",
+	}
+
+	tt := []struct {
+		testName   string
+		target     string
+		remoteAddr string
+		tenant     string
+		// desired response status code and Location header of redirection
+		statusCode int
+		location   string
+	}{
+		{
+			testName:   "no tenant",
+			target:     "/imageJPEG.jpeg?w=100",
+			remoteAddr: "10.0.0.2:51234",
+			statusCode: http.StatusSeeOther,
+			location:   path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0.jpeg"),
+		},
+		{
+			testName:   "tenant from a trusted proxy",
+			target:     "/imageJPEG.jpeg?w=100",
+			remoteAddr: "10.0.0.2:51234",
+			tenant:     "acme",
+			statusCode: http.StatusSeeOther,
+			location:   path.Join(sev.FolderResized, "tenants", "acme", "imageJPEG.jpeg", "w100h0.jpeg"),
+		},
+		{
+			// originals are shared by every tenant
+			testName:   "original of a tenant",
+			target:     "/imageJPEG.jpeg",
+			remoteAddr: "10.0.0.2:51234",
+			tenant:     "acme",
+			statusCode: http.StatusSeeOther,
+			location:   path.Join(sev.FolderOriginal, "imageJPEG.jpeg"),
+		},
+		{
+			testName:   "tenant from anyone else is ignored",
+			target:     "/imageJPEG.jpeg?w=100",
+			remoteAddr: "203.0.113.7:51234",
+			tenant:     "acme",
+			statusCode: http.StatusSeeOther,
+			location:   path.Join(sev.FolderResized, "imageJPEG.jpeg", "w100h0.jpeg"),
+		},
+		{
+			testName:   "invalid tenant",
+			target:     "/imageJPEG.jpeg?w=100",
+			remoteAddr: "10.0.0.2:51234",
+			tenant:     "../acme",
+			statusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			ssc := newStubStorageClient(sev)
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+			req.RemoteAddr = tc.remoteAddr
+			if tc.tenant != "" {
+				req.Header.Set(sev.TenantHeader, tc.tenant)
+			}
+			ss.ServeHTTP(rr, req)
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.location != "" {
+				assertEqual(t, rr.Header().Get("Location"), "https://test.test/"+path.Join(sev.BucketName, tc.location))
+				_, ok := ssc.storage[tc.location]
+				assertEqual(t, ok, true)
+			}
+		})
+	}
+}
+
+func TestValidTenant(t *testing.T) {
+	for tenant, want := range map[string]bool{
+		"acme":                                  true,
+		"Acme_2-prod":                           true,
+		"":                                      false,
+		"acme/west":                             false,
+		"..":                                    false,
+		"acme corp":                             false,
+		"acmé":                                  false,
+		string(make([]byte, maxTenantLength+1)): false,
+	} {
+		assertEqual(t, validTenant(tenant), want)
+	}
+}
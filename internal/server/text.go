@@ -0,0 +1,83 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/disintegration/gift"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	maxTextLength       = 100
+	maxTextSize         = 8
+	defaultTextSize     = 2
+	defaultTextPosition = "south"
+)
+
+// sanitizeText rejects captions that are too long or hold control characters
+// the built-in font only has glyphs for printable ASCII, so anything else is drawn as "?"
+func sanitizeText(text string) (string, error) {
+	if !utf8.ValidString(text) {
+		return "", errors.New("text must be valid UTF-8")
+	}
+	if utf8.RuneCountInString(text) > maxTextLength {
+		return "", errors.New("text must be at most 100 characters long")
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", errors.New("text must not be blank")
+	}
+	var b strings.Builder
+	for _, r := range text {
+		switch {
+		case unicode.IsControl(r):
+			return "", errors.New("text must not contain control characters")
+		case r > unicode.MaxASCII:
+			b.WriteRune('?')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), nil
+}
+
+// textHash keeps the resized key bounded and free of the caption's characters
+func textHash(text string) string {
+	sum := sha256.Sum256([]byte(text))
+	return hex.EncodeToString(sum[:4])
+}
+
+// drawText renders the caption with the built-in 7x13 font, scaled up by size with nearest-neighbor
+// so the glyphs stay crisp, and draws it over dst at the given position
+func drawText(dst *image.RGBA, text string, position string, size int, c color.NRGBA) {
+	face := basicfont.Face7x13
+	metrics := face.Metrics()
+	width := font.MeasureString(face, text).Ceil()
+	height := (metrics.Ascent + metrics.Descent).Ceil()
+
+	mask := image.NewAlpha(image.Rect(0, 0, width, height))
+	d := font.Drawer{
+		Dst:  mask,
+		Src:  image.Opaque,
+		Face: face,
+		Dot:  fixed.Point26_6{Y: metrics.Ascent},
+	}
+	d.DrawString(text)
+
+	g := gift.New(gift.Resize(width*size, height*size, gift.NearestNeighborResampling))
+	scaled := image.NewRGBA(g.Bounds(mask.Bounds()))
+	g.Draw(scaled, mask)
+
+	offset := overlayOffset(dst.Bounds(), scaled.Bounds().Size(), position, 2*size)
+	r := image.Rectangle{Min: offset, Max: offset.Add(scaled.Bounds().Size())}
+	draw.DrawMask(dst, r, image.NewUniform(c), image.Point{}, scaled, image.Point{}, draw.Over)
+}
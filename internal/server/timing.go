@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTiming collects how long the phases of a request took, sent back in the Server-Timing header
+type serverTiming struct {
+	mu      sync.Mutex
+	metrics []string
+}
+
+type serverTimingKey struct{}
+
+// startPhase starts timing a phase of the request in ctx, the returned func stops it and only counts once
+// phases may overlap, like encode and upload which run through a pipe
+func startPhase(ctx context.Context, name string) func() {
+	st, ok := ctx.Value(serverTimingKey{}).(*serverTiming)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return sync.OnceFunc(func() {
+		ms := float64(time.Since(start).Microseconds()) / 1000
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		st.metrics = append(st.metrics, fmt.Sprintf("%s;dur=%.3f", name, ms))
+	})
+}
+
+func (st *serverTiming) String() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return strings.Join(st.metrics, ", ")
+}
+
+// timingWriter adds the phases timed so far to the headers, right before they are sent
+// an image streamed as it is encoded leaves out encode and upload, which only end after its headers are sent
+type timingWriter struct {
+	http.ResponseWriter
+	st                *serverTiming
+	timingAllowOrigin string
+	wroteHeader       bool
+}
+
+func (tw *timingWriter) WriteHeader(status int) {
+	if !tw.wroteHeader {
+		tw.wroteHeader = true
+		if metrics := tw.st.String(); metrics != "" {
+			tw.Header().Set("Server-Timing", metrics)
+		}
+		if tw.timingAllowOrigin != "" {
+			tw.Header().Set("Timing-Allow-Origin", tw.timingAllowOrigin)
+		}
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timingWriter) Write(b []byte) (int, error) {
+	if !tw.wroteHeader {
+		tw.WriteHeader(http.StatusOK)
+	}
+	return tw.ResponseWriter.Write(b)
+}
+
+func (tw *timingWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// timeRequests times the phases of every request to next, see startPhase
+func timeRequests(timingAllowOrigin string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := &serverTiming{}
+		tw := &timingWriter{ResponseWriter: w, st: st, timingAllowOrigin: timingAllowOrigin}
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), serverTimingKey{}, st)))
+	})
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/gift"
+)
+
+// render produces the output of p from the decoded original, before it is encoded
+func render(src image.Image, p params, watermark image.Image) *image.RGBA {
+	if p.trim {
+		src = trimmed(src, p.trimTolerance)
+	}
+	dst := transform(src, p)
+	if p.watermark {
+		applyWatermark(dst, watermark, p.watermarkPos, p.watermarkOpacity)
+	}
+	if p.text != "" {
+		drawText(dst, p.text, p.textPosition, p.textSize, p.textColor)
+	}
+	return dst
+}
+
+// transform applies the requested transforms to the decoded original
+func transform(src image.Image, p params) *image.RGBA {
+	if p.pad {
+		return padded(src, p)
+	}
+	if p.scale > 1 {
+		// every pixel of src turns into a square of scale pixels, which nearest neighbor keeps crisp
+		size := outputSize(src.Bounds(), p)
+		g := gift.New(gift.Resize(size.X, size.Y, gift.NearestNeighborResampling))
+		dst := image.NewRGBA(g.Bounds(src.Bounds()))
+		g.Draw(dst, src)
+		return dst
+	}
+
+	// a size that is already the one of src needs no resampling, only converting into RGBA,
+	// which draw does much faster than gift copying pixel by pixel
+	bounds := src.Bounds()
+	size := outputSize(bounds, p)
+	if size == bounds.Size() {
+		// only the watermark and the caption draw on the output, so without them an RGBA src can be encoded as is,
+		// even when the original cache shares it
+		if rgba, ok := src.(*image.RGBA); ok && bounds.Min == (image.Point{}) && !p.watermark && p.text == "" {
+			return rgba
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(dst, dst.Bounds(), src, bounds.Min, draw.Src)
+		return dst
+	}
+
+	g := gift.New(gift.Resize(p.width, p.height, p.resampling.filter(bounds.Size(), size)))
+	dst := image.NewRGBA(g.Bounds(bounds))
+	g.Draw(dst, src)
+	return dst
+}
+
+// outputSize is the size transform gives to an original of the given bounds
+func outputSize(bounds image.Rectangle, p params) image.Point {
+	if p.pad {
+		return image.Pt(p.width, p.height)
+	}
+	if p.scale > 1 {
+		return bounds.Size().Mul(p.scale)
+	}
+	if p.width == 0 && p.height == 0 {
+		return bounds.Size()
+	}
+	return gift.New(gift.Resize(p.width, p.height, gift.LanczosResampling)).Bounds(bounds).Size()
+}
+
+// withinBounds resolves upscale=0 against the bounds of the original, so the resized key names the final size
+//
+//   - w or h alone is capped at the matching side of the original, the other side following its aspect ratio
+//   - w and h together shrink by the same factor until both fit, keeping the requested aspect ratio
+//   - pad keeps the size of its canvas, the image fitted in it is never enlarged anyway
+//
+// a size capped to the one of the original is dropped, so the original itself answers when nothing else is requested
+func (p params) withinBounds(bounds image.Rectangle) params {
+	if !p.noUpscale || p.pad || p.width == 0 && p.height == 0 {
+		return p
+	}
+	size := bounds.Size()
+
+	switch {
+	case p.width != 0 && p.height != 0:
+		f := min(float64(size.X)/float64(p.width), float64(size.Y)/float64(p.height))
+		if f < 1 {
+			p.width = max(1, int(math.Round(float64(p.width)*f)))
+			p.height = max(1, int(math.Round(float64(p.height)*f)))
+		}
+	case p.width > size.X:
+		p.width = size.X
+	case p.height > size.Y:
+		p.height = size.Y
+	}
+	if p.width == size.X && (p.height == 0 || p.height == size.Y) || p.width == 0 && p.height == size.Y {
+		p.width, p.height = 0, 0
+		p.resampleTransform = ""
+	}
+	return p
+}
+
+// padded scales src to fit within width x height and centers it on a canvas filled with the background color
+func padded(src image.Image, p params) *image.RGBA {
+	fitted := gift.New(gift.ResizeToFit(p.width, p.height, gift.LanczosResampling)).Bounds(src.Bounds())
+	g := gift.New(gift.ResizeToFit(p.width, p.height, p.resampling.filter(src.Bounds().Size(), fitted.Size())))
+
+	dst := image.NewRGBA(image.Rect(0, 0, p.width, p.height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(p.background), image.Point{}, draw.Src)
+	offset := image.Pt((p.width-fitted.Dx())/2, (p.height-fitted.Dy())/2)
+	g.DrawAt(dst, src, offset, gift.OverOperator)
+	return dst
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+// BenchmarkResize answers requests for new variants end to end, from the download of the original to the upload
+//
+//	go test ./internal/server -run '^$' -bench 'Resize|Transform' -benchmem
+func BenchmarkResize(b *testing.B) {
+	sev := &envvar.EnvVar{
+		BucketName:     "stub-bucket",
+		FolderOriginal: "stub-original-folder",
+		FolderResized:  "stub-resized-folder",
+	}
+
+	for _, format := range []string{"jpeg", "png"} {
+		other := map[string]string{"jpeg": "png", "png": "jpeg"}[format]
+		// resized, converted at the size of the original, and requested at that size with another format
+		for _, query := range []string{"w=800", "fm=" + other, "w=1920&fm=" + other} {
+			b.Run(fmt.Sprintf("%s/%s", format, query), func(b *testing.B) {
+				ssc := newStubStorageClient(sev)
+				ssc.storage[path.Join(sev.FolderOriginal, "large."+format)] = newStubObject(format, 1920, 1080)
+				ss := New(slogt.New(b), ssc, sev)
+
+				for b.Loop() {
+					rr := httptest.NewRecorder()
+					ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/large."+format+"?"+query+"&nocache=0", nil))
+					if rr.Code != http.StatusSeeOther {
+						b.Fatalf("got status %d", rr.Code)
+					}
+					// the next request produces the variant again
+					for key := range ssc.storage {
+						if path.Dir(key) == path.Join(sev.FolderResized, "large."+format) {
+							delete(ssc.storage, key)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkTransform isolates transform from decoding and encoding
+func BenchmarkTransform(b *testing.B) {
+	rect := image.Rect(0, 0, 1920, 1080)
+	sources := map[string]image.Image{
+		"rgba":  image.NewRGBA(rect),
+		"ycbcr": image.NewYCbCr(rect, image.YCbCrSubsampleRatio420),
+	}
+
+	for _, name := range []string{"rgba", "ycbcr"} {
+		for _, tc := range []struct {
+			name string
+			p    params
+		}{
+			{name: "resize", p: params{width: 800}},
+			{name: "same size", p: params{width: 1920}},
+			{name: "no resize", p: params{}},
+		} {
+			b.Run(name+"/"+tc.name, func(b *testing.B) {
+				for b.Loop() {
+					transform(sources[name], tc.p)
+				}
+			})
+		}
+	}
+}
+
+func TestTransformSameSize(t *testing.T) {
+	rgba := image.NewRGBA(image.Rect(0, 0, 4, 3))
+	rgba.Set(1, 1, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+	ycbcr := image.NewYCbCr(image.Rect(0, 0, 4, 3), image.YCbCrSubsampleRatio444)
+	for i := range ycbcr.Y {
+		ycbcr.Y[i], ycbcr.Cb[i], ycbcr.Cr[i] = uint8(i*20), 90, 160
+	}
+
+	tt := []struct {
+		testName string
+		src      image.Image
+		p        params
+		// whether src itself is the output
+		same bool
+	}{
+		{testName: "rgba without resize", src: rgba, p: params{}, same: true},
+		{testName: "rgba at its own size", src: rgba, p: params{width: 4}, same: true},
+		// the watermark and the caption draw on the output, which must not be the src the original cache may share
+		{testName: "rgba with a watermark", src: rgba, p: params{watermark: true}},
+		{testName: "rgba with a caption", src: rgba, p: params{text: "hi"}},
+		{testName: "ycbcr at its own size", src: ycbcr, p: params{width: 4, height: 3}},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			dst := transform(tc.src, tc.p)
+			assertEqual(t, image.Image(dst) == tc.src, tc.same)
+			assertEqual(t, dst.Bounds(), tc.src.Bounds())
+			for y := range 3 {
+				for x := range 4 {
+					assertEqual(t, dst.At(x, y), color.RGBAModel.Convert(tc.src.At(x, y)))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/url"
+	"strconv"
+)
+
+const (
+	queryTrim          = "trim"
+	queryTrimTolerance = "trim_tolerance"
+)
+
+// defaultTrimTolerance lets the noise of a scan or of a lossy encode pass for the border color, which the resized keys leave out
+const defaultTrimTolerance = 10
+
+// parseTrim reads ?trim and ?trim_tolerance, the tolerance of a request trimming nothing being 0
+func parseTrim(q url.Values) (trim bool, tolerance int, err error) {
+	if q.Has(queryTrim) {
+		trim, err = strconv.ParseBool(q.Get(queryTrim))
+		if err != nil {
+			return false, 0, fmt.Errorf("trim must be a boolean, got %q", q.Get(queryTrim))
+		}
+	}
+	if !q.Has(queryTrimTolerance) {
+		if !trim {
+			return false, 0, nil
+		}
+		return true, defaultTrimTolerance, nil
+	}
+	if !trim {
+		return false, 0, errors.New("trim_tolerance requires trim=1")
+	}
+	tolerance, err = strconv.Atoi(q.Get(queryTrimTolerance))
+	if err != nil || tolerance < 0 || tolerance > 255 {
+		return false, 0, fmt.Errorf("trim_tolerance must be an integer between 0 and 255, got %q", q.Get(queryTrimTolerance))
+	}
+	return true, tolerance, nil
+}
+
+// trimTransform names the trim in the resized key, like "trim" or "trim30" for another tolerance than the default
+func trimTransform(tolerance int) string {
+	if tolerance == defaultTrimTolerance {
+		return queryTrim
+	}
+	return queryTrim + strconv.Itoa(tolerance)
+}
+
+// trimmed crops the borders of src in the color of its top left pixel, every channel of theirs within tolerance of it
+// on a scale of 0 to 255, scanning inwards from each edge until another color shows up
+//
+// an image of that color only has nothing else to keep, so it is returned whole
+func trimmed(src image.Image, tolerance int) image.Image {
+	b := src.Bounds()
+	if b.Empty() {
+		return src
+	}
+	bg := src.At(b.Min.X, b.Min.Y)
+	border := func(x, y int) bool {
+		return similarColors(src.At(x, y), bg, tolerance)
+	}
+	rowBorder := func(y, minX, maxX int) bool {
+		for x := minX; x < maxX; x++ {
+			if !border(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	colBorder := func(x, minY, maxY int) bool {
+		for y := minY; y < maxY; y++ {
+			if !border(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	r := b
+	for r.Min.Y < r.Max.Y && rowBorder(r.Min.Y, r.Min.X, r.Max.X) {
+		r.Min.Y++
+	}
+	if r.Empty() {
+		return src
+	}
+	for rowBorder(r.Max.Y-1, r.Min.X, r.Max.X) {
+		r.Max.Y--
+	}
+	for colBorder(r.Min.X, r.Min.Y, r.Max.Y) {
+		r.Min.X++
+	}
+	for colBorder(r.Max.X-1, r.Min.Y, r.Max.Y) {
+		r.Max.X--
+	}
+	if r == b {
+		return src
+	}
+
+	if s, ok := src.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, r.Min, draw.Src)
+	return dst
+}
+
+// similarColors tells whether every channel of a and b, alpha included, differs by at most tolerance out of 255
+func similarColors(a, b color.Color, tolerance int) bool {
+	r1, g1, b1, a1 := a.RGBA()
+	r2, g2, b2, a2 := b.RGBA()
+	for _, d := range [4][2]uint32{{r1, r2}, {g1, g2}, {b1, b2}, {a1, a2}} {
+		if diff := int(d[0]>>8) - int(d[1]>>8); diff > tolerance || -diff > tolerance {
+			return false
+		}
+	}
+	return true
+}
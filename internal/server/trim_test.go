@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+// newBorderedImage is a size x size white image holding a red content rectangle, tinted by noise at its top left corner
+func newBorderedImage(size int, content image.Rectangle, noise uint8) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	draw.Draw(img, content, image.NewUniform(red), image.Point{}, draw.Src)
+	img.Set(0, 0, color.NRGBA{R: 0xff - noise, G: 0xff - noise, B: 0xff - noise, A: 0xff})
+	return img
+}
+
+func TestTrimmed(t *testing.T) {
+	content := image.Rect(3, 5, 7, 8)
+	tt := []struct {
+		testName  string
+		src       image.Image
+		tolerance int
+		want      image.Rectangle
+	}{
+		{testName: "borders", src: newBorderedImage(10, content, 0), want: content},
+		{testName: "noise within tolerance", src: newBorderedImage(10, content, 5), tolerance: 10, want: content},
+		// the top left pixel is taken for the border color, so the white around it is content
+		{testName: "noise beyond tolerance", src: newBorderedImage(10, content, 5), want: image.Rect(0, 0, 10, 10)},
+		{testName: "uniform", src: newBorderedImage(10, image.Rectangle{}, 0), want: image.Rect(0, 0, 10, 10)},
+		{testName: "content touching the edges", src: newBorderedImage(10, image.Rect(0, 2, 10, 10), 0), want: image.Rect(0, 2, 10, 10)},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			assertEqual(t, trimmed(tc.src, tc.tolerance).Bounds(), tc.want)
+		})
+	}
+}
+
+func TestTrim(t *testing.T) {
+	tt := []struct {
+		testName string
+		original image.Image
+		target   string
+		// desired response status code, and body or key and size of the variant
+		statusCode int
+		body       string
+		key        string
+		size       image.Point
+	}{
+		{testName: "trimmed", original: newBorderedImage(20, image.Rect(5, 4, 15, 9), 0), target: "/scan.png?trim=1", statusCode: http.StatusSeeOther, key: "w0h0-trim.png", size: image.Pt(10, 5)},
+		{testName: "trimmed then resized", original: newBorderedImage(20, image.Rect(5, 4, 15, 9), 0), target: "/scan.png?trim=1&w=20", statusCode: http.StatusSeeOther, key: "w20h0-trim.png", size: image.Pt(20, 10)},
+		{testName: "tolerance", original: newBorderedImage(20, image.Rect(5, 4, 15, 9), 20), target: "/scan.png?trim=1&trim_tolerance=30", statusCode: http.StatusSeeOther, key: "w0h0-trim30.png", size: image.Pt(10, 5)},
+		{testName: "uniform original", original: newBorderedImage(20, image.Rectangle{}, 0), target: "/scan.png?trim=1", statusCode: http.StatusSeeOther, key: "w0h0-trim.png", size: image.Pt(20, 20)},
+		{testName: "trim=0", original: newBorderedImage(20, image.Rect(5, 4, 15, 9), 0), target: "/scan.png?trim=0&w=10", statusCode: http.StatusSeeOther, key: "w10h0.png", size: image.Pt(10, 10)},
+		{testName: "tolerance without trim", original: newBorderedImage(20, image.Rectangle{}, 0), target: "/scan.png?trim_tolerance=30", statusCode: http.StatusBadRequest, body: "trim_tolerance requires trim=1"},
+		{testName: "invalid tolerance", original: newBorderedImage(20, image.Rectangle{}, 0), target: "/scan.png?trim=1&trim_tolerance=256", statusCode: http.StatusBadRequest, body: `trim_tolerance must be an integer between 0 and 255, got "256"`},
+		{testName: "with upscale=0", original: newBorderedImage(20, image.Rectangle{}, 0), target: "/scan.png?trim=1&w=10&upscale=0", statusCode: http.StatusBadRequest, body: "trim can't be combined with upscale=0"},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+			}
+			ssc := newStubStorageClient(sev)
+			var buf bytes.Buffer
+			if err := png.Encode(&buf, tc.original); err != nil {
+				t.Fatal(err)
+			}
+			ssc.storage[path.Join(sev.FolderOriginal, "scan.png")] = stubObject{data: buf.Bytes(), contentType: "image/png"}
+			ss := New(slogt.New(t), ssc, sev)
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, tc.target, nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			if tc.body != "" {
+				assertEqual(t, strings.TrimSpace(rr.Body.String()), tc.body)
+				return
+			}
+			key := path.Join(sev.FolderResized, "scan.png", tc.key)
+			assertEqual(t, rr.Header().Get("Location"), ssc.ObjectURL(key))
+			cfg, _, err := image.DecodeConfig(bytes.NewReader(ssc.storage[key].data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEqual(t, image.Pt(cfg.Width, cfg.Height), tc.size)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/obzva/image-server/internal/storage"
+)
+
+// errUploadQueueFull is returned for a variant whose upload waited longer than the timeout of the UploadLimiter
+var errUploadQueueFull = errors.New("no upload slot freed up in time")
+
+// UploadLimiter bounds the uploads of new variants in flight, apart from the resizes producing them,
+// so that a burst of misses doesn't run into the request rate limits of S3
+//
+// a variant waiting for a slot is encoded into memory meanwhile, rather than blocking its encoder on the upload,
+// and is given up on once it waited for timeout
+type UploadLimiter struct {
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func NewUploadLimiter(concurrency int, timeout time.Duration) *UploadLimiter {
+	return &UploadLimiter{slots: make(chan struct{}, concurrency), timeout: timeout}
+}
+
+// tryAcquire takes a slot when one is free right away
+func (ul *UploadLimiter) tryAcquire() bool {
+	select {
+	case ul.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire waits for a slot, until the timeout or ctx is done
+func (ul *UploadLimiter) acquire(ctx context.Context) bool {
+	timer := time.NewTimer(ul.timeout)
+	defer timer.Stop()
+	select {
+	case ul.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// release gives back a slot taken by tryAcquire or acquire
+func (ul *UploadLimiter) release() {
+	<-ul.slots
+}
+
+// produceQueued is produce for a variant that found no free upload slot, encoding it into memory while it waits for one
+//
+// when none frees up in time, the variant is still written to inline if set, without being stored, along with errUploadQueueFull
+func produceQueued(ctx context.Context, storageClient storage.Client, uploads *UploadLimiter, key string, contentType string, write func(w io.Writer) error, inline func(contentType string) io.Writer) (encodeErr error, uploadErr error, streamed bool) {
+	var buf bytes.Buffer
+	stopEncode := startPhase(ctx, "encode")
+	encodeErr = write(&buf)
+	stopEncode()
+	if encodeErr != nil {
+		return encodeErr, nil, false
+	}
+
+	stopQueue := startPhase(ctx, "upload_queue")
+	acquired := uploads.acquire(ctx)
+	stopQueue()
+	if !acquired {
+		return nil, errUploadQueueFull, writeUnstored(inline, contentType, buf.Bytes())
+	}
+	defer uploads.release()
+
+	stopUpload := startPhase(ctx, "upload")
+	uploadErr = storageClient.UploadObject(ctx, key, bytes.NewReader(buf.Bytes()), contentType)
+	stopUpload()
+	if uploadErr != nil {
+		return nil, uploadErr, writeUnstored(inline, contentType, buf.Bytes())
+	}
+	if inline != nil {
+		// a client gone by now doesn't undo anything stored
+		inline(contentType).Write(buf.Bytes())
+		streamed = true
+	}
+	return nil, nil, streamed
+}
+
+// writeUnstored writes data to inline if set, for a variant answered without being stored, telling whether it did
+func writeUnstored(inline func(contentType string) io.Writer, contentType string, data []byte) bool {
+	if inline == nil {
+		return false
+	}
+	inline(contentType).Write(data)
+	return true
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/neilotoole/slogt"
+	"github.com/obzva/image-server/internal/envvar"
+)
+
+func TestUploadLimiterAcquire(t *testing.T) {
+	ul := NewUploadLimiter(2, 10*time.Millisecond)
+
+	assertEqual(t, ul.tryAcquire(), true)
+	assertEqual(t, ul.acquire(context.Background()), true)
+	assertEqual(t, ul.tryAcquire(), false)
+	// times out while every slot is taken
+	assertEqual(t, ul.acquire(context.Background()), false)
+
+	// or gives up with its request
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	full := NewUploadLimiter(1, time.Hour)
+	full.tryAcquire()
+	assertEqual(t, full.acquire(ctx), false)
+
+	// waits for a slot to be released
+	go func() {
+		time.Sleep(time.Millisecond)
+		ul.release()
+	}()
+	ul.timeout = time.Second
+	assertEqual(t, ul.acquire(context.Background()), true)
+	ul.release()
+	ul.release()
+	assertEqual(t, len(ul.slots), 0)
+}
+
+func TestUploadLimiter(t *testing.T) {
+	tt := []struct {
+		testName  string
+		serveMode string
+		dedup     bool
+		// released while the variant waits for it
+		release bool
+		// desired response status code, and whether the variant was uploaded
+		statusCode int
+		uploaded   bool
+	}{
+		{testName: "slot freed up", release: true, statusCode: http.StatusSeeOther, uploaded: true},
+		{testName: "slot freed up inline", serveMode: envvar.ServeModeInline, release: true, statusCode: http.StatusOK, uploaded: true},
+		{testName: "slot freed up deduplicated", dedup: true, release: true, statusCode: http.StatusSeeOther, uploaded: true},
+		{testName: "timed out", statusCode: http.StatusServiceUnavailable},
+		{testName: "timed out inline", serveMode: envvar.ServeModeInline, statusCode: http.StatusOK},
+		{testName: "timed out deduplicated", dedup: true, statusCode: http.StatusServiceUnavailable},
+		{testName: "timed out deduplicated inline", serveMode: envvar.ServeModeInline, dedup: true, statusCode: http.StatusOK},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			sev := &envvar.EnvVar{
+				BucketName:     "stub-bucket",
+				FolderOriginal: "stub-original-folder",
+				FolderResized:  "stub-resized-folder",
+				ServeMode:      tc.serveMode,
+				Dedup:          tc.dedup,
+			}
+			ssc := newStubStorageClient(sev)
+			timeout := 20 * time.Millisecond
+			if tc.release {
+				timeout = 10 * time.Second
+			}
+			ul := NewUploadLimiter(1, timeout)
+			ss := New(slogt.New(t), ssc, sev, WithUploadLimiter(ul))
+
+			// another upload is in flight
+			assertEqual(t, ul.tryAcquire(), true)
+			if tc.release {
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					ul.release()
+				}()
+			}
+
+			rr := httptest.NewRecorder()
+			ss.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/imagePNG.png?w=100", nil))
+
+			assertEqual(t, rr.Code, tc.statusCode)
+			assertEqual(t, ssc.execution[exeKeyUpload], tc.uploaded)
+			if tc.statusCode == http.StatusOK {
+				assertEqual(t, rr.Header().Get("Content-Type"), "image/png")
+				assertEqual(t, rr.Body.Len() > 0, true)
+			}
+			if !tc.release {
+				ul.release()
+			}
+			assertEqual(t, len(ul.slots), 0)
+		})
+	}
+}
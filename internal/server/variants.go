@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/obzva/image-server/internal/envvar"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+// storedVariant describes a resized variant found in the resized folder of an image
+// width or height is 0 when the other one alone was requested
+type storedVariant struct {
+	Key        string   `json:"key"`
+	Width      int      `json:"width"`
+	Height     int      `json:"height"`
+	Format     string   `json:"format"`
+	Transforms []string `json:"transforms"`
+	URL        string   `json:"url"`
+}
+
+// variantsHandler lists the resized variants stored for an image, read back from their keys
+// objects of the resized folder that aren't variants, like cached blurhashes, are left out
+func variantsHandler(logger *slog.Logger, storageClient storage.Client, envVar *envvar.EnvVar) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// check image path
+		imagePath := r.PathValue(slug)
+		imageName, _, ok := parseImageName(imagePath)
+		if !ok {
+			http.Error(w, errStrInvalidImagePath, http.StatusBadRequest)
+			return
+		}
+
+		folder := resizedFolder(envVar, tenant(r.Context()), imagePath, imageName)
+		objects, err := storageClient.ListObjects(r.Context(), folder+"/")
+		if err != nil {
+			if se := storageStatus(err); se != nil {
+				http.Error(w, se.message, se.code)
+				return
+			}
+			logger.ErrorContext(r.Context(), "listing resized images", "folder", folder, "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		variants := []storedVariant{}
+		for _, object := range objects {
+			key := object.Key
+			width, height, ext, transforms, ok := parseResizedKey(key)
+			// nested keys belong to another image, like "dir/img.jpg" under the folder of "dir"
+			if !ok || path.Dir(key) != folder {
+				continue
+			}
+			target := key
+			if envVar.Dedup {
+				// the variant is a link to the blob holding its content
+				target, err = storageClient.ResolveObject(r.Context(), key)
+				if err != nil {
+					if errors.Is(err, storage.ErrNotFound) {
+						// deleted since it was listed
+						continue
+					}
+					if se := storageStatus(err); se != nil {
+						http.Error(w, se.message, se.code)
+						return
+					}
+					logger.ErrorContext(r.Context(), "resolving resized image", "key", key, "error", err)
+					http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+					return
+				}
+			}
+			if transforms == nil {
+				transforms = []string{}
+			}
+			variants = append(variants, storedVariant{
+				Key:        key,
+				Width:      width,
+				Height:     height,
+				Format:     formatFromExtension(ext),
+				Transforms: transforms,
+				URL:        storageClient.ObjectURL(target),
+			})
+		}
+
+		data, err := json.Marshal(struct {
+			Variants []storedVariant `json:"variants"`
+		}{variants})
+		if err != nil {
+			logger.ErrorContext(r.Context(), "encoding variants response", "error", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data)
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/disintegration/gift"
+	"github.com/obzva/image-server/internal/storage"
+)
+
+const defaultWatermarkPosition = "southeast"
+
+// gravity of every overlay position, as fractions of the free space left around the overlay
+var overlayPositions = map[string][2]float64{
+	"center":    {0.5, 0.5},
+	"north":     {0.5, 0},
+	"south":     {0.5, 1},
+	"east":      {1, 0.5},
+	"west":      {0, 0.5},
+	"northeast": {1, 0},
+	"northwest": {0, 0},
+	"southeast": {1, 1},
+	"southwest": {0, 1},
+}
+
+// LoadWatermark downloads and decodes the watermark image once, so requests don't fetch it again
+func LoadWatermark(ctx context.Context, storageClient storage.Client, key string) (image.Image, error) {
+	body, _, err := storageClient.DownloadObject(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("downloading watermark %q: %w", key, err)
+	}
+	defer body.Close()
+
+	img, _, err := decodeImage(body)
+	if err != nil {
+		return nil, fmt.Errorf("decoding watermark %q: %w", key, err)
+	}
+	return img, nil
+}
+
+// applyWatermark draws the watermark over dst at the given position and opacity
+// a watermark larger than dst is scaled down to fit within it
+func applyWatermark(dst *image.RGBA, watermark image.Image, position string, opacity float64) {
+	wb := watermark.Bounds()
+	db := dst.Bounds()
+	if wb.Dx() > db.Dx() || wb.Dy() > db.Dy() {
+		g := gift.New(gift.ResizeToFit(db.Dx(), db.Dy(), gift.LanczosResampling))
+		fitted := image.NewRGBA(g.Bounds(wb))
+		g.Draw(fitted, watermark)
+		watermark = fitted
+		wb = fitted.Bounds()
+	}
+
+	offset := overlayOffset(db, wb.Size(), position, 0)
+	mask := image.NewUniform(color.Alpha{A: uint8(opacity*0xff + 0.5)})
+	draw.DrawMask(dst, image.Rectangle{Min: offset, Max: offset.Add(wb.Size())}, watermark, wb.Min, mask, image.Point{}, draw.Over)
+}
+
+// overlayOffset places an overlay of the given size within bounds, keeping margin pixels away from the edges it leans on
+func overlayOffset(bounds image.Rectangle, size image.Point, position string, margin int) image.Point {
+	gravity := overlayPositions[position]
+	free := bounds.Size().Sub(size).Sub(image.Pt(2*margin, 2*margin))
+	return image.Pt(
+		bounds.Min.X+margin+int(float64(free.X)*gravity[0]),
+		bounds.Min.Y+margin+int(float64(free.Y)*gravity[1]),
+	)
+}
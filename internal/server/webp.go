@@ -0,0 +1,23 @@
+//go:build cgo
+
+package server
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+// the WebP encoder and decoder wrap libwebp, so they are only available in cgo builds
+func init() {
+	registerEncoder(formatWebP, encodeWebP)
+	registerDecoder(formatWebP, "RIFF????WEBPVP8", webp.Decode, webp.DecodeConfig)
+}
+
+func encodeWebP(w io.Writer, img image.Image, opts encodeOptions) error {
+	return webp.Encode(w, img, &webp.Options{
+		Lossless: opts.webpLossless,
+		Quality:  float32(opts.webpQuality),
+	})
+}
@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrUnavailable = errors.New(http.StatusText(http.StatusServiceUnavailable))
+
+// BreakerClient wraps a Client with a circuit breaker
+//
+// after threshold consecutive failures the breaker opens and every call fails fast with ErrUnavailable
+// once the cooldown has passed a single call is let through as a probe: success closes the breaker, failure opens it again
+// not-found, forbidden and bad-request errors are answers from the backend, so they don't count as failures,
+// and canceled calls and uploads failing on their body aren't counted at all
+type BreakerClient struct {
+	client    Client
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewBreakerClient(client Client, threshold int, cooldown time.Duration) *BreakerClient {
+	return &BreakerClient{
+		client:    client,
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+func (bc *BreakerClient) ObjectURL(objectKey string) string {
+	return bc.client.ObjectURL(objectKey)
+}
+
+func (bc *BreakerClient) CheckObject(ctx context.Context, objectKey string) (bool, error) {
+	probe, ok := bc.allow()
+	if !ok {
+		return false, ErrUnavailable
+	}
+	ok, err := bc.client.CheckObject(ctx, objectKey)
+	bc.record(probe, err)
+	return ok, err
+}
+
+func (bc *BreakerClient) ObjectMetadata(ctx context.Context, objectKey string) (map[string]string, string, error) {
+	probe, ok := bc.allow()
+	if !ok {
+		return nil, "", ErrUnavailable
+	}
+	metadata, version, err := bc.client.ObjectMetadata(ctx, objectKey)
+	bc.record(probe, err)
+	return metadata, version, err
+}
+
+func (bc *BreakerClient) DownloadObject(ctx context.Context, objectKey string) (io.ReadCloser, string, error) {
+	probe, ok := bc.allow()
+	if !ok {
+		return nil, "", ErrUnavailable
+	}
+	body, contentType, err := bc.client.DownloadObject(ctx, objectKey)
+	bc.record(probe, err)
+	return body, contentType, err
+}
+
+func (bc *BreakerClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	probe, ok := bc.allow()
+	if !ok {
+		return ErrUnavailable
+	}
+	br := &bodyReader{r: body}
+	err := bc.client.UploadObject(ctx, objectKey, br, contentType)
+	if err != nil && br.err != nil {
+		bc.record(probe, &bodyError{br.err})
+	} else {
+		bc.record(probe, err)
+	}
+	return err
+}
+
+func (bc *BreakerClient) CopyObject(ctx context.Context, srcKey string, dstKey string) error {
+	probe, ok := bc.allow()
+	if !ok {
+		return ErrUnavailable
+	}
+	err := bc.client.CopyObject(ctx, srcKey, dstKey)
+	bc.record(probe, err)
+	return err
+}
+
+func (bc *BreakerClient) DeleteObject(ctx context.Context, objectKey string) error {
+	probe, ok := bc.allow()
+	if !ok {
+		return ErrUnavailable
+	}
+	err := bc.client.DeleteObject(ctx, objectKey)
+	bc.record(probe, err)
+	return err
+}
+
+func (bc *BreakerClient) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	probe, ok := bc.allow()
+	if !ok {
+		return nil, ErrUnavailable
+	}
+	objects, err := bc.client.ListObjects(ctx, prefix)
+	bc.record(probe, err)
+	return objects, err
+}
+
+func (bc *BreakerClient) LinkObject(ctx context.Context, objectKey string, targetKey string) error {
+	probe, ok := bc.allow()
+	if !ok {
+		return ErrUnavailable
+	}
+	err := bc.client.LinkObject(ctx, objectKey, targetKey)
+	bc.record(probe, err)
+	return err
+}
+
+func (bc *BreakerClient) ResolveObject(ctx context.Context, objectKey string) (string, error) {
+	probe, ok := bc.allow()
+	if !ok {
+		return "", ErrUnavailable
+	}
+	targetKey, err := bc.client.ResolveObject(ctx, objectKey)
+	bc.record(probe, err)
+	return targetKey, err
+}
+
+// allow tells whether a call may go through, and whether it is the probe of an open breaker
+func (bc *BreakerClient) allow() (probe bool, ok bool) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if bc.failures < bc.threshold {
+		return false, true
+	}
+	if bc.probing || bc.now().Sub(bc.openedAt) < bc.cooldown {
+		return false, false
+	}
+	bc.probing = true
+	return true, true
+}
+
+// record counts the result of a call let through by allow
+// only the probe decides whether an open breaker closes, calls that were already in flight when it opened don't,
+// and canceled calls or uploads failing on their body tell nothing about the backend, so they aren't counted at all
+func (bc *BreakerClient) record(probe bool, err error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if probe {
+		// a canceled probe leaves the breaker open for the next call to probe again
+		bc.probing = false
+	}
+	var be *bodyError
+	if errors.Is(err, context.Canceled) || errors.As(err, &be) {
+		return
+	}
+	if !probe && bc.failures >= bc.threshold {
+		return
+	}
+	if !isFailure(err) {
+		bc.failures = 0
+		return
+	}
+	bc.failures++
+	if bc.failures >= bc.threshold {
+		bc.openedAt = bc.now()
+	}
+}
+
+// bodyError is the error an upload failed with reading its body, like the encoder writing it failing
+// or the response it is teed into being gone
+type bodyError struct {
+	err error
+}
+
+func (be *bodyError) Error() string {
+	return be.err.Error()
+}
+
+func (be *bodyError) Unwrap() error {
+	return be.err
+}
+
+// bodyReader keeps the error reading the body of an upload failed with, which the wrapped client may not return as is
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (br *bodyReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	if err != nil && err != io.EOF {
+		br.err = err
+	}
+	return n, err
+}
+
+func isFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	for _, answer := range []error{ErrNotFound, ErrForbidden, ErrBadRequest} {
+		if errors.Is(err, answer) {
+			return false
+		}
+	}
+	return true
+}
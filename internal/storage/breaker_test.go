@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+type stubClient struct {
+	err   error
+	calls int
+}
+
+func (sc *stubClient) ObjectURL(objectKey string) string {
+	return objectKey
+}
+
+func (sc *stubClient) CheckObject(ctx context.Context, objectKey string) (bool, error) {
+	sc.calls++
+	return sc.err == nil, sc.err
+}
+
+func (sc *stubClient) ObjectMetadata(ctx context.Context, objectKey string) (map[string]string, string, error) {
+	sc.calls++
+	return nil, "", sc.err
+}
+
+func (sc *stubClient) DownloadObject(ctx context.Context, objectKey string) (io.ReadCloser, string, error) {
+	sc.calls++
+	return nil, "", sc.err
+}
+
+func (sc *stubClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	sc.calls++
+	if sc.err != nil {
+		return sc.err
+	}
+	// the body is read like the bucket would, failing the upload if it fails
+	_, err := io.Copy(io.Discard, body)
+	return err
+}
+
+func (sc *stubClient) CopyObject(ctx context.Context, srcKey string, dstKey string) error {
+	sc.calls++
+	return sc.err
+}
+
+func (sc *stubClient) DeleteObject(ctx context.Context, objectKey string) error {
+	sc.calls++
+	return sc.err
+}
+
+func (sc *stubClient) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	sc.calls++
+	return nil, sc.err
+}
+
+func (sc *stubClient) LinkObject(ctx context.Context, objectKey string, targetKey string) error {
+	sc.calls++
+	return sc.err
+}
+
+func (sc *stubClient) ResolveObject(ctx context.Context, objectKey string) (string, error) {
+	sc.calls++
+	return objectKey, sc.err
+}
+
+func TestBreakerClient(t *testing.T) {
+	errOutage := errors.New("connection refused")
+
+	sc := &stubClient{err: errOutage}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	bc := NewBreakerClient(sc, 3, time.Minute)
+	bc.now = func() time.Time { return now }
+
+	// consecutive failures trip the breaker
+	for range 3 {
+		if _, err := bc.CheckObject(context.Background(), "key"); !errors.Is(err, errOutage) {
+			t.Fatalf("got %v; want %v", err, errOutage)
+		}
+	}
+	assertEqual(t, sc.calls, 3)
+
+	// open breaker fails fast without calling the backend
+	if _, _, err := bc.DownloadObject(context.Background(), "key"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v; want %v", err, ErrUnavailable)
+	}
+	assertEqual(t, sc.calls, 3)
+
+	// failed probe after the cooldown opens it again
+	now = now.Add(time.Minute)
+	if err := bc.UploadObject(context.Background(), "key", nil, ""); !errors.Is(err, errOutage) {
+		t.Fatalf("got %v; want %v", err, errOutage)
+	}
+	assertEqual(t, sc.calls, 4)
+	if _, err := bc.CheckObject(context.Background(), "key"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v; want %v", err, ErrUnavailable)
+	}
+	assertEqual(t, sc.calls, 4)
+
+	// successful probe after the cooldown resets it
+	now = now.Add(time.Minute)
+	sc.err = nil
+	if _, err := bc.CheckObject(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	sc.err = errOutage
+	for range 2 {
+		bc.CheckObject(context.Background(), "key")
+	}
+	if _, err := bc.CheckObject(context.Background(), "key"); !errors.Is(err, errOutage) {
+		t.Fatalf("got %v; want %v", err, errOutage)
+	}
+	assertEqual(t, sc.calls, 8)
+}
+
+func TestBreakerClientIgnoresBackendAnswers(t *testing.T) {
+	sc := &stubClient{err: ErrNotFound}
+	bc := NewBreakerClient(sc, 1, time.Minute)
+
+	for range 3 {
+		if _, _, err := bc.DownloadObject(context.Background(), "key"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("got %v; want %v", err, ErrNotFound)
+		}
+	}
+	assertEqual(t, sc.calls, 3)
+}
+
+func TestBreakerClientIgnoresCanceledCalls(t *testing.T) {
+	errOutage := errors.New("connection refused")
+	sc := &stubClient{err: errOutage}
+	bc := NewBreakerClient(sc, 2, time.Minute)
+
+	// a canceled call between two failures doesn't reset the count
+	bc.CheckObject(context.Background(), "key")
+	sc.err = context.Canceled
+	bc.CheckObject(context.Background(), "key")
+	sc.err = errOutage
+	bc.CheckObject(context.Background(), "key")
+	if _, err := bc.CheckObject(context.Background(), "key"); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v; want %v", err, ErrUnavailable)
+	}
+	assertEqual(t, sc.calls, 3)
+}
+
+func TestBreakerClientIgnoresBodyErrors(t *testing.T) {
+	sc := &stubClient{}
+	bc := NewBreakerClient(sc, 2, time.Minute)
+
+	// an encoder failing on the other end of the pipe the body is read from, again and again
+	errEncode := errors.New("unsupported color model")
+	for range 3 {
+		pr, pw := io.Pipe()
+		pw.CloseWithError(errEncode)
+		if err := bc.UploadObject(context.Background(), "key", pr, "image/png"); !errors.Is(err, errEncode) {
+			t.Fatalf("got %v; want %v", err, errEncode)
+		}
+	}
+	if _, err := bc.CheckObject(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, sc.calls, 4)
+}
+
+func TestBreakerClientProbe(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	bc := NewBreakerClient(&stubClient{}, 1, time.Minute)
+	bc.now = func() time.Time { return now }
+
+	// a call in flight when the breaker opens
+	_, inFlight := bc.allow()
+	assertEqual(t, inFlight, true)
+	probe, _ := bc.allow()
+	bc.record(probe, errors.New("connection refused"))
+
+	now = now.Add(time.Minute)
+	probe, ok := bc.allow()
+	assertEqual(t, probe, true)
+	assertEqual(t, ok, true)
+
+	// the call in flight neither closes the breaker nor lets another probe through
+	bc.record(false, nil)
+	_, ok = bc.allow()
+	assertEqual(t, ok, false)
+
+	// a canceled probe leaves it open for the next call to probe again
+	bc.record(true, context.Canceled)
+	probe, ok = bc.allow()
+	assertEqual(t, probe, true)
+	assertEqual(t, ok, true)
+
+	// only the probe closes it
+	bc.record(true, nil)
+	probe, ok = bc.allow()
+	assertEqual(t, probe, false)
+	assertEqual(t, ok, true)
+}
+
+func assertEqual[U comparable](t *testing.T, got, want U) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// diskCacheTempPrefix names the files a DiskCacheClient is still writing, left over ones are removed at startup
+const diskCacheTempPrefix = ".tmp-"
+
+// DiskCacheClient wraps a Client, keeping the objects it downloads and uploads in files under dir
+// so the next downloads of the same objects skip the bucket
+//
+// files are named after the SHA-256 of their key and start with the content type of their object on a line of its own
+// downloads made with a context from WithVersion name theirs after the version too, so that an object replaced
+// by anyone else isn't answered from the file of its previous version
+// up to maxBytes of them are kept, the least recently used removed first once it is full
+// files found in dir at startup are kept, ranked by when they were last used
+//
+// uploads, copies, links and deletes through the client drop the file of their key,
+// while objects written or deleted by anyone else keep being answered from their file until it is evicted
+// only DownloadObject is answered from the files, everything else asks the wrapped client
+type DiskCacheClient struct {
+	client   Client
+	dir      string
+	maxBytes int64
+
+	mu    sync.Mutex
+	bytes int64
+	// most recently used first
+	lru *list.List
+	// by file name
+	entries map[string]*list.Element
+	// bumped by every forget, so a download started before an upload isn't kept after it
+	generation uint64
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type diskCacheEntry struct {
+	name        string
+	contentType string
+	// of the whole file, its content type line included
+	bytes int64
+}
+
+// NewDiskCacheClient creates dir if it doesn't exist and picks up the files a previous run left in it
+func NewDiskCacheClient(client Client, dir string, maxBytes int64) (*DiskCacheClient, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	dc := &DiskCacheClient{
+		client:   client,
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	if err := dc.load(); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+func (dc *DiskCacheClient) load() error {
+	dirEntries, err := os.ReadDir(dc.dir)
+	if err != nil {
+		return err
+	}
+	type found struct {
+		entry   *diskCacheEntry
+		modTime time.Time
+	}
+	var files []found
+	for _, de := range dirEntries {
+		name := de.Name()
+		if strings.HasPrefix(name, diskCacheTempPrefix) {
+			os.Remove(filepath.Join(dc.dir, name))
+			continue
+		}
+		// anything else in dir isn't a cached object
+		if !de.Type().IsRegular() || !isDiskCacheName(name) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		contentType, err := readContentTypeLine(filepath.Join(dc.dir, name))
+		if err != nil {
+			continue
+		}
+		files = append(files, found{
+			entry:   &diskCacheEntry{name: name, contentType: contentType, bytes: info.Size()},
+			modTime: info.ModTime(),
+		})
+	}
+	// the least recently used end up at the back
+	slices.SortFunc(files, func(a, b found) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	for _, f := range files {
+		dc.entries[f.entry.name] = dc.lru.PushFront(f.entry)
+		dc.bytes += f.entry.bytes
+	}
+	dc.evict()
+	return nil
+}
+
+func (dc *DiskCacheClient) ObjectURL(objectKey string) string {
+	return dc.client.ObjectURL(objectKey)
+}
+
+func (dc *DiskCacheClient) CheckObject(ctx context.Context, objectKey string) (bool, error) {
+	return dc.client.CheckObject(ctx, objectKey)
+}
+
+func (dc *DiskCacheClient) ObjectMetadata(ctx context.Context, objectKey string) (map[string]string, string, error) {
+	return dc.client.ObjectMetadata(ctx, objectKey)
+}
+
+// DownloadObject answers the object from its file when there is one,
+// or else downloads it into a file before answering it, failing only when the wrapped client does
+func (dc *DiskCacheClient) DownloadObject(ctx context.Context, objectKey string) (io.ReadCloser, string, error) {
+	name := diskCacheName(objectKey)
+	if version := Version(ctx); version != "" {
+		name = diskCacheName(objectKey + "\n" + version)
+	}
+	f, contentType, generation := dc.open(name)
+	if f != nil {
+		dc.hits.Add(1)
+		return f, contentType, nil
+	}
+	dc.misses.Add(1)
+
+	body, contentType, err := dc.client.DownloadObject(ctx, objectKey)
+	if err != nil {
+		return nil, "", err
+	}
+	tmp, err := dc.createTemp(contentType)
+	if err != nil {
+		return body, contentType, nil
+	}
+	size, err := io.Copy(tmp, body)
+	body.Close()
+	if err != nil {
+		removeTemp(tmp)
+		return nil, "", err
+	}
+	if _, err := tmp.Seek(int64(len(contentType))+1, io.SeekStart); err != nil {
+		removeTemp(tmp)
+		return nil, "", err
+	}
+	// the file stays readable through tmp once renamed
+	if !dc.commit(tmp, name, contentType, int64(len(contentType))+1+size, generation) {
+		return &tempFile{tmp}, contentType, nil
+	}
+	return tmp, contentType, nil
+}
+
+// UploadObject keeps the body in a file while it is uploaded, which may keep what was uploaded
+// when the wrapped client succeeds without writing, like S3Client does for existing objects
+// the file is only kept once the whole body was read into it, a client succeeding before that keeps none
+func (dc *DiskCacheClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	tmp, err := dc.createTemp(contentType)
+	if err != nil {
+		defer dc.forget(objectKey)
+		return dc.client.UploadObject(ctx, objectKey, body, contentType)
+	}
+	cw := &cacheWriter{w: tmp, bytes: int64(len(contentType)) + 1, maxBytes: dc.maxBytes}
+	er := &eofReader{r: io.TeeReader(body, cw)}
+	err = dc.client.UploadObject(ctx, objectKey, er, contentType)
+	generation := dc.forget(objectKey)
+	if err != nil || !er.eof || cw.failed || !sizeIs(tmp, cw.bytes) || tmp.Close() != nil || !dc.commit(tmp, diskCacheName(objectKey), contentType, cw.bytes, generation) {
+		removeTemp(tmp)
+	}
+	return err
+}
+
+func (dc *DiskCacheClient) CopyObject(ctx context.Context, srcKey string, dstKey string) error {
+	// forgotten whether or not the copy went through, it may have before failing
+	defer dc.forget(dstKey)
+	return dc.client.CopyObject(ctx, srcKey, dstKey)
+}
+
+func (dc *DiskCacheClient) DeleteObject(ctx context.Context, objectKey string) error {
+	defer dc.forget(objectKey)
+	return dc.client.DeleteObject(ctx, objectKey)
+}
+
+func (dc *DiskCacheClient) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	return dc.client.ListObjects(ctx, prefix)
+}
+
+func (dc *DiskCacheClient) LinkObject(ctx context.Context, objectKey string, targetKey string) error {
+	defer dc.forget(objectKey)
+	return dc.client.LinkObject(ctx, objectKey, targetKey)
+}
+
+func (dc *DiskCacheClient) ResolveObject(ctx context.Context, objectKey string) (string, error) {
+	return dc.client.ResolveObject(ctx, objectKey)
+}
+
+// Stats counts the downloads answered from a file as hits, the ones asking the wrapped client as misses
+func (dc *DiskCacheClient) Stats() CacheStats {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return CacheStats{
+		Hits:      dc.hits.Load(),
+		Misses:    dc.misses.Load(),
+		Evictions: dc.evictions.Load(),
+		Entries:   len(dc.entries),
+		Bytes:     dc.bytes,
+	}
+}
+
+// open opens the file of name past its content type line, nil when there is none
+func (dc *DiskCacheClient) open(name string) (f *os.File, contentType string, generation uint64) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	e, ok := dc.entries[name]
+	if !ok {
+		return nil, "", dc.generation
+	}
+	entry := e.Value.(*diskCacheEntry)
+	path := filepath.Join(dc.dir, name)
+	// opened under the lock, so an eviction can't remove it in between
+	f, err := os.Open(path)
+	if err == nil {
+		_, err = f.Seek(int64(len(entry.contentType))+1, io.SeekStart)
+	}
+	if err != nil {
+		// removed by someone else
+		if f != nil {
+			f.Close()
+		}
+		dc.remove(e)
+		return nil, "", dc.generation
+	}
+	dc.lru.MoveToFront(e)
+	// so that the next startup ranks it the same
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return f, entry.contentType, dc.generation
+}
+
+// createTemp creates a file to be committed, starting with the content type line
+func (dc *DiskCacheClient) createTemp(contentType string) (*os.File, error) {
+	tmp, err := os.CreateTemp(dc.dir, diskCacheTempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmp.WriteString(contentType + "\n"); err != nil {
+		removeTemp(tmp)
+		return nil, err
+	}
+	return tmp, nil
+}
+
+// commit renames tmp to the file of name, unless something was forgotten since generation or it is larger than the whole cache
+func (dc *DiskCacheClient) commit(tmp *os.File, name string, contentType string, size int64, generation uint64) bool {
+	if size > dc.maxBytes {
+		return false
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.generation != generation {
+		return false
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dc.dir, name)); err != nil {
+		return false
+	}
+	if e, ok := dc.entries[name]; ok {
+		// its file was just replaced
+		entry := dc.lru.Remove(e).(*diskCacheEntry)
+		dc.bytes -= entry.bytes
+	}
+	dc.entries[name] = dc.lru.PushFront(&diskCacheEntry{name: name, contentType: contentType, bytes: size})
+	dc.bytes += size
+	dc.evict()
+	return true
+}
+
+// forget removes the file of objectKey, returning the generation it bumped
+func (dc *DiskCacheClient) forget(objectKey string) uint64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if e, ok := dc.entries[diskCacheName(objectKey)]; ok {
+		dc.remove(e)
+	}
+	dc.generation++
+	return dc.generation
+}
+
+func (dc *DiskCacheClient) evict() {
+	for dc.bytes > dc.maxBytes {
+		dc.remove(dc.lru.Back())
+		dc.evictions.Add(1)
+	}
+}
+
+func (dc *DiskCacheClient) remove(e *list.Element) {
+	entry := dc.lru.Remove(e).(*diskCacheEntry)
+	delete(dc.entries, entry.name)
+	dc.bytes -= entry.bytes
+	// files being read stay readable until they are closed
+	os.Remove(filepath.Join(dc.dir, entry.name))
+}
+
+func diskCacheName(objectKey string) string {
+	sum := sha256.Sum256([]byte(objectKey))
+	return hex.EncodeToString(sum[:])
+}
+
+func isDiskCacheName(name string) bool {
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+func readContentTypeLine(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(line, "\n"), nil
+}
+
+// cacheWriter writes into a file to be committed what an upload reads, without ever failing the upload
+// failed is set once a write fails or the file grows larger than maxBytes
+type cacheWriter struct {
+	w        io.Writer
+	bytes    int64
+	maxBytes int64
+	failed   bool
+}
+
+func (cw *cacheWriter) Write(b []byte) (int, error) {
+	if cw.failed {
+		return len(b), nil
+	}
+	cw.bytes += int64(len(b))
+	if cw.bytes > cw.maxBytes {
+		cw.failed = true
+		return len(b), nil
+	}
+	if _, err := cw.w.Write(b); err != nil {
+		cw.failed = true
+	}
+	return len(b), nil
+}
+
+// eofReader tells whether r was read to its end
+type eofReader struct {
+	r   io.Reader
+	eof bool
+}
+
+func (er *eofReader) Read(p []byte) (int, error) {
+	n, err := er.r.Read(p)
+	if err == io.EOF {
+		er.eof = true
+	}
+	return n, err
+}
+
+// sizeIs tells whether f holds size bytes
+func sizeIs(f *os.File, size int64) bool {
+	info, err := f.Stat()
+	return err == nil && info.Size() == size
+}
+
+// tempFile is a download that wasn't committed, removed once it is read
+type tempFile struct {
+	*os.File
+}
+
+func (tf *tempFile) Close() error {
+	return removeTemp(tf.File)
+}
+
+func removeTemp(f *os.File) error {
+	err := f.Close()
+	os.Remove(f.Name())
+	return err
+}
@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// objectsClient stores objects in memory, counting downloads
+type objectsClient struct {
+	stubClient
+	mu        sync.Mutex
+	objects   map[string]string
+	downloads int
+}
+
+func (oc *objectsClient) DownloadObject(ctx context.Context, objectKey string) (io.ReadCloser, string, error) {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	oc.downloads++
+	data, ok := oc.objects[objectKey]
+	if !ok {
+		return nil, "", ErrNotFound
+	}
+	return io.NopCloser(strings.NewReader(data)), "image/jpeg", oc.err
+}
+
+func (oc *objectsClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	if oc.err == nil {
+		oc.objects[objectKey] = string(data)
+	}
+	return oc.err
+}
+
+func (oc *objectsClient) DeleteObject(ctx context.Context, objectKey string) error {
+	oc.mu.Lock()
+	defer oc.mu.Unlock()
+	delete(oc.objects, objectKey)
+	return oc.err
+}
+
+func newTestDiskCache(t *testing.T, dir string, maxBytes int64) (*DiskCacheClient, *objectsClient) {
+	t.Helper()
+	oc := &objectsClient{objects: make(map[string]string)}
+	dc, err := NewDiskCacheClient(oc, dir, maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dc, oc
+}
+
+func assertDownload(t *testing.T, dc *DiskCacheClient, key string, want string) {
+	t.Helper()
+	body, contentType, err := dc.DownloadObject(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, string(data), want)
+	assertEqual(t, contentType, "image/jpeg")
+}
+
+// cachedFiles counts the files of cached objects in dir
+func cachedFiles(t *testing.T, dir string) int {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestDiskCacheClient(t *testing.T) {
+	dir := t.TempDir()
+	dc, oc := newTestDiskCache(t, dir, 1<<20)
+	oc.objects["original"] = "original bytes"
+
+	// the first download misses and keeps the object, the next ones hit
+	for range 3 {
+		assertDownload(t, dc, "original", "original bytes")
+	}
+	assertEqual(t, oc.downloads, 1)
+	assertEqual(t, cachedFiles(t, dir), 1)
+	assertEqual(t, dc.Stats(), CacheStats{Hits: 2, Misses: 1, Entries: 1, Bytes: 25})
+
+	// missing objects aren't kept
+	for range 2 {
+		if _, _, err := dc.DownloadObject(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("got %v; want %v", err, ErrNotFound)
+		}
+	}
+	assertEqual(t, oc.downloads, 3)
+
+	// uploads are kept as they are sent
+	if err := dc.UploadObject(context.Background(), "resized", strings.NewReader("resized bytes"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	assertDownload(t, dc, "resized", "resized bytes")
+	assertEqual(t, oc.downloads, 3)
+
+	// a delete drops the file
+	if err := dc.DeleteObject(context.Background(), "resized"); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, cachedFiles(t, dir), 1)
+	if _, _, err := dc.DownloadObject(context.Background(), "resized"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v; want %v", err, ErrNotFound)
+	}
+
+	// files outlive a restart
+	dc, oc = newTestDiskCache(t, dir, 1<<20)
+	assertDownload(t, dc, "original", "original bytes")
+	assertEqual(t, oc.downloads, 0)
+}
+
+func TestDiskCacheClientVersions(t *testing.T) {
+	dir := t.TempDir()
+	dc, oc := newTestDiskCache(t, dir, 1<<20)
+
+	// the original replaced by anyone else under the same key is downloaded again at its new version
+	for _, version := range []struct {
+		etag string
+		data string
+	}{{"etag1", "original bytes"}, {"etag2", "replaced bytes"}, {"etag2", "replaced bytes"}} {
+		oc.objects["original"] = version.data
+		body, _, err := dc.DownloadObject(WithVersion(context.Background(), version.etag), "original")
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(t, string(data), version.data)
+	}
+	assertEqual(t, oc.downloads, 2)
+}
+
+func TestDiskCacheClientEviction(t *testing.T) {
+	dir := t.TempDir()
+	// each file takes its 11 bytes of content type line and 10 of object
+	dc, oc := newTestDiskCache(t, dir, 50)
+	for _, key := range []string{"a", "b", "c"} {
+		oc.objects[key] = strings.Repeat(key, 10)
+	}
+
+	assertDownload(t, dc, "a", "aaaaaaaaaa")
+	assertDownload(t, dc, "b", "bbbbbbbbbb")
+	// a was used last, so b is evicted for c
+	assertDownload(t, dc, "a", "aaaaaaaaaa")
+	assertDownload(t, dc, "c", "cccccccccc")
+	assertEqual(t, oc.downloads, 3)
+	assertEqual(t, cachedFiles(t, dir), 2)
+	assertEqual(t, dc.Stats().Evictions, int64(1))
+
+	assertDownload(t, dc, "a", "aaaaaaaaaa")
+	assertDownload(t, dc, "c", "cccccccccc")
+	assertEqual(t, oc.downloads, 3)
+	assertDownload(t, dc, "b", "bbbbbbbbbb")
+	assertEqual(t, oc.downloads, 4)
+
+	// objects larger than the whole cache are answered without being kept
+	oc.objects["large"] = strings.Repeat("l", 100)
+	for range 2 {
+		assertDownload(t, dc, "large", strings.Repeat("l", 100))
+	}
+	assertEqual(t, oc.downloads, 6)
+	assertEqual(t, cachedFiles(t, dir), 2)
+
+	// the bound holds at startup too
+	dc, _ = newTestDiskCache(t, dir, 25)
+	assertEqual(t, cachedFiles(t, dir), 1)
+	assertEqual(t, dc.bytes, int64(21))
+}
+
+func TestDiskCacheClientFailedUpload(t *testing.T) {
+	dir := t.TempDir()
+	dc, oc := newTestDiskCache(t, dir, 1<<20)
+
+	oc.err = errors.New("connection refused")
+	dc.UploadObject(context.Background(), "resized", strings.NewReader("resized bytes"), "image/jpeg")
+	oc.err = nil
+	assertEqual(t, cachedFiles(t, dir), 0)
+}
+
+// existingClient succeeds without reading the whole body, like a conditional upload finding the object exists
+type existingClient struct {
+	stubClient
+}
+
+func (ec *existingClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	_, err := io.ReadFull(body, make([]byte, 4))
+	return err
+}
+
+func TestDiskCacheClientPartialUpload(t *testing.T) {
+	dir := t.TempDir()
+	dc, err := NewDiskCacheClient(&existingClient{}, dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dc.UploadObject(context.Background(), "resized", strings.NewReader("resized bytes"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, cachedFiles(t, dir), 0)
+}
+
+func TestDiskCacheClientStartup(t *testing.T) {
+	dir := t.TempDir()
+	// left over by a run that stopped while writing, and a file the cache doesn't own
+	for _, name := range []string{diskCacheTempPrefix + "123", "notes.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	newTestDiskCache(t, dir, 1<<20)
+	_, err := os.Stat(filepath.Join(dir, diskCacheTempPrefix+"123"))
+	assertEqual(t, os.IsNotExist(err), true)
+	_, err = os.Stat(filepath.Join(dir, "notes.txt"))
+	assertEqual(t, err, nil)
+}
+
+func TestDiskCacheClientConcurrency(t *testing.T) {
+	dir := t.TempDir()
+	// room for about half of the objects, so downloads race evictions
+	dc, oc := newTestDiskCache(t, dir, 20*30)
+	content := func(key string) string {
+		return strings.Repeat(key[len(key)-1:], 18)
+	}
+	for i := range 40 {
+		oc.objects[fmt.Sprint(i)] = content(fmt.Sprint(i))
+	}
+
+	var wg sync.WaitGroup
+	for w := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 200 {
+				key := fmt.Sprint((w*7 + i) % 40)
+				if i%10 == 0 {
+					if err := dc.UploadObject(context.Background(), key, strings.NewReader(content(key)), "image/jpeg"); err != nil {
+						t.Error(err)
+					}
+					continue
+				}
+				body, _, err := dc.DownloadObject(context.Background(), key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				data, _ := io.ReadAll(body)
+				body.Close()
+				assertEqual(t, string(data), content(key))
+			}
+		}()
+	}
+	wg.Wait()
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	assertEqual(t, dc.bytes <= dc.maxBytes, true)
+	assertEqual(t, len(dc.entries), cachedFiles(t, dir))
+}
@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxExistenceEntries bounds the keys an ExistenceCacheClient remembers, expired ones are swept once it is reached
+const maxExistenceEntries = 100_000
+
+// ExistenceCacheClient wraps a Client, remembering the answers of CheckObject
+// so a burst of requests for the same key pays a single HEAD
+//
+// keys found are remembered for positiveTTL and keys missing for negativeTTL, a TTL of 0 doesn't remember them at all
+// uploads, copies, links and deletes through the client drop what was remembered of their key,
+// while objects written or deleted by anyone else are only seen once the entry expires
+// errors are never remembered
+type ExistenceCacheClient struct {
+	client      Client
+	positiveTTL time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]existenceEntry
+	// bumped by every forget, so an answer fetched before an upload isn't remembered after it
+	generation uint64
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type existenceEntry struct {
+	exists  bool
+	expires time.Time
+}
+
+func NewExistenceCacheClient(client Client, positiveTTL, negativeTTL time.Duration) *ExistenceCacheClient {
+	return &ExistenceCacheClient{
+		client:      client,
+		positiveTTL: positiveTTL,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		entries:     make(map[string]existenceEntry),
+	}
+}
+
+func (ec *ExistenceCacheClient) ObjectURL(objectKey string) string {
+	return ec.client.ObjectURL(objectKey)
+}
+
+func (ec *ExistenceCacheClient) CheckObject(ctx context.Context, objectKey string) (bool, error) {
+	exists, ok, generation := ec.lookup(objectKey)
+	if ok {
+		return exists, nil
+	}
+	exists, err := ec.client.CheckObject(ctx, objectKey)
+	if err == nil {
+		ec.remember(objectKey, exists, generation)
+	}
+	return exists, err
+}
+
+func (ec *ExistenceCacheClient) ObjectMetadata(ctx context.Context, objectKey string) (map[string]string, string, error) {
+	return ec.client.ObjectMetadata(ctx, objectKey)
+}
+
+func (ec *ExistenceCacheClient) DownloadObject(ctx context.Context, objectKey string) (io.ReadCloser, string, error) {
+	return ec.client.DownloadObject(ctx, objectKey)
+}
+
+func (ec *ExistenceCacheClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	err := ec.client.UploadObject(ctx, objectKey, body, contentType)
+	if err == nil {
+		ec.forget(objectKey)
+	}
+	return err
+}
+
+func (ec *ExistenceCacheClient) CopyObject(ctx context.Context, srcKey string, dstKey string) error {
+	err := ec.client.CopyObject(ctx, srcKey, dstKey)
+	if err == nil {
+		ec.forget(dstKey)
+	}
+	return err
+}
+
+func (ec *ExistenceCacheClient) DeleteObject(ctx context.Context, objectKey string) error {
+	// forgotten whether or not the delete went through, it may have before failing
+	defer ec.forget(objectKey)
+	return ec.client.DeleteObject(ctx, objectKey)
+}
+
+func (ec *ExistenceCacheClient) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	return ec.client.ListObjects(ctx, prefix)
+}
+
+func (ec *ExistenceCacheClient) LinkObject(ctx context.Context, objectKey string, targetKey string) error {
+	err := ec.client.LinkObject(ctx, objectKey, targetKey)
+	if err == nil {
+		ec.forget(objectKey)
+	}
+	return err
+}
+
+func (ec *ExistenceCacheClient) ResolveObject(ctx context.Context, objectKey string) (string, error) {
+	return ec.client.ResolveObject(ctx, objectKey)
+}
+
+// Stats counts the checks answered from what was remembered as hits, the ones asking the wrapped client as misses
+func (ec *ExistenceCacheClient) Stats() CacheStats {
+	ec.mu.Lock()
+	entries := len(ec.entries)
+	ec.mu.Unlock()
+	return CacheStats{
+		Hits:      ec.hits.Load(),
+		Misses:    ec.misses.Load(),
+		Evictions: ec.evictions.Load(),
+		Entries:   entries,
+	}
+}
+
+func (ec *ExistenceCacheClient) lookup(objectKey string) (exists bool, ok bool, generation uint64) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	e, ok := ec.entries[objectKey]
+	if !ok {
+		ec.misses.Add(1)
+		return false, false, ec.generation
+	}
+	if !ec.now().Before(e.expires) {
+		delete(ec.entries, objectKey)
+		ec.evictions.Add(1)
+		ec.misses.Add(1)
+		return false, false, ec.generation
+	}
+	ec.hits.Add(1)
+	return e.exists, true, ec.generation
+}
+
+func (ec *ExistenceCacheClient) remember(objectKey string, exists bool, generation uint64) {
+	ttl := ec.negativeTTL
+	if exists {
+		ttl = ec.positiveTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	if ec.generation != generation {
+		return
+	}
+	now := ec.now()
+	if len(ec.entries) >= maxExistenceEntries {
+		for key, e := range ec.entries {
+			if !now.Before(e.expires) {
+				delete(ec.entries, key)
+				ec.evictions.Add(1)
+			}
+		}
+		if len(ec.entries) >= maxExistenceEntries {
+			return
+		}
+	}
+	ec.entries[objectKey] = existenceEntry{exists: exists, expires: now.Add(ttl)}
+}
+
+func (ec *ExistenceCacheClient) forget(objectKey string) {
+	ec.mu.Lock()
+	defer ec.mu.Unlock()
+
+	delete(ec.entries, objectKey)
+	ec.generation++
+}
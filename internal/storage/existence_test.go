@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// existsClient answers CheckObject from the keys uploaded and not deleted since
+type existsClient struct {
+	stubClient
+	exists map[string]bool
+	checks int
+	// run during CheckObject, after the answer was looked up
+	onCheck func()
+}
+
+func (ec *existsClient) CheckObject(ctx context.Context, objectKey string) (bool, error) {
+	ec.checks++
+	exists := ec.exists[objectKey]
+	if ec.onCheck != nil {
+		ec.onCheck()
+	}
+	return exists, ec.err
+}
+
+func (ec *existsClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	if ec.err == nil {
+		ec.exists[objectKey] = true
+	}
+	return ec.err
+}
+
+func (ec *existsClient) DeleteObject(ctx context.Context, objectKey string) error {
+	if ec.err == nil {
+		delete(ec.exists, objectKey)
+	}
+	return ec.err
+}
+
+func newTestExistenceCache(t *testing.T, positiveTTL, negativeTTL time.Duration) (*ExistenceCacheClient, *existsClient, *time.Time) {
+	t.Helper()
+	sc := &existsClient{exists: make(map[string]bool)}
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	ec := NewExistenceCacheClient(sc, positiveTTL, negativeTTL)
+	ec.now = func() time.Time { return now }
+	return ec, sc, &now
+}
+
+func assertExists(t *testing.T, ec *ExistenceCacheClient, key string, want bool) {
+	t.Helper()
+	got, err := ec.CheckObject(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(t, got, want)
+}
+
+func TestExistenceCacheClient(t *testing.T) {
+	ec, sc, now := newTestExistenceCache(t, time.Minute, 5*time.Second)
+	sc.exists["found"] = true
+
+	// a burst of checks of the same key pays a single HEAD
+	for range 3 {
+		assertExists(t, ec, "found", true)
+		assertExists(t, ec, "missing", false)
+	}
+	assertEqual(t, sc.checks, 2)
+
+	// missing keys are forgotten after the negative TTL, found ones after the positive TTL
+	*now = now.Add(5 * time.Second)
+	assertExists(t, ec, "found", true)
+	assertExists(t, ec, "missing", false)
+	assertEqual(t, sc.checks, 3)
+	*now = now.Add(time.Minute)
+	assertExists(t, ec, "found", true)
+	assertEqual(t, sc.checks, 4)
+
+	// every expired entry looked up was evicted and missed
+	assertEqual(t, ec.Stats(), CacheStats{Hits: 5, Misses: 4, Evictions: 2, Entries: 2})
+}
+
+func TestExistenceCacheClientZeroTTL(t *testing.T) {
+	ec, sc, _ := newTestExistenceCache(t, 0, 5*time.Second)
+	sc.exists["found"] = true
+
+	for range 2 {
+		assertExists(t, ec, "found", true)
+		assertExists(t, ec, "missing", false)
+	}
+	assertEqual(t, sc.checks, 3)
+}
+
+func TestExistenceCacheClientErrors(t *testing.T) {
+	ec, sc, _ := newTestExistenceCache(t, time.Minute, 5*time.Second)
+	errOutage := errors.New("connection refused")
+	sc.err = errOutage
+
+	for range 2 {
+		if _, err := ec.CheckObject(context.Background(), "key"); !errors.Is(err, errOutage) {
+			t.Fatalf("got %v; want %v", err, errOutage)
+		}
+	}
+	assertEqual(t, sc.checks, 2)
+}
+
+func TestExistenceCacheClientInvalidation(t *testing.T) {
+	ec, sc, _ := newTestExistenceCache(t, time.Minute, time.Minute)
+	ctx := context.Background()
+
+	// a successful upload drops the negative entry of its key
+	assertExists(t, ec, "resized", false)
+	if err := ec.UploadObject(ctx, "resized", strings.NewReader("image"), "image/jpeg"); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t, ec, "resized", true)
+	assertEqual(t, sc.checks, 2)
+
+	// a failed upload keeps it
+	assertExists(t, ec, "failed", false)
+	sc.err = errors.New("connection refused")
+	ec.UploadObject(ctx, "failed", strings.NewReader("image"), "image/jpeg")
+	sc.err = nil
+	assertExists(t, ec, "failed", false)
+	assertEqual(t, sc.checks, 3)
+
+	// a link drops it too
+	assertExists(t, ec, "linked", false)
+	sc.exists["linked"] = true
+	if err := ec.LinkObject(ctx, "linked", "blob"); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t, ec, "linked", true)
+	assertEqual(t, sc.checks, 5)
+
+	// a copy drops the entry of its destination
+	assertExists(t, ec, "copied", false)
+	sc.exists["copied"] = true
+	if err := ec.CopyObject(ctx, "linked", "copied"); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t, ec, "copied", true)
+	assertEqual(t, sc.checks, 7)
+
+	// a delete drops the positive entry
+	if err := ec.DeleteObject(ctx, "resized"); err != nil {
+		t.Fatal(err)
+	}
+	assertExists(t, ec, "resized", false)
+	assertEqual(t, sc.checks, 8)
+}
+
+func TestExistenceCacheClientUploadDuringCheck(t *testing.T) {
+	ec, sc, _ := newTestExistenceCache(t, time.Minute, time.Minute)
+
+	// the check answers missing, but the upload finishes before the answer is remembered
+	sc.onCheck = func() {
+		sc.onCheck = nil
+		if err := ec.UploadObject(context.Background(), "resized", strings.NewReader("image"), "image/jpeg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertExists(t, ec, "resized", false)
+	assertExists(t, ec, "resized", true)
+	assertEqual(t, sc.checks, 2)
+}
@@ -0,0 +1,12 @@
+package storage
+
+// CacheStats counts what a cache answered since startup, along with what it holds now
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	// entries dropped to make room or once expired, not the ones replaced or forgotten after a write
+	Evictions int64
+	Entries   int
+	// 0 for caches that don't bound what they hold by size
+	Bytes int64
+}
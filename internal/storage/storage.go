@@ -1,14 +1,19 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	smithyhttp "github.com/aws/smithy-go/transport/http"
 )
@@ -23,30 +28,109 @@ type Client interface {
 	ObjectURL(objectKey string) string
 
 	CheckObject(ctx context.Context, objectKey string) (bool, error)
+	// ObjectMetadata returns the user metadata of the object and its version, ErrNotFound when it doesn't exist
+	// the version is the version ID in a versioned bucket, or else the ETag, either changing whenever the object is replaced
+	ObjectMetadata(ctx context.Context, objectKey string) (metadata map[string]string, version string, err error)
 	DownloadObject(ctx context.Context, objectKey string) (body io.ReadCloser, contentType string, err error)
 	UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error
+	// CopyObject copies the object at srcKey to dstKey, metadata included, replacing the object at dstKey if there is one
+	// it returns ErrNotFound when the object at srcKey doesn't exist
+	CopyObject(ctx context.Context, srcKey string, dstKey string) error
+	// DeleteObject succeeds when the object doesn't exist
+	DeleteObject(ctx context.Context, objectKey string) error
+	// ListObjects returns every object whose key starts with prefix, in lexicographic order of their keys
+	ListObjects(ctx context.Context, prefix string) ([]Object, error)
+
+	// LinkObject stores an empty object at objectKey standing for the object at targetKey, like UploadObject would
+	LinkObject(ctx context.Context, objectKey string, targetKey string) error
+	// ResolveObject returns the key holding the content of objectKey, the target of a link or objectKey itself
+	ResolveObject(ctx context.Context, objectKey string) (string, error)
+}
+
+// Object is an object found by ListObjects
+type Object struct {
+	Key          string
+	LastModified time.Time
+}
+
+type overwriteKey struct{}
+
+// WithOverwrite lets uploads made with the returned context replace existing objects, to regenerate a variant
+func WithOverwrite(ctx context.Context) context.Context {
+	return context.WithValue(ctx, overwriteKey{}, true)
+}
+
+// Overwrites tells whether ctx comes from WithOverwrite
+func Overwrites(ctx context.Context) bool {
+	overwrite, _ := ctx.Value(overwriteKey{}).(bool)
+	return overwrite
+}
+
+type versionKey struct{}
+
+// WithVersion tells downloads made with the returned context which version of the object they expect, as ObjectMetadata returned it
+func WithVersion(ctx context.Context, version string) context.Context {
+	return context.WithValue(ctx, versionKey{}, version)
+}
+
+// Version returns the version ctx comes from WithVersion with, empty if none
+func Version(ctx context.Context) string {
+	version, _ := ctx.Value(versionKey{}).(string)
+	return version
 }
 
 type S3Client struct {
-	client     *s3.Client
+	client *s3.Client
+	// uploads bodies of unknown length, buffering a single part at a time
+	uploader   *manager.Uploader
 	bucketName string
+	region     string
 }
 
-func NewS3Client(bucketName string) (*S3Client, error) {
-	cfg, err := config.LoadDefaultConfig(context.TODO())
+func NewS3Client(bucketName string, region string) (*S3Client, error) {
+	cfg, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(region))
 	if err != nil {
 		return nil, err
 	}
 
+	return newS3Client(s3.NewFromConfig(cfg), bucketName), nil
+}
+
+func newS3Client(client *s3.Client, bucketName string) *S3Client {
 	return &S3Client{
-		client:     s3.NewFromConfig(cfg),
+		client: client,
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			u.Concurrency = 1
+		}),
 		bucketName: bucketName,
-	}, nil
+		region:     client.Options().Region,
+	}
+}
+
+// CheckBucket tells whether the bucket exists and the credentials may access it, with a HeadBucket
+// it returns ErrNotFound when the bucket doesn't exist and ErrForbidden when the credentials may not access it
+func (sc *S3Client) CheckBucket(ctx context.Context) error {
+	_, err := sc.client.HeadBucket(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(sc.bucketName),
+	})
+	if err != nil {
+		var re *smithyhttp.ResponseError
+		if errors.As(err, &re) {
+			switch re.HTTPStatusCode() {
+			case http.StatusNotFound:
+				return ErrNotFound
+			case http.StatusForbidden:
+				return ErrForbidden
+			}
+		}
+		return err
+	}
+	return nil
 }
 
 func (sc *S3Client) ObjectURL(objectKey string) string {
-	s3URLFormat := "https://%s.s3.ca-west-1.amazonaws.com/%s"
-	return fmt.Sprintf(s3URLFormat, sc.bucketName, objectKey)
+	s3URLFormat := "https://%s.s3.%s.amazonaws.com/%s"
+	return fmt.Sprintf(s3URLFormat, sc.bucketName, sc.region, objectKey)
 }
 
 func (sc *S3Client) CheckObject(ctx context.Context, objectKey string) (bool, error) {
@@ -64,6 +148,31 @@ func (sc *S3Client) CheckObject(ctx context.Context, objectKey string) (bool, er
 	return true, nil
 }
 
+func (sc *S3Client) ObjectMetadata(ctx context.Context, objectKey string) (map[string]string, string, error) {
+	object, err := sc.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(sc.bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		var re *smithyhttp.ResponseError
+		if errors.As(err, &re) {
+			switch re.HTTPStatusCode() {
+			case http.StatusNotFound:
+				return nil, "", ErrNotFound
+			case http.StatusForbidden:
+				return nil, "", ErrForbidden
+			}
+		}
+		return nil, "", err
+	}
+	// objects put before versioning was enabled have the version ID "null"
+	version := aws.ToString(object.VersionId)
+	if version == "" || version == "null" {
+		version = strings.Trim(aws.ToString(object.ETag), `"`)
+	}
+	return object.Metadata, version, nil
+}
+
 func (sc *S3Client) DownloadObject(ctx context.Context, objectKey string) (io.ReadCloser, string, error) {
 	object, err := sc.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(sc.bucketName),
@@ -81,22 +190,151 @@ func (sc *S3Client) DownloadObject(ctx context.Context, objectKey string) (io.Re
 		}
 		return nil, "", err
 	}
-	return object.Body, *object.ContentType, nil
+	// objects uploaded without one have no content type, which the bytes or the extension stand in for
+	return object.Body, aws.ToString(object.ContentType), nil
 }
 
+// UploadObject never overwrites an existing object, unless ctx comes from WithOverwrite
+// when concurrent requests resize the same variant, the first upload wins and the others succeed without writing
+//
+// the body is streamed, so its length doesn't need to be known: S3 needs one for every request,
+// so bodies larger than a part are sent as a multipart upload
 func (sc *S3Client) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
-	_, err := sc.client.PutObject(ctx, &s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket:      aws.String(sc.bucketName),
 		Key:         aws.String(objectKey),
 		Body:        body,
 		ContentType: aws.String(contentType),
+		IfNoneMatch: aws.String("*"),
+	}
+	if Overwrites(ctx) {
+		input.IfNoneMatch = nil
+	}
+	_, err := sc.uploader.Upload(ctx, input)
+	if err != nil {
+		var re *smithyhttp.ResponseError
+		if errors.As(err, &re) {
+			switch re.HTTPStatusCode() {
+			case http.StatusBadRequest:
+				return ErrBadRequest
+			case http.StatusPreconditionFailed:
+				// the object already exists
+				return nil
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// metaLink is the user metadata of a link naming its target
+const metaLink = "link"
+
+func (sc *S3Client) LinkObject(ctx context.Context, objectKey string, targetKey string) error {
+	input := &s3.PutObjectInput{
+		Bucket:      aws.String(sc.bucketName),
+		Key:         aws.String(objectKey),
+		Body:        bytes.NewReader(nil),
+		ContentType: aws.String("application/octet-stream"),
+		Metadata:    map[string]string{metaLink: targetKey},
+		IfNoneMatch: aws.String("*"),
+	}
+	if Overwrites(ctx) {
+		input.IfNoneMatch = nil
+	}
+	_, err := sc.client.PutObject(ctx, input)
+	if err != nil {
+		var re *smithyhttp.ResponseError
+		if errors.As(err, &re) {
+			switch re.HTTPStatusCode() {
+			case http.StatusBadRequest:
+				return ErrBadRequest
+			case http.StatusPreconditionFailed:
+				// the object already exists
+				return nil
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func (sc *S3Client) ResolveObject(ctx context.Context, objectKey string) (string, error) {
+	object, err := sc.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(sc.bucketName),
+		Key:    aws.String(objectKey),
 	})
 	if err != nil {
 		var re *smithyhttp.ResponseError
-		if errors.As(err, &re) && re.HTTPStatusCode() == http.StatusBadRequest {
-			return ErrBadRequest
+		if errors.As(err, &re) && re.HTTPStatusCode() == http.StatusNotFound {
+			return "", ErrNotFound
+		}
+		return "", err
+	}
+	if target := object.Metadata[metaLink]; target != "" {
+		return target, nil
+	}
+	return objectKey, nil
+}
+
+// CopyObject copies within the bucket without downloading the object, links stay links to the same target
+func (sc *S3Client) CopyObject(ctx context.Context, srcKey string, dstKey string) error {
+	_, err := sc.client.CopyObject(ctx, &s3.CopyObjectInput{
+		Bucket: aws.String(sc.bucketName),
+		// the source is URL encoded, its slashes kept
+		CopySource: aws.String((&url.URL{Path: sc.bucketName + "/" + srcKey}).EscapedPath()),
+		Key:        aws.String(dstKey),
+	})
+	if err != nil {
+		var re *smithyhttp.ResponseError
+		if errors.As(err, &re) {
+			switch re.HTTPStatusCode() {
+			case http.StatusNotFound:
+				return ErrNotFound
+			case http.StatusForbidden:
+				return ErrForbidden
+			case http.StatusBadRequest:
+				return ErrBadRequest
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func (sc *S3Client) DeleteObject(ctx context.Context, objectKey string) error {
+	_, err := sc.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(sc.bucketName),
+		Key:    aws.String(objectKey),
+	})
+	if err != nil {
+		var re *smithyhttp.ResponseError
+		if errors.As(err, &re) && re.HTTPStatusCode() == http.StatusForbidden {
+			return ErrForbidden
 		}
 		return err
 	}
 	return nil
 }
+
+func (sc *S3Client) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	paginator := s3.NewListObjectsV2Paginator(sc.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(sc.bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			var re *smithyhttp.ResponseError
+			if errors.As(err, &re) && re.HTTPStatusCode() == http.StatusForbidden {
+				return nil, ErrForbidden
+			}
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, Object{Key: aws.ToString(object.Key), LastModified: aws.ToTime(object.LastModified)})
+		}
+	}
+	return objects, nil
+}
@@ -0,0 +1,368 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// stubS3 is a bucket answering PutObject like S3 does, honoring If-None-Match: *, HeadObject with the link and other metadata,
+// HeadBucket, and ListObjectsV2 by pages of pageSize keys
+type stubS3 struct {
+	mu       sync.Mutex
+	objects  map[string]string
+	links    map[string]string
+	metadata map[string]map[string]string
+	// version IDs of the objects of a versioned bucket
+	versions map[string]string
+	puts     int
+	pageSize int
+	// bucket answers HeadBucket, and denied answers 403 to everything like S3 to credentials without access
+	bucket string
+	denied bool
+}
+
+func (s *stubS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+		s.list(w, r)
+		return
+	}
+	if s.denied {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodHead && !strings.Contains(strings.Trim(r.URL.Path, "/"), "/") {
+		if r.URL.Path != "/"+s.bucket {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		return
+	}
+	if r.Method == http.MethodHead {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.objects[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if link := s.links[r.URL.Path]; link != "" {
+			w.Header().Set("X-Amz-Meta-Link", link)
+		}
+		for key, value := range s.metadata[r.URL.Path] {
+			w.Header().Set("X-Amz-Meta-"+key, value)
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum([]byte(s.objects[r.URL.Path]))))
+		if version := s.versions[r.URL.Path]; version != "" {
+			w.Header().Set("X-Amz-Version-Id", version)
+		}
+		return
+	}
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+		s.copy(w, r, source)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.puts++
+	if _, ok := s.objects[r.URL.Path]; ok && r.Header.Get("If-None-Match") == "*" {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		io.WriteString(w, `<Error><Code>PreconditionFailed</Code><Message>At least one of the pre-conditions you specified did not hold</Message></Error>`)
+		return
+	}
+	s.objects[r.URL.Path] = string(body)
+	if s.links != nil {
+		s.links[r.URL.Path] = r.Header.Get("X-Amz-Meta-Link")
+	}
+}
+
+// copy answers CopyObject, copying the metadata and the link along with the object
+func (s *stubS3) copy(w http.ResponseWriter, r *http.Request, source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	src, err := url.PathUnescape(source)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	src = "/" + strings.TrimPrefix(src, "/")
+	object, ok := s.objects[src]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, `<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>`)
+		return
+	}
+	s.puts++
+	s.objects[r.URL.Path] = object
+	if s.links != nil {
+		s.links[r.URL.Path] = s.links[src]
+	}
+	if s.metadata != nil {
+		s.metadata[r.URL.Path] = s.metadata[src]
+	}
+	io.WriteString(w, `<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`)
+}
+
+func (s *stubS3) list(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := r.URL.Query()
+	bucket := strings.TrimSuffix(r.URL.Path, "/")
+	var keys []string
+	for p := range s.objects {
+		key := strings.TrimPrefix(p, bucket+"/")
+		if strings.HasPrefix(key, q.Get("prefix")) && key > q.Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	truncated := len(keys) > s.pageSize
+	if truncated {
+		keys = keys[:s.pageSize]
+	}
+
+	io.WriteString(w, `<ListBucketResult>`)
+	for _, key := range keys {
+		fmt.Fprintf(w, `<Contents><Key>%s</Key><LastModified>2025-01-01T00:00:00.000Z</LastModified></Contents>`, key)
+	}
+	fmt.Fprintf(w, `<IsTruncated>%t</IsTruncated>`, truncated)
+	if truncated {
+		fmt.Fprintf(w, `<NextContinuationToken>%s</NextContinuationToken>`, keys[len(keys)-1])
+	}
+	io.WriteString(w, `</ListBucketResult>`)
+}
+
+func TestS3ClientUploadObjectIfNotExists(t *testing.T) {
+	stub := &stubS3{objects: make(map[string]string)}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	sc := newS3Client(s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region:       "ca-west-1",
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	}), "stub-bucket")
+
+	// two requests resizing the same variant, both having checked it doesn't exist yet
+	err := sc.UploadObject(context.Background(), "resized/img.jpg/w100h0.jpg", strings.NewReader("first"), "image/jpeg")
+	assertEqual(t, err, nil)
+	err = sc.UploadObject(context.Background(), "resized/img.jpg/w100h0.jpg", strings.NewReader("second"), "image/jpeg")
+	assertEqual(t, err, nil)
+
+	assertEqual(t, stub.puts, 2)
+	assertEqual(t, stub.objects["/stub-bucket/resized/img.jpg/w100h0.jpg"], "first")
+}
+
+func TestS3ClientUploadObjectOverwrite(t *testing.T) {
+	stub := &stubS3{objects: make(map[string]string)}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	sc := newS3Client(s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region:       "ca-west-1",
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	}), "stub-bucket")
+
+	err := sc.UploadObject(context.Background(), "resized/img.jpg/w100h0.jpg", strings.NewReader("corrupted"), "image/jpeg")
+	assertEqual(t, err, nil)
+	err = sc.UploadObject(WithOverwrite(context.Background()), "resized/img.jpg/w100h0.jpg", strings.NewReader("regenerated"), "image/jpeg")
+	assertEqual(t, err, nil)
+
+	assertEqual(t, stub.objects["/stub-bucket/resized/img.jpg/w100h0.jpg"], "regenerated")
+}
+
+func TestS3ClientLinkObject(t *testing.T) {
+	stub := &stubS3{objects: make(map[string]string), links: make(map[string]string)}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	sc := newS3Client(s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region:       "ca-west-1",
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	}), "stub-bucket")
+	ctx := context.Background()
+
+	err := sc.UploadObject(ctx, "resized/blobs/abc.jpg", strings.NewReader("content"), "image/jpeg")
+	assertEqual(t, err, nil)
+	err = sc.LinkObject(ctx, "resized/img.jpg/w100h0.jpg", "resized/blobs/abc.jpg")
+	assertEqual(t, err, nil)
+	assertEqual(t, stub.objects["/stub-bucket/resized/img.jpg/w100h0.jpg"], "")
+
+	target, err := sc.ResolveObject(ctx, "resized/img.jpg/w100h0.jpg")
+	assertEqual(t, err, nil)
+	assertEqual(t, target, "resized/blobs/abc.jpg")
+	// any other object stands for itself
+	target, err = sc.ResolveObject(ctx, "resized/blobs/abc.jpg")
+	assertEqual(t, err, nil)
+	assertEqual(t, target, "resized/blobs/abc.jpg")
+	_, err = sc.ResolveObject(ctx, "resized/img.jpg/w200h0.jpg")
+	assertEqual(t, err, ErrNotFound)
+}
+
+func TestS3ClientObjectMetadata(t *testing.T) {
+	stub := &stubS3{
+		objects:  map[string]string{"/stub-bucket/original/avatar.jpg": ""},
+		metadata: map[string]map[string]string{"/stub-bucket/original/avatar.jpg": {"Cache-Control": "max-age=60"}},
+	}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	sc := newS3Client(s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region:       "ca-west-1",
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	}), "stub-bucket")
+
+	// keys of the metadata come lowercased, as S3 stores them
+	metadata, version, err := sc.ObjectMetadata(context.Background(), "original/avatar.jpg")
+	assertEqual(t, err, nil)
+	assertEqual(t, metadata["cache-control"], "max-age=60")
+	// the ETag of an unversioned object, without its quotes
+	assertEqual(t, version, fmt.Sprintf("%x", md5.Sum(nil)))
+	_, _, err = sc.ObjectMetadata(context.Background(), "original/missing.jpg")
+	assertEqual(t, err, ErrNotFound)
+
+	stub.versions = map[string]string{"/stub-bucket/original/avatar.jpg": "3HL4kqtJlcpXroDTDmJ"}
+	_, version, err = sc.ObjectMetadata(context.Background(), "original/avatar.jpg")
+	assertEqual(t, err, nil)
+	assertEqual(t, version, "3HL4kqtJlcpXroDTDmJ")
+	// objects put before versioning was enabled
+	stub.versions = map[string]string{"/stub-bucket/original/avatar.jpg": "null"}
+	_, version, err = sc.ObjectMetadata(context.Background(), "original/avatar.jpg")
+	assertEqual(t, err, nil)
+	assertEqual(t, version, fmt.Sprintf("%x", md5.Sum(nil)))
+}
+
+func TestS3ClientCopyObject(t *testing.T) {
+	stub := &stubS3{
+		objects: map[string]string{
+			"/stub-bucket/resized/img.jpg/w100h0.jpg":      "variant",
+			"/stub-bucket/resized/my photo.jpg/w100h0.jpg": "spaced",
+			"/stub-bucket/resized/img.jpg/w200h0.jpg":      "",
+		},
+		links: map[string]string{"/stub-bucket/resized/img.jpg/w200h0.jpg": "resized/blobs/abc.jpg"},
+	}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	sc := newS3Client(s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region:       "ca-west-1",
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	}), "stub-bucket")
+
+	err := sc.CopyObject(context.Background(), "resized/img.jpg/w100h0.jpg", "canonical/img.jpg")
+	assertEqual(t, err, nil)
+	assertEqual(t, stub.objects["/stub-bucket/canonical/img.jpg"], "variant")
+	// the source is kept
+	assertEqual(t, stub.objects["/stub-bucket/resized/img.jpg/w100h0.jpg"], "variant")
+
+	// keys needing escaping
+	err = sc.CopyObject(context.Background(), "resized/my photo.jpg/w100h0.jpg", "canonical/my photo.jpg")
+	assertEqual(t, err, nil)
+	assertEqual(t, stub.objects["/stub-bucket/canonical/my photo.jpg"], "spaced")
+
+	// a copied link stands for the same target
+	err = sc.CopyObject(context.Background(), "resized/img.jpg/w200h0.jpg", "canonical/linked.jpg")
+	assertEqual(t, err, nil)
+	target, err := sc.ResolveObject(context.Background(), "canonical/linked.jpg")
+	assertEqual(t, err, nil)
+	assertEqual(t, target, "resized/blobs/abc.jpg")
+
+	err = sc.CopyObject(context.Background(), "resized/img.jpg/missing.jpg", "canonical/missing.jpg")
+	assertEqual(t, err, ErrNotFound)
+	_, ok := stub.objects["/stub-bucket/canonical/missing.jpg"]
+	assertEqual(t, ok, false)
+}
+
+func TestS3ClientListObjects(t *testing.T) {
+	stub := &stubS3{objects: map[string]string{
+		"/stub-bucket/resized/img.jpg/w100h0.jpg":     "",
+		"/stub-bucket/resized/img.jpg/w200h0.jpg":     "",
+		"/stub-bucket/resized/img.jpg/w300h0.jpg":     "",
+		"/stub-bucket/resized/img.png/w100h0.png":     "",
+		"/stub-bucket/original/img.jpg":               "",
+		"/stub-bucket/resized/img.jpg.bak/w100h0.jpg": "",
+	}, pageSize: 2}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	sc := newS3Client(s3.New(s3.Options{
+		BaseEndpoint: aws.String(srv.URL),
+		Region:       "ca-west-1",
+		UsePathStyle: true,
+		Credentials:  aws.AnonymousCredentials{},
+	}), "stub-bucket")
+
+	// the objects span two pages
+	objects, err := sc.ListObjects(context.Background(), "resized/img.jpg/")
+	assertEqual(t, err, nil)
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+		assertEqual(t, object.LastModified, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC))
+	}
+	assertEqual(t, strings.Join(keys, ","), "resized/img.jpg/w100h0.jpg,resized/img.jpg/w200h0.jpg,resized/img.jpg/w300h0.jpg")
+
+	objects, err = sc.ListObjects(context.Background(), "resized/none/")
+	assertEqual(t, err, nil)
+	assertEqual(t, len(objects), 0)
+}
+
+func TestS3ClientCheckBucket(t *testing.T) {
+	tt := []struct {
+		testName string
+		stub     *stubS3
+		want     error
+	}{
+		{testName: "accessible", stub: &stubS3{bucket: "stub-bucket"}},
+		{testName: "missing bucket", stub: &stubS3{bucket: "other-bucket"}, want: ErrNotFound},
+		{testName: "no access", stub: &stubS3{bucket: "stub-bucket", denied: true}, want: ErrForbidden},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.testName, func(t *testing.T) {
+			srv := httptest.NewServer(tc.stub)
+			defer srv.Close()
+
+			sc := newS3Client(s3.New(s3.Options{
+				BaseEndpoint: aws.String(srv.URL),
+				Region:       "ca-west-1",
+				UsePathStyle: true,
+				Credentials:  aws.AnonymousCredentials{},
+			}), "stub-bucket")
+
+			assertEqual(t, sc.CheckBucket(context.Background()), tc.want)
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"io"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/obzva/image-server/internal/storage"
+
+// TracingClient wraps a Client and records a span for every storage operation
+// spans go to the global tracer provider, which is a no-op until one is registered with otel.SetTracerProvider
+type TracingClient struct {
+	client Client
+	tracer trace.Tracer
+}
+
+func NewTracingClient(client Client) *TracingClient {
+	return &TracingClient{
+		client: client,
+		tracer: otel.Tracer(tracerName),
+	}
+}
+
+func (tc *TracingClient) ObjectURL(objectKey string) string {
+	return tc.client.ObjectURL(objectKey)
+}
+
+func (tc *TracingClient) CheckObject(ctx context.Context, objectKey string) (bool, error) {
+	ctx, span := tc.start(ctx, "CheckObject", objectKey)
+	defer span.End()
+
+	ok, err := tc.client.CheckObject(ctx, objectKey)
+	span.SetAttributes(attribute.Bool("storage.exists", ok))
+	recordError(span, err)
+	return ok, err
+}
+
+func (tc *TracingClient) ObjectMetadata(ctx context.Context, objectKey string) (map[string]string, string, error) {
+	ctx, span := tc.start(ctx, "ObjectMetadata", objectKey)
+	defer span.End()
+
+	metadata, version, err := tc.client.ObjectMetadata(ctx, objectKey)
+	recordError(span, err)
+	return metadata, version, err
+}
+
+func (tc *TracingClient) DownloadObject(ctx context.Context, objectKey string) (io.ReadCloser, string, error) {
+	ctx, span := tc.start(ctx, "DownloadObject", objectKey)
+	defer span.End()
+
+	body, contentType, err := tc.client.DownloadObject(ctx, objectKey)
+	recordError(span, err)
+	return body, contentType, err
+}
+
+func (tc *TracingClient) UploadObject(ctx context.Context, objectKey string, body io.Reader, contentType string) error {
+	ctx, span := tc.start(ctx, "UploadObject", objectKey)
+	defer span.End()
+
+	err := tc.client.UploadObject(ctx, objectKey, body, contentType)
+	recordError(span, err)
+	return err
+}
+
+func (tc *TracingClient) CopyObject(ctx context.Context, srcKey string, dstKey string) error {
+	ctx, span := tc.start(ctx, "CopyObject", dstKey)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("storage.source", srcKey))
+	err := tc.client.CopyObject(ctx, srcKey, dstKey)
+	recordError(span, err)
+	return err
+}
+
+func (tc *TracingClient) DeleteObject(ctx context.Context, objectKey string) error {
+	ctx, span := tc.start(ctx, "DeleteObject", objectKey)
+	defer span.End()
+
+	err := tc.client.DeleteObject(ctx, objectKey)
+	recordError(span, err)
+	return err
+}
+
+func (tc *TracingClient) ListObjects(ctx context.Context, prefix string) ([]Object, error) {
+	ctx, span := tc.start(ctx, "ListObjects", prefix)
+	defer span.End()
+
+	objects, err := tc.client.ListObjects(ctx, prefix)
+	span.SetAttributes(attribute.Int("storage.objects", len(objects)))
+	recordError(span, err)
+	return objects, err
+}
+
+func (tc *TracingClient) LinkObject(ctx context.Context, objectKey string, targetKey string) error {
+	ctx, span := tc.start(ctx, "LinkObject", objectKey)
+	defer span.End()
+
+	span.SetAttributes(attribute.String("storage.target", targetKey))
+	err := tc.client.LinkObject(ctx, objectKey, targetKey)
+	recordError(span, err)
+	return err
+}
+
+func (tc *TracingClient) ResolveObject(ctx context.Context, objectKey string) (string, error) {
+	ctx, span := tc.start(ctx, "ResolveObject", objectKey)
+	defer span.End()
+
+	targetKey, err := tc.client.ResolveObject(ctx, objectKey)
+	span.SetAttributes(attribute.String("storage.target", targetKey))
+	recordError(span, err)
+	return targetKey, err
+}
+
+func (tc *TracingClient) start(ctx context.Context, operation string, objectKey string) (context.Context, trace.Span) {
+	return tc.tracer.Start(ctx, "storage."+operation, trace.WithAttributes(
+		attribute.String("storage.operation", operation),
+		attribute.String("storage.key", objectKey),
+	))
+}
+
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}